@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"download_track/internal/logging"
+	"download_track/internal/store"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// errLabelTaken — метка занята подтверждённым адресом.
+var errLabelTaken = errors.New("label taken")
+
+// cmdAddresses показывает адресную книгу: основной email и адреса под
+// метками.
+func (b *Bot) cmdAddresses(ctx context.Context, m *tgbotapi.Message, _ []string) {
+	u, ok := b.addressUser(ctx, m)
+	if !ok {
+		return
+	}
+	addrs, err := b.store.Addresses(ctx, u.ID)
+	if err != nil {
+		log.Println("list addresses err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(b.t(ctx, "address.header"))
+	sb.WriteString(b.addressLine(ctx, &store.Address{Label: store.MainLabel, Email: u.Email}, true, u.DefaultAddress == ""))
+	for _, a := range addrs {
+		sb.WriteString(b.addressLine(ctx, a, a.VerifiedAt != nil, a.Label == u.DefaultAddress))
+	}
+	sb.WriteString(b.t(ctx, "address.footer"))
+	b.send(m.Chat.ID, sb.String())
+}
+
+func (b *Bot) addressLine(ctx context.Context, a *store.Address, verified, isDefault bool) string {
+	line := a.Label + " — " + a.Email
+	if a.Profile != "" {
+		line += " [" + a.Profile + "]"
+	}
+	if !verified {
+		line += " " + b.t(ctx, "address.unverified")
+	}
+	if isDefault {
+		line += " " + b.t(ctx, "address.default")
+	}
+	return line + "\n"
+}
+
+// cmdAddAddress добавляет адрес под меткой. Письмо с кодом отправляет
+// http-service: у бота нет SMTP.
+func (b *Bot) cmdAddAddress(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, ok := b.addressUser(ctx, m)
+	if !ok {
+		return
+	}
+	label, err := store.CleanLabel(args[0])
+	if err != nil {
+		b.send(m.Chat.ID, b.t(ctx, "address.bad_label", store.MaxLabelLen, store.MainLabel))
+		return
+	}
+	addr, err := mail.ParseAddress(args[1])
+	if err != nil {
+		b.send(m.Chat.ID, b.t(ctx, "address.bad_email"))
+		return
+	}
+	if strings.EqualFold(addr.Address, u.Email) {
+		b.send(m.Chat.ID, b.t(ctx, "address.is_main"))
+		return
+	}
+
+	err = b.callAddAddress(ctx, u.APIKey, label, addr.Address)
+	switch {
+	case errors.Is(err, errLabelTaken):
+		b.send(m.Chat.ID, b.t(ctx, "address.label_taken", label))
+	case err != nil:
+		b.log.ErrorContext(ctx, "add address failed", "user_id", u.ID, "error", err.Error())
+		b.send(m.Chat.ID, b.t(ctx, "address.add_failed"))
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "address.code_sent", addr.Address, label))
+	}
+}
+
+// callAddAddress вызывает POST /api/v1/addresses от имени пользователя.
+func (b *Bot) callAddAddress(ctx context.Context, apiKey, label, email string) error {
+	body, _ := json.Marshal(map[string]string{"label": label, "email": email})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiBase+"/api/v1/addresses", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if id := logging.CorrelationID(ctx); id != "" {
+		req.Header.Set(logging.CorrelationHeader, id)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errLabelTaken
+	}
+	return fmt.Errorf("add address http status %s", resp.Status)
+}
+
+func (b *Bot) cmdVerifyAddress(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, ok := b.addressUser(ctx, m)
+	if !ok {
+		return
+	}
+	label := strings.ToLower(args[0])
+	a, err := b.store.VerifyAddress(ctx, u.ID, label, args[1])
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		b.send(m.Chat.ID, b.t(ctx, "address.not_found", label))
+	case errors.Is(err, store.ErrCodeInvalid):
+		b.send(m.Chat.ID, b.t(ctx, "address.code_invalid"))
+	case err != nil:
+		log.Println("verify address err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "address.verified", a.Email, a.Label))
+	}
+}
+
+// cmdDefaultAddress показывает или меняет адрес, на который уходят
+// ссылки без меток; «-» возвращает основной email.
+func (b *Bot) cmdDefaultAddress(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, ok := b.addressUser(ctx, m)
+	if !ok {
+		return
+	}
+	if len(args) == 0 {
+		label := u.DefaultAddress
+		if label == "" {
+			label = store.MainLabel
+		}
+		b.send(m.Chat.ID, b.t(ctx, "address.default_current", label))
+		return
+	}
+
+	label := strings.ToLower(args[0])
+	if label == "-" || label == store.MainLabel {
+		label = ""
+	}
+	err := b.store.SetDefaultAddress(ctx, u.ID, label)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		b.send(m.Chat.ID, b.t(ctx, "address.not_found", label))
+	case errors.Is(err, store.ErrNotVerified):
+		b.send(m.Chat.ID, b.t(ctx, "address.not_verified", label))
+	case err != nil:
+		log.Println("set default address err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+	case label == "":
+		b.send(m.Chat.ID, b.t(ctx, "address.default_main", u.Email))
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "address.default_changed", label))
+	}
+}
+
+// cmdAddressProfile меняет профиль доставки адреса: kindle проверяет
+// формат и превращает страницы в EPUB, «-» возвращает обычные письма.
+func (b *Bot) cmdAddressProfile(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, ok := b.addressUser(ctx, m)
+	if !ok {
+		return
+	}
+	label, profile := strings.ToLower(args[0]), strings.ToLower(args[1])
+	if profile == "-" {
+		profile = ""
+	}
+	if profile != "" && profile != store.ProfileKindle {
+		b.send(m.Chat.ID, b.t(ctx, "address.bad_profile"))
+		return
+	}
+	_, err := b.store.SetAddressProfile(ctx, u.ID, label, profile)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		b.send(m.Chat.ID, b.t(ctx, "address.not_found", label))
+	case err != nil:
+		log.Println("set address profile err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+	case profile == "":
+		b.send(m.Chat.ID, b.t(ctx, "address.profile_cleared", label))
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "address.profile_kindle", label))
+	}
+}
+
+func (b *Bot) cmdDeleteAddress(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, ok := b.addressUser(ctx, m)
+	if !ok {
+		return
+	}
+	label := strings.ToLower(args[0])
+	err := b.store.DeleteAddress(ctx, u.ID, label)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		b.send(m.Chat.ID, b.t(ctx, "address.not_found", label))
+	case err != nil:
+		log.Println("delete address err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "address.deleted", label))
+	}
+}
+
+// addressUser — аккаунт отправителя команды; незарегистрированному
+// пользователю бот отвечает сам.
+func (b *Bot) addressUser(ctx context.Context, m *tgbotapi.Message) (*store.User, bool) {
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		b.send(m.Chat.ID, b.t(ctx, "address.unregistered"))
+		return nil, false
+	}
+	if err != nil {
+		log.Println("userForTelegram err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return nil, false
+	}
+	return u, true
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"download_track/internal/logging"
+	"download_track/internal/store"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// formLine — строка формы после ссылки или сайта: логин и пароль для
+// basic auth, Cookie, User-Agent, Authorization или любой другой
+// заголовок строкой «Header: Имя: значение». Остальные строки сообщения,
+// даже вида «Имя: текст», — обычный текст.
+var formLine = regexp.MustCompile(`^(?i)(login|username|логин|password|пароль|cookie|user-agent|authorization|header|заголовок):\s*(.*)$`)
+
+// headerName — имя заголовка в строке «Header: Имя: значение».
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// authForm — строки формы после строки, где стоит anchor (ссылка или
+// сайт); если anchor в тексте нет — после первой строки.
+func authForm(text, anchor string) []string {
+	lines := strings.Split(text, "\n")
+	start := 1
+	for i, line := range lines {
+		if anchor != "" && strings.Contains(line, anchor) {
+			start = i + 1
+			break
+		}
+	}
+	var form []string
+	for _, line := range lines[min(start, len(lines)):] {
+		if line = strings.TrimSpace(line); formLine.MatchString(line) {
+			form = append(form, line)
+		}
+	}
+	return form
+}
+
+// formHasSecrets сообщает, есть ли в форме пароль, cookie или заголовок:
+// такое сообщение нельзя оставлять в чате. Логин и User-Agent не секрет.
+func formHasSecrets(form []string) bool {
+	for _, line := range form {
+		switch strings.ToLower(formLine.FindStringSubmatch(line)[1]) {
+		case "password", "пароль", "cookie", "authorization", "header", "заголовок":
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// errBadCookie — строка Cookie не вида «имя=значение; имя=значение».
+	errBadCookie = errors.New("bad cookie line")
+	// errBadHeader — строка Header не вида «Header: Имя: значение».
+	errBadHeader = errors.New("bad header line")
+)
+
+// formErrorKey — текст для пользователя об ошибке parseAuthForm.
+func formErrorKey(err error) string {
+	if errors.Is(err, errBadHeader) {
+		return "auth.bad_header"
+	}
+	return "auth.bad_cookie"
+}
+
+// parseAuthForm собирает учётные данные из строк формы; nil — строк нет.
+// Проверяет их http-service: его ответ понятен пользователю.
+func parseAuthForm(form []string) (*store.JobAuth, error) {
+	if len(form) == 0 {
+		return nil, nil
+	}
+	a := &store.JobAuth{}
+	setHeader := func(name, value string) {
+		if a.Headers == nil {
+			a.Headers = make(map[string]string)
+		}
+		a.Headers[name] = value
+	}
+	for _, line := range form {
+		sub := formLine.FindStringSubmatch(line)
+		name, value := sub[1], strings.TrimSpace(sub[2])
+		switch strings.ToLower(name) {
+		case "login", "username", "логин":
+			a.Username = value
+		case "password", "пароль":
+			a.Password = value
+		case "user-agent":
+			a.UserAgent = value
+		case "authorization":
+			setHeader("Authorization", value)
+		case "header", "заголовок":
+			k, v, ok := strings.Cut(value, ":")
+			if k = strings.TrimSpace(k); !ok || !headerName.MatchString(k) {
+				return nil, fmt.Errorf("%w: %s", errBadHeader, k)
+			}
+			setHeader(k, strings.TrimSpace(v))
+		case "cookie":
+			for _, pair := range strings.Split(value, ";") {
+				if pair = strings.TrimSpace(pair); pair == "" {
+					continue
+				}
+				k, v, ok := strings.Cut(pair, "=")
+				if !ok || strings.TrimSpace(k) == "" {
+					return nil, fmt.Errorf("%w: %s", errBadCookie, pair)
+				}
+				if a.Cookies == nil {
+					a.Cookies = make(map[string]string)
+				}
+				a.Cookies[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return a, nil
+}
+
+// splitURLAuth переносит логин и пароль из ссылки http(s) в учётные
+// данные задания: в ссылке они попали бы в задание и журналы. Если логин
+// уже задан строкой формы, ссылка не меняется, и http-service отклонит её.
+func splitURLAuth(raw string, a *store.JobAuth) (string, *store.JobAuth) {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") || (a != nil && a.Username != "") {
+		return raw, a
+	}
+	out := &store.JobAuth{}
+	if a != nil {
+		*out = *a
+	}
+	out.Username = u.User.Username()
+	out.Password, _ = u.User.Password()
+	u.User = nil
+	return u.String(), out
+}
+
+// urlHasPassword сообщает, есть ли в ссылке пароль.
+func urlHasPassword(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	_, ok := u.User.Password()
+	return ok
+}
+
+// logURL — ссылка для журнала, без пароля.
+func logURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return raw
+}
+
+// hideSecrets удаляет сообщение с паролем или токеном из чата; если
+// удалить нельзя (в группе бот не админ), просит удалить его самому.
+func (b *Bot) hideSecrets(ctx context.Context, m *tgbotapi.Message) {
+	if _, err := b.api.Request(tgbotapi.NewDeleteMessage(m.Chat.ID, m.MessageID)); err != nil {
+		b.log.InfoContext(ctx, "delete message with secrets failed", "chat_id", m.Chat.ID, "error", err.Error())
+		b.send(m.Chat.ID, b.t(ctx, "auth.delete_failed"))
+	}
+}
+
+// parseSite разбирает сайт из /auth: хост или ссылку. Без схемы — https.
+func parseSite(s string) (scheme, host string, ok bool) {
+	scheme = "https"
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return "", "", false
+		}
+		scheme, s = u.Scheme, u.Hostname()
+	}
+	host = strings.ToLower(strings.TrimSuffix(s, "/"))
+	if host == "" || strings.ContainsAny(host, ":/@ ") {
+		return "", "", false
+	}
+	return scheme, host, true
+}
+
+// cmdAuth показывает сохранённые учётные данные сайтов, сохраняет новые
+// из строк формы или удаляет: /auth example.com -.
+func (b *Bot) cmdAuth(ctx context.Context, m *tgbotapi.Message, args []string) {
+	// первая строка — сайт и, для удаления, «-»; дальше форма
+	first, _, _ := strings.Cut(m.CommandArguments(), "\n")
+	fields := strings.Fields(first)
+	site := ""
+	if len(fields) > 0 {
+		site = fields[0]
+	}
+	// сообщение с паролем или токеном удаляется до любого ответа, даже
+	// если дальше команда не выполнится; форма — всё после строки команды
+	form := authForm(m.Text, "")
+	if formHasSecrets(form) || urlHasPassword(site) {
+		b.hideSecrets(ctx, m)
+	}
+
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		b.send(m.Chat.ID, b.t(ctx, "auth.unregistered"))
+		return
+	}
+	if err != nil {
+		log.Println("userForTelegram err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+	if len(args) == 0 {
+		b.listAuth(ctx, m, u)
+		return
+	}
+	if len(fields) == 0 {
+		b.send(m.Chat.ID, b.t(ctx, "auth.how"))
+		return
+	}
+	scheme, host, ok := parseSite(fields[0])
+	if !ok || len(fields) > 2 || len(fields) == 2 && fields[1] != "-" {
+		b.send(m.Chat.ID, b.t(ctx, "auth.bad_site", fields[0]))
+		return
+	}
+	site = scheme + "://" + host
+
+	if len(fields) == 2 {
+		err := b.store.DeleteCredential(ctx, u.ID, scheme, host)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			b.send(m.Chat.ID, b.t(ctx, "auth.not_found", site))
+		case err != nil:
+			log.Println("delete credential err:", err)
+			b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		default:
+			b.send(m.Chat.ID, b.t(ctx, "auth.deleted", site))
+		}
+		return
+	}
+
+	if len(form) == 0 {
+		b.send(m.Chat.ID, b.t(ctx, "auth.how"))
+		return
+	}
+	auth, err := parseAuthForm(form)
+	if err != nil {
+		b.send(m.Chat.ID, b.t(ctx, formErrorKey(err)))
+		return
+	}
+	if err := b.callSetCredential(ctx, u.APIKey, scheme, host, auth); err != nil {
+		b.log.InfoContext(ctx, "set credential failed", "chat_id", m.Chat.ID, "site", site, "error", err.Error())
+		b.send(m.Chat.ID, b.t(ctx, "auth.save_failed", err))
+		return
+	}
+	b.log.InfoContext(ctx, "credential saved", "chat_id", m.Chat.ID, "site", site)
+	b.send(m.Chat.ID, b.t(ctx, "auth.saved", site))
+}
+
+func (b *Bot) listAuth(ctx context.Context, m *tgbotapi.Message, u *store.User) {
+	creds, err := b.store.Credentials(ctx, u.ID)
+	if err != nil {
+		log.Println("list credentials err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+	if len(creds) == 0 {
+		b.send(m.Chat.ID, b.t(ctx, "auth.none")+"\n\n"+b.t(ctx, "auth.how"))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(b.t(ctx, "auth.header"))
+	for _, c := range creds {
+		// значения секретны, в чат попадают только имена
+		var parts []string
+		if c.Username != "" {
+			parts = append(parts, b.t(ctx, "auth.login", c.Username))
+		}
+		if len(c.Headers) > 0 {
+			parts = append(parts, b.t(ctx, "auth.headers", strings.Join(sortedNames(c.Headers), ", ")))
+		}
+		if len(c.Cookies) > 0 {
+			parts = append(parts, b.t(ctx, "auth.cookies", strings.Join(sortedNames(c.Cookies), ", ")))
+		}
+		if c.UserAgent != "" {
+			parts = append(parts, "User-Agent")
+		}
+		sb.WriteString(c.Scheme + "://" + c.Host + " — " + strings.Join(parts, "; ") + "\n")
+	}
+	sb.WriteString(b.t(ctx, "auth.footer"))
+	b.send(m.Chat.ID, sb.String())
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// callSetCredential вызывает PUT /api/v1/credentials/{scheme}/{host} от
+// имени пользователя: http-service проверяет и шифрует учётные данные.
+// Профиль заменяется целиком.
+func (b *Bot) callSetCredential(ctx context.Context, apiKey, scheme, host string, a *store.JobAuth) error {
+	headers, cookies := a.Headers, a.Cookies
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	if cookies == nil {
+		cookies = map[string]string{}
+	}
+	body, _ := json.Marshal(map[string]any{
+		"username": a.Username, "password": a.Password, "headers": headers, "cookies": cookies, "user_agent": a.UserAgent,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+		b.apiBase+"/api/v1/credentials/"+scheme+"/"+url.PathEscape(host), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if id := logging.CorrelationID(ctx); id != "" {
+		req.Header.Set(logging.CorrelationHeader, id)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnprocessableEntity:
+		// ошибка проверки понятна пользователю
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e) == nil && e.Error.Message != "" {
+			return errors.New(e.Error.Message)
+		}
+	}
+	return fmt.Errorf("set credential http status %s", resp.Status)
+}
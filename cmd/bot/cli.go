@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"download_track/internal/config"
+	"download_track/internal/migrations"
+)
+
+// runCommand выполняет подкоманду и возвращает код выхода. Без команды
+// запускается бот.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		return cmdMigrate(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprintln(os.Stderr, "usage: telegram-bot [migrate up|down [n]|status]\n\nWithout a command the bot is started.")
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+}
+
+func cmdMigrate(args []string) int {
+	cfg, err := config.LoadFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	if cfg.DB.DSN == "" {
+		fmt.Fprintln(os.Stderr, "migrate: db.dsn (DB_DSN) is required")
+		return 1
+	}
+	db, err := sql.Open("postgres", cfg.DB.DSN)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	defer db.Close()
+
+	if err := migrations.RunCommand(context.Background(), db, args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	return 0
+}
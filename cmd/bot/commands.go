@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"download_track/internal/i18n"
+	"download_track/internal/mailtmpl"
+	"download_track/internal/store"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// botCommands — команды бота в том порядке, в котором они показываются
+// в меню и /help.
+var botCommands = newRegistry(
+	&command{
+		name: "start",
+		help: "cmd.start",
+		run:  (*Bot).cmdStart,
+	},
+	&command{
+		name: "register",
+		args: []arg{{name: "arg.email"}},
+		help: "cmd.register",
+		run:  (*Bot).cmdRegister,
+	},
+	&command{
+		name: "link",
+		args: []arg{{name: "arg.code"}},
+		help: "cmd.link",
+		run:  (*Bot).cmdLink,
+	},
+	&command{
+		name: "change_email",
+		args: []arg{{name: "arg.new_email"}},
+		help: "cmd.change_email",
+		run:  (*Bot).cmdChangeEmail,
+	},
+	&command{
+		name: "send",
+		args: []arg{{name: "arg.recipients", optional: true}, {name: "arg.url", rest: true}},
+		help: "cmd.send",
+		run:  (*Bot).cmdSend,
+	},
+	&command{
+		name:    "article",
+		aliases: []string{"read"},
+		args:    []arg{{name: "arg.recipients", optional: true}, {name: "arg.url", rest: true}},
+		help:    "cmd.article",
+		run:     (*Bot).cmdArticle,
+	},
+	&command{
+		name: "tg",
+		args: []arg{{name: "arg.url", rest: true}},
+		help: "cmd.tg",
+		run:  (*Bot).cmdTelegram,
+	},
+	&command{
+		name: "addresses",
+		help: "cmd.addresses",
+		run:  (*Bot).cmdAddresses,
+	},
+	&command{
+		name: "add_address",
+		args: []arg{{name: "arg.label"}, {name: "arg.email"}},
+		help: "cmd.add_address",
+		run:  (*Bot).cmdAddAddress,
+	},
+	&command{
+		name:    "verify_address",
+		aliases: []string{"verify"},
+		args:    []arg{{name: "arg.label"}, {name: "arg.code"}},
+		help:    "cmd.verify_address",
+		run:     (*Bot).cmdVerifyAddress,
+	},
+	&command{
+		name: "default_address",
+		args: []arg{{name: "arg.label", optional: true}},
+		help: "cmd.default_address",
+		run:  (*Bot).cmdDefaultAddress,
+	},
+	&command{
+		name: "address_profile",
+		args: []arg{{name: "arg.label"}, {name: "arg.profile"}},
+		help: "cmd.address_profile",
+		run:  (*Bot).cmdAddressProfile,
+	},
+	&command{
+		name: "delete_address",
+		args: []arg{{name: "arg.label"}},
+		help: "cmd.delete_address",
+		run:  (*Bot).cmdDeleteAddress,
+	},
+	&command{
+		name: "language",
+		args: []arg{{name: "arg.language", optional: true}},
+		help: "cmd.language",
+		run:  (*Bot).cmdLanguage,
+	},
+	&command{
+		name:    "subject_prefix",
+		aliases: []string{"prefix"},
+		args:    []arg{{name: "arg.prefix", optional: true, rest: true}},
+		help:    "cmd.subject_prefix",
+		run:     (*Bot).cmdSubjectPrefix,
+	},
+	&command{
+		name:    "set_pgp_key",
+		aliases: []string{"set_key"},
+		help:    "cmd.set_pgp_key",
+		run:     (*Bot).cmdSetKey,
+	},
+	&command{
+		name: "encryption",
+		args: []arg{{name: "arg.encryption_mode", optional: true}},
+		help: "cmd.encryption",
+		run:  (*Bot).cmdEncryption,
+	},
+	&command{
+		name: "destination",
+		args: []arg{{name: "arg.destination", optional: true}},
+		help: "cmd.destination",
+		run:  (*Bot).cmdDestination,
+	},
+	&command{
+		name: "auth",
+		args: []arg{{name: "arg.site", optional: true, rest: true}},
+		help: "cmd.auth",
+		run:  (*Bot).cmdAuth,
+	},
+	&command{
+		name: "help",
+		help: "cmd.help",
+		run:  (*Bot).cmdHelp,
+	},
+	&command{
+		name:    "approve_change",
+		aliases: []string{"approve"},
+		role:    roleAdmin,
+		args:    []arg{{name: "arg.request_id"}},
+		help:    "cmd.approve_change",
+		run:     (*Bot).cmdApproveChange,
+	},
+	&command{
+		name:    "reject_change",
+		aliases: []string{"reject"},
+		role:    roleAdmin,
+		args:    []arg{{name: "arg.request_id"}},
+		help:    "cmd.reject_change",
+		run:     (*Bot).cmdRejectChange,
+	},
+	&command{
+		name:    "list_changes",
+		aliases: []string{"changes"},
+		role:    roleAdmin,
+		help:    "cmd.list_changes",
+		run:     (*Bot).cmdListChanges,
+	},
+)
+
+func (b *Bot) cmdStart(ctx context.Context, m *tgbotapi.Message, _ []string) {
+	registered, username, err := b.isTelegramRegistered(ctx, m.From.ID)
+	if err != nil {
+		log.Println("isTelegramRegistered err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	if !registered {
+		b.send(m.Chat.ID, b.t(ctx, "start.unregistered"))
+	} else {
+		b.send(m.Chat.ID, b.t(ctx, "start.registered", username))
+	}
+}
+
+func (b *Bot) cmdRegister(ctx context.Context, m *tgbotapi.Message, args []string) {
+	err := b.registerTelegramUser(ctx, m.From.ID, m.From.UserName, args[0], langFrom(ctx))
+	if errors.Is(err, store.ErrEmailTaken) {
+		b.send(m.Chat.ID, b.t(ctx, "register.email_taken"))
+	} else if err != nil {
+		log.Println("register err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "register.failed"))
+	} else {
+		b.send(m.Chat.ID, b.t(ctx, "register.done"))
+	}
+}
+
+func (b *Bot) cmdLink(ctx context.Context, m *tgbotapi.Message, args []string) {
+	email, err := b.linkTelegramUser(ctx, m.From.ID, m.From.UserName, args[0])
+	switch {
+	case errors.Is(err, store.ErrLinkCodeInvalid):
+		b.send(m.Chat.ID, b.t(ctx, "link.invalid"))
+	case errors.Is(err, store.ErrTelegramLinked):
+		b.send(m.Chat.ID, b.t(ctx, "link.telegram_linked"))
+	case errors.Is(err, store.ErrAccountLinked):
+		b.send(m.Chat.ID, b.t(ctx, "link.account_linked"))
+	case err != nil:
+		log.Println("link err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "link.failed"))
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "link.done", email))
+	}
+}
+
+func (b *Bot) cmdChangeEmail(ctx context.Context, m *tgbotapi.Message, args []string) {
+	if err := b.requestEmailChange(ctx, m.From.ID, m.From.UserName, args[0]); err != nil {
+		log.Println("requestEmailChange err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "change_email.failed"))
+	} else {
+		b.send(m.Chat.ID, b.t(ctx, "change_email.sent"))
+	}
+}
+
+// cmdSend отправляет ссылку; перед ней можно перечислить через запятую
+// метки получателей: /send work,kindle https://... Строки после ссылки —
+// заголовки, cookie и логин для закрытого сайта.
+func (b *Bot) cmdSend(ctx context.Context, m *tgbotapi.Message, args []string) {
+	b.sendURL(ctx, m, sendRecipients(m, args), "", false)
+}
+
+// cmdArticle отправляет только текст статьи со страницы, без меню,
+// рекламы и комментариев.
+func (b *Bot) cmdArticle(ctx context.Context, m *tgbotapi.Message, args []string) {
+	b.sendURL(ctx, m, sendRecipients(m, args), store.PageReadable, false)
+}
+
+// cmdTelegram присылает файл по ссылке документом в этот чат.
+func (b *Bot) cmdTelegram(ctx context.Context, m *tgbotapi.Message, _ []string) {
+	b.sendURL(ctx, m, nil, "", true)
+}
+
+// sendRecipients — метки получателей из аргументов /send.
+func sendRecipients(m *tgbotapi.Message, args []string) []string {
+	var recipients []string
+	// первый аргумент — метки, если ссылка не в нём
+	if url := extractFirstURL(m); len(args) == 2 && (url == "" || !strings.Contains(args[0], url)) {
+		for _, label := range strings.Split(args[0], ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				recipients = append(recipients, label)
+			}
+		}
+	}
+	return recipients
+}
+
+func (b *Bot) cmdHelp(ctx context.Context, m *tgbotapi.Message, _ []string) {
+	b.send(m.Chat.ID, b.commands.helpText(langFrom(ctx), b.roleOf(m)))
+}
+
+func (b *Bot) cmdApproveChange(ctx context.Context, m *tgbotapi.Message, args []string) {
+	if err := b.approveEmailChange(ctx, m.Chat.ID, args[0]); err != nil {
+		log.Println("approveEmailChange err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "change.approve_failed", err))
+	}
+}
+
+func (b *Bot) cmdRejectChange(ctx context.Context, m *tgbotapi.Message, args []string) {
+	if err := b.rejectEmailChange(ctx, m.Chat.ID, args[0]); err != nil {
+		log.Println("rejectEmailChange err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "change.reject_failed", err))
+	}
+}
+
+func (b *Bot) cmdListChanges(ctx context.Context, m *tgbotapi.Message, _ []string) {
+	if err := b.listEmailChanges(ctx, m.Chat.ID); err != nil {
+		log.Println("listEmailChanges err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "changes.list_failed", err))
+	}
+}
+
+func (b *Bot) cmdLanguage(ctx context.Context, m *tgbotapi.Message, args []string) {
+	var available []string
+	for _, lang := range i18n.Supported() {
+		available = append(available, lang+" — "+i18n.Name(lang))
+	}
+	list := strings.Join(available, ", ")
+
+	if len(args) == 0 {
+		lang := langFrom(ctx)
+		b.send(m.Chat.ID, b.t(ctx, "language.current", i18n.Name(lang)+" ("+lang+")", list))
+		return
+	}
+
+	lang := strings.ToLower(args[0])
+	if !i18n.IsSupported(lang) {
+		b.send(m.Chat.ID, b.t(ctx, "language.unknown", args[0], list))
+		return
+	}
+
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		b.send(m.Chat.ID, b.t(ctx, "language.unregistered"))
+		return
+	}
+	if err == nil {
+		err = b.store.SetLanguage(ctx, u.ID, lang)
+	}
+	if err != nil {
+		log.Println("set language err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	b.registerChatMenu(m.Chat.ID, lang)
+	b.send(m.Chat.ID, i18n.T(lang, "language.changed", i18n.Name(lang)))
+}
+
+// cmdSubjectPrefix показывает или меняет префикс темы писем; «-» убирает
+// его.
+func (b *Bot) cmdSubjectPrefix(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		b.send(m.Chat.ID, b.t(ctx, "prefix.unregistered"))
+		return
+	}
+	if err != nil {
+		log.Println("userForTelegram err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	if len(args) == 0 {
+		if u.SubjectPrefix == "" {
+			b.send(m.Chat.ID, b.t(ctx, "prefix.none"))
+		} else {
+			b.send(m.Chat.ID, b.t(ctx, "prefix.current", u.SubjectPrefix))
+		}
+		return
+	}
+
+	prefix := args[0]
+	if prefix == "-" {
+		prefix = ""
+	}
+	prefix, err = mailtmpl.CleanPrefix(prefix)
+	if err != nil {
+		b.send(m.Chat.ID, b.t(ctx, "prefix.invalid", mailtmpl.MaxPrefixLen))
+		return
+	}
+	if err := b.store.SetSubjectPrefix(ctx, u.ID, prefix); err != nil {
+		log.Println("set subject prefix err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	if prefix == "" {
+		b.send(m.Chat.ID, b.t(ctx, "prefix.cleared"))
+		return
+	}
+	b.send(m.Chat.ID, b.t(ctx, "prefix.changed", prefix))
+}
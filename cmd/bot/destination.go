@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"download_track/internal/logging"
+	"download_track/internal/store"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// cmdDestination показывает, куда уходят файлы; email возвращает
+// доставку на почту, telegram — в чат. Ключи хранилищ в чат не пишутся:
+// такие места доставки задаются через API.
+func (b *Bot) cmdDestination(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		b.send(m.Chat.ID, b.t(ctx, "destination.unregistered"))
+		return
+	}
+	if err != nil {
+		log.Println("userForTelegram err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	if len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "email", "-":
+		case store.DestTelegram, "tg":
+			_, err := b.store.SetDestination(ctx, store.Destination{UserID: u.ID, Kind: store.DestTelegram})
+			if err != nil {
+				log.Println("set destination err:", err)
+				b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+				return
+			}
+			b.send(m.Chat.ID, b.t(ctx, "destination.telegram_set"))
+			return
+		default:
+			b.send(m.Chat.ID, b.t(ctx, "command.usage", b.commands.lookup("destination").usage(langFrom(ctx))))
+			return
+		}
+		err := b.store.DeleteDestination(ctx, u.ID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Println("delete destination err:", err)
+			b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+			return
+		}
+		b.send(m.Chat.ID, b.t(ctx, "destination.cleared"))
+		return
+	}
+
+	d, err := b.store.Destination(ctx, u.ID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		b.send(m.Chat.ID, b.t(ctx, "destination.email"))
+	case err != nil:
+		log.Println("destination err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+	case d.Kind == store.DestTelegram:
+		b.send(m.Chat.ID, b.t(ctx, "destination.telegram"))
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "destination.status", destinationName(d.Kind), destinationPlace(d)))
+	}
+}
+
+func destinationName(kind string) string {
+	switch kind {
+	case store.DestS3:
+		return "S3"
+	case store.DestWebDAV:
+		return "WebDAV"
+	}
+	return kind
+}
+
+// destinationPlace — место доставки одной строкой, без логина и секрета.
+func destinationPlace(d *store.Destination) string {
+	switch d.Kind {
+	case store.DestS3:
+		return strings.TrimSuffix(d.Endpoint, "/") + "/" + strings.Trim(d.Bucket+"/"+d.Path, "/")
+	case store.DestWebDAV:
+		if d.Path == "" {
+			return d.Endpoint
+		}
+		return strings.TrimSuffix(d.Endpoint, "/") + "/" + d.Path
+	}
+	return d.Path
+}
+
+const (
+	// telegramUploadLimit — предел sendDocument в облачном Bot API; файлы
+	// больше http-service отправляет письмом.
+	telegramUploadLimit = 50 << 20
+	// время на одну попытку отчёта о загрузке
+	deliveryReportTimeout = 10 * time.Second
+)
+
+// sendToChat просит http-service скачать файл и вернуть его в ответе и
+// загружает ответ в чат документом, не сохраняя на диск. Чем кончилась
+// загрузка, бот сообщает http-service, и тот записывает это в задание.
+func (b *Bot) sendToChat(ctx context.Context, m *tgbotapi.Message, u *store.User, url, pageMode string, auth *store.JobAuth) {
+	chatID := m.Chat.ID
+	b.log.InfoContext(ctx, "send url to chat", "chat_id", chatID, "url", logURL(url), "page_mode", pageMode, "auth", auth != nil)
+
+	resp, err := b.postSend(ctx, sendReq{APIKey: u.APIKey, FileURL: url, PageMode: pageMode,
+		Destination: store.DestTelegram, MaxSize: telegramUploadLimit, Auth: auth})
+	if err != nil {
+		b.log.ErrorContext(ctx, "send url failed", "chat_id", chatID, "error", err.Error())
+		b.send(chatID, b.t(ctx, "url.failed", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	jobID := resp.Header.Get("X-Job-ID")
+	if jobID == "" {
+		// файл больше лимита, http-service отправил его письмом
+		b.send(chatID, b.t(ctx, "url.tg_emailed", telegramUploadLimit>>20, u.Email))
+		return
+	}
+	name := "file"
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+
+	// файл уходит в личный чат: http-service принимает отчёт только о
+	// чате Telegram, привязанного к аккаунту
+	docChat := m.From.ID
+	doc := tgbotapi.NewDocument(docChat, tgbotapi.FileReader{Name: name, Reader: resp.Body})
+	if auth == nil && docChat == chatID {
+		// сообщение с учётными данными уже удалено, отвечать не на что
+		doc.ReplyToMessageID = m.MessageID
+	}
+	sent, err := b.api.Send(doc)
+
+	var location, errText string
+	if err != nil {
+		errText = err.Error()
+	} else {
+		location = fmt.Sprintf("telegram:%d/%d", docChat, sent.MessageID)
+	}
+	if rerr := b.reportDelivery(ctx, u.APIKey, jobID, location, errText); rerr != nil {
+		b.log.ErrorContext(ctx, "report delivery failed", "job_id", jobID, "error", rerr.Error())
+	}
+	if err != nil {
+		b.log.ErrorContext(ctx, "send document failed", "chat_id", chatID, "job_id", jobID, "error", errText)
+		b.send(chatID, b.t(ctx, "url.failed", err))
+		return
+	}
+	b.log.InfoContext(ctx, "document sent", "chat_id", chatID, "job_id", jobID, "location", location)
+}
+
+// reportDelivery сообщает http-service результат загрузки и при ошибке
+// пробует ещё раз. Загрузка могла съесть всё время обработчика, а без
+// отчёта доставленное задание через час станет failed, поэтому у отчёта
+// свой таймаут.
+func (b *Bot) reportDelivery(ctx context.Context, apiKey, jobID, location, errText string) error {
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	for range 2 {
+		rctx, cancel := context.WithTimeout(ctx, deliveryReportTimeout)
+		err = b.callJobDelivery(rctx, apiKey, jobID, location, errText)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// callJobDelivery сообщает http-service, куда попал файл задания или
+// почему не попал.
+func (b *Bot) callJobDelivery(ctx context.Context, apiKey, jobID, location, errText string) error {
+	body, _ := json.Marshal(map[string]string{"location": location, "error": errText})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiBase+"/api/v1/jobs/"+jobID+"/delivery", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if id := logging.CorrelationID(ctx); id != "" {
+		req.Header.Set(logging.CorrelationHeader, id)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("job delivery http status %s", resp.Status)
+	}
+	return nil
+}
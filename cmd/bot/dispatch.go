@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"download_track/internal/logging"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// dispatcher обрабатывает сообщения параллельно в нескольких воркерах.
+// Чат всегда попадает в один и тот же воркер, поэтому сообщения одного
+// чата обрабатываются строго по порядку, а медленная ссылка одного
+// пользователя не блокирует остальных (кроме делящих с ним воркер).
+type dispatcher struct {
+	shards []chan tgbotapi.Update
+	// ограничение времени на одно сообщение; читается перед каждым
+	timeout func() time.Duration
+	handle  func(ctx context.Context, m *tgbotapi.Message)
+	// вызывается, если очередь чата переполнена и сообщение отброшено
+	reject func(m *tgbotapi.Message)
+	log    *slog.Logger
+
+	// базовый контекст обработчиков; отменяется, если дренаж не уложился
+	// в таймаут
+	baseCtx context.Context
+	abort   context.CancelFunc
+	wg      sync.WaitGroup
+
+	// учёт обработанных update_id, чтобы при остановке подтвердить
+	// Telegram только то, что действительно обработано
+	mu      sync.Mutex
+	pending map[int]struct{}
+	maxSeen int
+}
+
+func newDispatcher(workers, queueSize int, timeout func() time.Duration,
+	handle func(context.Context, *tgbotapi.Message), reject func(*tgbotapi.Message), logger *slog.Logger) *dispatcher {
+	d := &dispatcher{
+		shards:  make([]chan tgbotapi.Update, workers),
+		timeout: timeout,
+		handle:  handle,
+		reject:  reject,
+		log:     logger,
+		pending: make(map[int]struct{}),
+	}
+	for i := range d.shards {
+		d.shards[i] = make(chan tgbotapi.Update, queueSize)
+	}
+	return d
+}
+
+func (d *dispatcher) start() {
+	d.baseCtx, d.abort = context.WithCancel(context.Background())
+	for _, ch := range d.shards {
+		d.wg.Add(1)
+		go func(ch chan tgbotapi.Update) {
+			defer d.wg.Done()
+			for u := range ch {
+				d.run(u)
+			}
+		}(ch)
+	}
+}
+
+// submit ставит сообщение в очередь его чата и никогда не ждёт: цикл
+// приёма обновлений один на все чаты, и ожидание места для одного чата
+// задержало бы остальные. Если очередь переполнена, сообщение
+// отбрасывается, а чату отвечает reject. Обновления без сообщения только
+// отмечаются как обработанные.
+func (d *dispatcher) submit(u tgbotapi.Update) bool {
+	if u.Message == nil {
+		d.done(u.UpdateID, false)
+		return true
+	}
+
+	d.mu.Lock()
+	d.pending[u.UpdateID] = struct{}{}
+	d.mu.Unlock()
+
+	select {
+	case d.shards[d.shardFor(u.Message.Chat.ID)] <- u:
+		return true
+	default:
+	}
+
+	log.Printf("queue full, dropping message chat_id=%d message_id=%d", u.Message.Chat.ID, u.Message.MessageID)
+	updatesDropped.Inc()
+	d.done(u.UpdateID, false)
+	if d.reject != nil {
+		d.reject(u.Message)
+	}
+	return false
+}
+
+// shutdown перестаёт принимать сообщения и ждёт, пока воркеры разберут
+// очередь. Если ctx истекает раньше, выполняющиеся обработчики
+// отменяются, а ещё не начатые сообщения пропускаются — они не попадают
+// в safeOffset, и в режиме polling придут снова после перезапуска. В
+// режиме webhook Telegram их уже считает доставленными, и они теряются.
+func (d *dispatcher) shutdown(ctx context.Context) error {
+	for _, ch := range d.shards {
+		close(ch)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Println("drain timeout, aborting running handlers")
+	d.abort()
+	<-done
+	return ctx.Err()
+}
+
+// safeOffset — наибольший update_id, до которого включительно все
+// обновления обработаны.
+func (d *dispatcher) safeOffset() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	safe := d.maxSeen
+	for id := range d.pending {
+		if id-1 < safe {
+			safe = id - 1
+		}
+	}
+	return safe
+}
+
+// queued — сколько сообщений ждёт в очередях воркеров.
+func (d *dispatcher) queued() int {
+	n := 0
+	for _, ch := range d.shards {
+		n += len(ch)
+	}
+	return n
+}
+
+func (d *dispatcher) shardFor(chatID int64) int {
+	return int(uint64(chatID) % uint64(len(d.shards)))
+}
+
+// done отмечает обновление обработанным; keep оставляет его в pending,
+// чтобы оно не было подтверждено.
+func (d *dispatcher) done(updateID int, keep bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !keep {
+		delete(d.pending, updateID)
+	}
+	if updateID > d.maxSeen {
+		d.maxSeen = updateID
+	}
+}
+
+func (d *dispatcher) run(u tgbotapi.Update) {
+	m := u.Message
+
+	// дренаж прерван: не начинаем новых сообщений
+	if d.baseCtx.Err() != nil {
+		log.Printf("drain timeout, skipping update_id=%d chat_id=%d message_id=%d", u.UpdateID, m.Chat.ID, m.MessageID)
+		d.done(u.UpdateID, true)
+		return
+	}
+
+	// correlation_id уходит в http-service вместе с запросом и связывает
+	// логи бота с заданием
+	ctx := logging.WithCorrelationID(d.baseCtx, logging.NewCorrelationID())
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+
+	workersBusy.Inc()
+	command := commandLabel(m)
+	start := time.Now()
+	d.log.InfoContext(ctx, "update received", "update_id", u.UpdateID, "chat_id", m.Chat.ID, "command", command)
+
+	defer func() {
+		if r := recover(); r != nil {
+			handlerPanics.Inc()
+			log.Printf("handler panic chat_id=%d: %v\n%s", m.Chat.ID, r, debug.Stack())
+		}
+		workersBusy.Dec()
+		updatesTotal.WithLabelValues(command).Inc()
+		updateDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+		d.log.InfoContext(ctx, "update handled", "update_id", u.UpdateID, "chat_id", m.Chat.ID, "command", command, "duration", time.Since(start))
+		d.done(u.UpdateID, d.baseCtx.Err() != nil)
+	}()
+
+	d.handle(ctx, m)
+	if ctx.Err() == context.DeadlineExceeded {
+		handlerTimeouts.Inc()
+		log.Printf("handler timeout chat_id=%d message_id=%d after %s", m.Chat.ID, m.MessageID, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// checkSaturation сообщает о перегрузке, когда очереди воркеров заполнены
+// больше чем на 90%: новые сообщения скоро начнут отбрасываться.
+func (d *dispatcher) checkSaturation(ctx context.Context) error {
+	capacity := 0
+	for _, ch := range d.shards {
+		capacity += cap(ch)
+	}
+	if n := d.queued(); n*10 >= capacity*9 {
+		return fmt.Errorf("dispatcher queues are full: %d of %d", n, capacity)
+	}
+	return nil
+}
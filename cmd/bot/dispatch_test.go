@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeHandler записывает обработанные сообщения; сообщения из чатов в
+// block ждут, пока канал не закроют.
+type fakeHandler struct {
+	mu      sync.Mutex
+	handled map[int64][]int
+	block   map[int64]chan struct{}
+	started chan int
+}
+
+func newFakeHandler() *fakeHandler {
+	return &fakeHandler{handled: make(map[int64][]int), block: make(map[int64]chan struct{}), started: make(chan int, 100)}
+}
+
+func (h *fakeHandler) handle(ctx context.Context, m *tgbotapi.Message) {
+	h.started <- m.MessageID
+	if ch := h.block[m.Chat.ID]; ch != nil {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+		}
+	}
+	h.mu.Lock()
+	h.handled[m.Chat.ID] = append(h.handled[m.Chat.ID], m.MessageID)
+	h.mu.Unlock()
+}
+
+func (h *fakeHandler) messages(chatID int64) []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]int(nil), h.handled[chatID]...)
+}
+
+// waitStarted ждёт, пока обработчик возьмёт сообщение id.
+func (h *fakeHandler) waitStarted(t *testing.T, id int) {
+	t.Helper()
+	select {
+	case got := <-h.started:
+		if got != id {
+			t.Fatalf("started message %d, want %d", got, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message %d was not started", id)
+	}
+}
+
+func newTestDispatcher(workers, queueSize int, h *fakeHandler, reject func(*tgbotapi.Message)) *dispatcher {
+	d := newDispatcher(workers, queueSize, func() time.Duration { return time.Minute }, h.handle, reject,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	d.start()
+	return d
+}
+
+func chatUpdate(updateID int, chatID int64) tgbotapi.Update {
+	return tgbotapi.Update{UpdateID: updateID, Message: &tgbotapi.Message{MessageID: updateID, Chat: &tgbotapi.Chat{ID: chatID}}}
+}
+
+func TestDispatcherChatOrder(t *testing.T) {
+	h := newFakeHandler()
+	d := newTestDispatcher(3, 100, h, nil)
+	want := map[int64][]int{}
+	for id := 1; id <= 60; id++ {
+		chat := int64(id % 4)
+		want[chat] = append(want[chat], id)
+		if !d.submit(chatUpdate(id, chat)) {
+			t.Fatalf("update %d rejected", id)
+		}
+	}
+	if err := d.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for chat, ids := range want {
+		got := h.messages(chat)
+		if len(got) != len(ids) {
+			t.Fatalf("chat %d: handled %v, want %v", chat, got, ids)
+		}
+		for i := range ids {
+			if got[i] != ids[i] {
+				t.Fatalf("chat %d: handled %v, want %v", chat, got, ids)
+			}
+		}
+	}
+	if got := d.safeOffset(); got != 60 {
+		t.Fatalf("safeOffset = %d, want 60", got)
+	}
+}
+
+func TestDispatcherChatsInParallel(t *testing.T) {
+	h := newFakeHandler()
+	release := make(chan struct{})
+	h.block[0] = release
+	d := newTestDispatcher(2, 10, h, nil)
+
+	d.submit(chatUpdate(1, 0))
+	h.waitStarted(t, 1)
+	// чат 1 в другом воркере и не ждёт медленного чата 0
+	d.submit(chatUpdate(2, 1))
+	h.waitStarted(t, 2)
+	deadline := time.Now().Add(time.Second)
+	for len(h.messages(1)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("chat 1 blocked by chat 0")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// 2 обработано, но 1 ещё нет: подтверждать нечего
+	if got := d.safeOffset(); got != 0 {
+		t.Fatalf("safeOffset = %d while update 1 runs", got)
+	}
+
+	close(release)
+	if err := d.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.safeOffset(); got != 2 {
+		t.Fatalf("safeOffset = %d, want 2", got)
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	h := newFakeHandler()
+	release := make(chan struct{})
+	h.block[7] = release
+	var rejected []int
+	d := newTestDispatcher(2, 1, h, func(m *tgbotapi.Message) { rejected = append(rejected, m.MessageID) })
+
+	d.submit(chatUpdate(1, 7))
+	h.waitStarted(t, 1)
+	if !d.submit(chatUpdate(2, 7)) {
+		t.Fatal("update 2 did not fit into the queue")
+	}
+	// очередь занята: submit не ждёт места и сразу отбрасывает сообщение,
+	// чтобы приём не стоял из-за одного чата
+	start := time.Now()
+	if d.submit(chatUpdate(3, 7)) {
+		t.Fatal("update 3 accepted into a full queue")
+	}
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Fatalf("submit waited %s for a full queue", waited)
+	}
+	if len(rejected) != 1 || rejected[0] != 3 {
+		t.Fatalf("rejected = %v", rejected)
+	}
+	// чат другого воркера принимается как обычно
+	if !d.submit(chatUpdate(4, 8)) {
+		t.Fatal("update 4 for another worker rejected")
+	}
+	h.waitStarted(t, 4)
+
+	close(release)
+	if err := d.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.messages(7); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("handled %v", got)
+	}
+	// отброшенное сообщение подтверждается: повторять его незачем
+	if got := d.safeOffset(); got != 4 {
+		t.Fatalf("safeOffset = %d, want 4", got)
+	}
+}
+
+func TestDispatcherDrainTimeout(t *testing.T) {
+	h := newFakeHandler()
+	// обработчик чата 7 не заканчивает сам, только по отмене ctx
+	h.block[7] = make(chan struct{})
+	d := newTestDispatcher(1, 10, h, nil)
+
+	d.submit(chatUpdate(1, 7))
+	h.waitStarted(t, 1)
+	d.submit(chatUpdate(2, 7))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown = %v, want deadline exceeded", err)
+	}
+	// прерванное и не начатое сообщения не подтверждаются
+	if got := d.safeOffset(); got != 0 {
+		t.Fatalf("safeOffset = %d, want 0", got)
+	}
+	if got := h.messages(7); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("handled %v", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"download_track/internal/mailcrypt"
+	"download_track/internal/store"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxKeySize — ограничение на файл с ключом: открытые ключи и
+// сертификаты занимают единицы килобайт.
+const maxKeySize = 64 << 10
+
+// keyErrors — сообщения для ошибок разбора ключа.
+var keyErrors = []struct {
+	err error
+	key string
+}{
+	{mailcrypt.ErrPrivateKey, "key.private"},
+	{mailcrypt.ErrMultipleKeys, "key.multiple"},
+	{mailcrypt.ErrCannotEncrypt, "key.cannot_encrypt"},
+	{mailcrypt.ErrNotRSA, "key.not_rsa"},
+	{mailcrypt.ErrUnknownFormat, "key.unknown_format"},
+}
+
+func keyKindName(kind string) string {
+	if kind == store.KeySMIME {
+		return "S/MIME"
+	}
+	return "PGP"
+}
+
+// cmdSetKey сохраняет ключ шифрования из файла: файл с подписью-командой
+// или файл, на который команда отвечает.
+func (b *Bot) cmdSetKey(ctx context.Context, m *tgbotapi.Message, _ []string) {
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		b.send(m.Chat.ID, b.t(ctx, "key.unregistered"))
+		return
+	}
+	if err != nil {
+		log.Println("userForTelegram err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	doc := m.Document
+	if doc == nil && m.ReplyToMessage != nil {
+		doc = m.ReplyToMessage.Document
+	}
+	if doc == nil {
+		b.send(m.Chat.ID, b.t(ctx, "key.how"))
+		return
+	}
+	if doc.FileSize > maxKeySize {
+		b.send(m.Chat.ID, b.t(ctx, "key.too_large", maxKeySize>>10))
+		return
+	}
+
+	data, err := b.downloadFile(ctx, doc.FileID, maxKeySize)
+	if err != nil {
+		log.Println("download key err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "key.download_failed"))
+		return
+	}
+	if len(data) > maxKeySize {
+		b.send(m.Chat.ID, b.t(ctx, "key.too_large", maxKeySize>>10))
+		return
+	}
+
+	key, err := mailcrypt.ParseKey(data)
+	if err != nil {
+		b.log.InfoContext(ctx, "key rejected", "user_id", u.ID, "error", err.Error())
+		for _, ke := range keyErrors {
+			if errors.Is(err, ke.err) {
+				b.send(m.Chat.ID, b.t(ctx, ke.key))
+				return
+			}
+		}
+		b.send(m.Chat.ID, b.t(ctx, "key.unknown_format"))
+		return
+	}
+
+	_, err = b.store.SetEncryptionKey(ctx, store.EncryptionKey{
+		UserID:      u.ID,
+		Kind:        key.Kind,
+		Data:        key.Data,
+		Fingerprint: key.Fingerprint,
+	})
+	if err != nil {
+		log.Println("set encryption key err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+	b.log.InfoContext(ctx, "key saved", "user_id", u.ID, "kind", key.Kind, "fingerprint", key.Fingerprint)
+	b.send(m.Chat.ID, b.t(ctx, "key.saved", keyKindName(key.Kind), key.Fingerprint, key.Owner, u.Email))
+}
+
+// downloadFile скачивает файл из Telegram, читая не больше limit+1
+// байт: по длине результата вызывающий видит превышение.
+func (b *Bot) downloadFile(ctx context.Context, fileID string, limit int64) ([]byte, error) {
+	url, err := b.api.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file http status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit+1))
+}
+
+// cmdEncryption показывает настройки шифрования; required и optional
+// меняют требование шифрования, off удаляет ключ.
+func (b *Bot) cmdEncryption(ctx context.Context, m *tgbotapi.Message, args []string) {
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		b.send(m.Chat.ID, b.t(ctx, "encryption.unregistered"))
+		return
+	}
+	if err != nil {
+		log.Println("userForTelegram err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+		return
+	}
+
+	var reply string
+	mode := ""
+	if len(args) > 0 {
+		mode = args[0]
+	}
+	switch mode {
+	case "":
+		var k *store.EncryptionKey
+		if k, err = b.store.EncryptionKey(ctx, u.ID); err == nil {
+			reply = b.encryptionStatus(ctx, u, k)
+		}
+	case "required", "optional":
+		err = b.store.SetEncryptionRequired(ctx, u.ID, mode == "required")
+		reply = b.t(ctx, "encryption."+mode)
+	case "off":
+		err = b.store.DeleteEncryptionKey(ctx, u.ID)
+		reply = b.t(ctx, "encryption.removed")
+	default:
+		b.send(m.Chat.ID, b.t(ctx, "command.usage", b.commands.lookup("encryption").usage(langFrom(ctx))))
+		return
+	}
+
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		b.send(m.Chat.ID, b.t(ctx, "encryption.none"))
+	case err != nil:
+		log.Println("encryption err:", err)
+		b.send(m.Chat.ID, b.t(ctx, "error.internal"))
+	default:
+		b.send(m.Chat.ID, reply)
+	}
+}
+
+func (b *Bot) encryptionStatus(ctx context.Context, u *store.User, k *store.EncryptionKey) string {
+	var owner string
+	if key, err := mailcrypt.LoadKey(k.Kind, k.Data); err == nil {
+		owner = key.Owner
+	}
+	mode := b.t(ctx, "encryption.mode_optional")
+	if k.Required {
+		mode = b.t(ctx, "encryption.mode_required")
+	}
+	return b.t(ctx, "encryption.status", keyKindName(k.Kind), k.Fingerprint, owner, u.Email, mode)
+}
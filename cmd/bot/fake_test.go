@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"download_track/internal/logging"
+	"download_track/internal/store"
+	"download_track/internal/store/memory"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	testAdminChat = 999
+	testBotName   = "filemailer_bot"
+	// код, который fakeHTTPService «отправляет» на новые адреса
+	testVerifyCode = "123456"
+)
+
+// sentMessage — сообщение, которое бот отправил через fakeTelegram.
+type sentMessage struct {
+	ChatID int64
+	Text   string
+}
+
+// sentDocument — файл, который бот загрузил в чат.
+type sentDocument struct {
+	ChatID int64
+	Name   string
+	Data   string
+}
+
+// fakeTelegram записывает всё, что бот отправляет в Telegram, и отдаёт
+// файлы из files со своего httptest-сервера.
+type fakeTelegram struct {
+	mu        sync.Mutex
+	sent      []sentMessage
+	documents []sentDocument
+	requests  []tgbotapi.Chattable
+	files     map[string][]byte
+	fileSrv   *httptest.Server
+}
+
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	f := &fakeTelegram{files: make(map[string][]byte)}
+	f.fileSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		data, ok := f.files[strings.TrimPrefix(r.URL.Path, "/")]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(f.fileSrv.Close)
+	return f
+}
+
+func (f *fakeTelegram) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if m, ok := c.(tgbotapi.MessageConfig); ok {
+		f.sent = append(f.sent, sentMessage{ChatID: m.ChatID, Text: m.Text})
+	} else if d, ok := c.(tgbotapi.DocumentConfig); ok {
+		// загрузка читает файл целиком, как настоящий Bot API
+		name, r, err := d.File.UploadData()
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		f.documents = append(f.documents, sentDocument{ChatID: d.ChatID, Name: name, Data: string(data)})
+		return tgbotapi.Message{MessageID: 100 + len(f.documents)}, nil
+	} else {
+		f.requests = append(f.requests, c)
+	}
+	return tgbotapi.Message{MessageID: len(f.sent)}, nil
+}
+
+func (f *fakeTelegram) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, c)
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (f *fakeTelegram) GetFileDirectURL(fileID string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.files[fileID]; !ok {
+		return "", errors.New("Bad Request: invalid file_id")
+	}
+	return f.fileSrv.URL + "/" + fileID, nil
+}
+
+// addFile кладёт файл, который бот сможет скачать по fileID.
+func (f *fakeTelegram) addFile(fileID string, data []byte) {
+	f.mu.Lock()
+	f.files[fileID] = data
+	f.mu.Unlock()
+}
+
+// takeDocuments возвращает загруженные файлы и очищает запись.
+func (f *fakeTelegram) takeDocuments() []sentDocument {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.documents
+	f.documents = nil
+	return out
+}
+
+// deleted — сообщения, которые бот удалил из чата.
+func (f *fakeTelegram) deleted() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []int
+	for _, c := range f.requests {
+		if d, ok := c.(tgbotapi.DeleteMessageConfig); ok {
+			ids = append(ids, d.MessageID)
+		}
+	}
+	return ids
+}
+
+// take возвращает отправленные сообщения и очищает запись.
+func (f *fakeTelegram) take() []sentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.sent
+	f.sent = nil
+	return out
+}
+
+// sendCall — запрос бота к /send http-сервиса.
+type sendCall struct {
+	sendReq
+	CorrelationID string
+}
+
+// deliveryReport — отчёт бота о загрузке файла задания в чат.
+type deliveryReport struct {
+	JobID           string
+	Location, Error string
+}
+
+// fakeHTTPService — http-service на httptest: проверяет api_key по тому
+// же хранилищу, что и бот, и записывает вызовы /send. Для доставки в
+// Telegram отвечает содержимым file.
+type fakeHTTPService struct {
+	*httptest.Server
+	mu      sync.Mutex
+	calls   []sendCall
+	status  int
+	file    string
+	reports []deliveryReport
+	// столько следующих отчётов о загрузке получат 502
+	reportFailures int
+}
+
+func newFakeHTTPService(t *testing.T, st store.Store) *fakeHTTPService {
+	f := &fakeHTTPService{status: http.StatusOK}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /send", func(w http.ResponseWriter, r *http.Request) {
+		var req sendReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if _, err := st.UserByAPIKey(r.Context(), req.APIKey); err != nil {
+			http.Error(w, "invalid api_key", http.StatusUnauthorized)
+			return
+		}
+
+		f.mu.Lock()
+		f.calls = append(f.calls, sendCall{sendReq: req, CorrelationID: r.Header.Get(logging.CorrelationHeader)})
+		status := f.status
+		f.mu.Unlock()
+
+		if status != http.StatusOK {
+			http.Error(w, "download failed", status)
+			return
+		}
+		f.mu.Lock()
+		file := f.file
+		f.mu.Unlock()
+		// пустой file — файл «не влез», и ответ как после письма
+		if req.Destination == store.DestTelegram && file != "" && int64(len(file)) <= req.MaxSize {
+			w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"`)
+			w.Header().Set("X-Job-ID", "7")
+			io.WriteString(w, file)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("POST /api/v1/jobs/{id}/delivery", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := st.UserByAPIKey(r.Context(), strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		rep := deliveryReport{JobID: r.PathValue("id")}
+		var req struct{ Location, Error string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		rep.Location, rep.Error = req.Location, req.Error
+		f.mu.Lock()
+		if f.reportFailures > 0 {
+			f.reportFailures--
+			f.mu.Unlock()
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		f.reports = append(f.reports, rep)
+		f.mu.Unlock()
+		w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("POST /api/v1/addresses", func(w http.ResponseWriter, r *http.Request) {
+		u, err := st.UserByAPIKey(r.Context(), strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		var req struct{ Label, Email string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		_, err = st.CreateAddress(r.Context(), u.ID, req.Label, req.Email, testVerifyCode, time.Now().Add(time.Hour))
+		if errors.Is(err, store.ErrLabelTaken) {
+			http.Error(w, "label taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("PUT /api/v1/credentials/{scheme}/{host}", func(w http.ResponseWriter, r *http.Request) {
+		u, err := st.UserByAPIKey(r.Context(), strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Username, Password string
+			Headers, Cookies   map[string]string
+			UserAgent          string `json:"user_agent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if _, ok := req.Headers["Host"]; ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			io.WriteString(w, `{"error":{"code":"validation_failed","message":"header Host cannot be set"}}`)
+			return
+		}
+		_, err = st.SetCredential(r.Context(), store.Credential{UserID: u.ID, Scheme: r.PathValue("scheme"), Host: r.PathValue("host"),
+			Username: req.Username, Password: req.Password, Headers: req.Headers, Cookies: req.Cookies, UserAgent: req.UserAgent})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("{}"))
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHTTPService) takeCalls() []sendCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.calls
+	f.calls = nil
+	return out
+}
+
+func (f *fakeHTTPService) takeReports() []deliveryReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.reports
+	f.reports = nil
+	return out
+}
+
+func (f *fakeHTTPService) setFile(data string) {
+	f.mu.Lock()
+	f.file = data
+	f.mu.Unlock()
+}
+
+func (f *fakeHTTPService) failReports(n int) {
+	f.mu.Lock()
+	f.reportFailures = n
+	f.mu.Unlock()
+}
+
+func (f *fakeHTTPService) setStatus(status int) {
+	f.mu.Lock()
+	f.status = status
+	f.mu.Unlock()
+}
+
+type testEnv struct {
+	bot   *Bot
+	tg    *fakeTelegram
+	store *memory.Store
+	http  *fakeHTTPService
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	st := memory.New()
+	tg := newFakeTelegram(t)
+	svc := newFakeHTTPService(t, st)
+	return &testEnv{
+		bot: &Bot{
+			api:         tg,
+			log:         slog.New(slog.NewJSONHandler(io.Discard, nil)),
+			store:       st,
+			commands:    botCommands,
+			username:    testBotName,
+			apiBase:     svc.URL,
+			adminChatID: testAdminChat,
+		},
+		tg:    tg,
+		store: st,
+		http:  svc,
+	}
+}
+
+// message собирает сообщение пользователя в личном чате (chat_id равен
+// telegram_id). Команда в начале текста размечается, как это делает
+// Telegram.
+func message(fromID int64, username, text string) *tgbotapi.Message {
+	return messageInChat(fromID, fromID, username, text)
+}
+
+func messageInChat(chatID, fromID int64, username, text string) *tgbotapi.Message {
+	m := &tgbotapi.Message{
+		MessageID: 1,
+		From:      &tgbotapi.User{ID: fromID, UserName: username},
+		Chat:      &tgbotapi.Chat{ID: chatID},
+		Text:      text,
+	}
+	if len(text) > 0 && text[0] == '/' {
+		cmd := text
+		for i, r := range text {
+			if r == ' ' || r == '\n' {
+				cmd = text[:i]
+				break
+			}
+		}
+		m.Entities = append(m.Entities, tgbotapi.MessageEntity{
+			Type:   "bot_command",
+			Offset: 0,
+			Length: len(utf16.Encode([]rune(cmd))),
+		})
+	}
+	return m
+}
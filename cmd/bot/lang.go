@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"download_track/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type langKey struct{}
+
+// withLang запоминает язык ответа на время обработки сообщения.
+func withLang(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, langKey{}, lang)
+}
+
+func langFrom(ctx context.Context) string {
+	if lang, ok := ctx.Value(langKey{}).(string); ok {
+		return lang
+	}
+	return i18n.Default
+}
+
+// t — текст на языке текущего сообщения.
+func (b *Bot) t(ctx context.Context, key string, args ...any) string {
+	return i18n.T(langFrom(ctx), key, args...)
+}
+
+// senderLang — язык ответа отправителю: выбранный в аккаунте, а если его
+// нет — язык Telegram. Зарегистрированным пользователям без языка он
+// сохраняется, чтобы письма и уведомления шли на том же языке.
+func (b *Bot) senderLang(ctx context.Context, from *tgbotapi.User) string {
+	if from == nil {
+		return i18n.Default
+	}
+	lang := i18n.Match(from.LanguageCode)
+
+	u, err := b.userForTelegram(ctx, from.ID)
+	if err != nil {
+		return lang
+	}
+	if i18n.IsSupported(u.Language) {
+		return u.Language
+	}
+	if err := b.store.SetLanguage(ctx, u.ID, lang); err != nil {
+		log.Println("save language err:", err)
+	}
+	return lang
+}
+
+// userLang — язык пользователя, которому бот пишет сам (например, об
+// обработанной заявке).
+func (b *Bot) userLang(ctx context.Context, userID int) string {
+	u, err := b.store.UserByID(ctx, userID)
+	if err != nil || !i18n.IsSupported(u.Language) {
+		return i18n.Default
+	}
+	return u.Language
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"download_track/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func withLanguageCode(m *tgbotapi.Message, code string) *tgbotapi.Message {
+	m.From.LanguageCode = code
+	return m
+}
+
+func TestTelegramLanguage(t *testing.T) {
+	e := newTestEnv(t)
+
+	expectReplies(t, e.say(withLanguageCode(message(1, "alice", "/start"), "en-US")), sentMessage{1, "Hi! Send /register"})
+	// неподдерживаемый язык — язык по умолчанию
+	expectReplies(t, e.say(withLanguageCode(message(2, "bob", "/start"), "de")), sentMessage{2, "Привет!"})
+
+	expectReplies(t, e.say(withLanguageCode(message(1, "alice", "/register alice@example.com"), "en")), sentMessage{1, "Done!"})
+	u, _ := e.store.UserByEmail(context.Background(), "alice@example.com")
+	if u.Language != "en" {
+		t.Fatalf("language saved on register = %q, want en", u.Language)
+	}
+	expectReplies(t, e.say(withLanguageCode(message(1, "alice", "/link"), "en")), sentMessage{1, "Usage: /link <code>"})
+}
+
+func TestLanguageCommand(t *testing.T) {
+	e := newTestEnv(t)
+
+	expectReplies(t, e.say(message(1, "alice", "/language en")), sentMessage{1, "Сначала сделай /register"})
+
+	alice := e.register(t, 1, "alice", "alice@example.com")
+	expectReplies(t, e.say(message(1, "alice", "/language")), sentMessage{1, "Язык: Русский (ru)"})
+	expectReplies(t, e.say(message(1, "alice", "/language fr")), sentMessage{1, `Неизвестный язык "fr"`})
+
+	expectReplies(t, e.say(message(1, "alice", "/language EN")), sentMessage{1, "Language switched to English."})
+	if u, _ := e.store.UserByID(context.Background(), alice.ID); u.Language != "en" {
+		t.Fatalf("language = %q, want en", u.Language)
+	}
+	// выбранный язык важнее языка Telegram
+	expectReplies(t, e.say(withLanguageCode(message(1, "alice", "/start"), "ru")), sentMessage{1, "Hi, @alice!"})
+
+	// меню чата переключается на выбранный язык
+	var chatMenu *tgbotapi.SetMyCommandsConfig
+	for _, c := range e.tg.requests {
+		if cfg, ok := c.(tgbotapi.SetMyCommandsConfig); ok && cfg.Scope != nil && cfg.Scope.ChatID == 1 {
+			chatMenu = &cfg
+		}
+	}
+	if chatMenu == nil || chatMenu.Commands[0].Description != "Greeting and registration check" {
+		t.Fatalf("chat menu not switched: %+v", chatMenu)
+	}
+}
+
+func TestNotificationsUseRecipientLanguage(t *testing.T) {
+	e := newTestEnv(t)
+	e.register(t, 1, "alice", "old@example.com")
+	e.say(message(1, "alice", "/language en"))
+	e.say(message(1, "alice", "/change_email new@example.com"))
+
+	// админ пишет по-русски, пользователь получает уведомление на своём языке
+	expectReplies(t, e.say(messageInChat(testAdminChat, 42, "admin", "/approve_change 1")),
+		sentMessage{1, "The admin changed your email to new@example.com."},
+		sentMessage{testAdminChat, "Заявка #1 подтверждена"},
+	)
+}
+
+func TestMenusForEveryLanguage(t *testing.T) {
+	e := newTestEnv(t)
+	e.bot.registerMenus()
+
+	seen := map[string]int{}
+	for _, c := range e.tg.requests {
+		if cfg, ok := c.(tgbotapi.SetMyCommandsConfig); ok {
+			seen[cfg.LanguageCode]++
+		}
+	}
+	// общее и админское меню на каждом языке и без языка
+	for _, lang := range append([]string{""}, i18n.Supported()...) {
+		if seen[lang] != 2 {
+			t.Errorf("language %q: %d menus, want 2", lang, seen[lang])
+		}
+	}
+}
+
+func TestReplyBusyLanguage(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.bot.replyBusy(withLanguageCode(message(1, "alice", "hi"), "en"))
+	expectReplies(t, e.tg.take(), sentMessage{1, "Too many requests"})
+
+	// пост канала приходит без From: отвечаем на языке по умолчанию
+	post := messageInChat(-100, 0, "", "hi")
+	post.From = nil
+	e.bot.replyBusy(post)
+	expectReplies(t, e.tg.take(), sentMessage{-100, "Слишком много запросов"})
+}
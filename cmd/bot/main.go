@@ -1,620 +1,537 @@
-﻿package main
-
-import (
-    "bytes"
-    "crypto/rand"
-    "database/sql"
-    "encoding/hex"
-    "encoding/json"
-    "errors"
-    "fmt"
-    "log"
-    "net/http"
-    "os"
-    "strconv"
-    "strings"
-	"time"
-
-
-    tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-    _ "github.com/lib/pq"
-)
-
-type Bot struct {
-    api         *tgbotapi.BotAPI
-    db          *sql.DB
-    apiBase     string
-    adminChatID int64
-}
-
-type sendReq struct {
-    APIKey  string `json:"api_key"`
-    FileURL string `json:"file_url"`
-}
-
-func main() {
-    token := os.Getenv("TELEGRAM_TOKEN")
-    if token == "" {
-        log.Fatal("TELEGRAM_TOKEN is empty")
-    }
-
-    apiBase := os.Getenv("API_BASE")
-    if apiBase == "" {
-        apiBase = "http://http-service:8080"
-    }
-
-    dsn := os.Getenv("DB_DSN")
-    if dsn == "" {
-        log.Fatal("DB_DSN is empty")
-    }
-
-    adminChatIDStr := os.Getenv("ADMIN_CHAT_ID")
-    if adminChatIDStr == "" {
-        log.Fatal("ADMIN_CHAT_ID is empty")
-    }
-    adminChatID, err := strconv.ParseInt(adminChatIDStr, 10, 64)
-    if err != nil {
-        log.Fatal("invalid ADMIN_CHAT_ID:", err)
-    }
-
-    db, err := sql.Open("postgres", dsn)
-    if err != nil {
-        log.Fatal("db open:", err)
-    }
-    if err := db.Ping(); err != nil {
-        log.Fatal("db ping:", err)
-    }
-
-    botAPI, err := tgbotapi.NewBotAPI(token)
-    if err != nil {
-        log.Fatal("NewBotAPI:", err)
-    }
-	//Меню команд - для пользователей
-	userCommands := []tgbotapi.BotCommand{
-        {Command: "start", Description: "Приветствие и проверка регистрации"},
-        {Command: "register", Description: "Регистрация email: /register email@example.com"},
-        {Command: "change_email", Description: "Запрос на смену email: /change_email new_email@example.com"},
-        {Command: "send", Description: "Отправить файл по ссылке на почту"},
-        {Command: "help", Description: "Список доступных команд"},
-    }
-
-    _, err = botAPI.Request(tgbotapi.NewSetMyCommands(userCommands...))
-    if err != nil {
-        log.Println("set user commands err:", err)
-    }
-	//Меню для админа
-	adminCommands := []tgbotapi.BotCommand{
-        {Command: "start", Description: "Приветствие и проверка регистрации"},
-        {Command: "register", Description: "Регистрация email"},
-        {Command: "change_email", Description: "Запрос на смену email"},
-        {Command: "send", Description: "Отправить файл по ссылке"},
-        {Command: "help", Description: "Список доступных команд"},
-        {Command: "approve_change", Description: "Подтвердить смену email: /approve_change <id>"},
-        {Command: "reject_change", Description: "Отклонить смену email: /reject_change <id>"},
-        {Command: "list_changes", Description: "Показать все заявки на смену email"},
-    }
-
-    scope := tgbotapi.NewBotCommandScopeChat(adminChatID)
-    cfg := tgbotapi.NewSetMyCommandsWithScope(scope, adminCommands...)
-
-    _, err = botAPI.Request(cfg)
-    if err != nil {
-        log.Println("set admin commands err:", err)
-    }
-
-    b := &Bot{
-        api:         botAPI,
-        db:          db,
-        apiBase:     apiBase,
-        adminChatID: adminChatID,
-    }
-
-    u := tgbotapi.NewUpdate(0)
-    u.Timeout = 60
-
-    updates := b.api.GetUpdatesChan(u)
-
-    log.Println("bot started")
-
-    for update := range updates {
-        if update.Message == nil {
-            continue
-        }
-        b.handleMessage(update.Message)
-    }
-}
-
-func (b *Bot) handleMessage(m *tgbotapi.Message) {
-    if m == nil {
-        return
-    }
-
-    chatID := m.Chat.ID
-    text := strings.TrimSpace(m.Text)
-
-    // --- команды через префикс ---
-
-    if strings.HasPrefix(text, "/start") {
-        registered, username, err := b.isTelegramRegistered(m.From.ID)
-        if err != nil {
-            log.Println("isTelegramRegistered err:", err)
-            b.send(chatID, "Внутренняя ошибка, попробуй позже.")
-            return
-        }
-
-        if !registered {
-            b.send(chatID, "Привет! Отправь /register email@example.com для регистрации, потом просто кидай ссылки на файлы.")
-        } else {
-            b.send(chatID, "Привет! @"+username+". Просто кидай ссылки на файлы.")
-        }
-        return
-    }
-
-    if strings.HasPrefix(text, "/register") {
-        parts := strings.Fields(text)
-        if len(parts) != 2 {
-            b.send(chatID, "Использование: /register email@example.com")
-            return
-        }
-        email := parts[1]
-
-        if err := b.registerTelegramUser(m.From.ID, m.From.UserName, email); err != nil {
-            log.Println("register err:", err)
-            b.send(chatID, "Ошибка регистрации, попробуй позже.")
-        } else {
-            b.send(chatID, "Готово! Теперь просто пришли ссылку на файл.")
-        }
-        return
-    }
-
-    if strings.HasPrefix(text, "/help") {
-        b.send(chatID, "Доступные команды:\n"+
-            "/start - приветствие и проверка регистрации\n"+
-            "/register email@example.com - регистрация\n"+
-            "/change_email new_email@example.com - запрос на смену email\n"+
-            "/send <ссылка> - отправить файл по ссылке на почту (можно просто прислать ссылку без команды)\n"+
-            "/help - эта справка")
-		if chatID == b.adminChatID {
-            b.send(chatID, "Админские команды:\n"+
-                "/approve_change <id> - подтвердить смену email\n"+
-                "/reject_change <id> - отклонить смену email\n"+
-                "/list_changes - показать все заявки")
-        }
-
-        return
-    }
-
-    if strings.HasPrefix(text, "/change_email") {
-        parts := strings.Fields(text)
-        if len(parts) != 2 {
-            b.send(chatID, "Использование: /change_email new_email@example.com")
-            return
-        }
-        newEmail := parts[1]
-
-        if err := b.requestEmailChange(m.From.ID, m.From.UserName, newEmail); err != nil {
-            log.Println("requestEmailChange err:", err)
-            b.send(chatID, "Ошибка запроса на смену email, попробуй позже.")
-        } else {
-            b.send(chatID, "Запрос на смену email отправлен админу, ожидайте подтверждения.")
-        }
-        return
-    }
-
-    if strings.HasPrefix(text, "/approve_change") {
-        parts := strings.Fields(text)
-        if len(parts) != 2 {
-            b.send(chatID, "Использование: /approve_change <request_id>")
-            return
-        }
-        if err := b.approveEmailChange(chatID, parts[1]); err != nil {
-            log.Println("approveEmailChange err:", err)
-            b.send(chatID, "Ошибка подтверждения заявки: "+err.Error())
-        }
-        return
-    }
-
-    if strings.HasPrefix(text, "/reject_change") {
-        parts := strings.Fields(text)
-        if len(parts) != 2 {
-            b.send(chatID, "Использование: /reject_change <request_id>")
-            return
-        }
-        if err := b.rejectEmailChange(chatID, parts[1]); err != nil {
-            log.Println("rejectEmailChange err:", err)
-            b.send(chatID, "Ошибка отклонения заявки: "+err.Error())
-        }
-        return
-    }
-
-	if strings.HasPrefix(text, "/list_changes") {
-		if err := b.listEmailChanges(chatID); err != nil {
-			log.Println("listEmailChanges err:", err)
-			b.send(chatID, "Ошибка получения списка заявок: "+err.Error())
-		}
-        return
-    }
-
-	url := extractFirstURL(m)
-    if url == "" {
-        b.send(chatID, "Не нашёл ссылку в сообщении.")
-        return
-    }
-
-    apiKey, err := b.getAPIKeyForTelegram(m.From.ID)
-    if err != nil {
-        log.Println("get api key err:", err)
-        b.send(chatID, "Ты ещё не зарегистрирован. Сначала сделай /register email@example.com")
-        return
-    }
-
-    if err := b.callSend(apiKey, url); err != nil {
-        log.Println("process url err:", err)
-        b.send(chatID, "Ошибка обработки ссылки: "+err.Error())
-    } else {
-        b.send(chatID, "Ссылка отправлена в HTTP-сервис, он обработает файл и отправит на твою почту.")
-    }
-}
-//вывод всех заявок на смену email
-func (b *Bot) listEmailChanges(chatID int64) error {
-    if chatID != b.adminChatID {
-        return nil
-    }
-
-    rows, err := b.db.Query(
-        `SELECT id, user_id, old_email, new_email, status, created_at
-         FROM email_change_requests
-         WHERE status = 'pending'
-		 ORDER BY
-		 	created_at DESC,
-		 	id DESC`,
-    )
-    if err != nil {
-        return err
-    }
-    defer rows.Close()
-
-    var sb strings.Builder
-    sb.WriteString("Заявки на смену email:\nДля подтверждения: /approve_change x\nДля отказа: /reject_change x\n")
-
-    found := false
-    for rows.Next() {
-        found = true
-        var (
-            id        int64
-            userID    int
-            oldEmail  string
-            newEmail  string
-            status    string
-            createdAt time.Time
-        )
-        if err := rows.Scan(&id, &userID, &oldEmail, &newEmail, &status, &createdAt); err != nil {
-            return err
-        }
-
-        sb.WriteString(fmt.Sprintf(
-            "#%d user_id=%d [%s]\n%s -> %s\n\n",
-            id, userID, status, oldEmail, newEmail,
-        ))
-    }
-    if err := rows.Err(); err != nil {
-        return err
-    }
-
-    if !found {
-        b.send(chatID, "Заявок на смену email пока нет.")
-        return nil
-    }
-
-    b.send(chatID, sb.String())
-    return nil
-}
-// approveEmailChange подтверждает заявку и меняет email у пользователя.
-func (b *Bot) approveEmailChange(chatID int64, reqIDStr string) error {
-    // только админский чат
-    if chatID != b.adminChatID {
-        return nil
-    }
-
-    reqID, err := strconv.Atoi(reqIDStr)
-    if err != nil {
-        b.send(chatID, "Некорректный id заявки.")
-        return nil
-    }
-
-    var (
-        userID     int
-        telegramID int64
-        oldEmail   string
-        newEmail   string
-        status     string
-    )
-
-    err = b.db.QueryRow(
-        `SELECT user_id, telegram_id, old_email, new_email, status
-         FROM email_change_requests
-         WHERE id = $1`,
-        reqID,
-    ).Scan(&userID, &telegramID, &oldEmail, &newEmail, &status)
-    if err != nil {
-        if err == sql.ErrNoRows {
-            b.send(chatID, "Заявка не найдена.")
-            return nil
-        }
-        return err
-    }
-
-    if status != "pending" {
-        b.send(chatID, fmt.Sprintf("Заявка #%d уже обработана (status=%s).", reqID, status))
-        return nil
-    }
-
-    _, err = b.db.Exec(
-        `UPDATE users SET email = $1 WHERE id = $2`,
-        newEmail, userID,
-    )
-    if err != nil {
-        return err
-    }
-
-    _, err = b.db.Exec(
-        `UPDATE email_change_requests
-         SET status = 'approved', processed_at = now()
-         WHERE id = $1`,
-        reqID,
-    )
-    if err != nil {
-        return err
-    }
-
-    b.send(telegramID, fmt.Sprintf("Админ сменил твой email на %s.", newEmail))
-    b.send(chatID, fmt.Sprintf("Заявка #%d подтверждена, email пользователя обновлён на %s.", reqID, newEmail))
-
-    return nil
-}
-
-// rejectEmailChange отклоняет заявку на смену email.
-func (b *Bot) rejectEmailChange(chatID int64, reqIDStr string) error {
-    // только админский чат
-    if chatID != b.adminChatID {
-        return nil
-    }
-
-    reqID, err := strconv.Atoi(reqIDStr)
-    if err != nil {
-        b.send(chatID, "Некорректный id заявки.")
-        return nil
-    }
-
-    var (
-        userID     int
-        telegramID int64
-        oldEmail   string
-        newEmail   string
-        status     string
-    )
-
-    err = b.db.QueryRow(
-        `SELECT user_id, telegram_id, old_email, new_email, status
-         FROM email_change_requests
-         WHERE id = $1`,
-        reqID,
-    ).Scan(&userID, &telegramID, &oldEmail, &newEmail, &status)
-    if err != nil {
-        if err == sql.ErrNoRows {
-            b.send(chatID, "Заявка не найдена.")
-            return nil
-        }
-        return err
-    }
-
-    if status != "pending" {
-        b.send(chatID, fmt.Sprintf("Заявка #%d уже обработана (status=%s).", reqID, status))
-        return nil
-    }
-
-    _, err = b.db.Exec(
-        `UPDATE email_change_requests
-         SET status = 'rejected', processed_at = now()
-         WHERE id = $1`,
-        reqID,
-    )
-    if err != nil {
-        return err
-    }
-
-    b.send(telegramID, fmt.Sprintf("Админ отклонил смену email на %s.", newEmail))
-    b.send(chatID, fmt.Sprintf("Заявка #%d отклонена.", reqID))
-
-    return nil
-}
-
-func (b *Bot) send(chatID int64, text string) {
-    msg := tgbotapi.NewMessage(chatID, text)
-    if _, err := b.api.Send(msg); err != nil {
-        log.Println("send msg err:", err)
-    }
-}
-
-// регистрация: создаём пользователя и привязку к telegram_id
-func (b *Bot) registerTelegramUser(telegramID int64, username, email string) error {
-    var exists bool
-    err := b.db.QueryRow("SELECT EXISTS(SELECT 1 FROM telegram_users WHERE telegram_id=$1)", telegramID).Scan(&exists)
-    if err != nil {
-        return err
-    }
-    if exists {
-        return nil
-    }
-
-    apiKey, err := generateAPIKey()
-    if err != nil {
-        return err
-    }
-
-    var userID int
-    err = b.db.QueryRow(
-        "INSERT INTO users (email, api_key) VALUES ($1,$2) RETURNING id",
-        email, apiKey,
-    ).Scan(&userID)
-    if err != nil {
-        return err
-    }
-
-    _, err = b.db.Exec(
-        "INSERT INTO telegram_users (telegram_id, username, user_id) VALUES ($1,$2,$3)",
-        telegramID, username, userID,
-    )
-    return err
-}
-
-// получить api_key по telegram_id
-func (b *Bot) getAPIKeyForTelegram(telegramID int64) (string, error) {
-    var userID int
-    err := b.db.QueryRow("SELECT user_id FROM telegram_users WHERE telegram_id=$1", telegramID).Scan(&userID)
-    if err != nil {
-        return "", err
-    }
-
-    var apiKey string
-    err = b.db.QueryRow("SELECT api_key FROM users WHERE id=$1", userID).Scan(&apiKey)
-    if err != nil {
-        return "", err
-    }
-    return apiKey, nil
-}
-
-func (b *Bot) callSend(apiKey, fileURL string) error {
-    body, _ := json.Marshal(sendReq{
-        APIKey:  apiKey,
-        FileURL: fileURL,
-    })
-
-    resp, err := http.Post(b.apiBase+"/send", "application/json", bytes.NewReader(body))
-    if err != nil {
-        return err
-    }
-    defer resp.Body.Close()
-    if resp.StatusCode != http.StatusOK {
-        return errors.New("send http status " + resp.Status)
-    }
-    return nil
-}
-
-// проверить, зарегистрирован ли telegram-пользователь
-func (b *Bot) isTelegramRegistered(telegramID int64) (bool, string, error) {
-    var exists bool
-    var username string
-
-    err := b.db.QueryRow(
-        "SELECT EXISTS(SELECT 1 FROM telegram_users WHERE telegram_id=$1)",
-        telegramID,
-    ).Scan(&exists)
-    if err != nil {
-        return false, "", err
-    }
-    if !exists {
-        return false, "", nil
-    }
-
-    err = b.db.QueryRow(
-        "SELECT t.username FROM telegram_users t WHERE t.telegram_id=$1",
-        telegramID,
-    ).Scan(&username)
-    if err != nil {
-        return true, "", err
-    }
-
-    return true, username, nil
-}
-
-// запрос на смену email: создаёт запись в email_change_requests и шлёт админу
-func (b *Bot) requestEmailChange(telegramID int64, username string, newEmail string) error {
-    var userID int
-    var oldEmail string
-
-    err := b.db.QueryRow(
-        `SELECT u.id, u.email
-         FROM telegram_users t
-         JOIN users u ON u.id = t.user_id
-         WHERE t.telegram_id = $1`,
-        telegramID,
-    ).Scan(&userID, &oldEmail)
-    if err != nil {
-        return err
-    }
-
-    var requestID int64
-    err = b.db.QueryRow(
-        `INSERT INTO email_change_requests (user_id, telegram_id, old_email, new_email, status)
-         VALUES ($1, $2, $3, $4, 'pending')
-         RETURNING id`,
-        userID, telegramID, oldEmail, newEmail,
-    ).Scan(&requestID)
-    if err != nil {
-        return err
-    }
-
-    var sb strings.Builder
-    sb.WriteString("Заявка #")
-    sb.WriteString(fmt.Sprint(requestID))
-    sb.WriteString(" от @")
-    sb.WriteString(username)
-    sb.WriteString(" (telegram_id=")
-    sb.WriteString(fmt.Sprint(telegramID))
-    sb.WriteString(", user_id=")
-    sb.WriteString(fmt.Sprint(userID))
-    sb.WriteString("):\n")
-    sb.WriteString(oldEmail)
-    sb.WriteString(" -> ")
-    sb.WriteString(newEmail)
-    sb.WriteString("\n\nДля подтверждения:\n/approve_change ")
-    sb.WriteString(fmt.Sprint(requestID))
-    sb.WriteString("\n\nДля отказа:\n/reject_change ")
-    sb.WriteString(fmt.Sprint(requestID))
-
-    // заявки всегда в админский чат
-    msg := tgbotapi.NewMessage(b.adminChatID, sb.String())
-    if _, err := b.api.Send(msg); err != nil {
-        return err
-    }
-
-    return nil
-}
-//парсинг ссылок
-func extractFirstURL(m *tgbotapi.Message) string {
-    if m == nil {
-        return ""
-    }
-
-    runes := []rune(m.Text)
-
-    for _, e := range m.Entities {
-        if e.IsURL() {
-            start := e.Offset
-            end := e.Offset + e.Length
-            if start < 0 || end > len(runes) {
-                continue
-            }
-            return string(runes[start:end])
-        }
-
-        if e.IsTextLink() {
-            u, err := e.ParseURL()
-            if err != nil {
-                continue
-            }
-            return u.String()
-        }
-    }
-
-    return ""
-}
-
-func generateAPIKey() (string, error) {
-    b := make([]byte, 32)
-    if _, err := rand.Read(b); err != nil {
-        return "", err
-    }
-    return hex.EncodeToString(b), nil
-}
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"download_track/internal/config"
+	"download_track/internal/health"
+	"download_track/internal/i18n"
+	"download_track/internal/logging"
+	"download_track/internal/migrations"
+	"download_track/internal/store"
+	"download_track/internal/store/postgres"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// telegramClient — методы Bot API, которыми пользуется Bot; в тестах
+// вместо *tgbotapi.BotAPI подставляется записывающая заглушка.
+type telegramClient interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	GetFileDirectURL(fileID string) (string, error)
+}
+
+type Bot struct {
+	api      telegramClient
+	log      *slog.Logger
+	store    store.Store
+	commands *registry
+	// имя бота без @: команды вида /start@OtherBot в группах не для нас
+	username    string
+	apiBase     string
+	adminChatID int64
+}
+
+type sendReq struct {
+	APIKey     string   `json:"api_key"`
+	FileURL    string   `json:"file_url"`
+	Recipients []string `json:"recipients,omitempty"`
+	PageMode   string   `json:"page_mode,omitempty"`
+	// store.DestTelegram — http-service вернёт файл в ответе
+	Destination string `json:"destination,omitempty"`
+	MaxSize     int64  `json:"max_size,omitempty"`
+	// учётные данные из строк после ссылки
+	Auth *store.JobAuth `json:"auth,omitempty"`
+}
+
+func main() {
+	// telegram-bot migrate up|down [n]|status
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	// настройки: CONFIG_FILE (YAML или TOML) и переменные окружения
+	cfg, err := config.LoadFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.ValidateBot(); err != nil {
+		log.Fatalf("invalid config:\n%v", err)
+	}
+	log.Printf("effective config:\n%s", cfg.Redacted("db", "bot", "log", "shutdown_timeout"))
+	conf := config.NewStore(cfg, os.Getenv("CONFIG_FILE"), (*config.Config).ValidateBot)
+
+	// режим получения обновлений: polling (по умолчанию) или webhook
+	var webhookCfg *webhookConfig
+	if cfg.Bot.Mode == "webhook" {
+		webhookCfg, err = newWebhookConfig(cfg.Bot.Webhook)
+		if err != nil {
+			log.Fatal("webhook config: ", err)
+		}
+	}
+
+	secrets, err := cfg.DB.SecretBox()
+	if err != nil {
+		log.Fatal("db.secrets_key: ", err)
+	}
+	db, err := sql.Open("postgres", cfg.DB.DSN)
+	if err != nil {
+		log.Fatal("db open:", err)
+	}
+	if err := db.Ping(); err != nil {
+		log.Fatal("db ping:", err)
+	}
+	if err := migrations.OnStartup(context.Background(), db, cfg.DB.Migrate, log.Printf); err != nil {
+		log.Fatal("migrations: ", err)
+	}
+	st := postgres.New(db, secrets)
+	if secrets != nil {
+		// секреты, записанные до появления ключа
+		n, err := st.SealSecrets(context.Background())
+		if err != nil {
+			log.Fatal("seal secrets: ", err)
+		}
+		if n > 0 {
+			log.Printf("encrypted %d stored secrets", n)
+		}
+	}
+
+	botAPI, err := tgbotapi.NewBotAPI(cfg.Bot.Token)
+	if err != nil {
+		log.Fatal("NewBotAPI:", err)
+	}
+	// структурированный лог обработки сообщений с correlation_id
+	logger, logCloser := logging.New(logging.FromConfig(cfg.Log, "/logs/bot.log"))
+	defer logCloser.Close()
+
+	b := &Bot{
+		api:         botAPI,
+		log:         logger,
+		store:       st,
+		commands:    botCommands,
+		username:    botAPI.Self.UserName,
+		apiBase:     cfg.Bot.APIBase,
+		adminChatID: cfg.Bot.AdminChatID,
+	}
+	// меню строятся из реестра команд, как и /help
+	b.registerMenus()
+
+	// ограничение времени на сообщение меняется по SIGHUP
+	handlerTimeout := func() time.Duration { return conf.Get().Bot.HandlerTimeout }
+	d := newDispatcher(cfg.Bot.Workers, cfg.Bot.QueueSize, handlerTimeout, b.handleMessage, b.replyBusy, logger)
+	d.start()
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "filemailer_bot_queue_depth",
+		Help: "Messages waiting in dispatcher queues.",
+	}, func() float64 { return float64(d.queued()) })
+
+	var src updateSource
+	switch cfg.Bot.Mode {
+	case "polling":
+		// Telegram подтверждается только то, что обработано
+		src, err = newPollingSource(botAPI, d.safeOffset)
+	case "webhook":
+		src, err = newWebhookSource(botAPI, webhookCfg)
+	}
+	if err != nil {
+		log.Fatal("start updates:", err)
+	}
+
+	ready := &health.Checker{}
+	ready.Add("db", 0, health.DB(db))
+	ready.Add("http_service", 0, health.HTTP(http.DefaultClient, cfg.Bot.APIBase+"/healthz"))
+	ready.Add("telegram", 5*time.Second, func(ctx context.Context) error {
+		_, err := botAPI.GetMe()
+		return err
+	})
+	ready.Add("dispatcher", 0, d.checkSaturation)
+	ops := startOpsServer(cfg.Bot.MetricsAddr, ready)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conf.ReloadOnSIGHUP(ctx)
+
+	log.Println("bot started in", cfg.Bot.Mode, "mode")
+
+	var srcErr error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case srcErr = <-src.failed():
+			log.Println(srcErr)
+			break loop
+		case update, ok := <-src.updates():
+			if !ok {
+				break loop
+			}
+			d.submit(update)
+		}
+	}
+	// повторный сигнал завершит процесс сразу
+	stop()
+
+	shutdownTimeout := conf.Get().ShutdownTimeout
+	log.Println("shutting down, drain timeout", shutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := drainUpdates(drainCtx, src, d); err != nil {
+		log.Println("dispatcher shutdown:", err)
+	}
+	src.commit(d.safeOffset())
+
+	if err := ops.Shutdown(drainCtx); err != nil {
+		log.Println("ops shutdown:", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Println("db close:", err)
+	}
+	log.Println("bot stopped")
+	if srcErr != nil {
+		os.Exit(1)
+	}
+}
+
+func (b *Bot) handleMessage(ctx context.Context, m *tgbotapi.Message) {
+	if m == nil {
+		return
+	}
+	ctx = withLang(ctx, b.senderLang(ctx, m.From))
+	// у файла команда приходит в подписи: /set_pgp_key к ключу
+	if m.Text == "" && m.Caption != "" {
+		cp := *m
+		cp.Text, cp.Entities = m.Caption, m.CaptionEntities
+		m = &cp
+	}
+	if m.IsCommand() {
+		b.runCommand(ctx, m)
+		return
+	}
+	b.sendURL(ctx, m, nil, "", false)
+}
+
+// replyBusy отвечает на сообщение, которое не поместилось в очередь.
+// Язык берётся из клиента: в хранилище за ответом не ходим.
+func (b *Bot) replyBusy(m *tgbotapi.Message) {
+	lang := i18n.Default
+	// у постов каналов и анонимных админов нет From
+	if m.From != nil {
+		lang = i18n.Match(m.From.LanguageCode)
+	}
+	b.send(m.Chat.ID, i18n.T(lang, "bot.busy"))
+}
+
+// sendURL передаёт первую ссылку из сообщения в http-service; пустой
+// recipients — место доставки или адрес по умолчанию, пустой pageMode —
+// страница целиком, toChat — файл в этот чат.
+func (b *Bot) sendURL(ctx context.Context, m *tgbotapi.Message, recipients []string, pageMode string, toChat bool) {
+	chatID := m.Chat.ID
+
+	// строки после ссылки — учётные данные сайта; сообщение с паролем
+	// или токеном не остаётся в чате, чем бы ни кончилась обработка
+	url := extractFirstURL(m)
+	form := authForm(m.Text, url)
+	if formHasSecrets(form) || urlHasPassword(url) {
+		b.hideSecrets(ctx, m)
+	}
+
+	if url == "" {
+		b.send(chatID, b.t(ctx, "url.not_found"))
+		return
+	}
+
+	u, err := b.userForTelegram(ctx, m.From.ID)
+	if err != nil {
+		log.Println("get api key err:", err)
+		b.send(chatID, b.t(ctx, "url.unregistered"))
+		return
+	}
+
+	auth, err := parseAuthForm(form)
+	if err != nil {
+		b.send(chatID, b.t(ctx, formErrorKey(err)))
+		return
+	}
+	url, auth = splitURLAuth(url, auth)
+
+	var dest *store.Destination
+	if len(recipients) == 0 && !toChat {
+		if d, err := b.store.Destination(ctx, u.ID); err == nil {
+			dest, toChat = d, d.Kind == store.DestTelegram
+		}
+	}
+	if toChat {
+		b.sendToChat(ctx, m, u, url, pageMode, auth)
+		return
+	}
+
+	b.log.InfoContext(ctx, "send url", "chat_id", chatID, "url", logURL(url), "recipients", recipients, "page_mode", pageMode,
+		"auth", auth != nil)
+	if err := b.callSend(ctx, u.APIKey, url, recipients, pageMode, auth); err != nil {
+		b.log.ErrorContext(ctx, "send url failed", "chat_id", chatID, "error", err.Error())
+		b.send(chatID, b.t(ctx, "url.failed", err))
+	} else if len(recipients) > 0 {
+		b.send(chatID, b.t(ctx, "url.sent_to", strings.Join(recipients, ", ")))
+	} else if dest != nil {
+		b.send(chatID, b.t(ctx, "url.sent_dest", destinationName(dest.Kind)+" "+destinationPlace(dest)))
+	} else {
+		b.send(chatID, b.t(ctx, "url.sent"))
+	}
+}
+
+// вывод всех заявок на смену email
+func (b *Bot) listEmailChanges(ctx context.Context, chatID int64) error {
+	changes, err := b.store.PendingEmailChanges(ctx)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		b.send(chatID, b.t(ctx, "changes.empty"))
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(b.t(ctx, "changes.header"))
+	for _, ec := range changes {
+		sb.WriteString(b.t(ctx, "changes.item", ec.ID, ec.UserID, ec.Status, ec.OldEmail, ec.NewEmail))
+	}
+
+	b.send(chatID, sb.String())
+	return nil
+}
+
+// approveEmailChange подтверждает заявку и меняет email у пользователя.
+func (b *Bot) approveEmailChange(ctx context.Context, chatID int64, reqIDStr string) error {
+	reqID, err := strconv.ParseInt(reqIDStr, 10, 64)
+	if err != nil {
+		b.send(chatID, b.t(ctx, "change.bad_id"))
+		return nil
+	}
+
+	ec, err := b.store.ApproveEmailChange(ctx, reqID)
+	if done := b.reportProcessed(ctx, chatID, reqID, ec, err); done {
+		return nil
+	}
+	if errors.Is(err, store.ErrEmailTaken) {
+		b.send(chatID, b.t(ctx, "change.email_taken", reqID))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b.send(ec.TelegramID, i18n.T(b.userLang(ctx, ec.UserID), "change.approved_user", ec.NewEmail))
+	b.send(chatID, b.t(ctx, "change.approved_admin", reqID, ec.NewEmail))
+
+	return nil
+}
+
+// rejectEmailChange отклоняет заявку на смену email.
+func (b *Bot) rejectEmailChange(ctx context.Context, chatID int64, reqIDStr string) error {
+	reqID, err := strconv.ParseInt(reqIDStr, 10, 64)
+	if err != nil {
+		b.send(chatID, b.t(ctx, "change.bad_id"))
+		return nil
+	}
+
+	ec, err := b.store.RejectEmailChange(ctx, reqID)
+	if done := b.reportProcessed(ctx, chatID, reqID, ec, err); done {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b.send(ec.TelegramID, i18n.T(b.userLang(ctx, ec.UserID), "change.rejected_user", ec.NewEmail))
+	b.send(chatID, b.t(ctx, "change.rejected_admin", reqID))
+
+	return nil
+}
+
+// reportProcessed отвечает админу, если заявки нет или она уже
+// обработана; true — ответ отправлен.
+func (b *Bot) reportProcessed(ctx context.Context, chatID, reqID int64, ec *store.EmailChange, err error) bool {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		b.send(chatID, b.t(ctx, "change.not_found"))
+		return true
+	case errors.Is(err, store.ErrNotPending):
+		b.send(chatID, b.t(ctx, "change.processed", reqID, ec.Status))
+		return true
+	}
+	return false
+}
+
+func (b *Bot) send(chatID int64, text string) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	if _, err := b.api.Send(msg); err != nil {
+		log.Println("send msg err:", err)
+	}
+}
+
+// регистрация: создаём пользователя и привязку к telegram_id; lang —
+// язык аккаунта для писем и уведомлений
+func (b *Bot) registerTelegramUser(ctx context.Context, telegramID int64, username, email, lang string) error {
+	apiKey, err := store.NewAPIKey()
+	if err != nil {
+		return err
+	}
+	u, err := b.store.RegisterTelegram(ctx, telegramID, username, email, apiKey)
+	if errors.Is(err, store.ErrTelegramLinked) {
+		// повторная регистрация ничего не меняет
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.store.SetLanguage(ctx, u.ID, lang)
+}
+
+// привязка Telegram к существующему аккаунту по одноразовому коду;
+// возвращает email аккаунта
+func (b *Bot) linkTelegramUser(ctx context.Context, telegramID int64, username, code string) (string, error) {
+	u, err := b.store.LinkTelegram(ctx, telegramID, username, code)
+	if err != nil {
+		return "", err
+	}
+	return u.Email, nil
+}
+
+// userForTelegram возвращает аккаунт, к которому привязан telegram_id.
+func (b *Bot) userForTelegram(ctx context.Context, telegramID int64) (*store.User, error) {
+	ti, err := b.store.IdentityByTelegramID(ctx, telegramID)
+	if err != nil {
+		return nil, err
+	}
+	return b.store.UserByID(ctx, ti.UserID)
+}
+
+func (b *Bot) callSend(ctx context.Context, apiKey, fileURL string, recipients []string, pageMode string, auth *store.JobAuth) error {
+	resp, err := b.postSend(ctx, sendReq{
+		APIKey:     apiKey,
+		FileURL:    fileURL,
+		Recipients: recipients,
+		PageMode:   pageMode,
+		Auth:       auth,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// postSend вызывает /send http-service; ответ со статусом не 200
+// становится ошибкой, тело успешного ответа закрывает вызывающий.
+func (b *Bot) postSend(ctx context.Context, sr sendReq) (*http.Response, error) {
+	body, _ := json.Marshal(sr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiBase+"/send", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := logging.CorrelationID(ctx); id != "" {
+		req.Header.Set(logging.CorrelationHeader, id)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		// неизвестный или неподтверждённый получатель, сайт требует
+		// входа: текст ошибки понятен пользователю
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.New(strings.TrimSpace(string(msg)))
+	}
+	return nil, errors.New("send http status " + resp.Status)
+}
+
+// проверить, зарегистрирован ли telegram-пользователь
+func (b *Bot) isTelegramRegistered(ctx context.Context, telegramID int64) (bool, string, error) {
+	ti, err := b.store.IdentityByTelegramID(ctx, telegramID)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	return true, ti.Username, nil
+}
+
+// запрос на смену email: создаёт запись в email_change_requests и шлёт админу
+func (b *Bot) requestEmailChange(ctx context.Context, telegramID int64, username string, newEmail string) error {
+	u, err := b.userForTelegram(ctx, telegramID)
+	if err != nil {
+		return err
+	}
+
+	ec, err := b.store.CreateEmailChange(ctx, u.ID, telegramID, u.Email, newEmail)
+	if err != nil {
+		return err
+	}
+	// заявки всегда в админский чат, на языке по умолчанию
+	text := i18n.T(i18n.Default, "change.request", ec.ID, username, telegramID, ec.UserID, ec.OldEmail, newEmail)
+	msg := tgbotapi.NewMessage(b.adminChatID, text)
+	if _, err := b.api.Send(msg); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// парсинг ссылок; смещения сущностей Telegram считает в UTF-16
+func extractFirstURL(m *tgbotapi.Message) string {
+	if m == nil {
+		return ""
+	}
+
+	text := utf16.Encode([]rune(m.Text))
+
+	for _, e := range m.Entities {
+		if e.IsURL() {
+			start := e.Offset
+			end := e.Offset + e.Length
+			if start < 0 || end > len(text) || start > end {
+				continue
+			}
+			return string(utf16.Decode(text[start:end]))
+		}
+
+		if e.IsTextLink() {
+			u, err := e.ParseURL()
+			if err != nil {
+				continue
+			}
+			return u.String()
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	updatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filemailer_bot_updates_total",
+		Help: "Processed messages by command.",
+	}, []string{"command"})
+
+	updateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filemailer_bot_update_duration_seconds",
+		Help:    "Time to process a message by command.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16), // 10ms .. ~5m
+	}, []string{"command"})
+
+	updatesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filemailer_bot_updates_dropped_total",
+		Help: "Messages rejected because the chat queue was full.",
+	})
+
+	handlerTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filemailer_bot_handler_timeouts_total",
+		Help: "Handlers that ran past BOT_HANDLER_TIMEOUT.",
+	})
+
+	handlerPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filemailer_bot_handler_panics_total",
+		Help: "Handlers that panicked.",
+	})
+
+	workersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "filemailer_bot_workers_active",
+		Help: "Dispatcher workers currently processing a message.",
+	})
+)
+
+// commandLabel — значение метки command для сообщения.
+func commandLabel(m *tgbotapi.Message) string {
+	// только команды из реестра, чтобы метки не разрастались от
+	// произвольного текста
+	if m.IsCommand() {
+		if cmd := botCommands.lookup(m.Command()); cmd != nil {
+			return cmd.name
+		}
+		return "unknown"
+	}
+	if extractFirstURL(m) != "" {
+		return "url"
+	}
+	return "text"
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"download_track/internal/health"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// startOpsServer поднимает служебный HTTP-листенер с /metrics, /healthz и
+// /readyz. Он отделён от webhook-листенера, который смотрит наружу.
+func startOpsServer(addr string, ready *health.Checker) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", health.LiveHandler())
+	mux.Handle("/readyz", ready.ReadyHandler())
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("ops listener:", err)
+		}
+	}()
+	log.Println("ops listener on", addr)
+	return srv
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"download_track/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// role — кому доступна команда.
+type role int
+
+const (
+	roleUser role = iota
+	// только из админского чата (bot.admin_chat_id)
+	roleAdmin
+)
+
+// arg — аргумент команды. По списку аргументов проверяется число слов
+// после команды и строится подсказка «Использование: ...».
+type arg struct {
+	// ключ i18n с названием аргумента
+	name     string
+	optional bool
+	// rest забирает остаток строки целиком, с пробелами
+	rest bool
+}
+
+type command struct {
+	name    string
+	aliases []string
+	role    role
+	args    []arg
+	// ключ i18n с описанием для /help и меню команд
+	help string
+	run  func(b *Bot, ctx context.Context, m *tgbotapi.Message, args []string)
+}
+
+// usage — команда с аргументами на языке lang: /register <email>, /foo [n].
+func (c *command) usage(lang string) string {
+	var sb strings.Builder
+	sb.WriteString("/" + c.name)
+	for _, a := range c.args {
+		if a.optional {
+			sb.WriteString(" [" + i18n.T(lang, a.name) + "]")
+		} else {
+			sb.WriteString(" <" + i18n.T(lang, a.name) + ">")
+		}
+	}
+	return sb.String()
+}
+
+// parseArgs делит строку после команды на аргументы и проверяет их число.
+func (c *command) parseArgs(s string) ([]string, bool) {
+	fields := strings.Fields(s)
+
+	required := 0
+	for _, a := range c.args {
+		if !a.optional {
+			required++
+		}
+	}
+	if len(fields) < required {
+		return nil, false
+	}
+
+	n := len(c.args)
+	if n > 0 && c.args[n-1].rest && len(fields) > n {
+		fields[n-1] = strings.Join(fields[n-1:], " ")
+		fields = fields[:n]
+	}
+	if len(fields) > n {
+		return nil, false
+	}
+	return fields, true
+}
+
+// registry — все команды бота. По нему работают разбор сообщений,
+// /help и меню команд в Telegram, поэтому они не расходятся.
+type registry struct {
+	commands []*command
+	// имена и псевдонимы в нижнем регистре
+	byName map[string]*command
+}
+
+func newRegistry(cmds ...*command) *registry {
+	r := &registry{commands: cmds, byName: make(map[string]*command)}
+	for _, c := range cmds {
+		for _, name := range append([]string{c.name}, c.aliases...) {
+			name = strings.ToLower(name)
+			if _, dup := r.byName[name]; dup {
+				panic("duplicate bot command " + name)
+			}
+			r.byName[name] = c
+		}
+	}
+	return r
+}
+
+func (r *registry) lookup(name string) *command {
+	return r.byName[strings.ToLower(name)]
+}
+
+// available — команды, доступные роли, в порядке объявления.
+func (r *registry) available(ro role) []*command {
+	var out []*command
+	for _, c := range r.commands {
+		if c.role <= ro {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// menu — меню команд для SetMyCommands.
+func (r *registry) menu(lang string, ro role) []tgbotapi.BotCommand {
+	var out []tgbotapi.BotCommand
+	for _, c := range r.available(ro) {
+		desc := upperFirst(i18n.T(lang, c.help))
+		if len(c.args) > 0 {
+			desc += ": " + c.usage(lang)
+		}
+		out = append(out, tgbotapi.BotCommand{Command: c.name, Description: desc})
+	}
+	return out
+}
+
+// helpText — справка для /help; админу дополнительно показываются
+// админские команды.
+func (r *registry) helpText(lang string, ro role) string {
+	var sb strings.Builder
+	sb.WriteString(i18n.T(lang, "help.header") + "\n")
+	for _, c := range r.available(ro) {
+		if c.role == roleAdmin && ro == roleAdmin {
+			continue
+		}
+		writeHelpLine(&sb, lang, c)
+	}
+	if ro == roleAdmin {
+		sb.WriteString("\n" + i18n.T(lang, "help.admin_header") + "\n")
+		for _, c := range r.available(ro) {
+			if c.role == roleAdmin {
+				writeHelpLine(&sb, lang, c)
+			}
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+func writeHelpLine(sb *strings.Builder, lang string, c *command) {
+	fmt.Fprintf(sb, "%s - %s", c.usage(lang), i18n.T(lang, c.help))
+	if len(c.aliases) > 0 {
+		sb.WriteString(" (" + i18n.T(lang, "help.aliases") + " /" + strings.Join(c.aliases, ", /") + ")")
+	}
+	sb.WriteString("\n")
+}
+
+// roleOf — роль отправителя по чату.
+func (b *Bot) roleOf(m *tgbotapi.Message) role {
+	if m.Chat.ID == b.adminChatID {
+		return roleAdmin
+	}
+	return roleUser
+}
+
+// runCommand находит команду сообщения в реестре, проверяет доступ и
+// аргументы и выполняет её.
+func (b *Bot) runCommand(ctx context.Context, m *tgbotapi.Message) {
+	// в группах команда может быть адресована другому боту: /start@OtherBot
+	name, at, _ := strings.Cut(m.CommandWithAt(), "@")
+	if at != "" && b.username != "" && !strings.EqualFold(at, b.username) {
+		return
+	}
+
+	cmd := b.commands.lookup(name)
+	if cmd == nil {
+		b.send(m.Chat.ID, b.t(ctx, "command.unknown", name))
+		return
+	}
+	// админские команды из чужих чатов молча игнорируются
+	if cmd.role > b.roleOf(m) {
+		return
+	}
+
+	args, ok := cmd.parseArgs(m.CommandArguments())
+	if !ok {
+		b.send(m.Chat.ID, b.t(ctx, "command.usage", cmd.usage(langFrom(ctx))))
+		return
+	}
+	cmd.run(b, ctx, m, args)
+}
+
+// registerMenus выставляет меню команд на каждом языке: общее и
+// расширенное для админского чата. Меню без языка — на i18n.Default,
+// его видят клиенты с неподдерживаемым языком.
+func (b *Bot) registerMenus() {
+	for _, lang := range append([]string{""}, i18n.Supported()...) {
+		menuLang := lang
+		if menuLang == "" {
+			menuLang = i18n.Default
+		}
+		users := tgbotapi.NewSetMyCommands(b.commands.menu(menuLang, roleUser)...)
+		users.LanguageCode = lang
+		if _, err := b.api.Request(users); err != nil {
+			log.Printf("set user commands (%s) err: %v", menuLang, err)
+		}
+
+		scope := tgbotapi.NewBotCommandScopeChat(b.adminChatID)
+		admins := tgbotapi.NewSetMyCommandsWithScopeAndLanguage(scope, lang, b.commands.menu(menuLang, roleAdmin)...)
+		if _, err := b.api.Request(admins); err != nil {
+			log.Printf("set admin commands (%s) err: %v", menuLang, err)
+		}
+	}
+}
+
+// registerChatMenu выставляет меню конкретного чата на выбранном
+// пользователем языке: язык Telegram у него может быть другим.
+func (b *Bot) registerChatMenu(chatID int64, lang string) {
+	ro := roleUser
+	if chatID == b.adminChatID {
+		ro = roleAdmin
+	}
+	scope := tgbotapi.NewBotCommandScopeChat(chatID)
+	if _, err := b.api.Request(tgbotapi.NewSetMyCommandsWithScope(scope, b.commands.menu(lang, ro)...)); err != nil {
+		log.Println("set chat commands err:", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"download_track/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCommandRouting(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// пусто — бот не отвечает
+		want string
+	}{
+		{"exact", "/start", "/register email@example.com"},
+		{"prefix is not a command", "/startfoo", "Неизвестная команда /startfoo"},
+		{"addressed to us", "/start@" + testBotName, "/register email@example.com"},
+		{"bot name case-insensitive", "/start@FileMailer_Bot", "/register email@example.com"},
+		{"addressed to another bot", "/start@OtherBot", ""},
+		{"command case-insensitive", "/START", "/register email@example.com"},
+		{"missing argument", "/link", "Использование: /link <код>"},
+		{"extra argument", "/link A B", "Использование: /link <код>"},
+		{"argument after bot name", "/register@" + testBotName + " a@example.com", "Готово!"},
+		{"rest argument", "/send", "Использование: /send [метки] <ссылка>"},
+		{"admin command from user chat", "/list_changes", ""},
+		{"admin alias from user chat", "/approve 1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			got := e.say(message(1, "alice", tt.text))
+			if tt.want == "" {
+				expectReplies(t, got)
+				return
+			}
+			expectReplies(t, got, sentMessage{1, tt.want})
+		})
+	}
+}
+
+func TestAdminAliases(t *testing.T) {
+	e := newTestEnv(t)
+	e.register(t, 1, "alice", "old@example.com")
+	e.say(message(1, "alice", "/change_email new@example.com"))
+
+	expectReplies(t, e.say(messageInChat(testAdminChat, 42, "admin", "/changes")),
+		sentMessage{testAdminChat, "old@example.com -> new@example.com"})
+	expectReplies(t, e.say(messageInChat(testAdminChat, 42, "admin", "/approve 1")),
+		sentMessage{1, "new@example.com"},
+		sentMessage{testAdminChat, "подтверждена"},
+	)
+}
+
+func TestParseArgs(t *testing.T) {
+	cmd := &command{name: "x", args: []arg{{name: "a"}, {name: "b", optional: true}}}
+	rest := &command{name: "y", args: []arg{{name: "label"}, {name: "text", rest: true}}}
+
+	tests := []struct {
+		cmd  *command
+		in   string
+		want []string
+		ok   bool
+	}{
+		{cmd, "", nil, false},
+		{cmd, "1", []string{"1"}, true},
+		{cmd, "  1   2 ", []string{"1", "2"}, true},
+		{cmd, "1 2 3", nil, false},
+		{rest, "work", nil, false},
+		{rest, "work hello", []string{"work", "hello"}, true},
+		{rest, "work hello   big world", []string{"work", "hello big world"}, true},
+	}
+	for _, tt := range tests {
+		got, ok := tt.cmd.parseArgs(tt.in)
+		if ok != tt.ok || strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s.parseArgs(%q) = %q, %v; want %q, %v", tt.cmd.name, tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHelpAndMenusFromRegistry(t *testing.T) {
+	e := newTestEnv(t)
+
+	user := e.say(message(1, "alice", "/help"))
+	admin := e.say(messageInChat(testAdminChat, 42, "admin", "/help"))
+	if len(user) != 1 || len(admin) != 1 {
+		t.Fatalf("help replies: user %+v, admin %+v", user, admin)
+	}
+
+	e.bot.registerMenus()
+	menus := map[string][]tgbotapi.BotCommand{}
+	for _, c := range e.tg.requests {
+		cfg, ok := c.(tgbotapi.SetMyCommandsConfig)
+		if !ok || cfg.LanguageCode != "" {
+			continue
+		}
+		if cfg.Scope == nil {
+			menus["user"] = cfg.Commands
+		} else {
+			menus["admin"] = cfg.Commands
+		}
+	}
+
+	// каждая команда из реестра есть в справке и меню своей роли, а
+	// админские не видны пользователю
+	for _, c := range botCommands.commands {
+		inUserHelp := strings.Contains(user[0].Text, c.usage(i18n.Default)+" - ")
+		inAdminHelp := strings.Contains(admin[0].Text, c.usage(i18n.Default)+" - ")
+		inUserMenu, inAdminMenu := hasCommand(menus["user"], c.name), hasCommand(menus["admin"], c.name)
+
+		if !inAdminHelp || !inAdminMenu {
+			t.Errorf("/%s missing from admin help or menu", c.name)
+		}
+		wantUser := c.role == roleUser
+		if inUserHelp != wantUser || inUserMenu != wantUser {
+			t.Errorf("/%s: in user help %v, in user menu %v, want %v", c.name, inUserHelp, inUserMenu, wantUser)
+		}
+	}
+}
+
+func hasCommand(menu []tgbotapi.BotCommand, name string) bool {
+	for _, c := range menu {
+		if c.Command == name {
+			return true
+		}
+	}
+	return false
+}
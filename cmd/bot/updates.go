@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"download_track/internal/config"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// заголовок, в котором Telegram присылает secret_token из setWebhook
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// updateSource — откуда бот получает обновления: long polling или webhook.
+type updateSource interface {
+	updates() tgbotapi.UpdatesChannel
+	// failed получает ошибку, после которой обновления больше не
+	// приходят. Бот в этом случае завершается обычным порядком.
+	failed() <-chan error
+	// stop прекращает приём обновлений.
+	stop(ctx context.Context)
+	// commit подтверждает Telegram обновления до lastID включительно,
+	// чтобы после перезапуска они не пришли снова. Необработанные
+	// обновления после lastID приходят снова только в режиме polling.
+	commit(lastID int)
+}
+
+// webhookConfig — настройки режима webhook.
+type webhookConfig struct {
+	// публичный адрес, который регистрируется в setWebhook
+	URL *url.URL
+	// адрес локального HTTP-листенера
+	Listen string
+	// значение заголовка X-Telegram-Bot-Api-Secret-Token
+	Secret string
+	// сертификат и ключ, если TLS завершается в самом боте, а не на прокси
+	TLSCert string
+	TLSKey  string
+	// загрузить сертификат в Telegram (для самоподписанных)
+	UploadCert     bool
+	MaxConnections int
+}
+
+// newWebhookConfig собирает настройки webhook из уже проверенного
+// конфига.
+func newWebhookConfig(c config.Webhook) (*webhookConfig, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookConfig{
+		URL:            u,
+		Listen:         c.Listen,
+		Secret:         c.Secret,
+		TLSCert:        c.TLSCert,
+		TLSKey:         c.TLSKey,
+		UploadCert:     c.UploadCert,
+		MaxConnections: c.MaxConnections,
+	}, nil
+}
+
+// updatesAPI — часть Bot API, которая нужна long polling.
+type updatesAPI interface {
+	GetUpdates(config tgbotapi.UpdateConfig) ([]tgbotapi.Update, error)
+}
+
+// pollingSource — long polling через getUpdates. Свой цикл вместо
+// GetUpdatesChan из библиотеки, чтобы останавливаться сразу, а не после
+// очередного long poll, и подтверждать Telegram только обработанное.
+type pollingSource struct {
+	api  updatesAPI
+	ch   chan tgbotapi.Update
+	quit chan struct{}
+	// confirmed — update_id, до которого включительно все обновления
+	// обработаны; только они подтверждаются следующим getUpdates
+	confirmed func() int
+	// пауза между опросами, пока Telegram возвращает только уже
+	// полученные, но ещё не обработанные обновления
+	retry time.Duration
+}
+
+func newPollingSource(api *tgbotapi.BotAPI, confirmed func() int) (*pollingSource, error) {
+	// getUpdates не работает, пока зарегистрирован webhook, например
+	// оставшийся после запуска в другом режиме
+	if _, err := api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		return nil, fmt.Errorf("delete webhook: %w", err)
+	}
+	return startPolling(api, api.Buffer, time.Second, confirmed), nil
+}
+
+func startPolling(api updatesAPI, buffer int, retry time.Duration, confirmed func() int) *pollingSource {
+	p := &pollingSource{
+		api:       api,
+		ch:        make(chan tgbotapi.Update, buffer),
+		quit:      make(chan struct{}),
+		confirmed: confirmed,
+		retry:     retry,
+	}
+	go p.loop()
+	return p
+}
+
+func (p *pollingSource) loop() {
+	defer close(p.ch)
+
+	// next — первый update_id, которого ещё не было в канале
+	next := 0
+	for {
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+
+		// offset подтверждает Telegram всё, что раньше него, поэтому
+		// передаётся только обработанное: сообщения в очередях и в
+		// обработке придут снова после перезапуска. Пока они есть,
+		// Telegram возвращает их сразу, не дожидаясь новых.
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 60
+		if id := p.confirmed(); id > 0 {
+			u.Offset = id + 1
+		}
+		updates, err := p.api.GetUpdates(u)
+		if err != nil {
+			log.Println("get updates err:", err)
+			if !p.wait(3 * time.Second) {
+				return
+			}
+			continue
+		}
+
+		fresh := false
+		for _, update := range updates {
+			if update.UpdateID < next {
+				continue
+			}
+			next, fresh = update.UpdateID+1, true
+			select {
+			case p.ch <- update:
+			case <-p.quit:
+				return
+			}
+		}
+		if len(updates) > 0 && !fresh && !p.wait(p.retry) {
+			return
+		}
+	}
+}
+
+// wait ждёт d; false — источник остановлен.
+func (p *pollingSource) wait(d time.Duration) bool {
+	select {
+	case <-p.quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (p *pollingSource) updates() tgbotapi.UpdatesChannel { return p.ch }
+
+// failed: ошибки getUpdates polling переживает сам, повторяя запрос.
+func (p *pollingSource) failed() <-chan error { return nil }
+
+func (p *pollingSource) stop(ctx context.Context) {
+	close(p.quit)
+}
+
+func (p *pollingSource) commit(lastID int) {
+	if lastID <= 0 {
+		return
+	}
+	// getUpdates с offset подтверждает всё, что раньше него; limit=1 и
+	// timeout=0 — чтобы не ждать и не забрать лишнего
+	_, err := p.api.GetUpdates(tgbotapi.UpdateConfig{Offset: lastID + 1, Limit: 1})
+	if err != nil {
+		log.Println("commit update offset err:", err)
+		return
+	}
+	log.Println("committed updates up to", lastID)
+}
+
+// webhookSource — собственный HTTP-листенер, на который Telegram
+// присылает обновления.
+type webhookSource struct {
+	api *tgbotapi.BotAPI
+	cfg *webhookConfig
+	srv *http.Server
+	ch  chan tgbotapi.Update
+	// закрывается при остановке: новые запросы получают 503 и Telegram
+	// повторит их позже
+	closing chan struct{}
+	// ошибка листенера, например занятый порт
+	errc chan error
+}
+
+func newWebhookSource(api *tgbotapi.BotAPI, cfg *webhookConfig) (*webhookSource, error) {
+	w := &webhookSource{
+		api: api,
+		cfg: cfg,
+		ch:  make(chan tgbotapi.Update, api.Buffer),
+
+		closing: make(chan struct{}),
+		errc:    make(chan error, 1),
+	}
+
+	path := cfg.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, w.handle)
+
+	w.srv = &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if cfg.TLSCert != "" {
+			err = w.srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = w.srv.ListenAndServe()
+		}
+		// log.Fatal здесь пропустил бы дренаж очереди: ошибку разбирает main
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			w.errc <- fmt.Errorf("webhook listener: %w", err)
+		}
+	}()
+
+	if err := w.register(); err != nil {
+		w.srv.Close()
+		return nil, err
+	}
+	log.Println("webhook registered at", cfg.URL.Redacted(), "listening on", cfg.Listen)
+
+	return w, nil
+}
+
+// register вызывает setWebhook. WebhookConfig из библиотеки не умеет
+// secret_token, поэтому параметры собираются вручную.
+func (w *webhookSource) register() error {
+	params := tgbotapi.Params{}
+	params["url"] = w.cfg.URL.String()
+	params["secret_token"] = w.cfg.Secret
+	params.AddNonZero("max_connections", w.cfg.MaxConnections)
+	if err := params.AddInterface("allowed_updates", []string{"message"}); err != nil {
+		return err
+	}
+
+	var (
+		resp *tgbotapi.APIResponse
+		err  error
+	)
+	if w.cfg.UploadCert {
+		resp, err = w.api.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{{
+			Name: "certificate",
+			Data: tgbotapi.FilePath(w.cfg.TLSCert),
+		}})
+	} else {
+		resp, err = w.api.MakeRequest("setWebhook", params)
+	}
+	if err != nil {
+		return fmt.Errorf("setWebhook: %w", err)
+	}
+	if !resp.Ok {
+		return fmt.Errorf("setWebhook: %s", resp.Description)
+	}
+	return nil
+}
+
+func (w *webhookSource) handle(rw http.ResponseWriter, r *http.Request) {
+	got := r.Header.Get(webhookSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(w.cfg.Secret)) != 1 {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(rw, r.Body, 1<<20)
+	update, err := w.api.HandleUpdate(r)
+	if err != nil {
+		http.Error(rw, "bad update", http.StatusBadRequest)
+		return
+	}
+
+	// select выбирает случайно среди готовых веток, поэтому остановку
+	// проверяем заранее: после неё в буфер ничего не добавляется
+	select {
+	case <-w.closing:
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	select {
+	case w.ch <- *update:
+		rw.WriteHeader(http.StatusOK)
+	case <-w.closing:
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+		// Telegram повторит доставку, раз ответа не было
+	}
+}
+
+func (w *webhookSource) updates() tgbotapi.UpdatesChannel { return w.ch }
+
+func (w *webhookSource) failed() <-chan error { return w.errc }
+
+// stop снимает webhook, чтобы Telegram копил обновления до следующего
+// запуска, и дожидается завершения входящих запросов.
+func (w *webhookSource) stop(ctx context.Context) {
+	close(w.closing)
+	if _, err := w.api.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		log.Println("delete webhook err:", err)
+	}
+	if err := w.srv.Shutdown(ctx); err != nil {
+		log.Println("webhook shutdown err:", err)
+	}
+}
+
+// commit в режиме webhook не нужен: обновление считается доставленным,
+// как только бот ответил 200 и положил его в буфер. Поэтому сообщения,
+// которые не успели обработать до конца дренажа, теряются: Telegram их
+// не повторит.
+func (w *webhookSource) commit(lastID int) {}
+
+// drainUpdates останавливает источник, передаёт диспетчеру обновления,
+// которые уже лежат в буфере, и дожидается их обработки. В режиме
+// webhook на них уже ответили 200, и Telegram их не повторит.
+func drainUpdates(ctx context.Context, src updateSource, d *dispatcher) error {
+	src.stop(ctx)
+	for {
+		select {
+		case update, ok := <-src.updates():
+			if !ok {
+				return d.shutdown(ctx)
+			}
+			d.submit(update)
+		default:
+			return d.shutdown(ctx)
+		}
+	}
+}
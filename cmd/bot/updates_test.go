@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeUpdates ведёт себя как getUpdates: offset подтверждает и удаляет
+// всё, что раньше него, остальное возвращается снова.
+type fakeUpdates struct {
+	mu        sync.Mutex
+	updates   []tgbotapi.Update
+	maxOffset int
+}
+
+func (f *fakeUpdates) GetUpdates(c tgbotapi.UpdateConfig) ([]tgbotapi.Update, error) {
+	f.mu.Lock()
+	if c.Offset > 0 {
+		kept := f.updates[:0]
+		for _, u := range f.updates {
+			if u.UpdateID >= c.Offset {
+				kept = append(kept, u)
+			}
+		}
+		f.updates = kept
+		f.maxOffset = max(f.maxOffset, c.Offset)
+	}
+	out := append([]tgbotapi.Update(nil), f.updates...)
+	f.mu.Unlock()
+	if len(out) == 0 {
+		// long poll без новых обновлений
+		time.Sleep(5 * time.Millisecond)
+	}
+	return out, nil
+}
+
+func (f *fakeUpdates) offset() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.maxOffset
+}
+
+func receive(t *testing.T, p *pollingSource, want ...int) {
+	t.Helper()
+	for _, id := range want {
+		select {
+		case u := <-p.updates():
+			if u.UpdateID != id {
+				t.Fatalf("got update %d, want %d", u.UpdateID, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("update %d was not received", id)
+		}
+	}
+}
+
+func TestPollingConfirmsOnlyProcessed(t *testing.T) {
+	api := &fakeUpdates{updates: []tgbotapi.Update{{UpdateID: 10}, {UpdateID: 11}, {UpdateID: 12}}}
+	var processed atomic.Int64
+	p := startPolling(api, 10, time.Millisecond, func() int { return int(processed.Load()) })
+
+	receive(t, p, 10, 11, 12)
+	time.Sleep(20 * time.Millisecond)
+	if got := api.offset(); got != 0 {
+		t.Fatalf("offset %d confirmed unprocessed updates", got)
+	}
+
+	processed.Store(11)
+	deadline := time.Now().Add(time.Second)
+	for api.offset() != 12 {
+		if time.Now().After(deadline) {
+			t.Fatalf("offset = %d, want 12", api.offset())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// 12 ещё у Telegram, но в канал второй раз не попадает
+	select {
+	case u := <-p.updates():
+		t.Fatalf("update %d delivered twice", u.UpdateID)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.stop(context.Background())
+	for range p.updates() {
+	}
+	p.commit(11)
+
+	// после перезапуска необработанное приходит снова
+	p = startPolling(api, 10, time.Millisecond, func() int { return 0 })
+	receive(t, p, 12)
+	p.stop(context.Background())
+}
+
+// fakeBotAPI — Bot API на httptest-сервере, который на любой метод
+// отвечает успехом и запоминает вызванные методы.
+func fakeBotAPI(t *testing.T, buffer int) (*tgbotapi.BotAPI, func() []string) {
+	var (
+		mu      sync.Mutex
+		methods []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		mu.Unlock()
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	t.Cleanup(srv.Close)
+	api := &tgbotapi.BotAPI{Token: "test", Client: srv.Client(), Buffer: buffer}
+	api.SetAPIEndpoint(srv.URL + "/bot%s/%s")
+	return api, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), methods...)
+	}
+}
+
+// newTestWebhook собирает webhookSource без листенера: запросы подаются
+// прямо в handle.
+func newTestWebhook(api *tgbotapi.BotAPI) *webhookSource {
+	return &webhookSource{
+		api:     api,
+		cfg:     &webhookConfig{Secret: "s3cret"},
+		srv:     &http.Server{},
+		ch:      make(chan tgbotapi.Update, api.Buffer),
+		closing: make(chan struct{}),
+		errc:    make(chan error, 1),
+	}
+}
+
+func postUpdate(w *webhookSource, secret, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set(webhookSecretHeader, secret)
+	}
+	rec := httptest.NewRecorder()
+	w.handle(rec, req)
+	return rec
+}
+
+func updateJSON(id int, chatID int64) string {
+	return fmt.Sprintf(`{"update_id":%d,"message":{"message_id":%d,"chat":{"id":%d}}}`, id, id, chatID)
+}
+
+func TestWebhookDrainOnShutdown(t *testing.T) {
+	api, methods := fakeBotAPI(t, 10)
+	w := newTestWebhook(api)
+
+	// обновления приняты, но до остановки ни одно не забрано из буфера
+	for id := 1; id <= 5; id++ {
+		if rec := postUpdate(w, "s3cret", updateJSON(id, int64(id%2))); rec.Code != http.StatusOK {
+			t.Fatalf("update %d: status %d", id, rec.Code)
+		}
+	}
+
+	h := newFakeHandler()
+	d := newTestDispatcher(2, 10, h, nil)
+	if err := drainUpdates(context.Background(), w, d); err != nil {
+		t.Fatal(err)
+	}
+	// на всё, что получило 200, Telegram не пришлёт повтор
+	if got := len(h.messages(0)) + len(h.messages(1)); got != 5 {
+		t.Fatalf("handled %d of 5 accepted updates: %v %v", got, h.messages(0), h.messages(1))
+	}
+	if got := d.safeOffset(); got != 5 {
+		t.Fatalf("safeOffset = %d, want 5", got)
+	}
+	if m := methods(); len(m) != 1 || m[0] != "deleteWebhook" {
+		t.Fatalf("Bot API calls = %v", m)
+	}
+
+	// после остановки в буфере есть место, но обновления не принимаются
+	for id := 6; id <= 50; id++ {
+		if rec := postUpdate(w, "s3cret", updateJSON(id, 1)); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("update %d after stop: status %d", id, rec.Code)
+		}
+	}
+	if n := len(w.ch); n != 0 {
+		t.Fatalf("%d updates buffered after stop", n)
+	}
+}
+
+func TestWebhookHandle(t *testing.T) {
+	api, _ := fakeBotAPI(t, 10)
+	w := newTestWebhook(api)
+
+	huge := `{"update_id":1,"message":{"message_id":1,"chat":{"id":1},"text":"` + strings.Repeat("a", 1<<20) + `"}}`
+	for _, tc := range []struct {
+		name   string
+		secret string
+		body   string
+		code   int
+	}{
+		{"missing secret", "", updateJSON(1, 1), http.StatusForbidden},
+		{"wrong secret", "guess", updateJSON(1, 1), http.StatusForbidden},
+		{"secret prefix", "s3cre", updateJSON(1, 1), http.StatusForbidden},
+		{"bad body", "s3cret", `{"update_id":`, http.StatusBadRequest},
+		{"not json", "s3cret", "update", http.StatusBadRequest},
+		{"oversize", "s3cret", huge, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if rec := postUpdate(w, tc.secret, tc.body); rec.Code != tc.code {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.code)
+			}
+			if n := len(w.ch); n != 0 {
+				t.Fatalf("%d updates buffered", n)
+			}
+		})
+	}
+
+	if rec := postUpdate(w, "s3cret", updateJSON(7, 1)); rec.Code != http.StatusOK {
+		t.Fatalf("valid update: status %d", rec.Code)
+	}
+	if u := <-w.ch; u.UpdateID != 7 || u.Message == nil || u.Message.Chat.ID != 1 {
+		t.Fatalf("buffered update = %+v", u)
+	}
+}
+
+func TestWebhookListenerFailure(t *testing.T) {
+	// порт уже занят: листенер не поднимется
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	api, methods := fakeBotAPI(t, 10)
+	u, _ := url.Parse("https://bot.example.com/hook")
+	w, err := newWebhookSource(api, &webhookConfig{URL: u, Listen: busy.Addr().String(), Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ошибка приходит в main, а не завершает процесс из горутины
+	select {
+	case err := <-w.failed():
+		if !strings.Contains(err.Error(), "webhook listener") {
+			t.Fatalf("failed = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listener error not reported")
+	}
+
+	// после ошибки остановка идёт обычным порядком
+	d := newTestDispatcher(1, 1, newFakeHandler(), nil)
+	if err := drainUpdates(context.Background(), w, d); err != nil {
+		t.Fatal(err)
+	}
+	if m := methods(); len(m) != 2 || m[0] != "setWebhook" || m[1] != "deleteWebhook" {
+		t.Fatalf("Bot API calls = %v", m)
+	}
+}
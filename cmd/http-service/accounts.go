@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"download_track/internal/store"
+)
+
+// срок жизни кода привязки Telegram
+const linkCodeTTL = 15 * time.Minute
+
+// createAccount создаёт пользователя без привязки к Telegram и
+// возвращает его вместе с API-ключом.
+func (s *Server) createAccount(ctx context.Context, email string) (*store.User, error) {
+	apiKey, err := store.NewAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	return s.store.CreateUser(ctx, email, apiKey)
+}
+
+// createLinkCode выдаёт одноразовый код, который пользователь отправляет
+// боту командой /link, чтобы привязать Telegram к аккаунту.
+func (s *Server) createLinkCode(ctx context.Context, acc *store.User) (string, time.Time, error) {
+	// username у привязанного Telegram может и не быть
+	if acc.TelegramID != 0 {
+		return "", time.Time{}, store.ErrAccountLinked
+	}
+
+	code, err := store.NewLinkCode()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(linkCodeTTL)
+
+	if err := s.store.CreateLinkCode(ctx, acc.ID, code, expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return code, expiresAt, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"download_track/internal/i18n"
+	"download_track/internal/mailmsg"
+	"download_track/internal/store"
+)
+
+const (
+	// срок жизни кода подтверждения адреса
+	verifyCodeTTL = 24 * time.Hour
+	// сколько получателей можно указать в одном запросе
+	maxRecipients = 10
+)
+
+var (
+	errBadRecipient = errors.New("bad recipient")
+	errVerifyEmail  = errors.New("verification email failed")
+)
+
+// recipient — получатель задания и его профиль доставки. Если у
+// аккаунта есть место доставки, вместо адреса — его вид.
+type recipient struct {
+	Email       string
+	Profile     string
+	Destination string
+}
+
+// addAddress сохраняет адрес под меткой и отправляет на него код
+// подтверждения. Если письмо не ушло, адрес остаётся неподтверждённым:
+// его можно добавить ещё раз.
+func (s *Server) addAddress(ctx context.Context, acc *store.User, label, email, profile string) (*store.Address, error) {
+	code, err := store.NewVerifyCode()
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.store.CreateAddress(ctx, acc.ID, label, email, code, time.Now().Add(verifyCodeTTL))
+	if err != nil {
+		return nil, err
+	}
+	// заменённый неподтверждённый адрес мог быть с другим профилем
+	if a.Profile != profile {
+		if a, err = s.store.SetAddressProfile(ctx, acc.ID, label, profile); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := &mailmsg.Message{
+		To:      []string{email},
+		Subject: i18n.T(acc.Language, "verify_email.subject", label),
+		Text:    i18n.T(acc.Language, "verify_email.body", acc.Email, label, code, int(verifyCodeTTL.Hours())),
+	}
+	if err := s.sendEmail(msg); err != nil {
+		return a, fmt.Errorf("%w: %v", errVerifyEmail, err)
+	}
+	return a, nil
+}
+
+// resolveRecipients превращает метки и адреса из запроса в получателей
+// без повторов; пустой список — место доставки аккаунта или адрес по
+// умолчанию. Писать можно только на email аккаунта и подтверждённые
+// адреса, ошибки выбора оборачивают errBadRecipient.
+func (s *Server) resolveRecipients(ctx context.Context, acc *store.User, names []string) ([]recipient, error) {
+	if len(names) == 0 {
+		d, err := s.store.Destination(ctx, acc.ID)
+		// в Telegram файл загружает бот, и он просит об этом сам
+		if err == nil && d.Kind != store.DestTelegram {
+			return []recipient{{Destination: d.Kind}}, nil
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+		names = []string{acc.DefaultAddress}
+	}
+	if len(names) > maxRecipients {
+		return nil, fmt.Errorf("%w: at most %d recipients", errBadRecipient, maxRecipients)
+	}
+
+	addrs, err := s.store.Addresses(ctx, acc.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []recipient
+	seen := make(map[string]bool)
+	for _, name := range names {
+		r, err := pickRecipient(acc, addrs, strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		if key := strings.ToLower(r.Email); !seen[key] {
+			seen[key] = true
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// pickRecipient — получатель для метки или email из запроса.
+func pickRecipient(acc *store.User, addrs []*store.Address, name string) (recipient, error) {
+	if name == "" || strings.EqualFold(name, store.MainLabel) {
+		return recipient{Email: acc.Email}, nil
+	}
+
+	if strings.Contains(name, "@") {
+		addr, err := mail.ParseAddress(name)
+		if err != nil {
+			return recipient{}, fmt.Errorf("%w: %q is not a valid email address", errBadRecipient, name)
+		}
+		if strings.EqualFold(addr.Address, acc.Email) {
+			return recipient{Email: acc.Email}, nil
+		}
+		for _, a := range addrs {
+			if a.VerifiedAt != nil && strings.EqualFold(a.Email, addr.Address) {
+				return recipient{Email: a.Email, Profile: a.Profile}, nil
+			}
+		}
+		return recipient{}, fmt.Errorf("%w: %s is not the account email or a verified address", errBadRecipient, addr.Address)
+	}
+
+	label := strings.ToLower(name)
+	for _, a := range addrs {
+		if a.Label != label {
+			continue
+		}
+		if a.VerifiedAt == nil {
+			return recipient{}, fmt.Errorf("%w: address %q is not verified", errBadRecipient, label)
+		}
+		return recipient{Email: a.Email, Profile: a.Profile}, nil
+	}
+	return recipient{}, fmt.Errorf("%w: unknown address %q", errBadRecipient, label)
+}
@@ -0,0 +1,1124 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"download_track/internal/mailtmpl"
+	"download_track/internal/store"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// apiError — единый формат ошибки для /api/v1.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type jobResponse struct {
+	ID        int64  `json:"id"`
+	URL       string `json:"url"`
+	Recipient string `json:"recipient"`
+	Filename  string `json:"filename,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Profile   string `json:"profile,omitempty"`
+	PageMode  string `json:"page_mode,omitempty"`
+	// место доставки вместо письма и куда попал файл
+	Destination string     `json:"destination,omitempty"`
+	DeliveredTo string     `json:"delivered_to,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	SizeBytes   int64      `json:"size_bytes"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// jobDeliveryRequest — отчёт бота о загрузке файла в чат: место
+// сообщения или ошибка.
+type jobDeliveryRequest struct {
+	Location string `json:"location"`
+	Error    string `json:"error"`
+}
+
+// createJobRequest — новое задание. Recipient и Recipients — метки
+// адресов или сами адреса; с Recipients создаётся по заданию на адрес.
+type createJobRequest struct {
+	URL        string   `json:"url"`
+	Recipient  string   `json:"recipient"`
+	Recipients []string `json:"recipients"`
+	Filename   string   `json:"filename"`
+	Subject    string   `json:"subject"`
+	// full, readable или raw; пустой — full
+	PageMode string `json:"page_mode"`
+	// учётные данные для скачивания только этого файла; для хоста ссылки
+	// заменяют сохранённые
+	Auth *store.JobAuth `json:"auth"`
+}
+
+type accountResponse struct {
+	ID               int       `json:"id"`
+	Email            string    `json:"email"`
+	TelegramUsername string    `json:"telegram_username,omitempty"`
+	Language         string    `json:"language,omitempty"`
+	SubjectPrefix    string    `json:"subject_prefix,omitempty"`
+	DefaultAddress   string    `json:"default_address,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// updateAccountRequest — изменяемые настройки аккаунта; отсутствующее
+// поле не меняется.
+type updateAccountRequest struct {
+	SubjectPrefix *string `json:"subject_prefix"`
+	// метка адреса по умолчанию; пустая — основной email
+	DefaultAddress *string `json:"default_address"`
+}
+
+type addressResponse struct {
+	Label      string     `json:"label"`
+	Email      string     `json:"email"`
+	Profile    string     `json:"profile,omitempty"`
+	Verified   bool       `json:"verified"`
+	Default    bool       `json:"default,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type createAddressRequest struct {
+	Label string `json:"label"`
+	Email string `json:"email"`
+	// нет — угадывается по домену: адреса @kindle.com получают kindle
+	Profile *string `json:"profile"`
+}
+
+type updateAddressRequest struct {
+	Profile *string `json:"profile"`
+}
+
+// destinationResponse — место доставки без секрета.
+type destinationResponse struct {
+	Kind      string     `json:"kind"`
+	Endpoint  string     `json:"endpoint,omitempty"`
+	Bucket    string     `json:"bucket,omitempty"`
+	Region    string     `json:"region,omitempty"`
+	Path      string     `json:"path,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	HasSecret bool       `json:"has_secret,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// credentialResponse — учётные данные хоста без пароля, ключа и значений
+// заголовков и cookie.
+type credentialResponse struct {
+	Scheme        string    `json:"scheme"`
+	Host          string    `json:"host"`
+	Username      string    `json:"username"`
+	HasPassword   bool      `json:"has_password"`
+	HasPrivateKey bool      `json:"has_private_key"`
+	HostKey       string    `json:"host_key,omitempty"`
+	Headers       []string  `json:"headers,omitempty"`
+	Cookies       []string  `json:"cookies,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// setCredentialRequest — учётные данные для хоста; пароль, ключ,
+// заголовки и cookie, которых нет в запросе, остаются прежними.
+type setCredentialRequest struct {
+	Username   string            `json:"username"`
+	Password   *string           `json:"password"`
+	PrivateKey *string           `json:"private_key"`
+	HostKey    string            `json:"host_key"`
+	Headers    map[string]string `json:"headers"`
+	Cookies    map[string]string `json:"cookies"`
+	UserAgent  string            `json:"user_agent"`
+}
+
+// setDestinationRequest — новое место доставки; kind email возвращает
+// доставку письмом.
+type setDestinationRequest struct {
+	Kind     string `json:"kind"`
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region"`
+	Path     string `json:"path"`
+	Username string `json:"username"`
+	// нет — прежний секрет, если вид места доставки не меняется
+	Secret *string `json:"secret"`
+}
+
+type verifyAddressRequest struct {
+	Code string `json:"code"`
+}
+
+type createAccountRequest struct {
+	Email string `json:"email"`
+}
+
+type createAccountResponse struct {
+	accountResponse
+	APIKey string `json:"api_key"`
+}
+
+type linkCodeResponse struct {
+	Code      string    `json:"code"`
+	Command   string    `json:"command"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type accountKey struct{}
+
+func (s *Server) registerAPI(mux *http.ServeMux) {
+	mux.Handle("/api/v1/openapi.yaml", methods{
+		http.MethodGet: s.handleOpenAPI,
+	})
+	mux.Handle("/api/v1/accounts", methods{
+		http.MethodPost: s.adminOnly(s.handleCreateAccount),
+	})
+	mux.Handle("/api/v1/account", methods{
+		http.MethodGet:   s.authed(s.handleGetAccount),
+		http.MethodPatch: s.authed(s.handleUpdateAccount),
+	})
+	mux.Handle("/api/v1/account/telegram", methods{
+		http.MethodDelete: s.authed(s.handleUnlinkTelegram),
+	})
+	mux.Handle("/api/v1/account/telegram/link-code", methods{
+		http.MethodPost: s.authed(s.handleCreateLinkCode),
+	})
+	mux.Handle("/api/v1/addresses", methods{
+		http.MethodGet:  s.authed(s.handleListAddresses),
+		http.MethodPost: s.authed(s.handleCreateAddress),
+	})
+	mux.Handle("/api/v1/addresses/{label}", methods{
+		http.MethodPatch:  s.authed(s.handleUpdateAddress),
+		http.MethodDelete: s.authed(s.handleDeleteAddress),
+	})
+	mux.Handle("/api/v1/addresses/{label}/verify", methods{
+		http.MethodPost: s.authed(s.handleVerifyAddress),
+	})
+	mux.Handle("/api/v1/destination", methods{
+		http.MethodGet:    s.authed(s.handleGetDestination),
+		http.MethodPut:    s.authed(s.handleSetDestination),
+		http.MethodDelete: s.authed(s.handleDeleteDestination),
+	})
+	mux.Handle("/api/v1/credentials", methods{
+		http.MethodGet: s.authed(s.handleListCredentials),
+	})
+	mux.Handle("/api/v1/credentials/{scheme}/{host}", methods{
+		http.MethodPut:    s.authed(s.handleSetCredential),
+		http.MethodDelete: s.authed(s.handleDeleteCredential),
+	})
+	mux.Handle("/api/v1/jobs", methods{
+		http.MethodGet:  s.authed(s.handleListJobs),
+		http.MethodPost: s.authed(s.handleCreateJob),
+	})
+	mux.Handle("/api/v1/jobs/{id}", methods{
+		http.MethodGet: s.authed(s.handleGetJob),
+	})
+	mux.Handle("/api/v1/jobs/{id}/cancel", methods{
+		http.MethodPost: s.authed(s.handleCancelJob),
+	})
+	mux.Handle("/api/v1/jobs/{id}/delivery", methods{
+		http.MethodPost: s.authed(s.handleJobDelivery),
+	})
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+}
+
+// methods отдаёт обработчик по HTTP-методу, а на остальные отвечает
+// 405 в формате API.
+type methods map[string]http.HandlerFunc
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := m[r.Method]; ok {
+		h(w, r)
+		return
+	}
+	allowed := make([]string, 0, len(m))
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+}
+
+// authed проверяет заголовок Authorization: Bearer <api_key> и кладёт
+// пользователя в контекст запроса.
+func (s *Server) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing bearer token")
+			return
+		}
+
+		acc, err := s.store.UserByAPIKey(r.Context(), token)
+		if errors.Is(err, store.ErrNotFound) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "invalid api key")
+			return
+		}
+		if err != nil {
+			log.Println("api auth err:", err)
+			writeError(w, http.StatusInternalServerError, "internal", "internal error")
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), accountKey{}, acc)))
+	}
+}
+
+// adminOnly пускает только запросы с токеном ADMIN_API_TOKEN. Без
+// настроенного токена эндпоинт выключен.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+			return
+		}
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if !ok || !strings.EqualFold(scheme, "Bearer") ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			writeError(w, http.StatusForbidden, "forbidden", "admin token required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func accountFrom(r *http.Request) *store.User {
+	return r.Context().Value(accountKey{}).(*store.User)
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+func (s *Server) handleGetAccount(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, toAccountResponse(accountFrom(r)))
+}
+
+func (s *Server) handleUpdateAccount(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+
+	var req updateAccountRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+
+	if req.SubjectPrefix != nil {
+		prefix, err := mailtmpl.CleanPrefix(*req.SubjectPrefix)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+			return
+		}
+		if err := s.store.SetSubjectPrefix(r.Context(), acc.ID, prefix); err != nil {
+			log.Println("set subject prefix err:", err)
+			writeError(w, http.StatusInternalServerError, "internal", "internal error")
+			return
+		}
+		acc.SubjectPrefix = prefix
+	}
+
+	if req.DefaultAddress != nil {
+		label := strings.ToLower(strings.TrimSpace(*req.DefaultAddress))
+		if label == store.MainLabel {
+			label = ""
+		}
+		err := s.store.SetDefaultAddress(r.Context(), acc.ID, label)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusUnprocessableEntity, "validation_failed", "unknown address "+strconv.Quote(label))
+			return
+		case errors.Is(err, store.ErrNotVerified):
+			writeError(w, http.StatusUnprocessableEntity, "validation_failed", "address "+strconv.Quote(label)+" is not verified")
+			return
+		case err != nil:
+			log.Println("set default address err:", err)
+			writeError(w, http.StatusInternalServerError, "internal", "internal error")
+			return
+		}
+		acc.DefaultAddress = label
+	}
+
+	writeJSON(w, http.StatusOK, toAccountResponse(acc))
+}
+
+func toAccountResponse(acc *store.User) accountResponse {
+	return accountResponse{
+		ID:               acc.ID,
+		Email:            acc.Email,
+		TelegramUsername: acc.TelegramUsername,
+		Language:         acc.Language,
+		SubjectPrefix:    acc.SubjectPrefix,
+		DefaultAddress:   acc.DefaultAddress,
+		CreatedAt:        acc.CreatedAt,
+	}
+}
+
+func (s *Server) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
+	var req createAccountRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+
+	addr, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", "email is not a valid email address")
+		return
+	}
+
+	acc, err := s.createAccount(r.Context(), addr.Address)
+	if errors.Is(err, store.ErrEmailTaken) {
+		writeError(w, http.StatusConflict, "email_taken", "email is already registered")
+		return
+	}
+	if err != nil {
+		log.Println("create account err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, createAccountResponse{
+		accountResponse: accountResponse{ID: acc.ID, Email: acc.Email, CreatedAt: acc.CreatedAt},
+		APIKey:          acc.APIKey,
+	})
+}
+
+func (s *Server) handleCreateLinkCode(w http.ResponseWriter, r *http.Request) {
+	code, expiresAt, err := s.createLinkCode(r.Context(), accountFrom(r))
+	if errors.Is(err, store.ErrAccountLinked) {
+		writeError(w, http.StatusConflict, "telegram_linked", "telegram is already linked to this account")
+		return
+	}
+	if err != nil {
+		log.Println("create link code err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, linkCodeResponse{
+		Code:      code,
+		Command:   "/link " + code,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (s *Server) handleUnlinkTelegram(w http.ResponseWriter, r *http.Request) {
+	err := s.store.UnlinkTelegram(r.Context(), accountFrom(r).ID)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "telegram is not linked")
+		return
+	}
+	if err != nil {
+		log.Println("unlink telegram err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+
+	var req createJobRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+
+	opts, err := validateJobRequest(req)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+
+	names := req.Recipients
+	if req.Recipient != "" {
+		names = []string{req.Recipient}
+	}
+	recipients, err := s.resolveRecipients(r.Context(), acc, names)
+	if errors.Is(err, errBadRecipient) {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("resolve recipients err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+
+	// по заданию на получателя: у каждого свой статус и своя попытка
+	jobs := make([]jobResponse, 0, len(recipients))
+	for _, rcpt := range recipients {
+		opts.Recipient, opts.Profile, opts.Destination = rcpt.Email, rcpt.Profile, rcpt.Destination
+		j, err := s.createJob(r.Context(), acc, opts, store.StatusQueued)
+		if noSecretsKey(w, err) {
+			return
+		}
+		if err != nil {
+			log.Println("create job err:", err)
+			writeError(w, http.StatusInternalServerError, "internal", "internal error")
+			return
+		}
+		jobs = append(jobs, toJobResponse(j))
+	}
+	s.queue.notify()
+
+	if len(req.Recipients) > 0 {
+		writeJSON(w, http.StatusAccepted, struct {
+			Jobs []jobResponse `json:"jobs"`
+		}{jobs})
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+strconv.FormatInt(jobs[0].ID, 10))
+	writeJSON(w, http.StatusAccepted, jobs[0])
+}
+
+func validateJobRequest(req createJobRequest) (jobOptions, error) {
+	opts := jobOptions{
+		URL:      strings.TrimSpace(req.URL),
+		Filename: sanitizeFilename(req.Filename),
+		Subject:  strings.TrimSpace(req.Subject),
+	}
+
+	if opts.URL == "" {
+		return opts, errors.New("url is required")
+	}
+	if err := checkFileURL(opts.URL); err != nil {
+		return opts, err
+	}
+
+	if req.Recipient != "" && len(req.Recipients) > 0 {
+		return opts, errors.New("use either recipient or recipients")
+	}
+
+	if req.Filename != "" && opts.Filename == "" {
+		return opts, errors.New("filename is not valid")
+	}
+	if strings.ContainsAny(opts.Subject, "\r\n") {
+		return opts, errors.New("subject must be a single line")
+	}
+	mode, ok := parsePageMode(req.PageMode)
+	if !ok {
+		return opts, errors.New("page_mode must be full, readable or raw")
+	}
+	opts.PageMode = mode
+
+	auth, err := cleanJobAuth(req.Auth, opts.URL)
+	if err != nil {
+		return opts, err
+	}
+	opts.Auth = auth
+
+	return opts, nil
+}
+
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+	q := r.URL.Query()
+
+	limit := defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, http.StatusBadRequest, "bad_request", "limit must be between 1 and "+strconv.Itoa(maxListLimit))
+			return
+		}
+		limit = n
+	}
+
+	var before int64
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "bad_request", "before must be a job id")
+			return
+		}
+		before = n
+	}
+
+	status := q.Get("status")
+	switch status {
+	case "", store.StatusQueued, store.StatusDownloading, store.StatusSending, store.StatusSent, store.StatusFailed, store.StatusCanceled:
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", "unknown status "+strconv.Quote(status))
+		return
+	}
+
+	jobs, err := s.store.ListJobs(r.Context(), store.JobFilter{UserID: acc.ID, Status: status, BeforeID: before, Limit: limit})
+	if err != nil {
+		log.Println("list jobs err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+
+	resp := struct {
+		Jobs       []jobResponse `json:"jobs"`
+		NextBefore int64         `json:"next_before,omitempty"`
+	}{Jobs: make([]jobResponse, 0, len(jobs))}
+	for _, j := range jobs {
+		resp.Jobs = append(resp.Jobs, toJobResponse(j))
+	}
+	if len(jobs) == limit {
+		resp.NextBefore = jobs[len(jobs)-1].ID
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	s.withJobID(w, r, func(id int64) (*store.Job, error) {
+		return s.store.Job(r.Context(), accountFrom(r).ID, id)
+	})
+}
+
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	s.withJobID(w, r, func(id int64) (*store.Job, error) {
+		j, err := s.cancelJob(r.Context(), accountFrom(r).ID, id)
+		if err == nil && j.Status != store.StatusCanceled {
+			writeError(w, http.StatusConflict, "job_finished", "job is already "+j.Status)
+			return nil, nil
+		}
+		return j, err
+	})
+}
+
+// handleJobDelivery завершает задание с доставкой в Telegram, которое
+// http-service отдал боту.
+func (s *Server) handleJobDelivery(w http.ResponseWriter, r *http.Request) {
+	var req jobDeliveryRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+	if (req.Location == "") == (req.Error == "") {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", "exactly one of location and error is required")
+		return
+	}
+	acc := accountFrom(r)
+	errText := ""
+	if req.Error != "" {
+		errText = "telegram: " + req.Error
+	} else if chatID, ok := telegramLocationChat(req.Location); !ok {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", "location must be telegram:<chat_id>/<message_id>")
+		return
+	} else if acc.TelegramID == 0 || chatID != acc.TelegramID {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", "location is not in the account's telegram chat")
+		return
+	}
+
+	s.withJobID(w, r, func(id int64) (*store.Job, error) {
+		j, ok, err := s.store.ReportDelivery(r.Context(), acc.ID, id, req.Location, errText)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			writeError(w, http.StatusConflict, "job_not_handed_over", "job is not waiting for telegram delivery")
+			return nil, nil
+		}
+
+		jobTransitions.WithLabelValues(j.Status).Inc()
+		if req.Error != "" {
+			jobErrors.WithLabelValues("delivery_error", "telegram").Inc()
+			s.logJobError(j, "delivery_error", "telegram", errors.New(req.Error))
+		} else {
+			s.logJob(j, "sent", "send", "delivered_to", req.Location, "bytes", j.Size)
+		}
+		return j, nil
+	})
+}
+
+// telegramLocationChat разбирает место telegram:<chat_id>/<message_id>,
+// которое бот присылает в отчёте о загрузке.
+func telegramLocationChat(location string) (int64, bool) {
+	rest, ok := strings.CutPrefix(location, "telegram:")
+	if !ok {
+		return 0, false
+	}
+	chat, msg, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, false
+	}
+	chatID, err := strconv.ParseInt(chat, 10, 64)
+	if err != nil || chatID == 0 {
+		return 0, false
+	}
+	if id, err := strconv.ParseInt(msg, 10, 64); err != nil || id < 1 {
+		return 0, false
+	}
+	return chatID, true
+}
+
+// withJobID разбирает {id} из пути и отдаёт результат fn как задание.
+// Если fn сам записал ответ, он возвращает (nil, nil).
+func (s *Server) withJobID(w http.ResponseWriter, r *http.Request, fn func(id int64) (*store.Job, error)) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		writeError(w, http.StatusNotFound, "not_found", "job not found")
+		return
+	}
+
+	j, err := fn(id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "job not found")
+		return
+	}
+	if err != nil {
+		log.Println("job request err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	if j != nil {
+		writeJSON(w, http.StatusOK, toJobResponse(j))
+	}
+}
+
+func (s *Server) handleListAddresses(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+	addrs, err := s.store.Addresses(r.Context(), acc.ID)
+	if err != nil {
+		log.Println("list addresses err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+
+	resp := struct {
+		Addresses []addressResponse `json:"addresses"`
+	}{Addresses: make([]addressResponse, 0, len(addrs))}
+	for _, a := range addrs {
+		resp.Addresses = append(resp.Addresses, toAddressResponse(a, acc))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleCreateAddress(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+
+	var req createAddressRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+
+	label, err := store.CleanLabel(req.Label)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+	addr, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", "email is not a valid email address")
+		return
+	}
+	if strings.EqualFold(addr.Address, acc.Email) {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", "this is the account email, it needs no label")
+		return
+	}
+	profile := guessProfile(addr.Address)
+	if req.Profile != nil {
+		profile = *req.Profile
+	}
+	if !validProfile(profile) {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", "unknown profile "+strconv.Quote(profile))
+		return
+	}
+
+	a, err := s.addAddress(r.Context(), acc, label, addr.Address, profile)
+	switch {
+	case errors.Is(err, store.ErrLabelTaken):
+		writeError(w, http.StatusConflict, "label_taken", "label "+strconv.Quote(label)+" is already used by a verified address")
+		return
+	case errors.Is(err, errVerifyEmail):
+		log.Println("add address err:", err)
+		writeError(w, http.StatusBadGateway, "email_failed", "could not send the verification email, try again later")
+		return
+	case err != nil:
+		log.Println("add address err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, toAddressResponse(a, acc))
+}
+
+func (s *Server) handleVerifyAddress(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+
+	var req verifyAddressRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+
+	a, err := s.store.VerifyAddress(r.Context(), acc.ID, strings.ToLower(r.PathValue("label")), strings.TrimSpace(req.Code))
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "address not found")
+		return
+	case errors.Is(err, store.ErrCodeInvalid):
+		writeError(w, http.StatusUnprocessableEntity, "code_invalid", err.Error())
+		return
+	case err != nil:
+		log.Println("verify address err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAddressResponse(a, acc))
+}
+
+func (s *Server) handleUpdateAddress(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+
+	var req updateAddressRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+
+	label := strings.ToLower(r.PathValue("label"))
+	var (
+		a   *store.Address
+		err error
+	)
+	if req.Profile != nil {
+		if !validProfile(*req.Profile) {
+			writeError(w, http.StatusUnprocessableEntity, "validation_failed", "unknown profile "+strconv.Quote(*req.Profile))
+			return
+		}
+		a, err = s.store.SetAddressProfile(r.Context(), acc.ID, label, *req.Profile)
+	} else {
+		a, err = s.store.Address(r.Context(), acc.ID, label)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "address not found")
+		return
+	}
+	if err != nil {
+		log.Println("update address err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAddressResponse(a, acc))
+}
+
+func (s *Server) handleDeleteAddress(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DeleteAddress(r.Context(), accountFrom(r).ID, strings.ToLower(r.PathValue("label")))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "address not found")
+		return
+	}
+	if err != nil {
+		log.Println("delete address err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetDestination(w http.ResponseWriter, r *http.Request) {
+	d, err := s.store.Destination(r.Context(), accountFrom(r).ID)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSON(w, http.StatusOK, destinationResponse{Kind: destEmail})
+		return
+	}
+	if err != nil {
+		log.Println("get destination err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, toDestinationResponse(d))
+}
+
+func (s *Server) handleSetDestination(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+
+	var req setDestinationRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+	if strings.EqualFold(strings.TrimSpace(req.Kind), destEmail) {
+		if s.deleteDestination(w, r) {
+			writeJSON(w, http.StatusOK, destinationResponse{Kind: destEmail})
+		}
+		return
+	}
+
+	d := store.Destination{UserID: acc.ID, Kind: req.Kind, Endpoint: req.Endpoint, Bucket: req.Bucket,
+		Region: req.Region, Path: req.Path, Username: req.Username}
+	if req.Secret != nil {
+		d.Secret = *req.Secret
+	} else {
+		old, err := s.store.Destination(r.Context(), acc.ID)
+		if noSecretsKey(w, err) {
+			return
+		}
+		if err == nil && strings.EqualFold(old.Kind, strings.TrimSpace(req.Kind)) {
+			d.Secret = old.Secret
+		}
+	}
+	d, err := s.cleanDestination(d)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+
+	saved, err := s.store.SetDestination(r.Context(), d)
+	if noSecretsKey(w, err) {
+		return
+	}
+	if err != nil {
+		log.Println("set destination err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, toDestinationResponse(saved))
+}
+
+// handleDeleteDestination возвращает доставку письмом; повторный вызов —
+// не ошибка.
+func (s *Server) handleDeleteDestination(w http.ResponseWriter, r *http.Request) {
+	if s.deleteDestination(w, r) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) deleteDestination(w http.ResponseWriter, r *http.Request) bool {
+	err := s.store.DeleteDestination(r.Context(), accountFrom(r).ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Println("delete destination err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return false
+	}
+	return true
+}
+
+func toDestinationResponse(d *store.Destination) destinationResponse {
+	return destinationResponse{
+		Kind:      d.Kind,
+		Endpoint:  d.Endpoint,
+		Bucket:    d.Bucket,
+		Region:    d.Region,
+		Path:      d.Path,
+		Username:  d.Username,
+		HasSecret: d.Secret != "",
+		UpdatedAt: &d.UpdatedAt,
+	}
+}
+
+func (s *Server) handleListCredentials(w http.ResponseWriter, r *http.Request) {
+	creds, err := s.store.Credentials(r.Context(), accountFrom(r).ID)
+	if err != nil {
+		log.Println("list credentials err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	resp := struct {
+		Credentials []credentialResponse `json:"credentials"`
+	}{Credentials: []credentialResponse{}}
+	for _, c := range creds {
+		resp.Credentials = append(resp.Credentials, toCredentialResponse(c))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleSetCredential(w http.ResponseWriter, r *http.Request) {
+	acc := accountFrom(r)
+
+	var req setCredentialRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json: "+err.Error())
+		return
+	}
+
+	c := store.Credential{UserID: acc.ID, Scheme: r.PathValue("scheme"), Host: r.PathValue("host"),
+		Username: req.Username, HostKey: req.HostKey, Headers: req.Headers, Cookies: req.Cookies, UserAgent: req.UserAgent}
+	// без пароля, ключа, заголовков или cookie в запросе остаются
+	// сохранённые; пустой объект headers или cookies их стирает
+	old, err := s.store.Credential(r.Context(), acc.ID, strings.ToLower(c.Scheme), strings.ToLower(c.Host))
+	if noSecretsKey(w, err) {
+		return
+	}
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Println("get credential err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	if req.Password != nil {
+		c.Password = *req.Password
+	} else if old != nil {
+		c.Password = old.Password
+	}
+	if req.PrivateKey != nil {
+		c.PrivateKey = *req.PrivateKey
+	} else if old != nil {
+		c.PrivateKey = old.PrivateKey
+	}
+	if req.Headers == nil && old != nil {
+		c.Headers = old.Headers
+	}
+	if req.Cookies == nil && old != nil {
+		c.Cookies = old.Cookies
+	}
+	c, err = cleanCredential(c)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "validation_failed", err.Error())
+		return
+	}
+
+	saved, err := s.store.SetCredential(r.Context(), c)
+	if noSecretsKey(w, err) {
+		return
+	}
+	if err != nil {
+		log.Println("set credential err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, toCredentialResponse(saved))
+}
+
+func (s *Server) handleDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DeleteCredential(r.Context(), accountFrom(r).ID,
+		strings.ToLower(r.PathValue("scheme")), strings.ToLower(r.PathValue("host")))
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "credential not found")
+		return
+	}
+	if err != nil {
+		log.Println("delete credential err:", err)
+		writeError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func toCredentialResponse(c *store.Credential) credentialResponse {
+	return credentialResponse{
+		Scheme:        c.Scheme,
+		Host:          c.Host,
+		Username:      c.Username,
+		HasPassword:   c.Password != "",
+		HasPrivateKey: c.PrivateKey != "",
+		HostKey:       c.HostKey,
+		Headers:       sortedKeys(c.Headers),
+		Cookies:       sortedKeys(c.Cookies),
+		UserAgent:     c.UserAgent,
+		UpdatedAt:     c.UpdatedAt,
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// noSecretsKey отвечает 422, если секрет не сохранить без ключа
+// шифрования на сервере.
+func noSecretsKey(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, store.ErrNoSecretKey) {
+		return false
+	}
+	writeError(w, http.StatusUnprocessableEntity, "validation_failed",
+		"the server cannot store passwords, keys, headers or cookies: db.secrets_key is not configured")
+	return true
+}
+
+func toAddressResponse(a *store.Address, acc *store.User) addressResponse {
+	return addressResponse{
+		Label:      a.Label,
+		Email:      a.Email,
+		Profile:    a.Profile,
+		Verified:   a.VerifiedAt != nil,
+		Default:    a.Label == acc.DefaultAddress,
+		VerifiedAt: a.VerifiedAt,
+		CreatedAt:  a.CreatedAt,
+	}
+}
+
+func toJobResponse(j *store.Job) jobResponse {
+	return jobResponse{
+		ID:        j.ID,
+		URL:       j.URL,
+		Recipient: j.Recipient,
+		Filename:  j.Filename,
+		Subject:   j.Subject,
+		Profile:   j.Profile,
+		PageMode:  j.PageMode,
+		Status:    j.Status,
+
+		Destination: j.Destination,
+		DeliveredTo: j.DeliveredTo,
+		Error:       j.Error,
+		SizeBytes:   j.Size,
+		CreatedAt:   j.CreatedAt,
+		UpdatedAt:   j.UpdatedAt,
+		StartedAt:   j.StartedAt,
+		FinishedAt:  j.FinishedAt,
+
+		CorrelationID: j.CorrelationID,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("write json err:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: message}})
+}
@@ -0,0 +1,880 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"download_track/internal/config"
+	"download_track/internal/store"
+	"download_track/internal/store/memory"
+)
+
+// testAPI — http-service на хранилище в памяти. Воркеры очереди не
+// запущены: задания из API остаются queued.
+type testAPI struct {
+	t       *testing.T
+	srv     *Server
+	store   *memory.Store
+	handler http.Handler
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	st := memory.New()
+	srv := &Server{
+		store:  st,
+		jobLog: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		conf:   config.NewStore(config.Default(), "", nil),
+	}
+	srv.queue = newJobQueue(srv, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", srv.handleSend)
+	srv.registerAPI(mux)
+	return &testAPI{t: t, srv: srv, store: st, handler: withCorrelationID(mux)}
+}
+
+// user создаёт аккаунт с API-ключом key-<email>.
+func (a *testAPI) user(email string) *store.User {
+	a.t.Helper()
+	u, err := a.store.CreateUser(context.Background(), email, "key-"+email)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return u
+}
+
+// telegramUser создаёт аккаунт с привязанным Telegram telegramID.
+func (a *testAPI) telegramUser(telegramID int64, email string) *store.User {
+	a.t.Helper()
+	u, err := a.store.RegisterTelegram(context.Background(), telegramID, "", email, "key-"+email)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return u
+}
+
+// do выполняет запрос с ключом key; пустой key — без Authorization.
+func (a *testAPI) do(method, path, key, body string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	a.handler.ServeHTTP(rec, r)
+	return rec
+}
+
+// decode разбирает ответ, проверив статус.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, status int, v any) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status %d, want %d: %s", rec.Code, status, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+}
+
+// wantError проверяет ответ с ошибкой в формате API.
+func wantError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	var resp struct {
+		Error apiError `json:"error"`
+	}
+	decode(t, rec, status, &resp)
+	if resp.Error.Code != code || resp.Error.Message == "" {
+		t.Fatalf("error = %+v, want code %q", resp.Error, code)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+
+	rec := a.do("GET", "/api/v1/account", "", "")
+	wantError(t, rec, http.StatusUnauthorized, "unauthorized")
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+	r := httptest.NewRequest("GET", "/api/v1/account", nil)
+	r.Header.Set("Authorization", "Basic YWxpY2U6cHc=")
+	rec = httptest.NewRecorder()
+	a.handler.ServeHTTP(rec, r)
+	wantError(t, rec, http.StatusUnauthorized, "unauthorized")
+	wantError(t, a.do("GET", "/api/v1/account", "wrong-key", ""), http.StatusUnauthorized, "unauthorized")
+
+	var acc accountResponse
+	decode(t, a.do("GET", "/api/v1/account", "key-alice@example.com", ""), http.StatusOK, &acc)
+	if acc.Email != "alice@example.com" {
+		t.Fatalf("account = %+v", acc)
+	}
+
+	rec = a.do("DELETE", "/api/v1/account", "key-alice@example.com", "")
+	wantError(t, rec, http.StatusMethodNotAllowed, "method_not_allowed")
+	if got := rec.Header().Get("Allow"); got != "GET, PATCH" {
+		t.Errorf("Allow = %q", got)
+	}
+	wantError(t, a.do("GET", "/api/v1/nothing", "key-alice@example.com", ""), http.StatusNotFound, "not_found")
+}
+
+func TestAPIAdminAccounts(t *testing.T) {
+	a := newTestAPI(t)
+	body := `{"email":"bob@example.com"}`
+	// без ADMIN_API_TOKEN эндпоинта нет
+	wantError(t, a.do("POST", "/api/v1/accounts", "anything", body), http.StatusNotFound, "not_found")
+
+	a.srv.adminToken = "admin-secret"
+	wantError(t, a.do("POST", "/api/v1/accounts", "wrong", body), http.StatusForbidden, "forbidden")
+	wantError(t, a.do("POST", "/api/v1/accounts", "admin-secret", `{"email":"not an email"}`), http.StatusUnprocessableEntity, "validation_failed")
+
+	var created createAccountResponse
+	decode(t, a.do("POST", "/api/v1/accounts", "admin-secret", body), http.StatusCreated, &created)
+	if created.Email != "bob@example.com" || created.APIKey == "" {
+		t.Fatalf("created = %+v", created)
+	}
+	wantError(t, a.do("POST", "/api/v1/accounts", "admin-secret", body), http.StatusConflict, "email_taken")
+
+	var acc accountResponse
+	decode(t, a.do("GET", "/api/v1/account", created.APIKey, ""), http.StatusOK, &acc)
+	if acc.ID != created.ID {
+		t.Fatalf("new api key belongs to %+v", acc)
+	}
+}
+
+func TestAPITelegramLink(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	key := "key-alice@example.com"
+	path := "/api/v1/account/telegram/link-code"
+
+	var lc linkCodeResponse
+	decode(t, a.do("POST", path, key, ""), http.StatusCreated, &lc)
+	if lc.Code == "" || lc.Command != "/link "+lc.Code || !lc.ExpiresAt.After(time.Now()) {
+		t.Fatalf("link code = %+v", lc)
+	}
+	// у пользователя Telegram нет username: привязка всё равно видна
+	if _, err := a.store.LinkTelegram(context.Background(), 100, "", lc.Code); err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, a.do("POST", path, key, ""), http.StatusConflict, "telegram_linked")
+
+	// аккаунт, зарегистрированный из Telegram без username, — тоже
+	a.telegramUser(200, "bob@example.com")
+	wantError(t, a.do("POST", path, "key-bob@example.com", ""), http.StatusConflict, "telegram_linked")
+
+	if rec := a.do("DELETE", "/api/v1/account/telegram", key, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("unlink = %d %s", rec.Code, rec.Body)
+	}
+	wantError(t, a.do("DELETE", "/api/v1/account/telegram", key, ""), http.StatusNotFound, "not_found")
+	decode(t, a.do("POST", path, key, ""), http.StatusCreated, &lc)
+}
+
+func TestCreateLinkCodeLinkedWithoutUsername(t *testing.T) {
+	a := newTestAPI(t)
+	acc := &store.User{ID: 1, TelegramID: 100}
+	// решение принимается по TelegramID, до обращения к хранилищу
+	if _, _, err := a.srv.createLinkCode(context.Background(), acc); !errors.Is(err, store.ErrAccountLinked) {
+		t.Fatalf("createLinkCode = %v, want ErrAccountLinked", err)
+	}
+}
+
+func TestAPICreateJobValidation(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	key := "key-alice@example.com"
+
+	for _, tc := range []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"url":`, http.StatusBadRequest, "bad_request"},
+		{`{"url":"https://example.com/f","color":"red"}`, http.StatusBadRequest, "bad_request"},
+		{`{}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{`{"url":"gopher://example.com/f"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{`{"url":"/relative/path"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{`{"url":"https://alice:pw@example.com/f"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{`{"url":"https://example.com/f","recipient":"a@example.com","recipients":["b@example.com"]}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{`{"url":"https://example.com/f","subject":"two\nlines"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{`{"url":"https://example.com/f","page_mode":"pretty"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{`{"url":"https://example.com/f","recipient":"stranger@example.com"}`, http.StatusUnprocessableEntity, "validation_failed"},
+	} {
+		t.Run(tc.body, func(t *testing.T) {
+			wantError(t, a.do("POST", "/api/v1/jobs", key, tc.body), tc.status, tc.code)
+		})
+	}
+	if jobs, _ := a.store.ListJobs(context.Background(), store.JobFilter{UserID: 1, Limit: 10}); len(jobs) != 0 {
+		t.Fatalf("invalid requests created %d jobs", len(jobs))
+	}
+
+	rec := a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/report.pdf","subject":"Отчёт"}`)
+	var j jobResponse
+	decode(t, rec, http.StatusAccepted, &j)
+	if j.Status != store.StatusQueued || j.Recipient != "alice@example.com" || j.Subject != "Отчёт" || j.CorrelationID == "" {
+		t.Fatalf("job = %+v", j)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/api/v1/jobs/"+strconv.FormatInt(j.ID, 10) {
+		t.Errorf("Location = %q", loc)
+	}
+}
+
+func TestAPIListJobsPagination(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	a.user("bob@example.com")
+	key := "key-alice@example.com"
+
+	var created []int64
+	for i := range 5 {
+		var j jobResponse
+		decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/`+strconv.Itoa(i)+`"}`), http.StatusAccepted, &j)
+		created = append(created, j.ID)
+	}
+	// чужие задания в список не попадают
+	decode(t, a.do("POST", "/api/v1/jobs", "key-bob@example.com", `{"url":"https://example.com/bob"}`), http.StatusAccepted, &jobResponse{})
+
+	type page struct {
+		Jobs       []jobResponse `json:"jobs"`
+		NextBefore int64         `json:"next_before"`
+	}
+	var got []int64
+	path := "/api/v1/jobs?limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination does not end")
+		}
+		var p page
+		decode(t, a.do("GET", path, key, ""), http.StatusOK, &p)
+		for _, j := range p.Jobs {
+			got = append(got, j.ID)
+		}
+		if p.NextBefore == 0 {
+			break
+		}
+		path = "/api/v1/jobs?limit=2&before=" + strconv.FormatInt(p.NextBefore, 10)
+	}
+	if len(got) != len(created) {
+		t.Fatalf("listed %v, created %v", got, created)
+	}
+	for i, id := range got {
+		// от новых к старым
+		if id != created[len(created)-1-i] {
+			t.Fatalf("listed %v, created %v", got, created)
+		}
+	}
+
+	decode(t, a.do("POST", "/api/v1/jobs/"+strconv.FormatInt(created[0], 10)+"/cancel", key, ""), http.StatusOK, &jobResponse{})
+	var p page
+	decode(t, a.do("GET", "/api/v1/jobs?status=canceled", key, ""), http.StatusOK, &p)
+	if len(p.Jobs) != 1 || p.Jobs[0].ID != created[0] || p.NextBefore != 0 {
+		t.Fatalf("canceled jobs = %+v", p)
+	}
+
+	for _, q := range []string{"limit=0", "limit=201", "limit=x", "before=0", "before=x", "status=lost"} {
+		wantError(t, a.do("GET", "/api/v1/jobs?"+q, key, ""), http.StatusBadRequest, "bad_request")
+	}
+}
+
+func TestAPICancelJob(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	a.user("bob@example.com")
+	key := "key-alice@example.com"
+
+	var j jobResponse
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f"}`), http.StatusAccepted, &j)
+	path := "/api/v1/jobs/" + strconv.FormatInt(j.ID, 10)
+
+	// чужое задание не видно и не отменить
+	wantError(t, a.do("GET", path, "key-bob@example.com", ""), http.StatusNotFound, "not_found")
+	wantError(t, a.do("POST", path+"/cancel", "key-bob@example.com", ""), http.StatusNotFound, "not_found")
+
+	var canceled jobResponse
+	decode(t, a.do("POST", path+"/cancel", key, ""), http.StatusOK, &canceled)
+	if canceled.Status != store.StatusCanceled || canceled.FinishedAt == nil {
+		t.Fatalf("canceled = %+v", canceled)
+	}
+	// повторная отмена ничего не меняет
+	var again jobResponse
+	decode(t, a.do("POST", path+"/cancel", key, ""), http.StatusOK, &again)
+	if again.Status != store.StatusCanceled {
+		t.Fatalf("second cancel = %+v", again)
+	}
+	// отменённое задание воркер не берёт
+	if _, err := a.store.ClaimJob(context.Background(), time.Hour); err != store.ErrNotFound {
+		t.Fatalf("ClaimJob after cancel: %v", err)
+	}
+
+	var sent jobResponse
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/g"}`), http.StatusAccepted, &sent)
+	if _, err := a.store.SetJobStatus(context.Background(), sent.ID, store.StatusSent, "", 10); err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, a.do("POST", "/api/v1/jobs/"+strconv.FormatInt(sent.ID, 10)+"/cancel", key, ""), http.StatusConflict, "job_finished")
+
+	wantError(t, a.do("POST", "/api/v1/jobs/999/cancel", key, ""), http.StatusNotFound, "not_found")
+	wantError(t, a.do("GET", "/api/v1/jobs/abc", key, ""), http.StatusNotFound, "not_found")
+}
+
+// fakeSMTP принимает письма по SMTP без TLS и авторизации и отдаёт их
+// тела в mails.
+type fakeSMTP struct {
+	ln    net.Listener
+	mails chan string
+}
+
+func startSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{ln: ln, mails: make(chan string, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			data, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			f.mails <- string(data)
+			tc.PrintfLine("250 queued")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 %s not implemented", cmd)
+		}
+	}
+}
+
+// useSMTP направляет письма сервера в fakeSMTP.
+func (a *testAPI) useSMTP(f *fakeSMTP) {
+	host, port, _ := net.SplitHostPort(f.ln.Addr().String())
+	a.srv.smtpHost, a.srv.smtpPort, a.srv.fromAddr = host, port, "bot@example.com"
+}
+
+var verifyCodeRe = regexp.MustCompile(`\b\d{6}\b`)
+
+// verifyCode достаёт код подтверждения из письма.
+func (f *fakeSMTP) verifyCode(t *testing.T) string {
+	t.Helper()
+	select {
+	case m := <-f.mails:
+		_, body, _ := strings.Cut(m, "\n\n")
+		text, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := verifyCodeRe.FindString(string(text))
+		if code == "" {
+			t.Fatalf("no code in %q", text)
+		}
+		return code
+	case <-time.After(time.Second):
+		t.Fatal("verification email was not sent")
+		return ""
+	}
+}
+
+func TestAPIAddresses(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	key := "key-alice@example.com"
+
+	for _, body := range []string{
+		`{"label":"main","email":"w@example.com"}`,
+		`{"label":"бад","email":"w@example.com"}`,
+		`{"label":"work","email":"not an email"}`,
+		`{"label":"work","email":"Alice@Example.com"}`,
+		`{"label":"work","email":"w@example.com","profile":"fax"}`,
+	} {
+		wantError(t, a.do("POST", "/api/v1/addresses", key, body), http.StatusUnprocessableEntity, "validation_failed")
+	}
+
+	// письмо не ушло — адрес остаётся неподтверждённым
+	wantError(t, a.do("POST", "/api/v1/addresses", key, `{"label":"work","email":"w@example.com"}`), http.StatusBadGateway, "email_failed")
+
+	smtp := startSMTP(t)
+	a.useSMTP(smtp)
+	var addr addressResponse
+	decode(t, a.do("POST", "/api/v1/addresses", key, `{"label":"Work","email":"w@example.com"}`), http.StatusCreated, &addr)
+	if addr.Label != "work" || addr.Verified {
+		t.Fatalf("address = %+v", addr)
+	}
+	code := smtp.verifyCode(t)
+	decode(t, a.do("POST", "/api/v1/addresses", key, `{"label":"kindle","email":"me@kindle.com"}`), http.StatusCreated, &addr)
+	if addr.Profile != store.ProfileKindle {
+		t.Fatalf("kindle address = %+v", addr)
+	}
+	smtp.verifyCode(t)
+
+	// на неподтверждённый адрес задание не создаётся
+	wantError(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f","recipient":"work"}`), http.StatusUnprocessableEntity, "validation_failed")
+	wantError(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f","recipient":"w@example.com"}`), http.StatusUnprocessableEntity, "validation_failed")
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	wantError(t, a.do("POST", "/api/v1/addresses/work/verify", key, `{"code":"`+wrong+`"}`), http.StatusUnprocessableEntity, "code_invalid")
+	wantError(t, a.do("POST", "/api/v1/addresses/home/verify", key, `{"code":"`+code+`"}`), http.StatusNotFound, "not_found")
+	decode(t, a.do("POST", "/api/v1/addresses/work/verify", key, `{"code":"`+code+`"}`), http.StatusOK, &addr)
+	if !addr.Verified || addr.VerifiedAt == nil {
+		t.Fatalf("verified address = %+v", addr)
+	}
+	// подтверждённую метку не занять другим адресом
+	wantError(t, a.do("POST", "/api/v1/addresses", key, `{"label":"work","email":"x@example.com"}`), http.StatusConflict, "label_taken")
+
+	var list struct {
+		Addresses []addressResponse `json:"addresses"`
+	}
+	decode(t, a.do("GET", "/api/v1/addresses", key, ""), http.StatusOK, &list)
+	if len(list.Addresses) != 2 || list.Addresses[0].Label != "kindle" || list.Addresses[1].Label != "work" {
+		t.Fatalf("addresses = %+v", list.Addresses)
+	}
+
+	// повторы получателей схлопываются, метка и адрес — одно и то же
+	var created struct {
+		Jobs []jobResponse `json:"jobs"`
+	}
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f","recipients":["work","W@example.com","main","alice@example.com"]}`), http.StatusAccepted, &created)
+	if len(created.Jobs) != 2 || created.Jobs[0].Recipient != "w@example.com" || created.Jobs[1].Recipient != "alice@example.com" {
+		t.Fatalf("jobs = %+v", created.Jobs)
+	}
+	many := `"a@example.com"` + strings.Repeat(`,"a@example.com"`, maxRecipients)
+	wantError(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f","recipients":[`+many+`]}`), http.StatusUnprocessableEntity, "validation_failed")
+
+	// адрес по умолчанию заменяет email аккаунта
+	var acc accountResponse
+	decode(t, a.do("PATCH", "/api/v1/account", key, `{"default_address":"work"}`), http.StatusOK, &acc)
+	if acc.DefaultAddress != "work" {
+		t.Fatalf("account = %+v", acc)
+	}
+	var j jobResponse
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f"}`), http.StatusAccepted, &j)
+	if j.Recipient != "w@example.com" {
+		t.Fatalf("default recipient = %q", j.Recipient)
+	}
+
+	if rec := a.do("DELETE", "/api/v1/addresses/work", key, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body)
+	}
+	wantError(t, a.do("DELETE", "/api/v1/addresses/work", key, ""), http.StatusNotFound, "not_found")
+	var after accountResponse
+	decode(t, a.do("GET", "/api/v1/account", key, ""), http.StatusOK, &after)
+	if after.DefaultAddress != "" {
+		t.Fatalf("default address %q survived delete", after.DefaultAddress)
+	}
+}
+
+// noKeyStore — хранилище без db.secrets_key: секреты не сохраняются.
+type noKeyStore struct {
+	*memory.Store
+}
+
+func (s noKeyStore) SetDestination(ctx context.Context, d store.Destination) (*store.Destination, error) {
+	if d.Secret != "" {
+		return nil, store.ErrNoSecretKey
+	}
+	return s.Store.SetDestination(ctx, d)
+}
+
+func (s noKeyStore) SetCredential(ctx context.Context, c store.Credential) (*store.Credential, error) {
+	if c.Password != "" || c.PrivateKey != "" || len(c.Headers) > 0 || len(c.Cookies) > 0 {
+		return nil, store.ErrNoSecretKey
+	}
+	return s.Store.SetCredential(ctx, c)
+}
+
+func (s noKeyStore) CreateJob(ctx context.Context, nj store.NewJob) (*store.Job, error) {
+	if nj.Auth != nil {
+		return nil, store.ErrNoSecretKey
+	}
+	return s.Store.CreateJob(ctx, nj)
+}
+
+func TestAPIDestination(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	key := "key-alice@example.com"
+
+	var d destinationResponse
+	decode(t, a.do("GET", "/api/v1/destination", key, ""), http.StatusOK, &d)
+	if d.Kind != destEmail || d.HasSecret {
+		t.Fatalf("default destination = %+v", d)
+	}
+
+	for _, body := range []string{
+		`{"kind":"ftp","endpoint":"ftp://example.com"}`,
+		`{"kind":"s3","endpoint":"https://s3.example.com","username":"AK","secret":"SK"}`,
+		`{"kind":"s3","endpoint":"https://s3.example.com","bucket":"books","username":"AK"}`,
+		`{"kind":"s3","endpoint":"s3.example.com","bucket":"books","username":"AK","secret":"SK"}`,
+		`{"kind":"webdav","endpoint":"https://bob:pw@dav.example.com"}`,
+		`{"kind":"webdav","endpoint":"https://dav.example.com","secret":"pw"}`,
+		`{"kind":"local","path":"books"}`,
+	} {
+		wantError(t, a.do("PUT", "/api/v1/destination", key, body), http.StatusUnprocessableEntity, "validation_failed")
+	}
+
+	rec := a.do("PUT", "/api/v1/destination", key, `{"kind":"S3","endpoint":"https://s3.example.com","bucket":"books","path":"/in/","username":"AK","secret":"s3cret-key"}`)
+	if strings.Contains(rec.Body.String(), "s3cret-key") {
+		t.Fatalf("secret in response: %s", rec.Body)
+	}
+	decode(t, rec, http.StatusOK, &d)
+	if d.Kind != store.DestS3 || d.Path != "in" || !d.HasSecret {
+		t.Fatalf("s3 destination = %+v", d)
+	}
+	// без secret остаётся прежний, пока вид тот же
+	var kept destinationResponse
+	decode(t, a.do("PUT", "/api/v1/destination", key, `{"kind":"s3","endpoint":"https://s3.example.com","bucket":"other","username":"AK"}`), http.StatusOK, &kept)
+	if kept.Bucket != "other" || !kept.HasSecret {
+		t.Fatalf("updated s3 destination = %+v", kept)
+	}
+	if saved, _ := a.store.Destination(context.Background(), 1); saved.Secret != "s3cret-key" {
+		t.Fatalf("stored secret = %q", saved.Secret)
+	}
+	var dav destinationResponse
+	decode(t, a.do("PUT", "/api/v1/destination", key, `{"kind":"webdav","endpoint":"https://dav.example.com"}`), http.StatusOK, &dav)
+	if dav.HasSecret {
+		t.Fatalf("secret carried over to another kind: %+v", dav)
+	}
+
+	// задания идут в место доставки, а не на почту
+	var j jobResponse
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f"}`), http.StatusAccepted, &j)
+	if j.Destination != store.DestWebDAV {
+		t.Fatalf("job = %+v", j)
+	}
+
+	cfg := config.Default()
+	cfg.Delivery.LocalRoot = t.TempDir()
+	a.srv.conf = config.NewStore(cfg, "", nil)
+	wantError(t, a.do("PUT", "/api/v1/destination", key, `{"kind":"local","path":"../other"}`), http.StatusUnprocessableEntity, "validation_failed")
+	var local destinationResponse
+	decode(t, a.do("PUT", "/api/v1/destination", key, `{"kind":"local","path":"books","secret":"ignored"}`), http.StatusOK, &local)
+	if local.Kind != store.DestLocal || local.Path != "books" || local.HasSecret {
+		t.Fatalf("local destination = %+v", local)
+	}
+
+	if rec := a.do("DELETE", "/api/v1/destination", key, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body)
+	}
+	if rec := a.do("DELETE", "/api/v1/destination", key, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("second delete: %d %s", rec.Code, rec.Body)
+	}
+	var email destinationResponse
+	decode(t, a.do("GET", "/api/v1/destination", key, ""), http.StatusOK, &email)
+	if email.Kind != destEmail {
+		t.Fatalf("destination after delete = %+v", email)
+	}
+
+	// без ключа шифрования секрет не сохранить, без секрета — можно
+	a.srv.store = noKeyStore{a.store}
+	wantError(t, a.do("PUT", "/api/v1/destination", key, `{"kind":"webdav","endpoint":"https://dav.example.com","username":"bob","secret":"pw"}`), http.StatusUnprocessableEntity, "validation_failed")
+	decode(t, a.do("PUT", "/api/v1/destination", key, `{"kind":"telegram"}`), http.StatusOK, &d)
+}
+
+// handOver отдаёт файл боту через /send, как при доставке в Telegram, и
+// возвращает номер задания.
+func (a *testAPI) handOver(key string) int64 {
+	a.t.Helper()
+	rec := a.do("POST", "/send", "", `{"api_key":"`+key+`","file_url":"data:text/plain;base64,aGVsbG8=","destination":"telegram"}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		a.t.Fatalf("/send: %d %q", rec.Code, rec.Body)
+	}
+	id, err := strconv.ParseInt(rec.Header().Get("X-Job-ID"), 10, 64)
+	if err != nil {
+		a.t.Fatalf("X-Job-ID: %v", err)
+	}
+	return id
+}
+
+func TestAPIJobDelivery(t *testing.T) {
+	a := newTestAPI(t)
+	a.telegramUser(100, "alice@example.com")
+	a.user("bob@example.com")
+	key := "key-alice@example.com"
+
+	id := a.handOver(key)
+	path := "/api/v1/jobs/" + strconv.FormatInt(id, 10)
+	var j jobResponse
+	decode(t, a.do("GET", path, key, ""), http.StatusOK, &j)
+	if j.Status != store.StatusSending || j.Destination != store.DestTelegram || j.SizeBytes != 5 {
+		t.Fatalf("handed over job = %+v", j)
+	}
+
+	wantError(t, a.do("POST", path+"/delivery", key, `{}`), http.StatusUnprocessableEntity, "validation_failed")
+	wantError(t, a.do("POST", path+"/delivery", key, `{"location":"telegram:100/2","error":"x"}`), http.StatusUnprocessableEntity, "validation_failed")
+	wantError(t, a.do("POST", path+"/delivery", key, `{"chat":1}`), http.StatusBadRequest, "bad_request")
+	wantError(t, a.do("POST", path+"/delivery", "key-bob@example.com", `{"error":"x"}`), http.StatusNotFound, "not_found")
+	// место — только сообщение в личном чате владельца
+	for _, loc := range []string{"tg://1/2", "telegram:100", "telegram:100/x", "telegram:x/2", "telegram:100/0"} {
+		wantError(t, a.do("POST", path+"/delivery", key, `{"location":"`+loc+`"}`), http.StatusUnprocessableEntity, "validation_failed")
+	}
+	wantError(t, a.do("POST", path+"/delivery", key, `{"location":"telegram:200/2"}`), http.StatusUnprocessableEntity, "validation_failed")
+	// у bob нет Telegram, ни один чат не его
+	wantError(t, a.do("POST", path+"/delivery", "key-bob@example.com", `{"location":"telegram:100/2"}`), http.StatusUnprocessableEntity, "validation_failed")
+
+	// задание из API боту не отдавалось
+	var queued jobResponse
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f"}`), http.StatusAccepted, &queued)
+	wantError(t, a.do("POST", "/api/v1/jobs/"+strconv.FormatInt(queued.ID, 10)+"/delivery", key, `{"location":"telegram:100/2"}`), http.StatusConflict, "job_not_handed_over")
+
+	var sent jobResponse
+	decode(t, a.do("POST", path+"/delivery", key, `{"location":"telegram:100/2"}`), http.StatusOK, &sent)
+	if sent.Status != store.StatusSent || sent.DeliveredTo != "telegram:100/2" || sent.FinishedAt == nil {
+		t.Fatalf("reported job = %+v", sent)
+	}
+	wantError(t, a.do("POST", path+"/delivery", key, `{"error":"late"}`), http.StatusConflict, "job_not_handed_over")
+
+	failedID := a.handOver(key)
+	var failed jobResponse
+	decode(t, a.do("POST", "/api/v1/jobs/"+strconv.FormatInt(failedID, 10)+"/delivery", key, `{"error":"file is too big"}`), http.StatusOK, &failed)
+	if failed.Status != store.StatusFailed || failed.Error != "telegram: file is too big" {
+		t.Fatalf("failed job = %+v", failed)
+	}
+
+	// одновременные отчёты: задание завершает ровно один
+	raceID := a.handOver(key)
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := `{"location":"telegram:100/` + strconv.Itoa(i+1) + `"}`
+			if i%2 == 1 {
+				body = `{"error":"upload failed"}`
+			}
+			codes <- a.do("POST", "/api/v1/jobs/"+strconv.FormatInt(raceID, 10)+"/delivery", key, body).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	won := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("concurrent report: status %d", code)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("%d concurrent reports finished the job", won)
+	}
+}
+
+func TestFailUnreportedJobs(t *testing.T) {
+	a := newTestAPI(t)
+	a.telegramUser(100, "alice@example.com")
+	key := "key-alice@example.com"
+	id := a.handOver(key)
+	path := "/api/v1/jobs/" + strconv.FormatInt(id, 10)
+
+	// свежая передача ждёт отчёта
+	a.srv.failUnreportedJobs(context.Background())
+	var j jobResponse
+	decode(t, a.do("GET", path, key, ""), http.StatusOK, &j)
+	if j.Status != store.StatusSending {
+		t.Fatalf("fresh handoff = %+v", j)
+	}
+
+	// бот так и не сообщил: задание завершается, поздний отчёт не принимается
+	if _, err := a.store.FailUnreportedJobs(context.Background(), time.Now().Add(telegramReportTimeout), "timeout"); err != nil {
+		t.Fatal(err)
+	}
+	decode(t, a.do("GET", path, key, ""), http.StatusOK, &j)
+	if j.Status != store.StatusFailed || j.FinishedAt == nil {
+		t.Fatalf("unreported job = %+v", j)
+	}
+	wantError(t, a.do("POST", path+"/delivery", key, `{"location":"telegram:100/2"}`), http.StatusConflict, "job_not_handed_over")
+}
+
+func TestAPICredentials(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	a.user("bob@example.com")
+	key := "key-alice@example.com"
+
+	for _, tc := range []struct{ path, body string }{
+		{"gopher/example.com", `{"username":"bob","password":"pw"}`},
+		{"ftp/example.com:21", `{"username":"bob","password":"pw"}`},
+		{"ftp/example.com", `{"password":"pw"}`},
+		{"ftp/example.com", `{"username":"bob","headers":{"X-Token":"t"}}`},
+		{"sftp/example.com", `{"username":"bob"}`},
+		{"sftp/example.com", `{"username":"bob","private_key":"not a key"}`},
+		{"sftp/example.com", `{"username":"bob","password":"pw","host_key":"not a key"}`},
+		{"https/example.com", `{}`},
+		{"https/example.com", `{"password":"pw"}`},
+		{"https/example.com", `{"username":"a:b","password":"pw"}`},
+		{"https/example.com", `{"username":"bob","private_key":"k"}`},
+		{"https/example.com", `{"headers":{"Host":"evil.example"}}`},
+		{"https/example.com", `{"headers":{"Cookie":"sid=1"}}`},
+		{"https/example.com", `{"cookies":{"bad name":"1"}}`},
+	} {
+		t.Run(tc.path+" "+tc.body, func(t *testing.T) {
+			wantError(t, a.do("PUT", "/api/v1/credentials/"+tc.path, key, tc.body), http.StatusUnprocessableEntity, "validation_failed")
+		})
+	}
+
+	rec := a.do("PUT", "/api/v1/credentials/FTP/Files.Example.com", key, `{"username":"bob","password":"ftp-s3cret"}`)
+	if strings.Contains(rec.Body.String(), "ftp-s3cret") {
+		t.Fatalf("password in response: %s", rec.Body)
+	}
+	var c credentialResponse
+	decode(t, rec, http.StatusOK, &c)
+	if c.Scheme != "ftp" || c.Host != "files.example.com" || c.Username != "bob" || !c.HasPassword {
+		t.Fatalf("ftp credential = %+v", c)
+	}
+	// без password остаётся прежний
+	var renamed credentialResponse
+	decode(t, a.do("PUT", "/api/v1/credentials/ftp/files.example.com", key, `{"username":"robert"}`), http.StatusOK, &renamed)
+	if renamed.Username != "robert" || !renamed.HasPassword {
+		t.Fatalf("updated ftp credential = %+v", renamed)
+	}
+	if saved, _ := a.store.Credential(context.Background(), 1, "ftp", "files.example.com"); saved.Password != "ftp-s3cret" {
+		t.Fatalf("stored password = %q", saved.Password)
+	}
+
+	rec = a.do("PUT", "/api/v1/credentials/https/example.com", key, `{"headers":{"x-api-key":"hdr-s3cret"},"cookies":{"sid":"cookie-s3cret"}}`)
+	if strings.Contains(rec.Body.String(), "s3cret") {
+		t.Fatalf("header or cookie value in response: %s", rec.Body)
+	}
+	var web credentialResponse
+	decode(t, rec, http.StatusOK, &web)
+	if len(web.Headers) != 1 || web.Headers[0] != "X-Api-Key" || len(web.Cookies) != 1 || web.Cookies[0] != "sid" {
+		t.Fatalf("https credential = %+v", web)
+	}
+	// пустой объект headers их стирает, cookies без изменений
+	var cleared credentialResponse
+	decode(t, a.do("PUT", "/api/v1/credentials/https/example.com", key, `{"headers":{},"user_agent":"Reader/1.0"}`), http.StatusOK, &cleared)
+	if len(cleared.Headers) != 0 || len(cleared.Cookies) != 1 || cleared.UserAgent != "Reader/1.0" {
+		t.Fatalf("cleared credential = %+v", cleared)
+	}
+
+	var list struct {
+		Credentials []credentialResponse `json:"credentials"`
+	}
+	decode(t, a.do("GET", "/api/v1/credentials", key, ""), http.StatusOK, &list)
+	if len(list.Credentials) != 2 {
+		t.Fatalf("credentials = %+v", list.Credentials)
+	}
+	var foreign struct {
+		Credentials []credentialResponse `json:"credentials"`
+	}
+	decode(t, a.do("GET", "/api/v1/credentials", "key-bob@example.com", ""), http.StatusOK, &foreign)
+	if len(foreign.Credentials) != 0 {
+		t.Fatalf("bob sees %+v", foreign.Credentials)
+	}
+	wantError(t, a.do("DELETE", "/api/v1/credentials/ftp/files.example.com", "key-bob@example.com", ""), http.StatusNotFound, "not_found")
+
+	if rec := a.do("DELETE", "/api/v1/credentials/ftp/files.example.com", key, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body)
+	}
+	wantError(t, a.do("DELETE", "/api/v1/credentials/ftp/files.example.com", key, ""), http.StatusNotFound, "not_found")
+
+	// без ключа шифрования пароль не сохранить, user_agent — можно
+	a.srv.store = noKeyStore{a.store}
+	wantError(t, a.do("PUT", "/api/v1/credentials/ftp/files.example.com", key, `{"username":"bob","password":"pw"}`), http.StatusUnprocessableEntity, "validation_failed")
+	decode(t, a.do("PUT", "/api/v1/credentials/https/other.example.com", key, `{"user_agent":"Reader/1.0"}`), http.StatusOK, &c)
+}
+
+func TestAPIJobAuth(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	key := "key-alice@example.com"
+
+	for _, body := range []string{
+		`{"url":"ftp://example.com/f","auth":{"username":"bob","password":"pw"}}`,
+		`{"url":"data:text/plain,hi","auth":{"headers":{"X-Token":"t"}}}`,
+		`{"url":"https://example.com/f","auth":{"password":"pw"}}`,
+		`{"url":"https://bob@example.com/f","auth":{"username":"bob","password":"pw"}}`,
+		`{"url":"https://example.com/f","auth":{"headers":{"Host":"evil.example"}}}`,
+		`{"url":"https://example.com/f","auth":{"headers":{"Sec-Fetch-Mode":"cors"}}}`,
+		`{"url":"https://example.com/f","auth":{"headers":{"X-Token":"a\nb"}}}`,
+		`{"url":"https://example.com/f","auth":{"cookies":{"a;b":"1"}}}`,
+	} {
+		t.Run(body, func(t *testing.T) {
+			wantError(t, a.do("POST", "/api/v1/jobs", key, body), http.StatusUnprocessableEntity, "validation_failed")
+		})
+	}
+
+	rec := a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f","auth":{"username":" bob ","password":"job-s3cret","headers":{"x-token":"t"},"cookies":{"sid":"1"}}}`)
+	if strings.Contains(rec.Body.String(), "job-s3cret") {
+		t.Fatalf("password in response: %s", rec.Body)
+	}
+	var j jobResponse
+	decode(t, rec, http.StatusAccepted, &j)
+	// учётные данные получает только воркер
+	claimed, err := a.store.ClaimJob(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.ID != j.ID || claimed.Auth == nil || claimed.Auth.Username != "bob" || claimed.Auth.Password != "job-s3cret" ||
+		claimed.Auth.Headers["X-Token"] != "t" || claimed.Auth.Cookies["sid"] != "1" {
+		t.Fatalf("claimed auth = %+v", claimed.Auth)
+	}
+
+	// пустой auth — задание без учётных данных
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/g","auth":{}}`), http.StatusAccepted, &j)
+	if claimed, err := a.store.ClaimJob(context.Background(), time.Hour); err != nil || claimed.Auth != nil {
+		t.Fatalf("claimed = %+v, %v", claimed, err)
+	}
+
+	// /send проверяет ссылку и auth так же
+	for _, body := range []string{
+		`{"api_key":"` + key + `","file_url":"https://bob:pw@example.com/f"}`,
+		`{"api_key":"` + key + `","file_url":"https://example.com/f","auth":{"password":"pw"}}`,
+	} {
+		if rec := a.do("POST", "/send", "", body); rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("/send %s: %d %s", body, rec.Code, rec.Body)
+		}
+	}
+
+	a.srv.store = noKeyStore{a.store}
+	wantError(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f","auth":{"username":"bob","password":"pw"}}`), http.StatusUnprocessableEntity, "validation_failed")
+	if rec := a.do("POST", "/send", "", `{"api_key":"`+key+`","file_url":"https://example.com/f","auth":{"username":"bob","password":"pw"}}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("/send without secrets key: %d %s", rec.Code, rec.Body)
+	}
+	decode(t, a.do("POST", "/api/v1/jobs", key, `{"url":"https://example.com/f"}`), http.StatusAccepted, &j)
+}
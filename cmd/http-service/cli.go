@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"download_track/internal/config"
+	"download_track/internal/migrations"
+	"download_track/internal/store"
+	"download_track/internal/store/postgres"
+)
+
+// runCommand выполняет подкоманду администрирования и возвращает код выхода.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "create-account":
+		return cmdCreateAccount(args[1:])
+	case "link-code":
+		return cmdLinkCode(args[1:])
+	case "migrate":
+		return cmdMigrate(args[1:])
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `usage: http-service [command]
+
+Without a command the HTTP server is started.
+
+Commands:
+  create-account -email <addr>   create an account without Telegram and print its API key
+  link-code -email <addr>        print a one-time code for /link in the bot
+  migrate up|down [n]|status     apply, revert or list schema migrations`)
+}
+
+func cmdMigrate(args []string) int {
+	srv, err := cliServer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	defer srv.db.Close()
+
+	if err := migrations.RunCommand(context.Background(), srv.db, args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	return 0
+}
+
+func cmdCreateAccount(args []string) int {
+	fs := flag.NewFlagSet("create-account", flag.ContinueOnError)
+	emailFlag := fs.String("email", "", "account email")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	addr, err := mail.ParseAddress(strings.TrimSpace(*emailFlag))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "create-account: -email must be a valid email address")
+		return 2
+	}
+
+	srv, err := cliServer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "create-account:", err)
+		return 1
+	}
+	defer srv.db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	acc, err := srv.createAccount(ctx, addr.Address)
+	if errors.Is(err, store.ErrEmailTaken) {
+		fmt.Fprintf(os.Stderr, "create-account: %s is already registered\n", addr.Address)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "create-account:", err)
+		return 1
+	}
+
+	fmt.Printf("id=%d email=%s\napi_key=%s\n", acc.ID, acc.Email, acc.APIKey)
+	return 0
+}
+
+func cmdLinkCode(args []string) int {
+	fs := flag.NewFlagSet("link-code", flag.ContinueOnError)
+	emailFlag := fs.String("email", "", "account email")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *emailFlag == "" {
+		fmt.Fprintln(os.Stderr, "link-code: -email is required")
+		return 2
+	}
+
+	srv, err := cliServer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "link-code:", err)
+		return 1
+	}
+	defer srv.db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	acc, err := srv.store.UserByEmail(ctx, strings.TrimSpace(*emailFlag))
+	if errors.Is(err, store.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "link-code: no account with email %s\n", *emailFlag)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "link-code:", err)
+		return 1
+	}
+
+	code, expiresAt, err := srv.createLinkCode(ctx, acc)
+	if errors.Is(err, store.ErrAccountLinked) {
+		fmt.Fprintln(os.Stderr, "link-code: telegram is already linked to this account")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "link-code:", err)
+		return 1
+	}
+
+	fmt.Printf("/link %s\nexpires at %s\n", code, expiresAt.Format(time.RFC3339))
+	return 0
+}
+
+// cliServer — Server только с подключением к БД, без SMTP и воркеров.
+func cliServer() (*Server, error) {
+	cfg, err := config.LoadFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DB.DSN == "" {
+		return nil, errors.New("db.dsn (DB_DSN) is required")
+	}
+	secrets, err := cfg.DB.SecretBox()
+	if err != nil {
+		return nil, fmt.Errorf("db.secrets_key: %w", err)
+	}
+	db, err := sql.Open("postgres", cfg.DB.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Server{db: db, store: postgres.New(db, secrets)}, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"download_track/internal/fetch"
+	"download_track/internal/store"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/http/httpguts"
+)
+
+// fetchSchemes — схемы ссылок, которые умеет скачивать http-service.
+var fetchSchemes = []string{"http", "https", "ftp", "sftp", "data"}
+
+// fetchers — загрузчики для задания: берутся сохранённые учётные данные
+// пользователя, а учётные данные самого задания заменяют их для хоста
+// его ссылки. Настройки читаются при каждом задании, чтобы SIGHUP менял
+// их сразу.
+func (s *Server) fetchers(acc *store.User, j *store.Job) fetch.Fetchers {
+	var jobHost string
+	if u, err := url.Parse(j.URL); err == nil && j.Auth != nil {
+		jobHost = strings.ToLower(u.Hostname())
+	}
+	logins := func(ctx context.Context, scheme, host string) (*fetch.Login, error) {
+		if jobHost != "" && host == jobHost && (scheme == "http" || scheme == "https") {
+			a := j.Auth
+			return &fetch.Login{User: a.Username, Password: a.Password, Headers: a.Headers, Cookies: a.Cookies, UserAgent: a.UserAgent}, nil
+		}
+		c, err := s.store.Credential(ctx, acc.ID, scheme, host)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &fetch.Login{User: c.Username, Password: c.Password, PrivateKey: []byte(c.PrivateKey), HostKey: c.HostKey,
+			Headers: c.Headers, Cookies: c.Cookies, UserAgent: c.UserAgent}, nil
+	}
+	// ссылки на облачные диски ведут на страницу, а не на файл
+	web := &fetch.Share{HTTP: &fetch.HTTP{Logins: logins}}
+	return fetch.Fetchers{
+		"http":  web,
+		"https": web,
+		"ftp":   &fetch.FTP{Logins: logins, Active: s.conf.Get().Fetch.FTPActive},
+		"sftp":  &fetch.SFTP{Logins: logins},
+		"data":  fetch.Data{},
+	}
+}
+
+// checkFileURL проверяет ссылку на файл из API. Пароль в ссылке попал бы
+// в задание и журнал, поэтому он хранится отдельно, в учётных данных.
+func checkFileURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("url is not valid")
+	}
+	scheme := strings.ToLower(u.Scheme)
+	switch {
+	case !slices.Contains(fetchSchemes, scheme):
+		return fmt.Errorf("url scheme must be one of %s", strings.Join(fetchSchemes, ", "))
+	case scheme == "data":
+		return nil
+	case u.Host == "":
+		return errors.New("url must be absolute")
+	}
+	if _, ok := u.User.Password(); ok {
+		return errors.New("url must not contain a password, save credentials for the host")
+	}
+	return nil
+}
+
+// cleanCredential проверяет учётные данные из API. Ключ сервера SFTP
+// можно не указывать: первое скачивание сообщит его в ошибке задания.
+func cleanCredential(c store.Credential) (store.Credential, error) {
+	c.Scheme = strings.ToLower(strings.TrimSpace(c.Scheme))
+	c.Host = strings.ToLower(strings.TrimSpace(c.Host))
+	c.Username = strings.TrimSpace(c.Username)
+	c.PrivateKey = strings.TrimSpace(c.PrivateKey)
+	c.HostKey = strings.TrimSpace(c.HostKey)
+	c.UserAgent = strings.TrimSpace(c.UserAgent)
+
+	if c.Host == "" || strings.ContainsAny(c.Host, ":/@ ") {
+		return c, errors.New("host must be a host name without port")
+	}
+	web := c.Scheme == "http" || c.Scheme == "https"
+	if !web && (len(c.Headers) > 0 || len(c.Cookies) > 0 || c.UserAgent != "") {
+		return c, errors.New("headers, cookies and user_agent are only for http and https")
+	}
+	if web {
+		if c.PrivateKey != "" || c.HostKey != "" {
+			return c, errors.New("private_key and host_key are only for sftp")
+		}
+		var err error
+		if c.Headers, c.Cookies, err = cleanHTTPAuth(c.Username, c.Password, c.Headers, c.Cookies, c.UserAgent); err != nil {
+			return c, err
+		}
+		if c.Username == "" && len(c.Headers) == 0 && len(c.Cookies) == 0 && c.UserAgent == "" {
+			return c, errors.New("username, headers, cookies or user_agent is required")
+		}
+		return c, nil
+	}
+	if c.Username == "" {
+		return c, errors.New("username is required")
+	}
+	switch c.Scheme {
+	case "ftp":
+		if c.PrivateKey != "" || c.HostKey != "" {
+			return c, errors.New("private_key and host_key are only for sftp")
+		}
+	case "sftp":
+		if c.Password == "" && c.PrivateKey == "" {
+			return c, errors.New("password or private_key is required for sftp")
+		}
+		if c.PrivateKey != "" {
+			if _, err := ssh.ParsePrivateKey([]byte(c.PrivateKey)); err != nil {
+				return c, fmt.Errorf("private_key must be an unencrypted key in PEM: %v", err)
+			}
+			c.PrivateKey += "\n"
+		}
+		if c.HostKey != "" {
+			k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.HostKey))
+			if err != nil {
+				return c, errors.New("host_key must be a public key in authorized_keys format")
+			}
+			// комментарий ключа не нужен
+			c.HostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+		}
+	default:
+		return c, errors.New("scheme must be ftp, sftp, http or https")
+	}
+	return c, nil
+}
+
+// Ограничения на учётные данные сайта: они уходят в каждый запрос.
+const (
+	maxAuthHeaders     = 20
+	maxAuthCookies     = 50
+	maxAuthValueLen    = 8 << 10
+	maxUserAgentLength = 512
+)
+
+// reservedHeaders задаёт клиент или отдельные поля учётных данных.
+// Accept-Encoding и Range сломали бы распаковку и размер файла.
+var reservedHeaders = []string{
+	"Host", "Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive", "Upgrade", "Te", "Trailer",
+	"Proxy-Authorization", "Proxy-Connection", "Accept-Encoding", "Range", "Cookie", "User-Agent",
+}
+
+// cleanJobAuth проверяет учётные данные задания из API. Они нужны только
+// для ссылок http и https; nil — учётных данных нет.
+func cleanJobAuth(a *store.JobAuth, rawURL string) (*store.JobAuth, error) {
+	if a == nil {
+		return nil, nil
+	}
+	out := *a
+	out.Username = strings.TrimSpace(a.Username)
+	out.UserAgent = strings.TrimSpace(a.UserAgent)
+	if out.Username == "" && out.Password == "" && len(a.Headers) == 0 && len(a.Cookies) == 0 && out.UserAgent == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("auth is only for http and https urls")
+	}
+	if u.User != nil && out.Username != "" {
+		return nil, errors.New("give the username either in the url or in auth")
+	}
+	if out.Headers, out.Cookies, err = cleanHTTPAuth(out.Username, out.Password, a.Headers, a.Cookies, out.UserAgent); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// cleanHTTPAuth проверяет basic auth, заголовки, cookie и User-Agent и
+// возвращает заголовки с каноническими именами.
+func cleanHTTPAuth(username, password string, headers, cookies map[string]string, userAgent string) (map[string]string, map[string]string, error) {
+	if password != "" && username == "" {
+		return nil, nil, errors.New("password requires username")
+	}
+	// имя и пароль в basic auth разделяет двоеточие
+	if strings.Contains(username, ":") || !httpguts.ValidHeaderFieldValue(username) {
+		return nil, nil, errors.New("username must not contain a colon or control characters")
+	}
+	if len(headers) > maxAuthHeaders {
+		return nil, nil, fmt.Errorf("at most %d headers are allowed", maxAuthHeaders)
+	}
+	if len(cookies) > maxAuthCookies {
+		return nil, nil, fmt.Errorf("at most %d cookies are allowed", maxAuthCookies)
+	}
+
+	var clean map[string]string
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, nil, fmt.Errorf("header name %q is not valid", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		switch {
+		case slices.Contains(reservedHeaders, name):
+			return nil, nil, fmt.Errorf("header %s cannot be set, use cookies and user_agent for Cookie and User-Agent", name)
+		case strings.HasPrefix(name, "Sec-"):
+			return nil, nil, fmt.Errorf("header %s cannot be set", name)
+		case len(value) > maxAuthValueLen || !httpguts.ValidHeaderFieldValue(value):
+			return nil, nil, fmt.Errorf("header %s has a bad value", name)
+		}
+		if clean == nil {
+			clean = make(map[string]string, len(headers))
+		}
+		if _, dup := clean[name]; dup {
+			return nil, nil, fmt.Errorf("header %s is given twice", name)
+		}
+		clean[name] = strings.TrimSpace(value)
+	}
+	for name, value := range cookies {
+		c := &http.Cookie{Name: name, Value: value}
+		if len(value) > maxAuthValueLen || c.Valid() != nil {
+			return nil, nil, fmt.Errorf("cookie %q is not valid", name)
+		}
+	}
+	if len(userAgent) > maxUserAgentLength || !httpguts.ValidHeaderFieldValue(userAgent) {
+		return nil, nil, errors.New("user_agent is not valid")
+	}
+	if len(cookies) == 0 {
+		cookies = nil
+	}
+	return clean, cookies, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"download_track/internal/deliver"
+	"download_track/internal/mailmsg"
+	"download_track/internal/store"
+)
+
+// destEmail — доставка письмом в API: места доставки нет.
+const destEmail = "email"
+
+var errBadDestination = errors.New("bad destination")
+
+// emailDeliverer отправляет уже собранное письмо: это доставка по
+// умолчанию.
+type emailDeliverer struct {
+	s   *Server
+	msg *mailmsg.Message
+}
+
+func (d *emailDeliverer) Deliver(_ context.Context, _ deliver.File) (string, error) {
+	smtpStart := time.Now()
+	err := d.s.sendEmail(d.msg)
+	smtpDuration.Observe(time.Since(smtpStart).Seconds())
+	if err != nil {
+		smtpErrors.Inc()
+		return "", err
+	}
+	return "mailto:" + strings.Join(d.msg.To, ","), nil
+}
+
+// deliverer — куда доставить файл задания, которое идёт не на почту.
+// Настройки берутся текущие: задание помнит только вид места доставки.
+func (s *Server) deliverer(ctx context.Context, j *store.Job) (deliver.Deliverer, error) {
+	d, err := s.store.Destination(ctx, j.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("%w: destination %s was removed", errBadDestination, j.Destination)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.Kind != j.Destination {
+		return nil, fmt.Errorf("%w: destination changed from %s to %s", errBadDestination, j.Destination, d.Kind)
+	}
+
+	switch d.Kind {
+	case store.DestS3:
+		return &deliver.S3{Endpoint: d.Endpoint, Bucket: d.Bucket, Region: d.Region, Prefix: d.Path,
+			AccessKey: d.Username, SecretKey: d.Secret}, nil
+	case store.DestWebDAV:
+		u, err := url.Parse(d.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadDestination, err)
+		}
+		if d.Path != "" {
+			u = u.JoinPath(d.Path)
+		}
+		return &deliver.WebDAV{URL: u.String(), Username: d.Username, Password: d.Secret}, nil
+	case store.DestLocal:
+		root := s.conf.Get().Delivery.LocalRoot
+		if root == "" {
+			return nil, fmt.Errorf("%w: local delivery is disabled", errBadDestination)
+		}
+		// у каждого пользователя свой каталог: чужой path туда не попадёт
+		return &deliver.Dir{Path: filepath.Join(root, strconv.Itoa(d.UserID), d.Path)}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown kind %q", errBadDestination, d.Kind)
+}
+
+// cleanDestination проверяет место доставки из API. Секрет не
+// проверяется: неверный покажет первая доставка.
+func (s *Server) cleanDestination(d store.Destination) (store.Destination, error) {
+	d.Kind = strings.ToLower(strings.TrimSpace(d.Kind))
+	d.Endpoint = strings.TrimSpace(d.Endpoint)
+	d.Bucket = strings.TrimSpace(d.Bucket)
+	d.Region = strings.TrimSpace(d.Region)
+	d.Path = strings.Trim(strings.TrimSpace(d.Path), "/")
+	d.Username = strings.TrimSpace(d.Username)
+
+	endpoint := func() error {
+		u, err := url.Parse(d.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("endpoint must be an absolute http(s) url")
+		}
+		if u.User != nil {
+			return errors.New("endpoint must not contain credentials, use username and secret")
+		}
+		return nil
+	}
+
+	switch d.Kind {
+	case store.DestS3:
+		if err := endpoint(); err != nil {
+			return d, err
+		}
+		if d.Bucket == "" || strings.ContainsAny(d.Bucket, "/ ") {
+			return d, errors.New("bucket is required and must not contain slashes")
+		}
+		if d.Username == "" || d.Secret == "" {
+			return d, errors.New("username (access key) and secret are required for s3")
+		}
+	case store.DestWebDAV:
+		if err := endpoint(); err != nil {
+			return d, err
+		}
+		if d.Username == "" && d.Secret != "" {
+			return d, errors.New("secret requires username")
+		}
+		d.Bucket, d.Region = "", ""
+	case store.DestLocal:
+		if s.conf.Get().Delivery.LocalRoot == "" {
+			return d, errors.New("local delivery is disabled on this server")
+		}
+		// подкаталог не может выйти за корень
+		if d.Path == "" || !filepath.IsLocal(d.Path) {
+			return d, errors.New("path must be a relative directory without ..")
+		}
+		d.Endpoint, d.Bucket, d.Region, d.Username, d.Secret = "", "", "", "", ""
+	case store.DestTelegram:
+		// действует только на ссылки, присланные боту
+		d.Endpoint, d.Bucket, d.Region, d.Path, d.Username, d.Secret = "", "", "", "", "", ""
+	default:
+		return d, fmt.Errorf("kind must be %s, %s, %s, %s or %s", destEmail, store.DestS3, store.DestWebDAV, store.DestLocal, store.DestTelegram)
+	}
+	return d, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"download_track/internal/config"
+	"download_track/internal/mailcrypt"
+	"download_track/internal/mailmsg"
+	"download_track/internal/mailtmpl"
+	"download_track/internal/store"
+)
+
+// validateConfig проверяет настройки и шаблоны писем — при старте и при
+// перезагрузке, чтобы сломанный шаблон не подменил рабочий.
+func validateConfig(c *config.Config) error {
+	if err := c.ValidateHTTPService(); err != nil {
+		return err
+	}
+	if _, err := mailtmpl.Load(c.Email.TemplatesDir); err != nil {
+		return fmt.Errorf("email.templates_dir (EMAIL_TEMPLATES_DIR): %w", err)
+	}
+	return nil
+}
+
+// reloadTemplates перечитывает шаблоны писем. При ошибке остаются
+// прежние.
+func (s *Server) reloadTemplates(c *config.Config) {
+	t, err := mailtmpl.Load(c.Email.TemplatesDir)
+	if err != nil {
+		log.Println("email templates reload failed, keeping current:", err)
+		return
+	}
+	s.templates.Store(t)
+}
+
+// composeEmail собирает письмо с файлом по шаблонам на языке
+// пользователя. Тема из задания заменяет шаблонную, префикс
+// пользователя добавляется к любой.
+func (s *Server) composeEmail(j *store.Job, acc *store.User, name, path, checksum string) (*mailmsg.Message, error) {
+	m, err := s.templates.Load().Render(acc.Language, mailtmpl.Data{
+		JobID:     j.ID,
+		URL:       j.URL,
+		FileName:  name,
+		Size:      j.Size,
+		Checksum:  checksum,
+		User:      acc.Email,
+		Recipient: j.Recipient,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	subject := m.Subject
+	if j.Subject != "" {
+		subject = j.Subject
+	}
+	return &mailmsg.Message{
+		To:          []string{j.Recipient},
+		Subject:     mailtmpl.Subject(acc.SubjectPrefix, subject),
+		Text:        m.Text,
+		HTML:        m.HTML,
+		Attachments: []mailmsg.Attachment{{Name: name, Path: path}},
+	}, nil
+}
+
+// errEncryptionRequired — пользователь запретил письма без шифрования, а
+// это письмо зашифровать нельзя.
+var errEncryptionRequired = errors.New("encryption required")
+
+// emailEncrypter возвращает ключ, которым шифруется письмо задания, или
+// nil, если письмо уходит открытым. Ключ пользователя шифрует только
+// письма на email аккаунта: другой получатель их не прочитает.
+func (s *Server) emailEncrypter(ctx context.Context, j *store.Job, acc *store.User) (mailmsg.Encrypter, error) {
+	k, err := s.store.EncryptionKey(ctx, acc.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := mailcrypt.LoadKey(k.Kind, k.Data)
+	switch {
+	case err != nil:
+	case !strings.EqualFold(j.Recipient, acc.Email):
+		err = fmt.Errorf("recipient %s is not the account email", j.Recipient)
+	case !key.CanEncrypt():
+		err = mailcrypt.ErrCannotEncrypt
+	default:
+		return key, nil
+	}
+	if k.Required {
+		return nil, fmt.Errorf("%w: %v", errEncryptionRequired, err)
+	}
+	s.logJob(j, "sending unencrypted", "encrypt", "reason", err.Error())
+	return nil, nil
+}
+
+// sendEmail отправляет письмо через SMTP; отправитель берётся из
+// настроек.
+func (s *Server) sendEmail(m *mailmsg.Message) error {
+	if s.smtpHost == "" || s.smtpPort == "" || s.fromAddr == "" {
+		return fmt.Errorf("smtp config incomplete")
+	}
+
+	m.From = mail.Address{
+		Name:    s.conf.Get().Email.FromName,
+		Address: s.fromAddr,
+	}
+
+	// подпись считается до соединения с сервером: письмо кодируется
+	// дважды, второй раз — уже в SMTP
+	var signature string
+	if s.dkim != nil {
+		var err error
+		if signature, err = s.signEmail(m); err != nil {
+			return err
+		}
+	}
+
+	addr := s.smtpHost + ":" + s.smtpPort
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("dial smtp: %w", err)
+	}
+	defer conn.Close()
+
+	c, err := smtp.NewClient(conn, s.smtpHost)
+	if err != nil {
+		return fmt.Errorf("smtp new client: %w", err)
+	}
+	defer c.Quit()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsconfig := &tls.Config{
+			ServerName: s.smtpHost,
+		}
+		if err = c.StartTLS(tlsconfig); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	if err = c.Mail(s.fromAddr); err != nil {
+		return fmt.Errorf("mail from: %w", err)
+	}
+	for _, to := range m.To {
+		if err = c.Rcpt(to); err != nil {
+			return fmt.Errorf("rcpt to: %w", err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	if _, err = io.WriteString(w, signature); err != nil {
+		return fmt.Errorf("write mime: %w", err)
+	}
+	if err = m.Encode(w); err != nil {
+		return fmt.Errorf("write mime: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("data close: %w", err)
+	}
+
+	return nil
+}
+
+// signEmail возвращает заголовок DKIM-Signature для письма.
+func (s *Server) signEmail(m *mailmsg.Message) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.Encode(pw))
+	}()
+	signature, err := s.dkim.Sign(pr)
+	// Sign мог остановиться на ошибке, не дочитав письмо
+	pr.CloseWithError(err)
+	return signature, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"time"
+
+	"download_track/internal/health"
+)
+
+// readiness собирает проверки для /readyz: база, SMTP, место во временном
+// каталоге и загрузка воркеров. Пороги берутся из текущих настроек.
+func (s *Server) readiness() *health.Checker {
+	c := &health.Checker{}
+	c.Add("db", 0, health.DB(s.db))
+	c.Add("smtp", 5*time.Second, s.checkSMTP)
+	c.Add("tmp_space", 0, func(ctx context.Context) error {
+		return health.DiskFree(os.TempDir(), s.conf.Get().Jobs.ReadyMinFree())(ctx)
+	})
+	c.Add("workers", 0, func(ctx context.Context) error {
+		return s.queue.checkSaturation(ctx, s.conf.Get().Jobs.ReadyMaxQueued)
+	})
+	return c
+}
+
+// checkSMTP подключается к SMTP-серверу и дожидается приветствия, ничего
+// не отправляя.
+func (s *Server) checkSMTP(ctx context.Context) error {
+	if s.smtpHost == "" || s.smtpPort == "" || s.fromAddr == "" {
+		return errors.New("smtp config incomplete")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.smtpHost+":"+s.smtpPort)
+	if err != nil {
+		return fmt.Errorf("dial smtp: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, s.smtpHost)
+	if err != nil {
+		return fmt.Errorf("smtp greeting: %w", err)
+	}
+	return c.Quit()
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"download_track/internal/deliver"
+	"download_track/internal/fetch"
+	"download_track/internal/logging"
+	"download_track/internal/mailmsg"
+	"download_track/internal/store"
+)
+
+// logName — имя для лога; у аккаунтов без Telegram его нет.
+func logName(u *store.User) string {
+	if u.TelegramUsername == "" {
+		return "-"
+	}
+	return u.TelegramUsername
+}
+
+// jobOptions — параметры, с которыми пользователь создаёт задание.
+type jobOptions struct {
+	URL       string
+	Recipient string
+	Filename  string
+	Subject   string
+	// профиль доставки получателя
+	Profile string
+	// режим сохранения HTML-страницы
+	PageMode string
+	// место доставки вместо письма, например store.DestS3
+	Destination string
+	// учётные данные для скачивания; в журнал не пишутся
+	Auth *store.JobAuth
+}
+
+// jobError — ошибка выполнения задания с ответом для старого /send.
+type jobError struct {
+	httpStatus int
+	public     string
+	err        error
+}
+
+func (e *jobError) Error() string { return e.public + ": " + e.err.Error() }
+func (e *jobError) Unwrap() error { return e.err }
+
+// createJob сохраняет задание; status — queued для очереди или downloading,
+// если задание сразу выполняется вызывающим.
+func (s *Server) createJob(ctx context.Context, acc *store.User, opts jobOptions, status string) (*store.Job, error) {
+	// файл, который уходит не на почту, получателя не имеет
+	recipient := opts.Recipient
+	if recipient == "" && opts.Destination == "" {
+		recipient = acc.Email
+	}
+
+	j, err := s.store.CreateJob(ctx, store.NewJob{
+		UserID:        acc.ID,
+		CorrelationID: logging.CorrelationID(ctx),
+		URL:           opts.URL,
+		Recipient:     recipient,
+		Filename:      opts.Filename,
+		Subject:       opts.Subject,
+		Profile:       opts.Profile,
+		PageMode:      opts.PageMode,
+		Destination:   opts.Destination,
+		Auth:          opts.Auth,
+		Status:        status,
+	})
+	if err != nil {
+		return nil, err
+	}
+	jobTransitions.WithLabelValues(status).Inc()
+	s.logJob(j, "job received", "create", "username", logName(acc), "url", j.URL, "recipient", j.Recipient,
+		"destination", j.Destination, "status", status, "auth", j.Auth != nil)
+	return j, nil
+}
+
+// cancelJob отменяет задание, если оно ещё не завершено. Запущенное
+// задание прерывается через контекст воркера.
+func (s *Server) cancelJob(ctx context.Context, userID int, id int64) (*store.Job, error) {
+	j, canceled, err := s.store.CancelJob(ctx, userID, id)
+	if err != nil || !canceled {
+		return j, err
+	}
+
+	jobTransitions.WithLabelValues(store.StatusCanceled).Inc()
+	s.queue.interrupt(j.ID)
+	s.logJob(j, "job canceled", "cancel")
+	return j, nil
+}
+
+// setJobStatus меняет статус, не трогая уже отменённые задания.
+func (s *Server) setJobStatus(j *store.Job, status, errText string, size int64) {
+	ok, err := s.store.SetJobStatus(context.Background(), j.ID, status, errText, size)
+	if err != nil {
+		log.Println("update job status err:", err)
+	} else if ok {
+		jobTransitions.WithLabelValues(status).Inc()
+	}
+	j.Status, j.Error, j.Size = status, errText, size
+}
+
+// failUnreportedJobs завершает ошибкой задания, о загрузке которых бот
+// не сообщил за telegramReportTimeout.
+func (s *Server) failUnreportedJobs(ctx context.Context) {
+	jobs, err := s.store.FailUnreportedJobs(ctx, time.Now().Add(-telegramReportTimeout), "telegram: no upload report from the bot")
+	if err != nil {
+		log.Println("fail unreported jobs err:", err)
+		return
+	}
+	for _, j := range jobs {
+		jobTransitions.WithLabelValues(store.StatusFailed).Inc()
+		jobErrors.WithLabelValues("delivery_error", "telegram").Inc()
+		s.logJobError(j, "delivery_error", "telegram", errors.New("no upload report within "+telegramReportTimeout.String()))
+	}
+}
+
+// requeueJob возвращает прерванное задание в очередь, чтобы его
+// выполнил следующий запущенный воркер.
+func (s *Server) requeueJob(j *store.Job) {
+	if _, err := s.store.RequeueJob(context.Background(), j.ID); err != nil {
+		log.Println("requeue job err:", err)
+		return
+	}
+	j.Status = store.StatusQueued
+	jobTransitions.WithLabelValues(store.StatusQueued).Inc()
+	s.logJob(j, "job requeued", "queue")
+}
+
+// runJob скачивает файл и отправляет его письмом. Статус задания
+// обновляется по ходу выполнения. Если ctx отменён, статус не меняется:
+// что делать с прерванным заданием, решает вызывающий. tg — ответ боту
+// для заданий с доставкой в Telegram; без него такие задания уходят
+// письмом.
+func (s *Server) runJob(ctx context.Context, j *store.Job, acc *store.User, tg *telegramHandoff) error {
+	start := time.Now()
+
+	// отменённое пользователем задание setJobStatus не перезапишет
+	fail := func(errStatus string, httpStatus int, public, stage string, err error) error {
+		s.logJobError(j, errStatus, stage, err, "bytes", j.Size, "duration", time.Since(start))
+		if ctx.Err() == nil {
+			jobErrors.WithLabelValues(errStatus, stage).Inc()
+			s.setJobStatus(j, store.StatusFailed, stage+": "+err.Error(), j.Size)
+		}
+		return &jobError{httpStatus: httpStatus, public: public, err: err}
+	}
+
+	// ключ проверяется до скачивания: письмо, которое нельзя отправить
+	// открытым, незачем и скачивать
+	var encrypter mailmsg.Encrypter
+	if j.Destination == "" {
+		var err error
+		encrypter, err = s.emailEncrypter(ctx, j, acc)
+		if errors.Is(err, errEncryptionRequired) {
+			return fail("encryption_required", http.StatusUnprocessableEntity, "encryption required", "encrypt", err)
+		}
+		if err != nil {
+			return fail("send_error", http.StatusInternalServerError, "internal error", "encrypt", err)
+		}
+	}
+
+	// Логируем старт скачивания без предварительной проверки размера
+	s.logJob(j, "download started", "download", "username", logName(acc), "url", j.URL)
+
+	dlStart := time.Now()
+	res, err := s.fetchers(acc, j).Fetch(ctx, j.URL)
+	var statusErr *fetch.StatusError
+	switch {
+	case errors.Is(err, fetch.ErrUnsupportedScheme):
+		return fail("download_error", http.StatusBadRequest, "bad file_url", "request", err)
+	case errors.Is(err, fetch.ErrLoginRequired):
+		downloadDuration.Observe(time.Since(dlStart).Seconds())
+		return fail("download_login_required", http.StatusUnprocessableEntity, err.Error(), "get", err)
+	case errors.As(err, &statusErr) && (statusErr.Code == http.StatusUnauthorized || statusErr.Code == http.StatusForbidden):
+		// сайт не принял учётные данные или их нет
+		downloadDuration.Observe(time.Since(dlStart).Seconds())
+		return fail("download_login_required", http.StatusUnprocessableEntity, "site requires login: "+statusErr.Error(), "get", err)
+	case errors.As(err, &statusErr):
+		downloadDuration.Observe(time.Since(dlStart).Seconds())
+		return fail("download_bad_status", http.StatusBadGateway, "download bad status", "get", err)
+	case err != nil:
+		downloadDuration.Observe(time.Since(dlStart).Seconds())
+		log.Println("get request err:", err)
+		return fail("download_error", http.StatusBadGateway, "download failed", "get", err)
+	}
+	defer res.Body.Close()
+
+	// лимит читается при каждом задании, чтобы SIGHUP менял его сразу
+	maxSize := s.conf.Get().Jobs.MaxFileSize()
+	if res.Size > maxSize {
+		return fail("download_too_large", http.StatusRequestEntityTooLarge, "file too large", "get",
+			fmt.Errorf("content length %d exceeds limit %d", res.Size, maxSize))
+	}
+
+	// Файл кладём во временный каталог под его настоящим именем,
+	// чтобы вложение в письме называлось так же
+	tmpDir, err := os.MkdirTemp("", "job-*")
+	if err != nil {
+		log.Println("temp dir create err:", err)
+		return fail("download_error", http.StatusInternalServerError, "internal error", "tempfile", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	name := attachmentName(j, res.Filename)
+	tmpPath := filepath.Join(tmpDir, name)
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		log.Println("temp file create err:", err)
+		return fail("download_error", http.StatusInternalServerError, "internal error", "tempfile", err)
+	}
+	defer tmpFile.Close()
+
+	// контрольная сумма считается по ходу скачивания и попадает в письмо
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hash), io.LimitReader(res.Body, maxSize+1))
+	j.Size = written
+	downloadDuration.Observe(time.Since(dlStart).Seconds())
+	if err != nil {
+		log.Println("io.Copy err:", err)
+		return fail("download_error", http.StatusBadGateway, "download failed", "copy", err)
+	}
+	if written > maxSize {
+		return fail("download_too_large", http.StatusRequestEntityTooLarge, "file too large", "copy",
+			fmt.Errorf("file exceeds limit %d", maxSize))
+	}
+
+	s.logJob(j, "downloaded", "download", "bytes", written, "duration", time.Since(dlStart), "path", tmpPath)
+	downloadBytes.Observe(float64(written))
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	// HTML-страница сохраняется вместе с картинками и стилями, иначе
+	// во вложении останется разметка со ссылками на сайт
+	if shouldCapture(j, tmpPath, res.ContentType) {
+		captureStart := time.Now()
+		page, err := capturePage(ctx, j, tmpPath, res.ContentType, res.URL, maxSize)
+		if errors.Is(err, errPageTooLarge) {
+			return fail("download_too_large", http.StatusRequestEntityTooLarge, "file too large", "capture", err)
+		}
+		if err != nil {
+			return fail("capture_error", http.StatusInternalServerError, "internal error", "capture", err)
+		}
+		s.logJob(j, "captured", "capture", "resources", page.res.Resources, "failed", page.res.Failed,
+			"resource_bytes", page.res.Bytes, "bytes", page.size, "duration", time.Since(captureStart), "path", page.path)
+		tmpPath, name, checksum, written = page.path, page.name, page.checksum, page.size
+		j.Size = written
+	}
+
+	// для Kindle файл проверяется, а HTML-страница становится EPUB
+	var subject string
+	if j.Profile == store.ProfileKindle {
+		kf, err := prepareKindle(j, tmpPath, name, res.ContentType, checksum)
+		if errors.Is(err, errUnsupportedFormat) {
+			return fail("unsupported_format", http.StatusUnprocessableEntity, err.Error(), "convert", err)
+		}
+		if err != nil {
+			return fail("convert_error", http.StatusInternalServerError, "internal error", "convert", err)
+		}
+		if kf.path != tmpPath {
+			s.logJob(j, "converted", "convert", "format", kf.format, "path", kf.path)
+		}
+		tmpPath, name, checksum = kf.path, kf.name, kf.checksum
+		subject = kindleSubject(kf.format)
+	}
+	s.setJobStatus(j, store.StatusSending, "", written)
+
+	var d deliver.Deliverer
+	switch {
+	case j.Destination == store.DestTelegram && tg != nil && written <= tg.maxSize:
+		d = tg
+	case j.Destination == "" || j.Destination == store.DestTelegram:
+		if j.Destination != "" {
+			// в Telegram файл не влезает: вместо него письмо
+			s.logJob(j, "telegram fallback", "send", "bytes", written, "recipient", j.Recipient)
+			encrypter, err = s.emailEncrypter(ctx, j, acc)
+			if errors.Is(err, errEncryptionRequired) {
+				return fail("encryption_required", http.StatusUnprocessableEntity, "encryption required", "encrypt", err)
+			}
+			if err != nil {
+				return fail("send_error", http.StatusInternalServerError, "internal error", "encrypt", err)
+			}
+		}
+		// Тема и текст — по шаблонам на языке пользователя, файл уходит
+		// вложением прямо из временного каталога
+		msg, err := s.composeEmail(j, acc, name, tmpPath, checksum)
+		if err != nil {
+			return fail("send_error", http.StatusInternalServerError, "internal error", "template", err)
+		}
+		if subject != "" {
+			// Kindle читает тему как команду, префикс ей помешает
+			msg.Subject = subject
+		}
+		// зашифрованное тело кладётся рядом с файлом
+		msg.Encrypter, msg.TempDir = encrypter, tmpDir
+		defer msg.Close()
+		d = &emailDeliverer{s: s, msg: msg}
+	default:
+		d, err = s.deliverer(ctx, j)
+		if errors.Is(err, errBadDestination) {
+			return fail("delivery_error", http.StatusUnprocessableEntity, "bad destination", "deliver", err)
+		}
+		if err != nil {
+			return fail("delivery_error", http.StatusInternalServerError, "internal error", "deliver", err)
+		}
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = res.ContentType
+	}
+	deliverStart := time.Now()
+	location, err := d.Deliver(ctx, deliver.File{Name: name, Path: tmpPath, Size: written, Checksum: checksum, ContentType: contentType})
+	if err != nil {
+		log.Println("deliver err:", err)
+		if _, ok := d.(*emailDeliverer); ok {
+			return fail("send_error", http.StatusBadGateway, "email send failed", "smtp", err)
+		}
+		return fail("delivery_error", http.StatusBadGateway, "delivery failed", "deliver", err)
+	}
+	if d == tg {
+		// файл у бота; sent и место в чате запишет его отчёт о загрузке.
+		// telegramReportTimeout отсчитывается с конца передачи
+		if _, err := s.store.SetJobStatus(context.Background(), j.ID, store.StatusSending, "", written); err != nil {
+			log.Println("update job status err:", err)
+		}
+		s.logJob(j, "handed over", "send", "bytes", written, "duration", time.Since(deliverStart))
+		return nil
+	}
+
+	if err := s.store.SetJobDeliveredTo(context.Background(), j.ID, location); err != nil {
+		log.Println("update job delivered_to err:", err)
+	}
+	j.DeliveredTo = location
+	s.setJobStatus(j, store.StatusSent, "", written)
+	s.logJob(j, "sent", "send", "recipient", j.Recipient, "delivered_to", location, "bytes", written, "duration", time.Since(deliverStart))
+
+	return nil
+}
+
+// logJob пишет событие задания в журнал. У каждого события есть
+// job_id, user_id, correlation_id и stage.
+func (s *Server) logJob(j *store.Job, event, stage string, attrs ...any) {
+	s.jobLog.Info(event, append(jobAttrs(j, stage), attrs...)...)
+}
+
+func (s *Server) logJobError(j *store.Job, event, stage string, err error, attrs ...any) {
+	attrs = append(attrs, "error", err.Error())
+	s.jobLog.Error(event, append(jobAttrs(j, stage), attrs...)...)
+}
+
+func jobAttrs(j *store.Job, stage string) []any {
+	return []any{"job_id", j.ID, "user_id", j.UserID, "correlation_id", j.CorrelationID, "stage", stage}
+}
+
+// attachmentName — имя вложения: заданное пользователем, сообщённое
+// загрузчиком (fetched) или последний сегмент пути URL.
+func attachmentName(j *store.Job, fetched string) string {
+	name := j.Filename
+	if name == "" {
+		name = fetched
+	}
+	if name == "" {
+		if u, err := url.Parse(j.URL); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	name = sanitizeFilename(name)
+	if name == "" {
+		name = "downloaded-file"
+	}
+	return name
+}
+
+// sanitizeFilename оставляет от имени только последний сегмент без
+// разделителей каталогов и управляющих символов.
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
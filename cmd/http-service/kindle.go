@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"download_track/internal/ebook"
+	"download_track/internal/store"
+)
+
+const (
+	// Send to Kindle не принимает письма больше 50 МБ
+	kindleMaxSize = 50 << 20
+	// тема, по которой Send to Kindle переводит PDF в свой формат
+	kindleConvertSubject = "convert"
+)
+
+// kindleFormats — форматы, которые принимает Send to Kindle.
+var kindleFormats = []string{ebook.EPUB, ebook.PDF, ebook.DOCX, ebook.TXT}
+
+var errUnsupportedFormat = errors.New("unsupported format")
+
+// validProfile — профиль доставки, который можно выбрать для адреса.
+func validProfile(profile string) bool {
+	return profile == "" || profile == store.ProfileKindle
+}
+
+// guessProfile — профиль для нового адреса, если его не указали явно.
+func guessProfile(email string) string {
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	if domain == "kindle.com" || domain == "free.kindle.com" {
+		return store.ProfileKindle
+	}
+	return ""
+}
+
+// kindleFile — файл, подготовленный для Send to Kindle.
+type kindleFile struct {
+	path, name string
+	format     string
+	// пересчитывается, если файл сконвертирован
+	checksum string
+}
+
+// prepareKindle проверяет, что Kindle примет файл, и собирает EPUB из
+// HTML-страницы. Расширение имени приводится к формату: Kindle
+// определяет формат по нему. Ошибки формата оборачивают
+// errUnsupportedFormat.
+func prepareKindle(j *store.Job, path, name, contentType, checksum string) (*kindleFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, ebook.SniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	kf := &kindleFile{path: path, format: ebook.Detect(name, contentType, head[:n]), checksum: checksum}
+	switch kf.format {
+	case ebook.EPUB, ebook.PDF, ebook.DOCX, ebook.TXT:
+	case ebook.HTML:
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		kf.format = ebook.EPUB
+		kf.path = strings.TrimSuffix(path, filepath.Ext(path)) + ".epub"
+		if kf.path == path {
+			kf.path += ".epub"
+		}
+		if kf.checksum, err = writeEPUB(kf.path, f, j.URL, strings.TrimSuffix(name, filepath.Ext(name))); err != nil {
+			return nil, fmt.Errorf("convert html to epub: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: kindle accepts %s", errUnsupportedFormat, strings.ToUpper(strings.Join(kindleFormats, ", ")))
+	}
+
+	st, err := os.Stat(kf.path)
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() > kindleMaxSize {
+		return nil, fmt.Errorf("%w: kindle accepts files up to %d MB", errUnsupportedFormat, kindleMaxSize>>20)
+	}
+
+	kf.name = name
+	if !strings.EqualFold(filepath.Ext(name), "."+kf.format) {
+		kf.name = strings.TrimSuffix(name, filepath.Ext(name)) + "." + kf.format
+	}
+	return kf, nil
+}
+
+// writeEPUB собирает EPUB из страницы и возвращает его SHA-256.
+func writeEPUB(path string, page io.Reader, source, title string) (string, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if err := ebook.FromHTML(io.MultiWriter(out, hash), page, ebook.Meta{Title: title, Source: source}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), out.Close()
+}
+
+// kindleSubject — тема письма для Kindle; пустая — обычная тема.
+func kindleSubject(format string) string {
+	if format == ebook.PDF {
+		return kindleConvertSubject
+	}
+	return ""
+}
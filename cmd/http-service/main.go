@@ -1,294 +1,353 @@
-﻿package main
-
-import (
-	"database/sql"
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net"
-	"net/http"
-	"net/smtp"
-	"net/mail"
-	"os"
-	"time"
-	"crypto/tls"
-	"path"
-	"github.com/scorredoira/email"
-	_ "github.com/lib/pq"
-)
-
-type Server struct {
-	db     *sql.DB
-	jobLog *log.Logger
-
-	smtpHost string
-	smtpPort string
-	smtpUser string
-	smtpPass string
-	fromAddr string
-}
-
-type sendRequest struct {
-	APIKey  string `json:"api_key"`
-	FileURL string `json:"file_url"`
-}
-
-const maxFileSize = 500 * 1024 * 1024 // 500 MB
-
-func main() {
-	dsn := os.Getenv("DB_DSN")
-	if dsn == "" {
-		log.Println("warning: DB_DSN is empty")
-	}
-
-	db, err := sql.Open("postgres", dsn)
-	if err != nil {
-		log.Fatal("db open:", err)
-	}
-	if err := db.Ping(); err != nil {
-		log.Println("warning: db ping error:", err)
-	}
-
-	// Лог-файл для истории отправок
-	f, err := os.OpenFile("/logs/send.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal("open send.log:", err)
-	}
-	defer f.Close()
-
-	jobLogger := log.New(f, "", log.LstdFlags)
-
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort := os.Getenv("SMTP_PORT")
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASS")
-	fromAddr := os.Getenv("SMTP_FROM")
-
-	if smtpHost == "" || smtpPort == "" || fromAddr == "" {
-	    log.Println("warning: SMTP settings are incomplete, email sending will likely fail")
-	}
-
-	srv := &Server{
-		db:       db,
-		jobLog:   jobLogger,
-		smtpHost: smtpHost,
-		smtpPort: smtpPort,
-		smtpUser: smtpUser,
-		smtpPass: smtpPass,
-		fromAddr: fromAddr,
-	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", srv.handleHealth)
-	mux.HandleFunc("/send", srv.handleSend)
-
-	addr := ":8080"
-	log.Println("http-service listening on", addr)
-	s := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 0,
-		IdleTimeout:  60 * time.Second,
-	}
-
-	log.Fatal(s.ListenAndServe())
-}
-
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
-}
-
-func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req sendRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	if req.APIKey == "" || req.FileURL == "" {
-		http.Error(w, "api_key and file_url are required", http.StatusBadRequest)
-		return
-	}
-
-	var userID int
-	var username string
-
-	err := s.db.QueryRow(
-		`SELECT users.id, telegram_users.username
-         FROM users
-         JOIN telegram_users ON telegram_users.user_id = users.id
-         WHERE users.api_key = $1`,
-		req.APIKey,
-	).Scan(&userID, &username)
-	if err == sql.ErrNoRows {
-		http.Error(w, "invalid api_key", http.StatusUnauthorized)
-		return
-	}
-	if err != nil {
-		log.Println("db query user err:", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-
-	s.jobLog.Printf("user_id=%d username=%s url=%s status=received\n", userID, username, req.FileURL)
-
-	// Логируем старт скачивания без предварительной проверки размера
-    s.jobLog.Printf("user_id=%d username=%s url=%s status=downloading\n", userID, username, req.FileURL)
-
-
-	getClient := &http.Client{
-		Timeout: 0,
-	}
-
-	getResp, err := getClient.Get(req.FileURL)
-	if err != nil {
-		log.Println("get request err:", err)
-		s.jobLog.Printf("user_id=%d username=%s url=%s status=download_error stage=get error=%q\n", userID, username, req.FileURL, err.Error())
-		http.Error(w, "download failed", http.StatusBadGateway)
-		return
-	}
-	defer getResp.Body.Close()
-
-	if getResp.StatusCode != http.StatusOK {
-		s.jobLog.Printf("user_id=%d username=%s url=%s status=download_bad_status http_status=%d\n", userID, username, req.FileURL, getResp.StatusCode)
-		http.Error(w, "download bad status", http.StatusBadGateway)
-		return
-	}
-
-	// Имя файла из URL (последний сегмент пути)
-    urlFileName := path.Base(req.FileURL)
-    if urlFileName == "." || urlFileName == "/" || urlFileName == "" {
-        urlFileName = "downloaded-file"
-    }
-
-    // Временный файл с этим именем как суффиксом
-    tmpFile, err := os.CreateTemp("", "download-*-" + urlFileName)
-    if err != nil {
-        log.Println("temp file create err:", err)
-        s.jobLog.Printf("user_id=%d username=%s url=%s status=download_error stage=tempfile error=%q\n", userID, username, req.FileURL, err.Error())
-        http.Error(w, "internal error", http.StatusInternalServerError)
-        return
-    }
-	defer func() {
-		tmpFile.Close()
-		os.Remove(tmpFile.Name())
-	}()
-
-	written, err := io.Copy(tmpFile, getResp.Body)
-	if err != nil {
-		log.Println("io.Copy err:", err)
-		s.jobLog.Printf("user_id=%d username=%s url=%s status=download_error stage=copy written=%d error=%q\n", userID, username, req.FileURL, written, err.Error())
-		http.Error(w, "download failed", http.StatusBadGateway)
-		return
-	}
-
-	s.jobLog.Printf(
-		"user_id=%d username=%s url=%s status=downloaded size=%d path=%s\n",
-		userID, username, req.FileURL, written, tmpFile.Name(),
-	)
-	    // Получаем email пользователя
-    var emailAddr string
-    err = s.db.QueryRow("SELECT email FROM users WHERE id=$1", userID).Scan(&emailAddr)
-    if err != nil {
-        log.Println("db query email err:", err)
-        s.jobLog.Printf("user_id=%d username=%s url=%s status=send_error stage=get_email error=%q\n",
-            userID, username, req.FileURL, err.Error())
-        http.Error(w, "internal error", http.StatusInternalServerError)
-        return
-    }
-
-    // Тема с датой/временем
-    now := time.Now()
-    subject := fmt.Sprintf("Скачанный файл на %s", now.Format("2006-01-02 15:04:05"))
-
-    // Текст письма остаётся информативным
-    body := fmt.Sprintf("Файл по ссылке %s был успешно скачан. Размер: %d байт.\n", req.FileURL, written)
-
-	// Передаём путь к временно скачанному файлу как вложение
-	if err := s.sendEmail(emailAddr, subject, body, tmpFile.Name()); err != nil {
-		log.Println("sendEmail err:", err)
-		s.jobLog.Printf("user_id=%d username=%s email=%s url=%s status=send_error stage=smtp error=%q\n",
-			userID, username, emailAddr, req.FileURL, err.Error())
-		http.Error(w, "email send failed", http.StatusBadGateway)
-		return
-	}
-
-    s.jobLog.Printf("user_id=%d username=%s email=%s url=%s status=sent size=%d\n",
-        userID, username, emailAddr, req.FileURL, written)
-
-    w.WriteHeader(http.StatusOK)
-    w.Write([]byte("ok"))
-
-}
-
-func (s *Server) sendEmail(to, subject, body, attachmentPath string) error {
-    if s.smtpHost == "" || s.smtpPort == "" || s.fromAddr == "" {
-        return fmt.Errorf("smtp config incomplete")
-    }
-
-    m := email.NewMessage(subject, body)
-    m.From = mail.Address{
-        Name:    "filemailer",
-        Address: s.fromAddr,
-    }
-    m.To = []string{to}
-
-    if attachmentPath != "" {
-        if err := m.Attach(attachmentPath); err != nil {
-            return fmt.Errorf("attach file: %w", err)
-        }
-    }
-
-    addr := s.smtpHost + ":" + s.smtpPort
-
-    conn, err := net.Dial("tcp", addr)
-    if err != nil {
-        return fmt.Errorf("dial smtp: %w", err)
-    }
-    defer conn.Close()
-
-    c, err := smtp.NewClient(conn, s.smtpHost)
-    if err != nil {
-        return fmt.Errorf("smtp new client: %w", err)
-    }
-    defer c.Quit()
-
-    if ok, _ := c.Extension("STARTTLS"); ok {
-        tlsconfig := &tls.Config{
-            ServerName: s.smtpHost,
-        }
-        if err = c.StartTLS(tlsconfig); err != nil {
-            return fmt.Errorf("starttls: %w", err)
-        }
-    }
-
-    if err = c.Mail(s.fromAddr); err != nil {
-        return fmt.Errorf("mail from: %w", err)
-    }
-    if err = c.Rcpt(to); err != nil {
-        return fmt.Errorf("rcpt to: %w", err)
-    }
-
-    w, err := c.Data()
-    if err != nil {
-        return fmt.Errorf("data: %w", err)
-    }
-
-    if _, err = w.Write(m.Bytes()); err != nil {
-        return fmt.Errorf("write mime: %w", err)
-    }
-    if err = w.Close(); err != nil {
-        return fmt.Errorf("data close: %w", err)
-    }
-
-    return nil
-}
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"download_track/internal/config"
+	"download_track/internal/dkim"
+	"download_track/internal/health"
+	"download_track/internal/logging"
+	"download_track/internal/mailtmpl"
+	"download_track/internal/migrations"
+	"download_track/internal/store"
+	"download_track/internal/store/postgres"
+
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Server struct {
+	// db — для миграций и проверки готовности; данные — через store
+	db     *sql.DB
+	store  store.Store
+	jobLog *slog.Logger
+	queue  *jobQueue
+	// настройки; лимиты меняются по SIGHUP
+	conf *config.Store
+	// шаблоны писем; подменяются по SIGHUP
+	templates atomic.Pointer[mailtmpl.Set]
+	// подпись DKIM; nil — письма уходят без подписи
+	dkim *dkim.Signer
+
+	// токен для администраторских эндпоинтов API; пустой — выключены
+	adminToken string
+
+	smtpHost string
+	smtpPort string
+	smtpUser string
+	smtpPass string
+	fromAddr string
+}
+
+type sendRequest struct {
+	APIKey  string `json:"api_key"`
+	FileURL string `json:"file_url"`
+	// метки или адреса получателей; пусто — адрес по умолчанию
+	Recipients []string `json:"recipients,omitempty"`
+	// full, readable или raw; пусто — full
+	PageMode string `json:"page_mode,omitempty"`
+	// telegram — вернуть файл в ответе, бот загрузит его в чат; больше
+	// max_size он уходит письмом на email аккаунта
+	Destination string `json:"destination,omitempty"`
+	MaxSize     int64  `json:"max_size,omitempty"`
+	// basic auth, заголовки и cookie для ссылки
+	Auth *store.JobAuth `json:"auth,omitempty"`
+}
+
+func main() {
+	// подкоманды для администрирования: http-service create-account ...
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	// настройки: CONFIG_FILE (YAML или TOML) и переменные окружения
+	cfg, err := config.LoadFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		log.Fatalf("invalid config:\n%v", err)
+	}
+	log.Printf("effective config:\n%s", cfg.Redacted("db", "http", "smtp", "email", "jobs", "delivery", "log", "shutdown_timeout"))
+	conf := config.NewStore(cfg, os.Getenv("CONFIG_FILE"), validateConfig)
+
+	secrets, err := cfg.DB.SecretBox()
+	if err != nil {
+		log.Fatal("db.secrets_key: ", err)
+	}
+	db, err := sql.Open("postgres", cfg.DB.DSN)
+	if err != nil {
+		log.Fatal("db open:", err)
+	}
+	st := postgres.New(db, secrets)
+	if err := db.Ping(); err != nil {
+		log.Println("warning: db ping error:", err)
+	} else if err := migrations.OnStartup(context.Background(), db, cfg.DB.Migrate, log.Printf); err != nil {
+		log.Fatal("migrations: ", err)
+	} else if secrets != nil {
+		// секреты, записанные до появления ключа
+		n, err := st.SealSecrets(context.Background())
+		if err != nil {
+			log.Fatal("seal secrets: ", err)
+		}
+		if n > 0 {
+			log.Printf("encrypted %d stored secrets", n)
+		}
+	}
+
+	// журнал заданий: stdout, файл с ротацией или оба
+	jobLogger, logCloser := logging.New(logging.FromConfig(cfg.Log, "/logs/jobs.log"))
+	defer logCloser.Close()
+
+	srv := &Server{
+		db:       db,
+		store:    st,
+		jobLog:   jobLogger,
+		conf:     conf,
+		smtpHost: cfg.SMTP.Host,
+		smtpPort: cfg.SMTP.Port,
+		smtpUser: cfg.SMTP.User,
+		smtpPass: cfg.SMTP.Pass,
+		fromAddr: cfg.SMTP.From,
+
+		adminToken: cfg.HTTP.AdminToken,
+	}
+	srv.reloadTemplates(cfg)
+	conf.OnReload(srv.reloadTemplates)
+	if d := cfg.Email.DKIM; d.Enabled() {
+		if srv.dkim, err = dkim.LoadSigner(d.Domain, d.Selector, d.KeyFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("dkim signing enabled, public key %s TXT %q", srv.dkim.RecordName(), srv.dkim.Record())
+	}
+	srv.queue = newJobQueue(srv, cfg.Jobs.Workers)
+	srv.queue.start()
+
+	workersTotal.Set(float64(cfg.Jobs.Workers))
+	prometheus.MustRegister(newJobsCollector(srv))
+
+	mux := http.NewServeMux()
+	// /health оставлен для старых проверок, это тот же liveness
+	mux.Handle("/health", health.LiveHandler())
+	mux.Handle("/healthz", health.LiveHandler())
+	mux.Handle("/readyz", srv.readiness().ReadyHandler())
+	mux.HandleFunc("/send", srv.handleSend)
+	srv.registerAPI(mux)
+
+	log.Println("http-service listening on", cfg.HTTP.Listen)
+	s := &http.Server{
+		Addr:         cfg.HTTP.Listen,
+		Handler:      withCorrelationID(mux),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 0,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP перечитывает лимиты и шаблоны писем без перезапуска
+	conf.ReloadOnSIGHUP(ctx)
+
+	metrics := newMetricsServer(cfg.HTTP.MetricsAddr)
+	log.Println("metrics listening on", cfg.HTTP.MetricsAddr)
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.ListenAndServe() }()
+	go func() { errc <- metrics.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+	shutdownTimeout := conf.Get().ShutdownTimeout
+	log.Println("shutting down, drain timeout", shutdownTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// HTTP-запросы (в том числе синхронные /send) и задания из очереди
+	// дорабатывают параллельно в пределах одного таймаута
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := s.Shutdown(drainCtx); err != nil {
+			log.Println("http shutdown:", err)
+			s.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := srv.queue.shutdown(drainCtx); err != nil {
+			log.Println("queue shutdown:", err)
+		}
+	}()
+	wg.Wait()
+
+	if err := metrics.Shutdown(drainCtx); err != nil {
+		log.Println("metrics shutdown:", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Println("db close:", err)
+	}
+	log.Println("http-service stopped")
+}
+
+// withCorrelationID берёт идентификатор запроса из X-Correlation-ID
+// (его присылает бот) или создаёт новый и возвращает его в ответе.
+func withCorrelationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(logging.CorrelationHeader)
+		if !logging.ValidCorrelationID(id) {
+			id = logging.NewCorrelationID()
+		}
+		w.Header().Set(logging.CorrelationHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithCorrelationID(r.Context(), id)))
+	})
+}
+
+// handleSend — старый синхронный эндпоинт, которым пользуется бот:
+// задание создаётся и выполняется прямо в рамках запроса.
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.APIKey == "" || req.FileURL == "" {
+		http.Error(w, "api_key and file_url are required", http.StatusBadRequest)
+		return
+	}
+
+	pageMode, ok := parsePageMode(req.PageMode)
+	if !ok {
+		http.Error(w, "page_mode must be full, readable or raw", http.StatusBadRequest)
+		return
+	}
+	// ошибку в ссылке и учётных данных бот показывает пользователю как
+	// есть; пароль в ссылке попал бы в задание и журнал
+	if err := checkFileURL(req.FileURL); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	auth, err := cleanJobAuth(req.Auth, req.FileURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	acc, err := s.store.UserByAPIKey(r.Context(), req.APIKey)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "invalid api_key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("db query user err:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var tg *telegramHandoff
+	switch req.Destination {
+	case "":
+	case store.DestTelegram:
+		if len(req.Recipients) > 0 {
+			http.Error(w, "recipients cannot be used with destination telegram", http.StatusBadRequest)
+			return
+		}
+		tg = &telegramHandoff{w: w, maxSize: req.MaxSize}
+		if tg.maxSize <= 0 {
+			tg.maxSize = defaultTelegramMaxSize
+		}
+	default:
+		http.Error(w, "destination must be telegram", http.StatusBadRequest)
+		return
+	}
+
+	var recipients []recipient
+	if tg != nil {
+		recipients = []recipient{{Email: acc.Email, Destination: store.DestTelegram}}
+	} else {
+		recipients, err = s.resolveRecipients(r.Context(), acc, req.Recipients)
+	}
+	if errors.Is(err, errBadRecipient) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Println("resolve recipients err:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// получатели обрабатываются по очереди; ответ — первая ошибка, но
+	// остальным письма всё равно уходят
+	var failed *jobError
+	for _, rcpt := range recipients {
+		j, err := s.createJob(r.Context(), acc, jobOptions{URL: req.FileURL, Recipient: rcpt.Email, Profile: rcpt.Profile,
+			Destination: rcpt.Destination, PageMode: pageMode, Auth: auth}, store.StatusDownloading)
+		if errors.Is(err, store.ErrNoSecretKey) {
+			http.Error(w, "auth cannot be used: the server has no secrets key", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			log.Println("create job err:", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		if tg != nil {
+			tg.jobID = j.ID
+		}
+		if err := s.runJob(r.Context(), j, acc, tg); err != nil {
+			var je *jobError
+			if !errors.As(err, &je) {
+				je = &jobError{public: "internal error", httpStatus: http.StatusInternalServerError, err: err}
+			}
+			if len(recipients) > 1 {
+				je = &jobError{public: rcpt.Email + ": " + je.public, httpStatus: je.httpStatus, err: je.err}
+			}
+			if failed == nil {
+				failed = je
+			}
+			if r.Context().Err() != nil {
+				// клиент ушёл или сервер остановился — ждать результата некому
+				s.setJobStatus(j, store.StatusFailed, "interrupted", j.Size)
+				break
+			}
+		}
+	}
+	if tg != nil && tg.started {
+		// файл уже в ответе или ответ оборван на середине
+		return
+	}
+	if failed != nil {
+		http.Error(w, failed.public, failed.httpStatus)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
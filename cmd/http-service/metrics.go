@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"download_track/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	jobTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filemailer_job_transitions_total",
+		Help: "Job status changes by target status.",
+	}, []string{"status"})
+
+	jobErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filemailer_job_errors_total",
+		Help: "Failed jobs by status (download_error, send_error) and stage.",
+	}, []string{"status", "stage"})
+
+	downloadBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "filemailer_download_bytes",
+		Help:    "Size of downloaded files.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 11), // 1 KiB .. 1 GiB
+	})
+
+	downloadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "filemailer_download_duration_seconds",
+		Help:    "Time to download a file, including failed downloads.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14), // 100ms .. ~27m
+	})
+
+	smtpDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "filemailer_smtp_send_duration_seconds",
+		Help:    "Time to send an email over SMTP, including failed attempts.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12), // 50ms .. ~100s
+	})
+
+	smtpErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "filemailer_smtp_errors_total",
+		Help: "Failed SMTP sends.",
+	})
+
+	workersActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "filemailer_workers_active",
+		Help: "Queue workers currently running a job.",
+	})
+
+	workersTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "filemailer_workers",
+		Help: "Configured number of queue workers.",
+	})
+)
+
+// jobsCollector отдаёт число незавершённых заданий по статусам прямо из
+// таблицы jobs, поэтому учитывает и задания других экземпляров сервиса.
+type jobsCollector struct {
+	srv   *Server
+	jobs  *prometheus.Desc
+	depth *prometheus.Desc
+}
+
+func newJobsCollector(srv *Server) *jobsCollector {
+	return &jobsCollector{
+		srv: srv,
+		jobs: prometheus.NewDesc("filemailer_jobs",
+			"Unfinished jobs by status (stage).", []string{"status"}, nil),
+		depth: prometheus.NewDesc("filemailer_queue_depth",
+			"Jobs waiting in the queue.", nil, nil),
+	}
+}
+
+func (c *jobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.jobs
+	ch <- c.depth
+}
+
+func (c *jobsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counts, err := c.srv.store.CountActiveJobs(ctx)
+	if err != nil {
+		log.Println("metrics jobs query err:", err)
+		ch <- prometheus.NewInvalidMetric(c.jobs, err)
+		return
+	}
+
+	for status, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, float64(n), status)
+	}
+	ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(counts[store.StatusQueued]))
+}
+
+// newMetricsServer — листенер только с /metrics. Метрики не отдаются на
+// порту API: он смотрит наружу, а ключа для /metrics нет.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
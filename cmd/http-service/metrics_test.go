@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"download_track/internal/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sample читает текущее значение счётчика или число наблюдений
+// гистограммы.
+func sample(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+	var out dto.Metric
+	if err := m.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if h := out.GetHistogram(); h != nil {
+		return float64(h.GetSampleCount())
+	}
+	return out.GetCounter().GetValue()
+}
+
+// metricDeltas запоминает значения метрик и возвращает их прирост.
+func metricDeltas(t *testing.T, metrics map[string]prometheus.Metric) func() map[string]float64 {
+	before := map[string]float64{}
+	for name, m := range metrics {
+		before[name] = sample(t, m)
+	}
+	return func() map[string]float64 {
+		delta := map[string]float64{}
+		for name, m := range metrics {
+			if d := sample(t, m) - before[name]; d != 0 {
+				delta[name] = d
+			}
+		}
+		return delta
+	}
+}
+
+func wantDeltas(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("metric changes = %v, want %v", got, want)
+	}
+	for name, d := range want {
+		if got[name] != d {
+			t.Fatalf("metric changes = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestJobMetrics(t *testing.T) {
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	a.srv.reloadTemplates(config.Default())
+	smtp := startSMTP(t)
+	a.useSMTP(smtp)
+	send := `{"api_key":"key-alice@example.com","file_url":"data:text/plain;base64,aGVsbG8="}`
+
+	metrics := map[string]prometheus.Metric{
+		"downloading":     jobTransitions.WithLabelValues("downloading"),
+		"sending":         jobTransitions.WithLabelValues("sending"),
+		"sent":            jobTransitions.WithLabelValues("sent"),
+		"failed":          jobTransitions.WithLabelValues("failed"),
+		"send_error/smtp": jobErrors.WithLabelValues("send_error", "smtp"),
+		"download_bytes":  downloadBytes,
+		"download_time":   downloadDuration,
+		"smtp_time":       smtpDuration,
+		"smtp_errors":     smtpErrors,
+	}
+
+	deltas := metricDeltas(t, metrics)
+	if rec := a.do("POST", "/send", "", send); rec.Code != http.StatusOK {
+		t.Fatalf("/send: %d %s", rec.Code, rec.Body)
+	}
+	<-smtp.mails
+	wantDeltas(t, deltas(), map[string]float64{
+		"downloading": 1, "sending": 1, "sent": 1,
+		"download_bytes": 1, "download_time": 1, "smtp_time": 1,
+	})
+
+	// SMTP недоступен: ошибка считается и по заданиям, и по отправке
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+	a.srv.smtpHost, a.srv.smtpPort = host, port
+
+	deltas = metricDeltas(t, metrics)
+	if rec := a.do("POST", "/send", "", send); rec.Code != http.StatusBadGateway {
+		t.Fatalf("/send with SMTP down: %d %s", rec.Code, rec.Body)
+	}
+	wantDeltas(t, deltas(), map[string]float64{
+		"downloading": 1, "sending": 1, "failed": 1, "send_error/smtp": 1,
+		"download_bytes": 1, "download_time": 1, "smtp_time": 1, "smtp_errors": 1,
+	})
+}
+
+func TestMetricsServer(t *testing.T) {
+	h := newMetricsServer(":0").Handler
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "filemailer_workers_active") {
+		t.Fatalf("/metrics = %d %s", rec.Code, rec.Body)
+	}
+	// на служебном порту нет API
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/account", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("/api/v1/account on metrics port = %d", rec.Code)
+	}
+
+	// а на порту API нет /metrics
+	a := newTestAPI(t)
+	a.user("alice@example.com")
+	if rec := a.do("GET", "/metrics", "key-alice@example.com", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("/metrics on API port = %d", rec.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"download_track/internal/deliver"
+)
+
+// defaultTelegramMaxSize — сколько бот может загрузить в чат через
+// облачный Bot API, если бот не прислал свой лимит.
+const defaultTelegramMaxSize = 50 << 20
+
+// telegramReportTimeout — сколько после передачи файла ждать отчёта бота.
+// Дальше задание считается проваленным: бот упал или не достучался до
+// сервиса, и иначе оно навсегда осталось бы в sending.
+const telegramReportTimeout = time.Hour
+
+// telegramHandoff отдаёт скачанный файл боту ответом на /send: бот сам
+// загружает его в чат и потом сообщает, чем кончилось, через
+// POST /api/v1/jobs/{id}/delivery. Письмо вместо файла бот узнаёт по
+// ответу без X-Job-ID.
+type telegramHandoff struct {
+	w       http.ResponseWriter
+	jobID   int64
+	maxSize int64
+	// ответ уже начат: ошибку текстом не отправить
+	started bool
+}
+
+func (h *telegramHandoff) Deliver(ctx context.Context, f deliver.File) (string, error) {
+	in, err := os.Open(f.Path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hdr := h.w.Header()
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	hdr.Set("Content-Type", contentType)
+	hdr.Set("Content-Length", strconv.FormatInt(f.Size, 10))
+	hdr.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}))
+	// по нему бот сообщит, чем кончилась загрузка в чат
+	hdr.Set("X-Job-ID", strconv.FormatInt(h.jobID, 10))
+	h.started = true
+	h.w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(h.w, in); err != nil {
+		return "", err
+	}
+	return "", ctx.Err()
+}
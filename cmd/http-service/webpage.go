@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"download_track/internal/store"
+	"download_track/internal/webpage"
+)
+
+// pageModeFull — режим по умолчанию в API: страница со всеми ресурсами.
+const pageModeFull = "full"
+
+var errPageTooLarge = errors.New("captured page exceeds size limit")
+
+// parsePageMode переводит режим из API в значение задания.
+func parsePageMode(mode string) (string, bool) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "", pageModeFull:
+		return "", true
+	case store.PageReadable, store.PageRaw:
+		return mode, true
+	}
+	return "", false
+}
+
+// capturedPage — страница, сохранённая одним файлом.
+type capturedPage struct {
+	path, name string
+	checksum   string
+	size       int64
+	res        *webpage.Result
+}
+
+// shouldCapture — скачанный файл является HTML-страницей, которую нужно
+// сохранить с ресурсами. Для Kindle страница и так становится EPUB без
+// картинок, поэтому её имеет смысл обработать только в режиме статьи.
+func shouldCapture(j *store.Job, path, contentType string) bool {
+	if j.PageMode == store.PageRaw || (j.Profile == store.ProfileKindle && j.PageMode != store.PageReadable) {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		return true
+	}
+	if mediaType != "" && mediaType != "application/octet-stream" && mediaType != "text/plain" {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return sniffed == "text/html"
+}
+
+// capturePage сохраняет страницу из path одним файлом рядом с ней. Имя
+// берётся из заголовка страницы, если пользователь не задал своё.
+// maxSize ограничивает и скачанные ресурсы, и итоговый файл.
+func capturePage(ctx context.Context, j *store.Job, path, contentType string, base *url.URL, maxSize int64) (*capturedPage, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	dir := filepath.Join(filepath.Dir(path), "page")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return nil, err
+	}
+	out, err := os.Create(filepath.Join(dir, "page.html"))
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(out, hash)}
+	res, err := webpage.Capture(ctx, cw, in, contentType, base, webpage.Options{
+		Readable: j.PageMode == store.PageReadable,
+		MaxBytes: maxSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if cw.n > maxSize {
+		return nil, errPageTooLarge
+	}
+
+	name := pageName(j, res.Title)
+	p := filepath.Join(dir, name)
+	if err := os.Rename(out.Name(), p); err != nil {
+		return nil, err
+	}
+	return &capturedPage{path: p, name: name, checksum: hex.EncodeToString(hash.Sum(nil)), size: cw.n, res: res}, nil
+}
+
+// pageName — имя сохранённой страницы: заданное пользователем, заголовок
+// страницы или последний сегмент URL, всегда с расширением .html.
+func pageName(j *store.Job, title string) string {
+	if j.Filename == "" {
+		title = sanitizeFilename(strings.NewReplacer("/", " ", "\\", " ", ":", " ").Replace(title))
+		if r := []rune(title); len(r) > 100 {
+			title = strings.TrimSpace(string(r[:100]))
+		}
+		if title != "" {
+			return title + ".html"
+		}
+	}
+	name := attachmentName(j, "")
+	if ext := strings.ToLower(filepath.Ext(name)); ext != ".html" && ext != ".htm" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".html"
+	}
+	return name
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"download_track/internal/store"
+)
+
+const (
+	// как часто воркеры проверяют очередь, если их не разбудили
+	queuePollInterval = 5 * time.Second
+	// как часто искать задания без отчёта бота
+	unreportedCheckInterval = time.Minute
+	// сколько задание числится за воркером без продления; задание
+	// упавшего экземпляра другой заберёт не раньше
+	jobLease = 2 * time.Minute
+)
+
+// jobQueue — пул воркеров, разбирающих задания со статусом queued.
+// Очередь хранится в таблице jobs, так что несколько экземпляров
+// сервиса могут работать с ней одновременно.
+type jobQueue struct {
+	srv     *Server
+	workers int
+	wake    chan struct{}
+
+	// stopLoops останавливает выборку новых заданий
+	stopLoops context.CancelFunc
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[int64]context.CancelFunc
+	// draining — прерванные задания возвращаются в очередь, а не падают
+	draining bool
+}
+
+func newJobQueue(srv *Server, workers int) *jobQueue {
+	return &jobQueue{
+		srv:     srv,
+		workers: workers,
+		wake:    make(chan struct{}, 1),
+		running: make(map[int64]context.CancelFunc),
+	}
+}
+
+func (q *jobQueue) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.stopLoops = cancel
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.loop(ctx)
+		}()
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.checkUnreported(ctx)
+	}()
+}
+
+// shutdown перестаёт брать задания и ждёт выполняющиеся. Если ctx
+// истёк раньше, оставшиеся задания прерываются и возвращаются в очередь.
+func (q *jobQueue) shutdown(ctx context.Context) error {
+	q.stopLoops()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	q.draining = true
+	n := len(q.running)
+	for _, cancel := range q.running {
+		cancel()
+	}
+	q.mu.Unlock()
+
+	log.Printf("drain timeout, returning %d running job(s) to the queue", n)
+	<-done
+	return ctx.Err()
+}
+
+// notify будит один из воркеров после добавления задания.
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// interrupt прерывает задание, если оно выполняется в этом процессе.
+func (q *jobQueue) interrupt(id int64) {
+	q.mu.Lock()
+	cancel, ok := q.running[id]
+	q.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (q *jobQueue) loop(ctx context.Context) {
+	t := time.NewTicker(queuePollInterval)
+	defer t.Stop()
+
+	for {
+		for {
+			j, err := q.srv.store.ClaimJob(ctx, jobLease)
+			if err != nil {
+				if !errors.Is(err, store.ErrNotFound) {
+					log.Println("claim job err:", err)
+				}
+				break
+			}
+			q.run(j)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// checkUnreported периодически завершает задания, застрявшие в ожидании
+// отчёта бота. Задание завершает один UPDATE, так что несколько
+// экземпляров сервиса друг другу не мешают.
+func (q *jobQueue) checkUnreported(ctx context.Context) {
+	t := time.NewTicker(unreportedCheckInterval)
+	defer t.Stop()
+	for {
+		q.srv.failUnreportedJobs(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (q *jobQueue) run(j *store.Job) {
+	// задание не зависит от ctx цикла: при остановке оно дорабатывает,
+	// пока не истечёт время на дренаж
+	jobCtx, cancel := context.WithCancel(context.Background())
+	q.mu.Lock()
+	q.running[j.ID] = cancel
+	q.mu.Unlock()
+
+	defer func() {
+		cancel()
+		q.mu.Lock()
+		delete(q.running, j.ID)
+		q.mu.Unlock()
+	}()
+
+	go q.renewLease(jobCtx, j.ID)
+
+	jobTransitions.WithLabelValues(store.StatusDownloading).Inc()
+	workersActive.Inc()
+	defer workersActive.Dec()
+
+	acc, err := q.srv.store.UserByID(jobCtx, j.UserID)
+	if err != nil {
+		log.Println("job account err:", err)
+		q.srv.setJobStatus(j, store.StatusFailed, "account: "+err.Error(), 0)
+		return
+	}
+
+	err = q.srv.runJob(jobCtx, j, acc, nil)
+	if err == nil {
+		return
+	}
+	log.Printf("job %d err: %v", j.ID, err)
+
+	// jobCtx отменяют либо при дренаже, либо по отмене пользователя —
+	// во втором случае статус canceled уже стоит
+	q.mu.Lock()
+	draining := q.draining
+	q.mu.Unlock()
+	if jobCtx.Err() != nil && draining {
+		q.srv.requeueJob(j)
+	}
+}
+
+// renewLease продлевает срок задания, пока оно выполняется, чтобы другой
+// экземпляр не забрал его как брошенное.
+func (q *jobQueue) renewLease(ctx context.Context, id int64) {
+	t := time.NewTicker(jobLease / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if _, err := q.srv.store.RenewJobLease(ctx, id, jobLease); err != nil && ctx.Err() == nil {
+			log.Println("renew job lease err:", err)
+		}
+	}
+}
+
+// checkSaturation сообщает о перегрузке, когда все воркеры заняты, а в
+// очереди больше maxQueued заданий.
+func (q *jobQueue) checkSaturation(ctx context.Context, maxQueued int) error {
+	q.mu.Lock()
+	busy := len(q.running)
+	q.mu.Unlock()
+	if busy < q.workers {
+		return nil
+	}
+
+	counts, err := q.srv.store.CountActiveJobs(ctx)
+	if err != nil {
+		return fmt.Errorf("count queued jobs: %w", err)
+	}
+	if queued := counts[store.StatusQueued]; queued > maxQueued {
+		return fmt.Errorf("all %d workers busy, %d jobs queued", q.workers, queued)
+	}
+	return nil
+}
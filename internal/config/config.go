@@ -0,0 +1,252 @@
+// Package config загружает настройки обоих сервисов: значения по
+// умолчанию, затем файл YAML или TOML (CONFIG_FILE), затем переменные
+// окружения. Переменные окружения всегда важнее файла.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"download_track/internal/secret"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Теги полей:
+//   - env — переменная окружения, переопределяющая значение;
+//   - secret — значение скрывается в Redacted;
+//   - reload — значение применяется по SIGHUP без перезапуска.
+
+// Config — настройки http-service и бота. Каждый сервис читает и
+// проверяет свою часть.
+type Config struct {
+	DB       DB       `yaml:"db" toml:"db"`
+	HTTP     HTTP     `yaml:"http" toml:"http"`
+	SMTP     SMTP     `yaml:"smtp" toml:"smtp"`
+	Email    Email    `yaml:"email" toml:"email"`
+	Jobs     Jobs     `yaml:"jobs" toml:"jobs"`
+	Fetch    Fetch    `yaml:"fetch" toml:"fetch"`
+	Delivery Delivery `yaml:"delivery" toml:"delivery"`
+	Log      Log      `yaml:"log" toml:"log"`
+	Bot      Bot      `yaml:"bot" toml:"bot"`
+
+	// сколько ждать завершения запросов и заданий при остановке
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type DB struct {
+	DSN string `yaml:"dsn" toml:"dsn" env:"DB_DSN" secret:"true"`
+	// применять миграции при старте; иначе только предупреждать о них
+	Migrate bool `yaml:"migrate" toml:"migrate" env:"DB_MIGRATE"`
+	// ключ шифрования учётных данных пользователей в БД: 32 байта в
+	// base64; пустой — сохранять пароли, ключи и заголовки нельзя
+	SecretsKey string `yaml:"secrets_key" toml:"secrets_key" env:"SECRETS_KEY" secret:"true"`
+}
+
+// SecretBox возвращает шифр учётных данных или nil, если ключ не задан.
+func (d DB) SecretBox() (*secret.Box, error) {
+	if d.SecretsKey == "" {
+		return nil, nil
+	}
+	key, err := secret.ParseKey(d.SecretsKey)
+	if err != nil {
+		return nil, err
+	}
+	return secret.NewBox(key)
+}
+
+type HTTP struct {
+	Listen string `yaml:"listen" toml:"listen" env:"HTTP_LISTEN"`
+	// отдельный листенер /metrics: основной порт смотрит наружу
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr" env:"HTTP_METRICS_ADDR"`
+	// токен для администраторских эндпоинтов API; пустой — выключены
+	AdminToken string `yaml:"admin_token" toml:"admin_token" env:"ADMIN_API_TOKEN" secret:"true"`
+}
+
+type SMTP struct {
+	Host string `yaml:"host" toml:"host" env:"SMTP_HOST"`
+	Port string `yaml:"port" toml:"port" env:"SMTP_PORT"`
+	User string `yaml:"user" toml:"user" env:"SMTP_USER"`
+	Pass string `yaml:"pass" toml:"pass" env:"SMTP_PASS" secret:"true"`
+	From string `yaml:"from" toml:"from" env:"SMTP_FROM"`
+}
+
+type Email struct {
+	// имя отправителя в поле From
+	FromName string `yaml:"from_name" toml:"from_name" env:"EMAIL_FROM_NAME" reload:"true"`
+	// каталог с шаблонами, переопределяющими встроенные; пустой — только
+	// встроенные. Шаблоны перечитываются по SIGHUP.
+	TemplatesDir string `yaml:"templates_dir" toml:"templates_dir" env:"EMAIL_TEMPLATES_DIR" reload:"true"`
+	DKIM         DKIM   `yaml:"dkim" toml:"dkim"`
+}
+
+// DKIM — подпись исходящих писем; выключена, пока не задан домен.
+type DKIM struct {
+	// домен подписи (d=); для DMARC должен совпадать с доменом smtp.from
+	Domain   string `yaml:"domain" toml:"domain" env:"DKIM_DOMAIN"`
+	Selector string `yaml:"selector" toml:"selector" env:"DKIM_SELECTOR"`
+	// закрытый ключ RSA или Ed25519 в PEM
+	KeyFile string `yaml:"key_file" toml:"key_file" env:"DKIM_KEY_FILE"`
+}
+
+// Enabled — задан ли домен подписи.
+func (d DKIM) Enabled() bool {
+	return d.Domain != ""
+}
+
+type Jobs struct {
+	Workers int `yaml:"workers" toml:"workers" env:"WORKERS"`
+	// максимальный размер скачиваемого файла
+	MaxFileSizeMB int64 `yaml:"max_file_size_mb" toml:"max_file_size_mb" env:"MAX_FILE_SIZE_MB" reload:"true"`
+	// readiness: свободное место во временном каталоге; 0 — max_file_size_mb
+	ReadyMinFreeMB int64 `yaml:"ready_min_free_mb" toml:"ready_min_free_mb" env:"READY_MIN_FREE_MB" reload:"true"`
+	// readiness: допустимая очередь при полностью занятых воркерах
+	ReadyMaxQueued int `yaml:"ready_max_queued" toml:"ready_max_queued" env:"READY_MAX_QUEUED" reload:"true"`
+}
+
+// Fetch — скачивание файлов по ссылкам.
+type Fetch struct {
+	// активный режим FTP: сервер сам подключается к http-service; нужен
+	// для серверов, которые не умеют пассивный
+	FTPActive bool `yaml:"ftp_active" toml:"ftp_active" env:"FETCH_FTP_ACTIVE" reload:"true"`
+}
+
+// Delivery — доставка файлов не на почту.
+type Delivery struct {
+	// каталог, в подкаталоги которого пользователи могут получать файлы;
+	// пустой — доставка в локальный каталог выключена
+	LocalRoot string `yaml:"local_root" toml:"local_root" env:"DELIVERY_LOCAL_ROOT"`
+}
+
+type Log struct {
+	// stdout, file или both
+	Output string `yaml:"output" toml:"output" env:"LOG_OUTPUT"`
+	// пустой — путь по умолчанию для сервиса
+	File        string        `yaml:"file" toml:"file" env:"LOG_FILE"`
+	MaxSizeMB   int64         `yaml:"max_size_mb" toml:"max_size_mb" env:"LOG_MAX_SIZE_MB"`
+	RotateEvery time.Duration `yaml:"rotate_every" toml:"rotate_every" env:"LOG_ROTATE_EVERY"`
+	MaxBackups  int           `yaml:"max_backups" toml:"max_backups" env:"LOG_MAX_BACKUPS"`
+}
+
+type Bot struct {
+	Token       string `yaml:"token" toml:"token" env:"TELEGRAM_TOKEN" secret:"true"`
+	APIBase     string `yaml:"api_base" toml:"api_base" env:"API_BASE"`
+	AdminChatID int64  `yaml:"admin_chat_id" toml:"admin_chat_id" env:"ADMIN_CHAT_ID"`
+	// polling или webhook
+	Mode      string `yaml:"mode" toml:"mode" env:"BOT_MODE"`
+	Workers   int    `yaml:"workers" toml:"workers" env:"BOT_WORKERS"`
+	QueueSize int    `yaml:"queue_size" toml:"queue_size" env:"BOT_QUEUE_SIZE"`
+	// ограничение времени на обработку одного сообщения
+	HandlerTimeout time.Duration `yaml:"handler_timeout" toml:"handler_timeout" env:"BOT_HANDLER_TIMEOUT" reload:"true"`
+	// служебный листенер: /metrics, /healthz, /readyz
+	MetricsAddr string  `yaml:"metrics_addr" toml:"metrics_addr" env:"METRICS_ADDR"`
+	Webhook     Webhook `yaml:"webhook" toml:"webhook"`
+}
+
+type Webhook struct {
+	// публичный https-адрес, который регистрируется в setWebhook
+	URL    string `yaml:"url" toml:"url" env:"WEBHOOK_URL"`
+	Listen string `yaml:"listen" toml:"listen" env:"WEBHOOK_LISTEN"`
+	// значение заголовка X-Telegram-Bot-Api-Secret-Token
+	Secret string `yaml:"secret" toml:"secret" env:"WEBHOOK_SECRET" secret:"true"`
+	// сертификат и ключ, если TLS завершается в самом боте, а не на прокси
+	TLSCert string `yaml:"tls_cert" toml:"tls_cert" env:"WEBHOOK_TLS_CERT"`
+	TLSKey  string `yaml:"tls_key" toml:"tls_key" env:"WEBHOOK_TLS_KEY"`
+	// загрузить сертификат в Telegram (для самоподписанных)
+	UploadCert     bool `yaml:"upload_cert" toml:"upload_cert" env:"WEBHOOK_UPLOAD_CERT"`
+	MaxConnections int  `yaml:"max_connections" toml:"max_connections" env:"WEBHOOK_MAX_CONNECTIONS"`
+}
+
+// Default возвращает настройки по умолчанию.
+func Default() *Config {
+	return &Config{
+		ShutdownTimeout: 30 * time.Second,
+		HTTP:            HTTP{Listen: ":8080", MetricsAddr: ":9090"},
+		Email:           Email{FromName: "filemailer"},
+		Jobs: Jobs{
+			Workers:        2,
+			MaxFileSizeMB:  500,
+			ReadyMaxQueued: 100,
+		},
+		Log: Log{
+			Output:     "stdout",
+			MaxSizeMB:  100,
+			MaxBackups: 7,
+		},
+		Bot: Bot{
+			APIBase:        "http://http-service:8080",
+			Mode:           "polling",
+			Workers:        8,
+			QueueSize:      32,
+			HandlerTimeout: 10 * time.Minute,
+			MetricsAddr:    ":9091",
+			Webhook:        Webhook{Listen: ":8443"},
+		},
+	}
+}
+
+// Load читает файл path (пустой — без файла) и переменные окружения.
+// Формат файла определяется по расширению: .yaml, .yml или .toml.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFromEnv — Load с путём из CONFIG_FILE.
+func LoadFromEnv() (*Config, error) {
+	return Load(os.Getenv("CONFIG_FILE"))
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return err
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return fmt.Errorf("unknown key %q", keys[0].String())
+		}
+	default:
+		return errors.New("unsupported format, want .yaml, .yml or .toml")
+	}
+	return nil
+}
+
+// MaxFileSize — максимальный размер файла в байтах.
+func (j Jobs) MaxFileSize() int64 {
+	return j.MaxFileSizeMB << 20
+}
+
+// ReadyMinFree — сколько байт должно быть свободно во временном каталоге.
+func (j Jobs) ReadyMinFree() uint64 {
+	if j.ReadyMinFreeMB > 0 {
+		return uint64(j.ReadyMinFreeMB) << 20
+	}
+	return uint64(j.MaxFileSize())
+}
@@ -0,0 +1,419 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv убирает переменные окружения конфига, чтобы на тест не
+// влияло окружение, в котором он запущен.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, f := range fields(reflect.ValueOf(Default()).Elem(), "") {
+		if name := f.tag.Get("env"); name != "" {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	const yamlFile = `
+smtp:
+  host: file.example.com
+  port: "2525"
+jobs:
+  workers: 4
+bot:
+  handler_timeout: 30s
+  webhook:
+    max_connections: 10
+`
+	const tomlFile = `
+[smtp]
+host = "file.example.com"
+port = "2525"
+
+[jobs]
+workers = 4
+
+[bot]
+handler_timeout = "30s"
+
+[bot.webhook]
+max_connections = 10
+`
+	tests := []struct {
+		name    string
+		file    string // имя и содержимое через перевод строки
+		env     map[string]string
+		check   func(t *testing.T, c *Config)
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, c *Config) {
+				if !reflect.DeepEqual(c, Default()) {
+					t.Fatalf("Load without file and env = %+v", c)
+				}
+			},
+		},
+		{
+			name: "yaml",
+			file: "config.yaml\n" + yamlFile,
+			check: func(t *testing.T, c *Config) {
+				if c.SMTP.Host != "file.example.com" || c.SMTP.Port != "2525" || c.Jobs.Workers != 4 ||
+					c.Bot.HandlerTimeout != 30*time.Second || c.Bot.Webhook.MaxConnections != 10 {
+					t.Fatalf("config = %+v", c)
+				}
+				// чего нет в файле, остаётся по умолчанию
+				if c.HTTP.Listen != ":8080" || c.Bot.Webhook.Listen != ":8443" || c.Jobs.MaxFileSizeMB != 500 {
+					t.Fatalf("defaults lost: %+v", c)
+				}
+			},
+		},
+		{
+			name: "toml",
+			file: "config.toml\n" + tomlFile,
+			check: func(t *testing.T, c *Config) {
+				if c.SMTP.Host != "file.example.com" || c.Jobs.Workers != 4 || c.Bot.HandlerTimeout != 30*time.Second ||
+					c.Bot.Webhook.MaxConnections != 10 || c.HTTP.Listen != ":8080" {
+					t.Fatalf("config = %+v", c)
+				}
+			},
+		},
+		{
+			name: "env over file",
+			file: "config.yml\n" + yamlFile,
+			env: map[string]string{"SMTP_HOST": "env.example.com", "WORKERS": "6", "BOT_HANDLER_TIMEOUT": "1m",
+				"DB_MIGRATE": "true", "ADMIN_CHAT_ID": "-100"},
+			check: func(t *testing.T, c *Config) {
+				if c.SMTP.Host != "env.example.com" || c.Jobs.Workers != 6 || c.Bot.HandlerTimeout != time.Minute ||
+					!c.DB.Migrate || c.Bot.AdminChatID != -100 {
+					t.Fatalf("config = %+v", c)
+				}
+				// переменной нет — значение из файла
+				if c.SMTP.Port != "2525" {
+					t.Fatalf("smtp.port = %q", c.SMTP.Port)
+				}
+			},
+		},
+		{
+			name: "env over defaults",
+			env:  map[string]string{"HTTP_LISTEN": ":9000"},
+			check: func(t *testing.T, c *Config) {
+				if c.HTTP.Listen != ":9000" {
+					t.Fatalf("http.listen = %q", c.HTTP.Listen)
+				}
+			},
+		},
+		{name: "unknown yaml key", file: "config.yaml\nsmtp:\n  hots: x\n", wantErr: "hots"},
+		{name: "unknown toml key", file: "config.toml\n[smtp]\nhots = \"x\"\n", wantErr: "smtp.hots"},
+		{name: "bad yaml value", file: "config.yaml\njobs:\n  workers: many\n", wantErr: "config.yaml"},
+		{name: "unsupported format", file: "config.json\n{}\n", wantErr: "unsupported format"},
+		{name: "bad integer env", env: map[string]string{"WORKERS": "x"}, wantErr: "WORKERS: invalid integer"},
+		{name: "bad duration env", env: map[string]string{"SHUTDOWN_TIMEOUT": "30"}, wantErr: "SHUTDOWN_TIMEOUT: invalid duration"},
+		{name: "bad boolean env", env: map[string]string{"DB_MIGRATE": "sure"}, wantErr: "DB_MIGRATE: invalid boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var path string
+			if tt.file != "" {
+				name, data, _ := strings.Cut(tt.file, "\n")
+				path = writeFile(t, name, data)
+			}
+			c, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, c)
+		})
+	}
+
+	clearEnv(t)
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("Load of a missing file succeeded")
+	}
+}
+
+// validHTTP — минимальные настройки, с которыми запускается http-service.
+func validHTTP() *Config {
+	c := Default()
+	c.DB.DSN = "postgres://localhost/db"
+	c.SMTP = SMTP{Host: "smtp.example.com", Port: "587", From: "bot@example.com"}
+	return c
+}
+
+func validBot() *Config {
+	c := Default()
+	c.DB.DSN = "postgres://localhost/db"
+	c.Bot.Token = "123:abc"
+	c.Bot.AdminChatID = 1
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		bot    bool
+		change func(c *Config)
+		// подстроки ошибки; пусто — настройки верные
+		want []string
+	}{
+		{name: "http ok", change: func(c *Config) {}},
+		{name: "http missing dsn and smtp", change: func(c *Config) { c.DB.DSN, c.SMTP.Host = "", "" },
+			want: []string{"db.dsn (DB_DSN): is required", "smtp.host (SMTP_HOST): is required"}},
+		{name: "smtp port", change: func(c *Config) { c.SMTP.Port = "70000" }, want: []string{"smtp.port"}},
+		{name: "smtp from", change: func(c *Config) { c.SMTP.From = "bot" }, want: []string{"smtp.from"}},
+		{name: "smtp user without pass", change: func(c *Config) { c.SMTP.User = "bot" }, want: []string{"set together"}},
+		{name: "from name newline", change: func(c *Config) { c.Email.FromName = "a\nb" }, want: []string{"email.from_name"}},
+		{name: "partial dkim", change: func(c *Config) { c.Email.DKIM.Domain = "example.com" },
+			want: []string{"email.dkim.selector", "email.dkim.key_file"}},
+		{name: "secrets key", change: func(c *Config) { c.DB.SecretsKey = "short" }, want: []string{"db.secrets_key"}},
+		{name: "relative local root", change: func(c *Config) { c.Delivery.LocalRoot = "files" }, want: []string{"delivery.local_root"}},
+		{name: "limits", change: func(c *Config) { c.Jobs.MaxFileSizeMB, c.Jobs.ReadyMaxQueued = 0, -1 },
+			want: []string{"jobs.max_file_size_mb", "jobs.ready_max_queued"}},
+		{name: "log output", change: func(c *Config) { c.Log.Output = "syslog" }, want: []string{"log.output"}},
+
+		{name: "bot ok", bot: true, change: func(c *Config) {}},
+		{name: "bot missing token", bot: true, change: func(c *Config) { c.Bot.Token, c.Bot.AdminChatID = "", 0 },
+			want: []string{"bot.token (TELEGRAM_TOKEN)", "bot.admin_chat_id"}},
+		{name: "bot api base", bot: true, change: func(c *Config) { c.Bot.APIBase = "http-service:8080" }, want: []string{"bot.api_base"}},
+		{name: "bot mode", bot: true, change: func(c *Config) { c.Bot.Mode = "push" }, want: []string{"bot.mode"}},
+		{name: "webhook ok", bot: true, change: func(c *Config) {
+			c.Bot.Mode = "webhook"
+			c.Bot.Webhook.URL, c.Bot.Webhook.Secret = "https://bot.example.com/hook", "s3cret_-"
+		}},
+		{name: "webhook", bot: true, change: func(c *Config) {
+			c.Bot.Mode = "webhook"
+			c.Bot.Webhook = Webhook{URL: "http://bot.example.com", Listen: ":8443", Secret: "bad secret", UploadCert: true, MaxConnections: 101}
+		}, want: []string{"bot.webhook.url", "bot.webhook.secret", "bot.webhook.upload_cert", "bot.webhook.max_connections"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, validate := validHTTP(), (*Config).ValidateHTTPService
+			if tt.bot {
+				c, validate = validBot(), (*Config).ValidateBot
+			}
+			tt.change(c)
+			err := validate(c)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("valid config: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			// все ошибки сообщаются сразу
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("error %q does not mention %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	clearEnv(t)
+	const base = `
+db:
+  dsn: postgres://localhost/db
+smtp:
+  host: smtp.example.com
+  port: "587"
+  from: bot@example.com
+email:
+  from_name: Old
+jobs:
+  workers: 2
+  max_file_size_mb: 100
+`
+	path := writeFile(t, "config.yaml", base)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(cfg, path, (*Config).ValidateHTTPService)
+	var hooked []*Config
+	s.OnReload(func(c *Config) { hooked = append(hooked, c) })
+
+	tests := []struct {
+		name                 string
+		file                 string
+		env                  map[string]string
+		wantApplied, restart []string
+		wantErr              bool
+		check                func(t *testing.T, c *Config)
+	}{
+		{
+			name: "unchanged",
+			file: base,
+			check: func(t *testing.T, c *Config) {
+				if c.Email.FromName != "Old" {
+					t.Fatalf("config = %+v", c)
+				}
+			},
+		},
+		{
+			name: "reload and restart fields",
+			file: strings.NewReplacer("Old", "New", "workers: 2", "workers: 8", "max_file_size_mb: 100", "max_file_size_mb: 200",
+				"smtp.example.com", "smtp2.example.com").Replace(base),
+			wantApplied: []string{"email.from_name", "jobs.max_file_size_mb"},
+			restart:     []string{"smtp.host", "jobs.workers"},
+			check: func(t *testing.T, c *Config) {
+				if c.Email.FromName != "New" || c.Jobs.MaxFileSizeMB != 200 {
+					t.Fatalf("reloadable fields not applied: %+v", c)
+				}
+				// без перезапуска остаются прежними
+				if c.Jobs.Workers != 2 || c.SMTP.Host != "smtp.example.com" {
+					t.Fatalf("restart-only fields changed: %+v", c)
+				}
+			},
+		},
+		{
+			name:        "env applies on reload",
+			file:        strings.NewReplacer("Old", "New", "max_file_size_mb: 100", "max_file_size_mb: 200").Replace(base),
+			env:         map[string]string{"BOT_HANDLER_TIMEOUT": "5m"},
+			wantApplied: []string{"bot.handler_timeout"},
+			check: func(t *testing.T, c *Config) {
+				if c.Bot.HandlerTimeout != 5*time.Minute {
+					t.Fatalf("bot.handler_timeout = %s", c.Bot.HandlerTimeout)
+				}
+			},
+		},
+		{name: "invalid", file: strings.Replace(base, "max_file_size_mb: 100", "max_file_size_mb: 0", 1), wantErr: true},
+		{name: "broken file", file: "jobs: [", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			before, hooks := s.Get(), len(hooked)
+			snapshot := *before
+
+			applied, restart, err := s.Reload()
+			// прежнее значение Get не меняется ни при каком исходе
+			if !reflect.DeepEqual(*before, snapshot) {
+				t.Fatalf("Reload modified the previous config")
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Reload accepted a bad file")
+				}
+				if s.Get() != before || len(hooked) != hooks {
+					t.Fatal("failed Reload replaced the config")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(applied, tt.wantApplied) || !reflect.DeepEqual(restart, tt.restart) {
+				t.Fatalf("applied %v, restart %v; want %v, %v", applied, restart, tt.wantApplied, tt.restart)
+			}
+			if len(hooked) != hooks+1 || hooked[len(hooked)-1] != s.Get() {
+				t.Fatal("OnReload hook was not called with the new config")
+			}
+			tt.check(t, s.Get())
+		})
+	}
+}
+
+func TestReloadValidatesMerged(t *testing.T) {
+	clearEnv(t)
+	const base = `
+jobs:
+  workers: 2
+  max_file_size_mb: 100
+`
+	path := writeFile(t, "config.yaml", base)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// правило связывает поле, которое меняется по SIGHUP, с полем, которое
+	// требует перезапуска
+	perWorker := func(c *Config) error {
+		if c.Jobs.MaxFileSizeMB > 100*int64(c.Jobs.Workers) {
+			return errors.New("jobs.max_file_size_mb: at most 100 per worker")
+		}
+		return nil
+	}
+	s := NewStore(cfg, path, perWorker)
+	hooked := 0
+	s.OnReload(func(*Config) { hooked++ })
+
+	// сам файл верен, но workers применится только после перезапуска, а
+	// 500 МБ при двух воркерах правило не пропускает
+	next := strings.NewReplacer("workers: 2", "workers: 8", "max_file_size_mb: 100", "max_file_size_mb: 500").Replace(base)
+	if err := os.WriteFile(path, []byte(next), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Reload(); err == nil || !strings.Contains(err.Error(), "per worker") {
+		t.Fatalf("Reload = %v, want validation error", err)
+	}
+	if s.Get() != cfg || hooked != 0 {
+		t.Fatal("invalid merged config went live")
+	}
+
+	// то же значение в пределах правила применяется
+	next = strings.Replace(base, "max_file_size_mb: 100", "max_file_size_mb: 200", 1)
+	if err := os.WriteFile(path, []byte(next), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Get().Jobs.MaxFileSizeMB != 200 || hooked != 1 {
+		t.Fatalf("config = %+v, hooks %d", s.Get().Jobs, hooked)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := validHTTP()
+	c.SMTP.Pass = "smtp-s3cret"
+	out := c.Redacted("smtp", "db")
+	if strings.Contains(out, "smtp-s3cret") || strings.Contains(out, "localhost/db") {
+		t.Fatalf("secrets in %q", out)
+	}
+	if !strings.Contains(out, "smtp.pass = [redacted]") || !strings.Contains(out, "smtp.host = smtp.example.com") {
+		t.Fatalf("Redacted = %q", out)
+	}
+	if strings.Contains(out, "jobs.") {
+		t.Fatalf("sections not filtered: %q", out)
+	}
+	// пустой секрет не прячется: видно, что он не задан
+	if !strings.Contains(out, "db.secrets_key = \n") {
+		t.Fatalf("empty secret hidden: %q", out)
+	}
+}
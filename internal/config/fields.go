@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field — лист структуры Config вместе с путём вида "smtp.host".
+type field struct {
+	path  string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+// fields обходит структуру и возвращает все листовые поля по порядку.
+func fields(v reflect.Value, prefix string) []field {
+	var out []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(sf.Name)
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			out = append(out, fields(fv, name)...)
+			continue
+		}
+		out = append(out, field{path: name, value: fv, tag: sf.Tag})
+	}
+	return out
+}
+
+// applyEnv переносит заданные переменные окружения в cfg.
+func applyEnv(cfg *Config) error {
+	for _, f := range fields(reflect.ValueOf(cfg).Elem(), "") {
+		name := f.tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw, ok := os.LookupEnv(name)
+		if !ok || raw == "" {
+			continue
+		}
+		if err := setValue(f.value, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Redacted возвращает настройки из секций sections (все, если пусто) по
+// строке на значение, скрывая секреты.
+func (c *Config) Redacted(sections ...string) string {
+	var b strings.Builder
+	for _, f := range fields(reflect.ValueOf(c).Elem(), "") {
+		if !inSections(f.path, sections) {
+			continue
+		}
+		val := fmt.Sprint(f.value.Interface())
+		if f.tag.Get("secret") == "true" && val != "" {
+			val = "[redacted]"
+		}
+		fmt.Fprintf(&b, "  %s = %s\n", f.path, val)
+	}
+	return b.String()
+}
+
+func inSections(path string, sections []string) bool {
+	if len(sections) == 0 {
+		return true
+	}
+	for _, s := range sections {
+		if path == s || strings.HasPrefix(path, s+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Store хранит текущие настройки и подменяет их при перезагрузке.
+type Store struct {
+	path     string
+	validate func(*Config) error
+	cur      atomic.Pointer[Config]
+
+	mu       sync.Mutex
+	onReload []func(*Config)
+}
+
+// NewStore оборачивает уже загруженный и проверенный cfg. path и
+// validate используются при перезагрузке.
+func NewStore(cfg *Config, path string, validate func(*Config) error) *Store {
+	s := &Store{path: path, validate: validate}
+	s.cur.Store(cfg)
+	return s
+}
+
+// Get возвращает текущие настройки. Возвращённое значение не меняется:
+// перезагрузка подставляет новый *Config.
+func (s *Store) Get() *Config {
+	return s.cur.Load()
+}
+
+// Reload перечитывает файл и окружение. Применяются только поля с тегом
+// reload; изменения остальных возвращаются в restart, чтобы о них
+// можно было предупредить. Проверяется и новый файл, и то, что из него
+// применится поверх текущих настроек. При ошибке текущие настройки не
+// меняются.
+func (s *Store) Reload() (applied, restart []string, err error) {
+	next, err := Load(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.validate(next); err != nil {
+		return nil, nil, err
+	}
+
+	cur := s.Get()
+	merged := *cur
+	nv := reflect.ValueOf(next).Elem()
+	mf := fields(reflect.ValueOf(&merged).Elem(), "")
+	for i, f := range fields(nv, "") {
+		if reflect.DeepEqual(f.value.Interface(), mf[i].value.Interface()) {
+			continue
+		}
+		if f.tag.Get("reload") == "true" {
+			mf[i].value.Set(f.value)
+			applied = append(applied, f.path)
+		} else {
+			restart = append(restart, f.path)
+		}
+	}
+	// новые значения могли пройти проверку только вместе с полями, которые
+	// без перезапуска не меняются
+	if err := s.validate(&merged); err != nil {
+		return nil, nil, fmt.Errorf("with settings that need a restart kept: %w", err)
+	}
+	s.cur.Store(&merged)
+
+	s.mu.Lock()
+	hooks := s.onReload
+	s.mu.Unlock()
+	for _, fn := range hooks {
+		fn(&merged)
+	}
+	return applied, restart, nil
+}
+
+// OnReload добавляет fn, которая вызывается после каждой успешной
+// перезагрузки с новыми настройками — даже если они не изменились, чтобы
+// можно было перечитать внешние файлы.
+func (s *Store) OnReload(fn func(*Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReload = append(s.onReload, fn)
+}
+
+// ReloadOnSIGHUP перезагружает настройки по каждому SIGHUP, пока ctx не
+// отменён.
+func (s *Store) ReloadOnSIGHUP(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+			}
+			applied, restart, err := s.Reload()
+			if err != nil {
+				log.Println("config reload failed, keeping current settings:", err)
+				continue
+			}
+			log.Printf("config reloaded, applied: %v", applied)
+			if len(restart) > 0 {
+				log.Printf("config changes that need a restart were ignored: %v", restart)
+			}
+		}
+	}()
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"download_track/internal/secret"
+)
+
+// validator собирает все ошибки сразу, чтобы не чинить конфиг по одной.
+type validator struct {
+	env  map[string]string
+	errs []error
+}
+
+func newValidator(c *Config) *validator {
+	v := &validator{env: make(map[string]string)}
+	for _, f := range fields(reflect.ValueOf(c).Elem(), "") {
+		if name := f.tag.Get("env"); name != "" {
+			v.env[f.path] = name
+		}
+	}
+	return v
+}
+
+func (v *validator) fail(path, format string, args ...any) {
+	name := path
+	if env := v.env[path]; env != "" {
+		name += " (" + env + ")"
+	}
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) require(path, value string) {
+	if value == "" {
+		v.fail(path, "is required")
+	}
+}
+
+func (v *validator) positive(path string, n int64) {
+	if n <= 0 {
+		v.fail(path, "must be positive, got %d", n)
+	}
+}
+
+func (v *validator) nonNegative(path string, n int64) {
+	if n < 0 {
+		v.fail(path, "must not be negative, got %d", n)
+	}
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// ValidateHTTPService проверяет настройки, нужные http-service.
+func (c *Config) ValidateHTTPService() error {
+	v := newValidator(c)
+	v.require("db.dsn", c.DB.DSN)
+	c.validateSecretsKey(v)
+	v.require("http.listen", c.HTTP.Listen)
+	v.require("http.metrics_addr", c.HTTP.MetricsAddr)
+	v.positive("shutdown_timeout", int64(c.ShutdownTimeout))
+
+	// без SMTP сервис не может выполнить ни одного задания
+	v.require("smtp.host", c.SMTP.Host)
+	if n, err := strconv.Atoi(c.SMTP.Port); err != nil || n < 1 || n > 65535 {
+		v.fail("smtp.port", "must be a port number, got %q", c.SMTP.Port)
+	}
+	if _, err := mail.ParseAddress(c.SMTP.From); err != nil {
+		v.fail("smtp.from", "must be an email address, got %q", c.SMTP.From)
+	}
+	if (c.SMTP.User == "") != (c.SMTP.Pass == "") {
+		v.fail("smtp.user", "smtp.user and smtp.pass must be set together")
+	}
+
+	if strings.ContainsFunc(c.Email.FromName, unicode.IsControl) {
+		v.fail("email.from_name", "must be a single line")
+	}
+	if d := c.Email.DKIM; d.Enabled() || d.Selector != "" || d.KeyFile != "" {
+		v.require("email.dkim.domain", d.Domain)
+		v.require("email.dkim.selector", d.Selector)
+		v.require("email.dkim.key_file", d.KeyFile)
+	}
+
+	v.positive("jobs.workers", int64(c.Jobs.Workers))
+	if root := c.Delivery.LocalRoot; root != "" && !filepath.IsAbs(root) {
+		v.fail("delivery.local_root", "must be an absolute path, got %q", root)
+	}
+	c.validateLimits(v)
+	c.validateLog(v)
+	return v.err()
+}
+
+// validateLimits проверяет настройки, которые можно менять по SIGHUP.
+func (c *Config) validateLimits(v *validator) {
+	v.positive("jobs.max_file_size_mb", c.Jobs.MaxFileSizeMB)
+	v.nonNegative("jobs.ready_min_free_mb", c.Jobs.ReadyMinFreeMB)
+	v.nonNegative("jobs.ready_max_queued", int64(c.Jobs.ReadyMaxQueued))
+	v.positive("bot.handler_timeout", int64(c.Bot.HandlerTimeout))
+}
+
+func (c *Config) validateSecretsKey(v *validator) {
+	if c.DB.SecretsKey == "" {
+		return
+	}
+	if _, err := secret.ParseKey(c.DB.SecretsKey); err != nil {
+		v.fail("db.secrets_key", "%v", err)
+	}
+}
+
+func (c *Config) validateLog(v *validator) {
+	switch c.Log.Output {
+	case "stdout", "file", "both":
+	default:
+		v.fail("log.output", "must be stdout, file or both, got %q", c.Log.Output)
+	}
+	v.nonNegative("log.max_size_mb", c.Log.MaxSizeMB)
+	v.nonNegative("log.rotate_every", int64(c.Log.RotateEvery))
+	v.nonNegative("log.max_backups", int64(c.Log.MaxBackups))
+}
+
+// ValidateBot проверяет настройки, нужные боту.
+func (c *Config) ValidateBot() error {
+	v := newValidator(c)
+	v.require("bot.token", c.Bot.Token)
+	v.require("db.dsn", c.DB.DSN)
+	c.validateSecretsKey(v)
+	if c.Bot.AdminChatID == 0 {
+		v.fail("bot.admin_chat_id", "is required")
+	}
+	if u, err := url.Parse(c.Bot.APIBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.fail("bot.api_base", "must be an absolute http(s) url, got %q", c.Bot.APIBase)
+	}
+	v.positive("bot.workers", int64(c.Bot.Workers))
+	v.positive("bot.queue_size", int64(c.Bot.QueueSize))
+	v.require("bot.metrics_addr", c.Bot.MetricsAddr)
+	v.positive("shutdown_timeout", int64(c.ShutdownTimeout))
+	c.validateLimits(v)
+	c.validateLog(v)
+
+	switch c.Bot.Mode {
+	case "polling":
+	case "webhook":
+		c.validateWebhook(v)
+	default:
+		v.fail("bot.mode", "must be polling or webhook, got %q", c.Bot.Mode)
+	}
+	return v.err()
+}
+
+func (c *Config) validateWebhook(v *validator) {
+	w := c.Bot.Webhook
+	if u, err := url.Parse(w.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		v.fail("bot.webhook.url", "must be an absolute https url, got %q", w.URL)
+	}
+	v.require("bot.webhook.listen", w.Listen)
+
+	// Telegram допускает 1-256 символов A-Z, a-z, 0-9, _ и -
+	if len(w.Secret) == 0 || len(w.Secret) > 256 {
+		v.fail("bot.webhook.secret", "must be 1-256 characters")
+	}
+	for _, r := range w.Secret {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			v.fail("bot.webhook.secret", "may contain only A-Z, a-z, 0-9, _ and -")
+			break
+		}
+	}
+
+	if (w.TLSCert == "") != (w.TLSKey == "") {
+		v.fail("bot.webhook.tls_cert", "tls_cert and tls_key must be set together")
+	}
+	if w.UploadCert && w.TLSCert == "" {
+		v.fail("bot.webhook.upload_cert", "requires tls_cert")
+	}
+	if w.MaxConnections != 0 && (w.MaxConnections < 1 || w.MaxConnections > 100) {
+		v.fail("bot.webhook.max_connections", "must be between 1 and 100")
+	}
+}
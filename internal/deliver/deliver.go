@@ -0,0 +1,58 @@
+// Package deliver кладёт скачанные файлы туда, где их ждёт пользователь,
+// если это не почта: в S3-совместимое хранилище, на WebDAV или в
+// локальный каталог. В хранилище файл с тем же именем заменяется, в
+// каталоге — нет.
+package deliver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// File — файл, который нужно доставить.
+type File struct {
+	// имя у получателя, без каталогов
+	Name string
+	// путь к файлу на диске
+	Path string
+	Size int64
+	// SHA-256 содержимого в hex
+	Checksum    string
+	ContentType string
+}
+
+// Deliverer доставляет файл в одно место.
+type Deliverer interface {
+	// Deliver возвращает, где оказался файл: URL или путь.
+	Deliver(ctx context.Context, f File) (string, error)
+}
+
+// checkName не даёт имени файла выйти за каталог назначения.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+func client(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return c
+}
+
+// statusError — ответ сервера с кодом, которого не ждали; начало тела
+// помогает понять причину.
+func statusError(op string, resp *http.Response, body []byte) error {
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 200 {
+		msg = msg[:200]
+	}
+	if msg == "" {
+		return fmt.Errorf("%s: http status %d", op, resp.StatusCode)
+	}
+	return fmt.Errorf("%s: http status %d: %s", op, resp.StatusCode, msg)
+}
@@ -0,0 +1,96 @@
+package deliver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxNameTries — сколько имён с номером пробовать, если файл уже есть.
+const maxNameTries = 1000
+
+// Dir кладёт файлы в локальный каталог, например примонтированный
+// сетевой диск. Файл сначала пишется под временным именем, так что
+// недописанный файл в каталоге не появляется. Существующий файл не
+// заменяется: новый получает номер, «отчёт (1).pdf».
+type Dir struct {
+	Path string
+}
+
+func (d *Dir) Deliver(ctx context.Context, f File) (string, error) {
+	if err := checkName(f.Name); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(d.Path, 0o755); err != nil {
+		return "", err
+	}
+	in, err := os.Open(f.Path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(d.Path, ".partial-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, readerCtx{ctx, in}); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	// CreateTemp создаёт файл 0600, владельцу каталога этого мало
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return "", err
+	}
+	// жёсткая ссылка, в отличие от rename, не заменяет существующий файл
+	for i := range maxNameTries {
+		dst := filepath.Join(d.Path, numbered(f.Name, i))
+		err := os.Link(tmp.Name(), dst)
+		if err == nil {
+			return dst, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%s: too many files named %q", d.Path, f.Name)
+}
+
+// numbered — имя файла с номером перед расширением; 0 — имя как есть.
+func numbered(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if ext == name {
+		// .bashrc — имя без расширения
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// readerCtx прерывает копирование большого файла при отмене задания.
+type readerCtx struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r readerCtx) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
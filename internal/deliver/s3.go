@@ -0,0 +1,191 @@
+package deliver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRegion — регион подписи, если он не задан: MinIO и большинство
+// совместимых хранилищ принимают его.
+const DefaultRegion = "us-east-1"
+
+// S3 загружает файлы в бакет S3-совместимого хранилища (AWS S3, MinIO,
+// Ceph). Запрос подписывается AWS Signature Version 4; адрес объекта —
+// в стиле path: <endpoint>/<bucket>/<key>, так его понимают все
+// совместимые хранилища.
+type S3 struct {
+	// адрес API, например https://s3.eu-central-1.amazonaws.com или
+	// http://minio:9000
+	Endpoint string
+	Bucket   string
+	// пустой — DefaultRegion
+	Region string
+	// префикс ключа объекта, например incoming/
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+
+	// для тестов; nil — time.Now
+	now func() time.Time
+}
+
+func (s *S3) Deliver(ctx context.Context, f File) (string, error) {
+	if err := checkName(f.Name); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimPrefix(path.Join(s.Prefix, f.Name), "/")
+	// на проводе путь закодирован так же, как в подписи
+	u.Path += "/" + s.Bucket + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+
+	in, err := os.Open(f.Path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), in)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = f.Size
+	if f.ContentType != "" {
+		req.Header.Set("Content-Type", f.ContentType)
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	// тело уже посчитано при скачивании: подпись покрывает и его
+	payloadHash := f.Checksum
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	s.sign(req, payloadHash, now())
+
+	resp, err := client(s.Client).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError("s3 put", resp, body)
+	}
+	return u.String(), nil
+}
+
+// sign добавляет к запросу заголовки подписи AWS Signature Version 4.
+// Подписываются Host и все заголовки, уже выставленные в запросе.
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	region := s.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(strings.Fields(strings.Join(v, ",")), " ")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonical)
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, signature))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode кодирует всё, кроме unreserved-символов RFC 3986; «/»
+// кодируется только в параметрах запроса.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
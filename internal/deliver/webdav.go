@@ -0,0 +1,99 @@
+package deliver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// WebDAV загружает файлы в каталог на WebDAV-сервере (Nextcloud,
+// ownCloud, nginx с dav_methods). Недостающие каталоги создаются.
+type WebDAV struct {
+	// адрес каталога
+	URL string
+	// пустой — без авторизации
+	Username, Password string
+	Client             *http.Client
+}
+
+func (d *WebDAV) Deliver(ctx context.Context, f File) (string, error) {
+	if err := checkName(f.Name); err != nil {
+		return "", err
+	}
+	dir, err := url.Parse(strings.TrimSuffix(d.URL, "/") + "/")
+	if err != nil {
+		return "", err
+	}
+	target := dir.JoinPath(f.Name)
+
+	status, err := d.put(ctx, target, f)
+	if status == http.StatusConflict {
+		// 409 — нет родительского каталога (RFC 4918, 9.7.1)
+		d.mkcolAll(ctx, dir)
+		status, err = d.put(ctx, target, f)
+	}
+	if err != nil {
+		return "", err
+	}
+	return target.String(), nil
+}
+
+func (d *WebDAV) put(ctx context.Context, target *url.URL, f File) (int, error) {
+	in, err := os.Open(f.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), in)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = f.Size
+	if f.ContentType != "" {
+		req.Header.Set("Content-Type", f.ContentType)
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, statusError("webdav put", resp, body)
+}
+
+// mkcolAll создаёт каталог dir и всех его родителей. Ошибки не
+// проверяются: существующий каталог отвечает 405, а каталоги выше
+// пользовательского сервер может не дать даже смотреть — что получилось,
+// покажет повторный PUT.
+func (d *WebDAV) mkcolAll(ctx context.Context, dir *url.URL) {
+	segments := strings.Split(strings.Trim(dir.Path, "/"), "/")
+	for i := range segments {
+		u := *dir
+		u.Path = "/" + strings.Join(segments[:i+1], "/") + "/"
+		u.RawPath = ""
+		req, err := http.NewRequestWithContext(ctx, "MKCOL", u.String(), nil)
+		if err != nil {
+			return
+		}
+		resp, err := d.do(req)
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+	}
+}
+
+func (d *WebDAV) do(req *http.Request) (*http.Response, error) {
+	if d.Username != "" {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+	return client(d.Client).Do(req)
+}
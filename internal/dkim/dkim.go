@@ -0,0 +1,269 @@
+// Package dkim подписывает исходящие письма по DKIM (RFC 6376) ключом
+// RSA (rsa-sha256) или Ed25519 (ed25519-sha256, RFC 8463). Заголовки и
+// тело канонизируются в режиме relaxed/relaxed: он переживает
+// переформатирование пробелов почтовыми серверами по пути.
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignedHeaders — заголовки, которые входят в подпись, если они есть в
+// письме.
+var SignedHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+// Signer подписывает письма одного домена одним ключом.
+type Signer struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	// rsa-sha256 или ed25519-sha256
+	algorithm string
+
+	// для тестов; nil — time.Now
+	now func() time.Time
+}
+
+// NewSigner создаёт подписывающего для domain и selector. keyPEM —
+// закрытый ключ в PEM: PKCS#8 (RSA или Ed25519) или PKCS#1 (RSA).
+func NewSigner(domain, selector string, keyPEM []byte) (*Signer, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("dkim: domain and selector are required")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM block in private key")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("dkim: unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: parse private key: %w", err)
+	}
+
+	s := &Signer{domain: domain, selector: selector}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		// RFC 8301: ключи короче 1024 бит проверяющие не принимают
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("dkim: rsa key is too short: %d bits", k.N.BitLen())
+		}
+		s.key, s.algorithm = k, "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.key, s.algorithm = k, "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("dkim: unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+// LoadSigner — NewSigner с ключом из файла.
+func LoadSigner(domain, selector, keyFile string) (*Signer, error) {
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	return NewSigner(domain, selector, keyPEM)
+}
+
+// Domain — домен подписи (тег d=).
+func (s *Signer) Domain() string { return s.domain }
+
+// RecordName — имя TXT-записи с открытым ключом.
+func (s *Signer) RecordName() string {
+	return s.selector + "._domainkey." + s.domain
+}
+
+// Record — значение TXT-записи с открытым ключом для DNS.
+func (s *Signer) Record() string {
+	var k string
+	var pub []byte
+	switch key := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		k = "rsa"
+		pub, _ = x509.MarshalPKIXPublicKey(key)
+	case ed25519.PublicKey:
+		k = "ed25519"
+		pub = key
+	}
+	return "v=DKIM1; k=" + k + "; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// Sign читает письмо целиком и возвращает поле DKIM-Signature вместе с
+// завершающим CRLF; его нужно записать перед письмом без изменений в
+// самом письме.
+func (s *Signer) Sign(r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+	headers, err := readHeaders(br)
+	if err != nil {
+		return "", err
+	}
+
+	bodyHash := sha256.New()
+	if err := canonicalBody(bodyHash, br); err != nil {
+		return "", err
+	}
+
+	// заголовки подписываются снизу вверх: при повторах берётся
+	// последний ещё не использованный экземпляр
+	var names []string
+	h := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range SignedHeaders {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headerName(headers[i]), name) {
+				continue
+			}
+			used[i] = true
+			names = append(names, strings.ToLower(name))
+			io.WriteString(h, canonicalHeader(headers[i]))
+			break
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		return "", errors.New("dkim: message has no From header")
+	}
+
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	// значение b= дописывается после подписи; всё до него подписано
+	// в том виде, в каком уйдёт
+	field := "DKIM-Signature: v=1; a=" + s.algorithm + "; c=relaxed/relaxed;\r\n" +
+		" d=" + s.domain + "; s=" + s.selector + "; t=" + strconv.FormatInt(now().Unix(), 10) + ";\r\n" +
+		" h=" + strings.Join(names, ":") + ";\r\n" +
+		" bh=" + base64.StdEncoding.EncodeToString(bodyHash.Sum(nil)) + ";\r\n" +
+		" b="
+	io.WriteString(h, strings.TrimSuffix(canonicalHeader(field+"\r\n"), "\r\n"))
+
+	sig, err := s.sign(h.Sum(nil))
+	if err != nil {
+		return "", fmt.Errorf("dkim: sign: %w", err)
+	}
+	return field + fold(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+func (s *Signer) sign(digest []byte) ([]byte, error) {
+	if s.algorithm == "ed25519-sha256" {
+		// RFC 8463: Ed25519 подписывает сам хэш SHA-256 как сообщение
+		return s.key.Sign(nil, digest, crypto.Hash(0))
+	}
+	return s.key.Sign(nil, digest, crypto.SHA256)
+}
+
+// readHeaders читает блок заголовков до пустой строки. Каждое поле —
+// вместе с продолжениями и завершающим CRLF.
+func readHeaders(br *bufio.Reader) ([]string, error) {
+	var headers []string
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return nil, errors.New("dkim: message has no body separator")
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = crlf(line)
+		if line == "\r\n" {
+			return headers, nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+			continue
+		}
+		headers = append(headers, line)
+	}
+}
+
+func headerName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
+
+// canonicalHeader — relaxed-канонизация поля (RFC 6376, 3.4.2): имя в
+// нижнем регистре, продолжения склеены, пробелы схлопнуты и обрезаны.
+func canonicalHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value + "\r\n"
+}
+
+// canonicalBody пишет в w тело в relaxed-канонизации (RFC 6376, 3.4.4):
+// пробелы внутри строк схлопнуты, в конце строк убраны, пустые строки в
+// конце тела отброшены.
+func canonicalBody(w io.Writer, br *bufio.Reader) error {
+	bw := bufio.NewWriter(w)
+	emptyLines := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			fields := bytes.FieldsFunc(line, isWSP)
+			// строка из одних пробелов после канонизации пустая
+			if len(fields) == 0 {
+				emptyLines++
+			} else {
+				for ; emptyLines > 0; emptyLines-- {
+					bw.WriteString("\r\n")
+				}
+				if isWSP(rune(line[0])) {
+					bw.WriteByte(' ')
+				}
+				bw.Write(bytes.Join(fields, []byte(" ")))
+				bw.WriteString("\r\n")
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func isWSP(r rune) bool { return r == ' ' || r == '\t' }
+
+func crlf(line string) string {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	return line + "\r\n"
+}
+
+// fold разбивает длинное значение b= на строки, чтобы поле не
+// превышало 78 символов в строке.
+func fold(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n ")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,294 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"download_track/internal/mailmsg"
+)
+
+// Проверяющий ниже написан отдельно от подписывающего и намеренно
+// прямолинейно: канонизация по RFC 6376 на регулярных выражениях по всему
+// письму в памяти, ключ — из «DNS» в виде map.
+
+var (
+	wsp      = regexp.MustCompile(`[ \t]+`)
+	fws      = regexp.MustCompile(`\r\n([ \t])`)
+	bTag     = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+	noSpaces = strings.NewReplacer(" ", "", "\t", "", "\r\n", "")
+)
+
+func verify(msg string, dns map[string]string) error {
+	head, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		return errors.New("no body")
+	}
+	fields := strings.Split(fws.ReplaceAllString(head, "$1"), "\r\n")
+
+	sigIdx := -1
+	for i, f := range fields {
+		if strings.HasPrefix(strings.ToLower(f), "dkim-signature:") {
+			sigIdx = i
+			break
+		}
+	}
+	if sigIdx < 0 {
+		return errors.New("no DKIM-Signature")
+	}
+	_, sigValue, _ := strings.Cut(fields[sigIdx], ":")
+	tags := map[string]string{}
+	for _, t := range strings.Split(sigValue, ";") {
+		k, v, ok := strings.Cut(t, "=")
+		if ok {
+			tags[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unexpected tags %v", tags)
+	}
+
+	// тело: пробелы схлопнуть, в конце строк убрать, пустые строки в конце отбросить
+	lines := strings.Split(body, "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(l, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	canonBody := ""
+	if len(lines) > 0 {
+		canonBody = strings.Join(lines, "\r\n") + "\r\n"
+	}
+	bh := sha256.Sum256([]byte(canonBody))
+	if base64.StdEncoding.EncodeToString(bh[:]) != noSpaces.Replace(tags["bh"]) {
+		return errors.New("body hash mismatch")
+	}
+
+	canon := func(f string) string {
+		name, value, _ := strings.Cut(f, ":")
+		return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	}
+	var signed strings.Builder
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			n, _, _ := strings.Cut(fields[i], ":")
+			if !used[i] && i != sigIdx && strings.EqualFold(strings.TrimSpace(n), strings.TrimSpace(name)) {
+				used[i] = true
+				signed.WriteString(canon(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	signed.WriteString(canon(bTag.ReplaceAllString(fields[sigIdx], "$1$2")))
+	digest := sha256.Sum256([]byte(signed.String()))
+
+	record, ok := dns[tags["s"]+"._domainkey."+tags["d"]]
+	if !ok {
+		return errors.New("no key record")
+	}
+	rec := map[string]string{}
+	for _, t := range strings.Split(record, ";") {
+		k, v, _ := strings.Cut(t, "=")
+		rec[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	pub, err := base64.StdEncoding.DecodeString(rec["p"])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(noSpaces.Replace(tags["b"]))
+	if err != nil {
+		return err
+	}
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		key, err := x509.ParsePKIXPublicKey(pub)
+		if err != nil {
+			return err
+		}
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+	case "ed25519-sha256":
+		if !ed25519.Verify(ed25519.PublicKey(pub), digest[:], sig) {
+			return errors.New("ed25519 signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown algorithm %q", tags["a"])
+}
+
+func rsaKeyPEM(t *testing.T, bits int) []byte {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+}
+
+func ed25519KeyPEM(t *testing.T) []byte {
+	t.Helper()
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// signedMessage собирает письмо с вложением и подписывает его.
+func signedMessage(t *testing.T, s *Signer) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("pdf "), 500), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m := &mailmsg.Message{
+		From:        mail.Address{Name: "filemailer", Address: "bot@example.com"},
+		To:          []string{"user@example.org"},
+		Subject:     "[files] Файл report.pdf",
+		Text:        "Файл   скачан.\n\n\n",
+		HTML:        "<p>Файл скачан.</p>",
+		Attachments: []mailmsg.Attachment{{Name: "report.pdf", Path: path}},
+	}
+
+	var msg bytes.Buffer
+	if err := m.Encode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := s.Sign(bytes.NewReader(msg.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(sig, "\r\n") {
+		if len(line) > 78 {
+			t.Fatalf("signature line is %d chars: %q", len(line), line)
+		}
+	}
+	return sig + msg.String()
+}
+
+func TestSignVerify(t *testing.T) {
+	for name, keyPEM := range map[string][]byte{
+		"rsa":     rsaKeyPEM(t, 2048),
+		"ed25519": ed25519KeyPEM(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewSigner("example.com", "mail", keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.now = func() time.Time { return time.Unix(1700000000, 0) }
+			dns := map[string]string{s.RecordName(): s.Record()}
+
+			msg := signedMessage(t, s)
+			if err := verify(msg, dns); err != nil {
+				t.Fatalf("verify: %v\n%s", err, msg[:600])
+			}
+			if !strings.Contains(msg, "a="+name+"-sha256;") || !strings.Contains(msg, "t=1700000000;") {
+				t.Fatalf("unexpected signature header:\n%s", msg[:400])
+			}
+			if !strings.Contains(msg, "h=from:to:subject:date:message-id:mime-version:content-type;") {
+				t.Fatalf("unexpected signed headers:\n%s", msg[:400])
+			}
+
+			// relaxed-канонизация переносит переформатирование пробелов
+			// и лишние пустые строки в конце
+			reformatted := strings.Replace(msg, "Subject: ", "Subject:   \r\n\t", 1) + "\r\n\r\n"
+			if err := verify(reformatted, dns); err != nil {
+				t.Fatalf("reformatted message: %v", err)
+			}
+
+			// а изменение содержимого — нет
+			if err := verify(strings.Replace(msg, "To: user@example.org", "To: evil@example.org", 1), dns); err == nil {
+				t.Fatal("changed header verified")
+			}
+			i := strings.LastIndex(msg, "cGRm")
+			if err := verify(msg[:i]+"cGRn"+msg[i+4:], dns); err == nil {
+				t.Fatal("changed body verified")
+			}
+
+			// подпись другим ключом того же селектора не проходит
+			other, _ := NewSigner("example.com", "mail", ed25519KeyPEM(t))
+			if err := verify(msg, map[string]string{s.RecordName(): other.Record()}); err == nil {
+				t.Fatal("verified with a wrong key")
+			}
+		})
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                             "",
+		"\r\n\r\n":                     "",
+		"a  b \t\r\n":                  "a b\r\n",
+		"  lead\r\n\r\n \r\nx\r\n\r\n": " lead\r\n\r\n\r\nx\r\n",
+		"no newline":                   "no newline\r\n",
+	} {
+		var b bytes.Buffer
+		if err := canonicalBody(&b, newReader(in)); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("canonicalBody(%q) = %q, want %q", in, b.String(), want)
+		}
+	}
+}
+
+func newReader(s string) *bufio.Reader {
+	return bufio.NewReader(strings.NewReader(s))
+}
+
+func TestCanonicalHeader(t *testing.T) {
+	got := canonicalHeader("SubJect \t:  Hello \r\n\t  world  \r\n")
+	if want := "subject:Hello world\r\n"; got != want {
+		t.Fatalf("canonicalHeader = %q, want %q", got, want)
+	}
+}
+
+func TestNewSignerErrors(t *testing.T) {
+	for name, keyPEM := range map[string][]byte{
+		"garbage":    []byte("not a key"),
+		"public key": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}),
+	} {
+		if _, err := NewSigner("example.com", "mail", keyPEM); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+	if _, err := NewSigner("", "mail", ed25519KeyPEM(t)); err == nil {
+		t.Error("empty domain: want error")
+	}
+}
+
+func TestSignWithoutFrom(t *testing.T) {
+	s, err := NewSigner("example.com", "mail", ed25519KeyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Sign(strings.NewReader("To: a@example.com\r\n\r\nbody\r\n")); err == nil {
+		t.Fatal("want error without From")
+	}
+	if _, err := s.Sign(strings.NewReader("From: a@example.com\r\n")); err == nil {
+		t.Fatal("want error without body separator")
+	}
+}
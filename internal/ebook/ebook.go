@@ -0,0 +1,328 @@
+// Package ebook определяет формат файла для электронных книг и собирает
+// EPUB 3 из HTML-страницы, чтобы её можно было читать на e-reader.
+package ebook
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// форматы; значение совпадает с расширением файла
+const (
+	EPUB = "epub"
+	PDF  = "pdf"
+	DOCX = "docx"
+	TXT  = "txt"
+	HTML = "html"
+)
+
+// SniffLen — сколько первых байт файла нужно Detect.
+const SniffLen = 512
+
+const (
+	epubMIME = "application/epub+zip"
+	docxMIME = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+)
+
+// Detect определяет формат по началу файла, имени и Content-Type из
+// ответа сервера. Содержимое важнее имени: PDF под именем .txt — всё
+// равно PDF. Пустая строка — формат не распознан.
+func Detect(name, contentType string, head []byte) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return PDF
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		// EPUB начинается с несжатого файла mimetype (OCF 3.0, 4.3)
+		if len(head) >= 30+8+len(epubMIME) && string(head[30:38]) == "mimetype" && string(head[38:38+len(epubMIME)]) == epubMIME {
+			return EPUB
+		}
+		switch {
+		case ext == DOCX || mediaType == docxMIME:
+			return DOCX
+		case ext == EPUB || mediaType == epubMIME:
+			return EPUB
+		}
+		return ""
+	}
+
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !strings.HasPrefix(sniffed, "text/") {
+		return ""
+	}
+	switch {
+	case sniffed == "text/html", mediaType == "text/html", mediaType == "application/xhtml+xml",
+		ext == "html", ext == "htm", ext == "xhtml":
+		return HTML
+	case ext == TXT, ext == "", mediaType == "text/plain":
+		return TXT
+	}
+	return ""
+}
+
+// Meta — данные книги, которых может не быть в самой странице.
+type Meta struct {
+	// заголовок, если у страницы нет <title>
+	Title string
+	// язык, если у страницы нет <html lang>
+	Language string
+	// адрес страницы; становится идентификатором книги
+	Source string
+	// время изменения; нулевое — сейчас
+	Modified time.Time
+}
+
+// FromHTML собирает EPUB из одной HTML-страницы. Скрипты, стили, формы и
+// встроенные объекты выбрасываются, картинки заменяются подписью: книга
+// не должна ничего подгружать из сети.
+func FromHTML(w io.Writer, r io.Reader, meta Meta) error {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return err
+	}
+
+	title := strings.Join(strings.Fields(textOf(find(doc, atom.Title))), " ")
+	if title == "" {
+		title = meta.Title
+	}
+	if title == "" {
+		title = "Untitled"
+	}
+	lang := meta.Language
+	if root := find(doc, atom.Html); root != nil {
+		if l := attr(root, "lang"); l != "" {
+			lang = l
+		}
+	}
+	if lang == "" {
+		lang = "en"
+	}
+
+	var body bytes.Buffer
+	if b := find(doc, atom.Body); b != nil {
+		clean(b)
+		for c := b.FirstChild; c != nil; c = c.NextSibling {
+			if err := html.Render(&body, c); err != nil {
+				return err
+			}
+		}
+	}
+
+	id := meta.Source
+	if id == "" {
+		sum := sha256.Sum256(body.Bytes())
+		id = "urn:sha256:" + hex.EncodeToString(sum[:])
+	}
+	modified := meta.Modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	zw := zip.NewWriter(w)
+	// mimetype — первым и без сжатия
+	mw, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	io.WriteString(mw, epubMIME)
+
+	files := []struct{ name, content string }{
+		{"META-INF/container.xml", containerXML},
+		{"OEBPS/content.opf", fmt.Sprintf(contentOPF, esc(id), esc(title), esc(lang), modified.UTC().Format(time.RFC3339))},
+		{"OEBPS/nav.xhtml", fmt.Sprintf(navXHTML, esc(lang), esc(title))},
+		{"OEBPS/index.xhtml", fmt.Sprintf(indexXHTML, esc(lang), esc(title), body.String())},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, f.content); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// dropped — элементы, которые выбрасываются вместе с содержимым: они
+// исполняются, подгружают внешние ресурсы или не отображаются. Сюда же
+// попадают все элементы, текст которых html.Render не экранирует.
+var dropped = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Iframe: true, atom.Frame: true, atom.Frameset: true, atom.Noframes: true,
+	atom.Object: true, atom.Embed: true, atom.Applet: true, atom.Noembed: true,
+	atom.Video: true, atom.Audio: true, atom.Source: true, atom.Track: true,
+	atom.Canvas: true, atom.Svg: true, atom.Math: true, atom.Map: true,
+	atom.Form: true, atom.Input: true, atom.Button: true, atom.Select: true,
+	atom.Textarea: true, atom.Link: true, atom.Meta: true, atom.Base: true,
+	atom.Plaintext: true, atom.Xmp: true, atom.Dialog: true,
+}
+
+// keptAttrs — атрибуты, которые остаются у элементов.
+var keptAttrs = map[string]bool{
+	"href": true, "id": true, "title": true, "lang": true, "dir": true,
+	"colspan": true, "rowspan": true, "start": true, "datetime": true, "cite": true,
+}
+
+// clean приводит поддерево к виду, который html.Render выводит
+// корректным XHTML.
+func clean(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch {
+		case c.Type == html.CommentNode || c.Type == html.DoctypeNode:
+			n.RemoveChild(c)
+		case c.Type != html.ElementNode:
+		case c.Namespace != "" || dropped[c.DataAtom]:
+			n.RemoveChild(c)
+		case c.DataAtom == atom.Img:
+			if alt := strings.TrimSpace(attr(c, "alt")); alt != "" {
+				n.InsertBefore(&html.Node{Type: html.TextNode, Data: "[" + alt + "]"}, c)
+			}
+			n.RemoveChild(c)
+		case !xmlName(c.Data):
+			// неизвестный элемент с именем, которое не годится для XML:
+			// оставляем только содержимое
+			clean(c)
+			for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+				c.RemoveChild(gc)
+				n.InsertBefore(gc, c)
+			}
+			n.RemoveChild(c)
+		default:
+			attrs := c.Attr[:0]
+			for _, a := range c.Attr {
+				if a.Namespace != "" || !keptAttrs[a.Key] {
+					continue
+				}
+				if a.Key == "href" && !safeHref(a.Val) {
+					continue
+				}
+				attrs = append(attrs, a)
+			}
+			c.Attr = attrs
+			clean(c)
+		}
+		c = next
+	}
+}
+
+func safeHref(href string) bool {
+	href = strings.ToLower(strings.TrimSpace(href))
+	return strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") ||
+		strings.HasPrefix(href, "mailto:") || strings.HasPrefix(href, "#")
+}
+
+func xmlName(s string) bool {
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func find(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := find(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func textOf(n *html.Node) string {
+	if n == nil {
+		return ""
+	}
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textOf(c))
+	}
+	return sb.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func esc(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const containerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const contentOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:language>%s</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="index" href="index.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="index"/>
+  </spine>
+</package>
+`
+
+const navXHTML = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="%s">
+<head><title>%[2]s</title></head>
+<body>
+<nav epub:type="toc"><ol><li><a href="index.xhtml">%[2]s</a></li></ol></nav>
+</body>
+</html>
+`
+
+const indexXHTML = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="%s">
+<head><title>%s</title></head>
+<body>
+%s
+</body>
+</html>
+`
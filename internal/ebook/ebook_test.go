@@ -0,0 +1,128 @@
+package ebook
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetect(t *testing.T) {
+	var epub bytes.Buffer
+	if err := FromHTML(&epub, strings.NewReader("<p>x</p>"), Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	var docx bytes.Buffer
+	zw := zip.NewWriter(&docx)
+	zw.Create("[Content_Types].xml")
+	zw.Close()
+
+	tests := []struct {
+		name, contentType string
+		head              []byte
+		want              string
+	}{
+		{"book.pdf", "application/pdf", []byte("%PDF-1.7\n"), PDF},
+		{"book.txt", "text/plain", []byte("%PDF-1.4\n"), PDF},
+		{"book", "application/octet-stream", epub.Bytes(), EPUB},
+		{"letter.docx", "application/octet-stream", docx.Bytes(), DOCX},
+		{"download", docxMIME, docx.Bytes(), DOCX},
+		{"archive.zip", "application/zip", docx.Bytes(), ""},
+		{"index", "text/html; charset=utf-8", []byte("<!doctype html><p>hi"), HTML},
+		{"page.htm", "", []byte("just text"), HTML},
+		{"notes.txt", "", []byte("just text"), TXT},
+		{"README", "text/plain", []byte("just text"), TXT},
+		{"main.go", "", []byte("package main"), ""},
+		{"photo.jpg", "image/jpeg", []byte("\xff\xd8\xff\xe0"), ""},
+	}
+	for _, tc := range tests {
+		if got := Detect(tc.name, tc.contentType, tc.head); got != tc.want {
+			t.Errorf("Detect(%q, %q) = %q, want %q", tc.name, tc.contentType, got, tc.want)
+		}
+	}
+}
+
+func TestFromHTML(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html lang="ru"><head><title> Статья &amp; заметки </title>
+<style>p { color: red }</style><script>alert("x")</script></head>
+<body onload="evil()">
+<h1 class="t" style="x">Заголовок</h1>
+<p>Текст&nbsp;с <b>разметкой</b><br>и <a href="javascript:evil()">ссылкой</a>, <a href="https://example.com/?a=1&b=2">ещё одной</a>
+<img src="https://example.com/a.png" alt="схема">
+<iframe src="https://example.com/ad"></iframe>
+<form><input name="q"></form>
+<svg><circle r="1"/></svg>
+<!-- комментарий -->
+<table><tr><td colspan=2>ячейка</td></tr></table>
+</body></html>`
+
+	var buf bytes.Buffer
+	err := FromHTML(&buf, strings.NewReader(page), Meta{Source: "https://example.com/article", Modified: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Fatalf("first entry %q, method %d", zr.File[0].Name, zr.File[0].Method)
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+		if strings.HasSuffix(f.Name, ".xml") || strings.HasSuffix(f.Name, ".opf") || strings.HasSuffix(f.Name, ".xhtml") {
+			wellFormed(t, f.Name, b)
+		}
+	}
+
+	if files["mimetype"] != "application/epub+zip" {
+		t.Fatalf("mimetype = %q", files["mimetype"])
+	}
+	opf := files["OEBPS/content.opf"]
+	for _, want := range []string{"<dc:title>Статья &amp; заметки</dc:title>", "<dc:language>ru</dc:language>",
+		"https://example.com/article", "2026-01-02T03:04:05Z"} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("content.opf has no %q:\n%s", want, opf)
+		}
+	}
+
+	index := files["OEBPS/index.xhtml"]
+	for _, want := range []string{"<h1>Заголовок</h1>", "<b>разметкой</b><br/>", "<a>ссылкой</a>",
+		`<a href="https://example.com/?a=1&amp;b=2">`, "[схема]", `<td colspan="2">ячейка</td>`} {
+		if !strings.Contains(index, want) {
+			t.Errorf("index.xhtml has no %q:\n%s", want, index)
+		}
+	}
+	for _, bad := range []string{"alert", "color: red", "evil", "iframe", "<form", "<input", "circle", "комментарий", "<img", "style="} {
+		if strings.Contains(index, bad) {
+			t.Errorf("index.xhtml still has %q:\n%s", bad, index)
+		}
+	}
+}
+
+func wellFormed(t *testing.T, name string, data []byte) {
+	t.Helper()
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s is not well-formed XML: %v\n%s", name, err, data)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// Data отдаёт содержимое data: URL (RFC 2397). Имени у такого файла нет.
+type Data struct{}
+
+func (Data) Fetch(_ context.Context, u *url.URL) (*Result, error) {
+	// data:text/plain;base64,SGVsbG8= разбирается в Opaque
+	raw := u.Opaque
+	if raw == "" {
+		raw = strings.TrimPrefix(u.String(), u.Scheme+":")
+	}
+	meta, payload, ok := strings.Cut(raw, ",")
+	if !ok {
+		return nil, errors.New("data url without comma")
+	}
+	meta, err := url.PathUnescape(meta)
+	if err != nil {
+		return nil, err
+	}
+	isBase64 := false
+	if m, ok := strings.CutSuffix(meta, ";base64"); ok {
+		meta, isBase64 = m, true
+	}
+	contentType := "text/plain;charset=US-ASCII"
+	if meta != "" {
+		if strings.HasPrefix(meta, ";") {
+			// только параметры, например ;charset=utf-8
+			meta = "text/plain" + meta
+		}
+		if _, _, err := mime.ParseMediaType(meta); err != nil {
+			return nil, err
+		}
+		contentType = meta
+	}
+
+	text, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(text)
+	if isBase64 {
+		// пробелы и переносы в base64 встречаются в скопированных ссылках
+		clean := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+				return -1
+			}
+			return r
+		}, text)
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(clean, "=")); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{
+		Body:        io.NopCloser(bytes.NewReader(data)),
+		Size:        int64(len(data)),
+		ContentType: contentType,
+		URL:         u,
+	}, nil
+}
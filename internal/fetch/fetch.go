@@ -0,0 +1,123 @@
+// Package fetch открывает файл по ссылке: загрузчик выбирается по схеме
+// URL, и каждый сообщает размер и имя файла одинаково.
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrUnsupportedScheme — для схемы URL нет загрузчика.
+var ErrUnsupportedScheme = errors.New("unsupported url scheme")
+
+// Result — открытый на чтение файл. Body закрывает вызывающий.
+type Result struct {
+	Body io.ReadCloser
+	// -1 — сервер не сообщил размер
+	Size int64
+	// имя файла без каталогов; пустое — неизвестно
+	Filename string
+	// пустой — неизвестен
+	ContentType string
+	// адрес после редиректов: по нему разрешаются ссылки страницы
+	URL *url.URL
+	// сервер отдал ответ как вложение (Content-Disposition: attachment)
+	attachment bool
+}
+
+// Fetcher открывает файл по URL своей схемы.
+type Fetcher interface {
+	Fetch(ctx context.Context, u *url.URL) (*Result, error)
+}
+
+// Fetchers — загрузчики по схеме URL в нижнем регистре.
+type Fetchers map[string]Fetcher
+
+// Fetch открывает файл загрузчиком для схемы rawURL.
+func (fs Fetchers) Fetch(ctx context.Context, rawURL string) (*Result, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fs[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedScheme, u.Scheme)
+	}
+	return f.Fetch(ctx, u)
+}
+
+// Supports сообщает, есть ли загрузчик для схемы.
+func (fs Fetchers) Supports(scheme string) bool {
+	_, ok := fs[strings.ToLower(scheme)]
+	return ok
+}
+
+// StatusError — сервер ответил, что файла нет или его не отдадут.
+type StatusError struct {
+	// код ответа HTTP, FTP или SFTP
+	Code int
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Code, e.Msg)
+}
+
+// Login — учётные данные пользователя на сервере FTP, SFTP или сайте.
+type Login struct {
+	User     string
+	Password string
+	// закрытый ключ SSH в PEM; только для SFTP
+	PrivateKey []byte
+	// открытый ключ сервера SSH в формате authorized_keys
+	HostKey string
+	// заголовки запроса, cookie и User-Agent; только для HTTP
+	Headers   map[string]string
+	Cookies   map[string]string
+	UserAgent string
+}
+
+// Logins находит учётные данные для схемы и хоста; nil без ошибки —
+// учётных данных нет.
+type Logins func(ctx context.Context, scheme, host string) (*Login, error)
+
+// login — учётные данные для u: сохранённые или имя из URL без пароля.
+// Имя в URL, не совпадающее с сохранённым, — ошибка: иначе файл
+// скачивался бы от чужого имени.
+func login(ctx context.Context, logins Logins, u *url.URL) (*Login, error) {
+	var l *Login
+	if logins != nil {
+		var err error
+		if l, err = logins(ctx, strings.ToLower(u.Scheme), strings.ToLower(u.Hostname())); err != nil {
+			return nil, err
+		}
+	}
+	name := u.User.Username()
+	switch {
+	case l == nil:
+		return &Login{User: name}, nil
+	case name != "" && name != l.User:
+		return nil, fmt.Errorf("no saved credentials for %s@%s", name, u.Hostname())
+	}
+	return l, nil
+}
+
+// baseName — последний сегмент пути файла.
+func baseName(p string) string {
+	name := path.Base(p)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// closeOnCancel закрывает c при отмене ctx, пока не вызвана stop:
+// сетевые чтения и записи в net.Conn не знают о контексте.
+func closeOnCancel(ctx context.Context, c io.Closer) (stop func() bool) {
+	return context.AfterFunc(ctx, func() { c.Close() })
+}
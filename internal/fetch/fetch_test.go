@@ -0,0 +1,573 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const content = "hello over the wire"
+
+func readAll(t *testing.T, res *Result) string {
+	t.Helper()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Body.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return string(data)
+}
+
+func TestFetchersScheme(t *testing.T) {
+	fs := Fetchers{"data": Data{}}
+	if _, err := fs.Fetch(context.Background(), "gopher://example.com/file"); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("err = %v, want ErrUnsupportedScheme", err)
+	}
+	if !fs.Supports("DATA") || fs.Supports("ftp") {
+		t.Fatal("Supports is wrong")
+	}
+}
+
+func TestData(t *testing.T) {
+	for _, tc := range []struct {
+		url, body, contentType string
+	}{
+		{"data:,Hello%2C%20World%21", "Hello, World!", "text/plain;charset=US-ASCII"},
+		{"data:text/plain;base64,SGVsbG8=", "Hello", "text/plain"},
+		{"data:;charset=utf-8;base64,0J/RgNC4%0A0LLQtdGC", "Привет", "text/plain;charset=utf-8"},
+		{"DATA:application/json,{}", "{}", "application/json"},
+	} {
+		res, err := Fetchers{"data": Data{}}.Fetch(context.Background(), tc.url)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		if res.Size != int64(len(tc.body)) || res.ContentType != tc.contentType || res.Filename != "" {
+			t.Errorf("%s: size %d, type %q, name %q", tc.url, res.Size, res.ContentType, res.Filename)
+		}
+		if got := readAll(t, res); got != tc.body {
+			t.Errorf("%s: body %q, want %q", tc.url, got, tc.body)
+		}
+	}
+	if _, err := (Data{}).Fetch(context.Background(), mustParse(t, "data:text/plain")); err == nil {
+		t.Error("data url without comma accepted")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/files/report.pdf", http.StatusFound)
+		case "/files/report.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			io.WriteString(w, content)
+		case "/download":
+			w.Header().Set("Content-Disposition", `attachment; filename="../data.csv"`)
+			io.WriteString(w, content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	h := &HTTP{Client: srv.Client()}
+
+	res, err := h.Fetch(context.Background(), mustParse(t, srv.URL+"/old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Filename != "report.pdf" || res.Size != int64(len(content)) || res.ContentType != "application/pdf" || res.URL.Path != "/files/report.pdf" {
+		t.Errorf("result = %+v", res)
+	}
+	readAll(t, res)
+
+	res, err = h.Fetch(context.Background(), mustParse(t, srv.URL+"/download?id=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Filename != "data.csv" {
+		t.Errorf("filename = %q", res.Filename)
+	}
+	readAll(t, res)
+
+	var serr *StatusError
+	if _, err := h.Fetch(context.Background(), mustParse(t, srv.URL+"/missing")); !errors.As(err, &serr) || serr.Code != 404 {
+		t.Fatalf("err = %v, want status 404", err)
+	}
+}
+
+func TestHTTPLogin(t *testing.T) {
+	// другой хост: учётные данные туда уходить не должны
+	var leaked []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{"Authorization", "Cookie", "X-Api-Key"} {
+			if r.Header.Get(h) != "" {
+				leaked = append(leaked, h)
+			}
+		}
+		io.WriteString(w, content)
+	}))
+	defer other.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		sid, _ := r.Cookie("sid")
+		if user != "alice" || pass != "pw" || r.Header.Get("X-Api-Key") != "k3y" || sid == nil || sid.Value != "s1" ||
+			r.UserAgent() != "Mozilla/5.0 (test)" {
+			http.Error(w, "who are you?", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/private/report.txt":
+			io.WriteString(w, content)
+		case "/private/elsewhere":
+			http.Redirect(w, r, other.URL+"/report.txt", http.StatusFound)
+		case "/private/again":
+			http.Redirect(w, r, "/private/report.txt", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	host := mustParse(t, srv.URL).Hostname()
+	h := &HTTP{Logins: func(_ context.Context, scheme, h string) (*Login, error) {
+		if scheme == "http" && h == host {
+			return &Login{User: "alice", Password: "pw", Headers: map[string]string{"X-Api-Key": "k3y"},
+				Cookies: map[string]string{"sid": "s1"}, UserAgent: "Mozilla/5.0 (test)"}, nil
+		}
+		return nil, nil
+	}}
+	for _, path := range []string{"/private/report.txt", "/private/again", "/private/elsewhere"} {
+		res, err := h.Fetch(context.Background(), mustParse(t, srv.URL+path))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got := readAll(t, res); got != content {
+			t.Errorf("%s: body %q", path, got)
+		}
+	}
+	if len(leaked) > 0 {
+		t.Errorf("redirect to another host got %v", leaked)
+	}
+
+	var serr *StatusError
+	if _, err := (&HTTP{}).Fetch(context.Background(), mustParse(t, srv.URL+"/private/report.txt")); !errors.As(err, &serr) || serr.Code != 401 {
+		t.Errorf("without login: %v, want status 401", err)
+	}
+}
+
+func TestHTTPLoginDowngrade(t *testing.T) {
+	// заголовки с учётными данными, дошедшие до файла
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/to-http":
+			http.Redirect(w, r, "http://site.test/file", http.StatusFound)
+		case "/to-https":
+			http.Redirect(w, r, "https://site.test/file", http.StatusFound)
+		default:
+			sent = nil
+			for _, h := range []string{"Authorization", "Cookie", "X-Api-Key"} {
+				if r.Header.Get(h) != "" {
+					sent = append(sent, h)
+				}
+			}
+			io.WriteString(w, content)
+		}
+	}))
+	defer srv.Close()
+
+	h := &HTTP{
+		Client: &http.Client{Transport: cloudTransport{srv.Listener.Addr().String()}},
+		Logins: func(_ context.Context, scheme, host string) (*Login, error) {
+			return &Login{User: "alice", Password: "pw", Headers: map[string]string{"X-Api-Key": "k3y"},
+				Cookies: map[string]string{"sid": "s1"}}, nil
+		},
+	}
+	for _, path := range []string{"/to-https", "/to-http"} {
+		res, err := h.Fetch(context.Background(), mustParse(t, "https://site.test"+path))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		readAll(t, res)
+		if path == "/to-https" && len(sent) != 3 {
+			t.Errorf("same-scheme redirect got %v, want all credentials", sent)
+		}
+		if path == "/to-http" && len(sent) != 0 {
+			t.Errorf("redirect from https to http got %v", sent)
+		}
+	}
+}
+
+func TestFTP(t *testing.T) {
+	srv := startFTP(t, "bob", "secret", map[string]string{"pub/report.txt": content})
+	logins := func(_ context.Context, scheme, host string) (*Login, error) {
+		if scheme == "ftp" && host == "127.0.0.1" {
+			return &Login{User: "bob", Password: "secret"}, nil
+		}
+		return nil, nil
+	}
+
+	for _, active := range []bool{false, true} {
+		f := &FTP{Logins: logins, Active: active, Timeout: 5 * time.Second}
+		res, err := f.Fetch(context.Background(), mustParse(t, "ftp://"+srv+"/pub/report.txt"))
+		if err != nil {
+			t.Fatalf("active %v: %v", active, err)
+		}
+		if res.Filename != "report.txt" || res.Size != int64(len(content)) {
+			t.Errorf("active %v: name %q, size %d", active, res.Filename, res.Size)
+		}
+		if got := readAll(t, res); got != content {
+			t.Errorf("active %v: body %q", active, got)
+		}
+	}
+
+	f := &FTP{Logins: logins, Timeout: 5 * time.Second}
+	var serr *StatusError
+	if _, err := f.Fetch(context.Background(), mustParse(t, "ftp://"+srv+"/pub/missing.txt")); !errors.As(err, &serr) || serr.Code != 550 {
+		t.Errorf("missing file: err = %v, want status 550", err)
+	}
+	// анонимный вход сервер не пускает
+	anon := &FTP{Timeout: 5 * time.Second}
+	if _, err := anon.Fetch(context.Background(), mustParse(t, "ftp://"+srv+"/pub/report.txt")); !errors.As(err, &serr) || serr.Code != 530 {
+		t.Errorf("anonymous: err = %v, want status 530", err)
+	}
+	if _, err := f.Fetch(context.Background(), mustParse(t, "ftp://eve@"+srv+"/pub/report.txt")); err == nil {
+		t.Error("login with another user name accepted")
+	}
+	if _, err := f.Fetch(context.Background(), mustParse(t, "ftp://"+srv+"/pub/")); err == nil {
+		t.Error("directory url accepted")
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	_, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, hostKey := startSFTP(t, "bob", "secret", clientSigner.PublicKey(), map[string]string{
+		"/srv/data.bin":       content,
+		"/home/bob/notes.txt": "notes",
+	})
+
+	var login *Login
+	s := &SFTP{Timeout: 5 * time.Second, Logins: func(_ context.Context, scheme, host string) (*Login, error) {
+		if scheme != "sftp" || host != "127.0.0.1" {
+			return nil, nil
+		}
+		return login, nil
+	}}
+
+	login = &Login{User: "bob", Password: "secret"}
+	_, err = s.Fetch(context.Background(), mustParse(t, "sftp://"+srv+"/srv/data.bin"))
+	if !errors.Is(err, ErrHostKeyUnknown) || !strings.Contains(err.Error(), hostKey) {
+		t.Fatalf("err = %v, want ErrHostKeyUnknown with %q", err, hostKey)
+	}
+
+	login.HostKey = hostKey
+	res, err := s.Fetch(context.Background(), mustParse(t, "sftp://"+srv+"/srv/data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Filename != "data.bin" || res.Size != int64(len(content)) {
+		t.Errorf("name %q, size %d", res.Filename, res.Size)
+	}
+	if got := readAll(t, res); got != content {
+		t.Errorf("body %q", got)
+	}
+
+	login = &Login{User: "bob", PrivateKey: pem.EncodeToMemory(pemKey), HostKey: hostKey}
+	res, err = s.Fetch(context.Background(), mustParse(t, "sftp://bob@"+srv+"/~/notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, res); got != "notes" {
+		t.Errorf("body %q", got)
+	}
+
+	var serr *StatusError
+	if _, err := s.Fetch(context.Background(), mustParse(t, "sftp://"+srv+"/srv/missing")); !errors.As(err, &serr) || serr.Code != 2 {
+		t.Errorf("missing file: err = %v, want status 2", err)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+	login.HostKey = string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey()))
+	if _, err := s.Fetch(context.Background(), mustParse(t, "sftp://"+srv+"/srv/data.bin")); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("foreign host key: err = %v", err)
+	}
+
+	login = &Login{User: "bob", Password: "wrong", HostKey: hostKey}
+	if _, err := s.Fetch(context.Background(), mustParse(t, "sftp://"+srv+"/srv/data.bin")); err == nil {
+		t.Error("wrong password accepted")
+	}
+	login = nil
+	if _, err := s.Fetch(context.Background(), mustParse(t, "sftp://"+srv+"/srv/data.bin")); err == nil {
+		t.Error("fetch without credentials succeeded")
+	}
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// startFTP запускает FTP-сервер с файлами files, пускающий только user.
+func startFTP(t *testing.T, user, pass string, files map[string]string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTP(conn, user, pass, files)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFTP(conn net.Conn, user, pass string, files map[string]string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(code int, msg string) { fmt.Fprintf(conn, "%d %s\r\n", code, msg) }
+	reply(220, "ready")
+
+	var name string
+	var loggedIn bool
+	var pasv net.Listener
+	var port string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch {
+		case cmd == "USER":
+			name = arg
+			reply(331, "password please")
+		case cmd == "PASS":
+			if name != user || arg != pass {
+				reply(530, "login incorrect")
+				continue
+			}
+			loggedIn = true
+			reply(230, "logged in")
+		case cmd == "QUIT":
+			reply(221, "bye")
+			return
+		case !loggedIn:
+			reply(530, "not logged in")
+		case cmd == "TYPE":
+			reply(200, "type set")
+		case cmd == "SIZE":
+			if data, ok := files[arg]; ok {
+				reply(213, strconv.Itoa(len(data)))
+			} else {
+				reply(550, "no such file")
+			}
+		case cmd == "EPSV":
+			pasv, _ = net.Listen("tcp", "127.0.0.1:0")
+			reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", pasv.Addr().(*net.TCPAddr).Port))
+		case cmd == "PORT":
+			p := strings.Split(arg, ",")
+			hi, _ := strconv.Atoi(p[4])
+			lo, _ := strconv.Atoi(p[5])
+			port = net.JoinHostPort(strings.Join(p[:4], "."), strconv.Itoa(hi<<8|lo))
+			reply(200, "port ok")
+		case cmd == "RETR":
+			data, ok := files[arg]
+			if !ok {
+				reply(550, "no such file")
+				continue
+			}
+			reply(150, "opening data connection")
+			var dc net.Conn
+			if pasv != nil {
+				dc, err = pasv.Accept()
+				pasv.Close()
+				pasv = nil
+			} else {
+				dc, err = net.Dial("tcp", port)
+			}
+			if err != nil {
+				reply(425, "cannot open data connection")
+				continue
+			}
+			io.WriteString(dc, data)
+			dc.Close()
+			reply(226, "transfer complete")
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
+
+// startSFTP запускает SSH-сервер с подсистемой sftp, пускающий user по
+// паролю или ключу clientKey. Возвращает адрес и ключ сервера в формате
+// authorized_keys.
+func startSFTP(t *testing.T, user, pass string, clientKey ssh.PublicKey, files map[string]string) (string, string) {
+	t.Helper()
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(p) == pass {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == user && string(k.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, "/home/"+user, files)
+		}
+	}()
+	return ln.Addr().String(), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, home string, files map[string]string) {
+	defer conn.Close()
+	sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range chReqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						serveSFTP(ch, home, files)
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func serveSFTP(rw io.ReadWriter, home string, files map[string]string) {
+	send := func(typ byte, payload []byte) {
+		pkt := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+		rw.Write(append(append(pkt, typ), payload...))
+	}
+	status := func(id, code uint32, msg string) {
+		p := binary.BigEndian.AppendUint32(nil, id)
+		p = binary.BigEndian.AppendUint32(p, code)
+		send(sftpStatus, appendString(appendString(p, msg), ""))
+	}
+	handles := map[string]string{}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+			return
+		}
+		pkt := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(rw, pkt); err != nil {
+			return
+		}
+		typ, body := pkt[0], pkt[1:]
+		if typ == sftpInit {
+			send(sftpVersion, binary.BigEndian.AppendUint32(nil, 3))
+			continue
+		}
+		id := binary.BigEndian.Uint32(body)
+		arg, rest, _ := readString(body[4:])
+		idb := binary.BigEndian.AppendUint32(nil, id)
+		switch typ {
+		case sftpOpen:
+			if !strings.HasPrefix(arg, "/") {
+				arg = home + "/" + arg
+			}
+			if _, ok := files[arg]; !ok {
+				status(id, 2, "no such file")
+				continue
+			}
+			h := strconv.Itoa(len(handles))
+			handles[h] = files[arg]
+			send(sftpHandle, appendString(idb, h))
+		case sftpFstat:
+			p := binary.BigEndian.AppendUint32(idb, sftpAttrSizeFlag)
+			send(sftpAttrs, binary.BigEndian.AppendUint64(p, uint64(len(handles[arg]))))
+		case sftpRead:
+			data := handles[arg]
+			off := binary.BigEndian.Uint64(rest)
+			n := uint64(binary.BigEndian.Uint32(rest[8:]))
+			if off >= uint64(len(data)) {
+				status(id, sftpEOF, "eof")
+				continue
+			}
+			// отдаём меньше запрошенного, как настоящие серверы
+			end := min(off+min(n, 7), uint64(len(data)))
+			send(sftpData, appendString(idb, data[off:end]))
+		case sftpClose:
+			delete(handles, arg)
+			status(id, sftpOK, "")
+		default:
+			status(id, 8, "unsupported")
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FTP скачивает файлы по ftp://. Путь в URL отсчитывается от каталога
+// после входа (RFC 1738), абсолютный путь пишется через %2F. Без
+// учётных данных вход анонимный.
+type FTP struct {
+	Logins Logins
+	// активный режим: сервер подключается к нам (PORT/EPRT); по
+	// умолчанию пассивный (EPSV, затем PASV)
+	Active bool
+	// на подключение и на каждый ответ сервера; 0 — 30 секунд
+	Timeout time.Duration
+}
+
+func (f *FTP) Fetch(ctx context.Context, u *url.URL) (*Result, error) {
+	l, err := login(ctx, f.Logins, u)
+	if err != nil {
+		return nil, err
+	}
+	if l.User == "" {
+		l = &Login{User: "anonymous", Password: "anonymous@"}
+	}
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	// ;type=a и другие параметры RFC 1738 не поддерживаются: всё двоичное
+	p, _, _ := strings.Cut(u.Path, ";")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" || strings.HasSuffix(p, "/") {
+		return nil, errors.New("ftp url must point to a file")
+	}
+
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{Conn: textproto.NewConn(conn), raw: conn, timeout: timeout}
+	stop := closeOnCancel(ctx, conn)
+	size, data, err := f.retrieve(ctx, c, l, p)
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	body := &ftpBody{data: data, c: c, stops: []func() bool{stop, closeOnCancel(ctx, data)}}
+	return &Result{Body: body, Size: size, Filename: baseName(p), URL: u}, nil
+}
+
+// retrieve входит на сервер и запускает передачу файла p.
+func (f *FTP) retrieve(ctx context.Context, c *ftpConn, l *Login, p string) (int64, net.Conn, error) {
+	if _, err := c.response(220); err != nil {
+		return 0, nil, err
+	}
+	code, _, err := c.cmd(0, "USER %s", l.User)
+	if err != nil {
+		return 0, nil, err
+	}
+	if code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", l.Password)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if code != 230 && code != 202 {
+		return 0, nil, &StatusError{Code: code, Msg: "login failed"}
+	}
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		return 0, nil, err
+	}
+
+	// размер знают не все серверы, ответ 213 — единственный надёжный
+	size := int64(-1)
+	if code, msg, err := c.cmd(0, "SIZE %s", p); err != nil {
+		return 0, nil, err
+	} else if code == 213 {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			size = n
+		}
+	}
+
+	var data net.Conn
+	if f.Active {
+		data, err = c.active(ctx, p)
+	} else {
+		data, err = c.passive(ctx, p)
+	}
+	return size, data, err
+}
+
+// ftpConn — управляющее соединение.
+type ftpConn struct {
+	*textproto.Conn
+	raw     net.Conn
+	timeout time.Duration
+}
+
+// cmd отправляет команду и читает ответ; want 0 — подходит любой код,
+// проверяет вызывающий.
+func (c *ftpConn) cmd(want int, format string, args ...any) (int, string, error) {
+	// перевод строки в имени файла стал бы второй командой
+	if strings.ContainsAny(fmt.Sprintf(format, args...), "\r\n") {
+		return 0, "", errors.New("ftp: line break in command")
+	}
+	c.raw.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.ReadResponse(want)
+	return code, msg, ftpError(err)
+}
+
+func (c *ftpConn) response(want int) (string, error) {
+	c.raw.SetDeadline(time.Now().Add(c.timeout))
+	_, msg, err := c.ReadResponse(want)
+	return msg, ftpError(err)
+}
+
+// ftpError делает из ответа сервера с кодом ошибки StatusError.
+func ftpError(err error) error {
+	var perr *textproto.Error
+	if errors.As(err, &perr) {
+		return &StatusError{Code: perr.Code, Msg: perr.Msg}
+	}
+	return err
+}
+
+// passive открывает соединение для данных к серверу. Адрес из ответа
+// PASV не используется: за NAT он бывает внутренним, а чужой адрес
+// превратил бы сервис в сканер портов.
+func (c *ftpConn) passive(ctx context.Context, p string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(c.raw.RemoteAddr().String())
+	var port int
+	code, msg, err := c.cmd(0, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	if code == 229 {
+		// 229 Entering Extended Passive Mode (|||6446|)
+		i, j := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if i < 0 || j < i+4 {
+			return nil, fmt.Errorf("ftp: bad EPSV reply %q", msg)
+		}
+		if port, err = strconv.Atoi(msg[i+4 : j]); err != nil {
+			return nil, fmt.Errorf("ftp: bad EPSV reply %q", msg)
+		}
+	} else {
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		i, j := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		parts := []string{}
+		if i >= 0 && j > i {
+			parts = strings.Split(msg[i+1:j], ",")
+		}
+		if len(parts) != 6 {
+			return nil, fmt.Errorf("ftp: bad PASV reply %q", msg)
+		}
+		hi, err1 := strconv.Atoi(strings.TrimSpace(parts[4]))
+		lo, err2 := strconv.Atoi(strings.TrimSpace(parts[5]))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("ftp: bad PASV reply %q", msg)
+		}
+		port = hi<<8 | lo
+	}
+
+	d := net.Dialer{Timeout: c.timeout}
+	data, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.retr(p); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// active ждёт подключения сервера на адресе управляющего соединения.
+func (c *ftpConn) active(ctx context.Context, p string) (net.Conn, error) {
+	local := c.raw.LocalAddr().(*net.TCPAddr)
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", net.JoinHostPort(local.IP.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	if ip4 := local.IP.To4(); ip4 != nil {
+		_, _, err = c.cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, _, err = c.cmd(200, "EPRT |2|%s|%d|", local.IP, port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.retr(p); err != nil {
+		return nil, err
+	}
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(c.timeout))
+	data, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// подключиться может кто угодно, нужен сам сервер
+	remote, _, _ := net.SplitHostPort(c.raw.RemoteAddr().String())
+	if peer, _, _ := net.SplitHostPort(data.RemoteAddr().String()); !net.ParseIP(peer).Equal(net.ParseIP(remote)) {
+		data.Close()
+		return nil, fmt.Errorf("ftp: data connection from unexpected address %s", peer)
+	}
+	return data, nil
+}
+
+func (c *ftpConn) retr(p string) error {
+	code, msg, err := c.cmd(0, "RETR %s", p)
+	if err != nil {
+		return err
+	}
+	if code != 150 && code != 125 {
+		return &StatusError{Code: code, Msg: msg}
+	}
+	// передача может идти дольше таймаута на ответ
+	c.raw.SetDeadline(time.Time{})
+	return nil
+}
+
+// ftpBody — содержимое файла из соединения для данных. Close дочитывает
+// итог передачи и закрывает управляющее соединение.
+type ftpBody struct {
+	data  net.Conn
+	c     *ftpConn
+	stops []func() bool
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) { return b.data.Read(p) }
+
+func (b *ftpBody) Close() error {
+	for _, stop := range b.stops {
+		stop()
+	}
+	b.data.Close()
+	_, err := b.c.response(226)
+	b.c.cmd(0, "QUIT")
+	b.c.Close()
+	return err
+}
@@ -0,0 +1,119 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// HTTP скачивает файлы по http и https, следуя редиректам.
+type HTTP struct {
+	// nil — http.DefaultClient
+	Client *http.Client
+	// учётные данные сайта: basic auth, заголовки и cookie
+	Logins Logins
+}
+
+func (h *HTTP) Fetch(ctx context.Context, u *url.URL) (*Result, error) {
+	l, err := login(ctx, h.Logins, u)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := h.client()
+	if l.authorizes() {
+		l.apply(req)
+		client = l.client(client, u)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{Code: resp.StatusCode, Msg: http.StatusText(resp.StatusCode)}
+	}
+
+	// имя из Content-Disposition точнее пути: у ссылок на загрузку
+	// путь часто вроде /download?id=1
+	name := baseName(resp.Request.URL.Path)
+	disposition, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		name = baseName(params["filename"])
+	}
+	return &Result{
+		Body:        resp.Body,
+		Size:        resp.ContentLength,
+		Filename:    name,
+		ContentType: resp.Header.Get("Content-Type"),
+		URL:         resp.Request.URL,
+		attachment:  err == nil && disposition == "attachment",
+	}, nil
+}
+
+func (h *HTTP) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+// authorizes — есть ли что добавить к запросу, кроме имени из URL: его
+// клиент и так отправляет в basic auth.
+func (l *Login) authorizes() bool {
+	return l.Password != "" || len(l.Headers) > 0 || len(l.Cookies) > 0 || l.UserAgent != ""
+}
+
+func (l *Login) apply(req *http.Request) {
+	if l.Password != "" {
+		req.SetBasicAuth(l.User, l.Password)
+	}
+	for name, value := range l.Headers {
+		req.Header.Set(name, value)
+	}
+	names := make([]string, 0, len(l.Cookies))
+	for name := range l.Cookies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		req.AddCookie(&http.Cookie{Name: name, Value: l.Cookies[name]})
+	}
+	if l.UserAgent != "" {
+		req.Header.Set("User-Agent", l.UserAgent)
+	}
+}
+
+// client — копия c, которая не отправляет учётные данные при редиректе
+// на другой хост или с https на http. Сам http.Client убирает только
+// Authorization и Cookie и только для чужих доменов, а поддоменам, свои
+// заголовки и открытому http оставляет.
+func (l *Login) client(c *http.Client, orig *url.URL) *http.Client {
+	cp := *c
+	check := c.CheckRedirect
+	cp.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		downgrade := orig.Scheme == "https" && req.URL.Scheme != "https"
+		if downgrade || !strings.EqualFold(req.URL.Host, orig.Host) {
+			req.Header.Del("Authorization")
+			req.Header.Del("Cookie")
+			for name := range l.Headers {
+				req.Header.Del(name)
+			}
+		}
+		if check != nil {
+			return check(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &cp
+}
@@ -0,0 +1,352 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP скачивает файлы по sftp://. Нужны имя пользователя, пароль или
+// закрытый ключ и сохранённый ключ сервера: без него подключение не
+// доверяется, а ошибка показывает ключ, чтобы его можно было сохранить.
+// Путь в URL абсолютный, /~/ в начале — от домашнего каталога.
+type SFTP struct {
+	Logins Logins
+	// на подключение и на каждый ответ сервера; 0 — 30 секунд
+	Timeout time.Duration
+}
+
+// ErrHostKeyUnknown — ключ сервера SSH не сохранён.
+var ErrHostKeyUnknown = errors.New("sftp: host key is not saved")
+
+func (s *SFTP) Fetch(ctx context.Context, u *url.URL) (*Result, error) {
+	l, err := login(ctx, s.Logins, u)
+	if err != nil {
+		return nil, err
+	}
+	if l.User == "" {
+		return nil, fmt.Errorf("no saved credentials for sftp://%s", u.Hostname())
+	}
+	config, err := sshConfig(l)
+	if err != nil {
+		return nil, err
+	}
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	p := u.Path
+	if rel, ok := strings.CutPrefix(p, "/~/"); ok {
+		p = rel
+	}
+	if p == "" || strings.HasSuffix(p, "/") {
+		return nil, errors.New("sftp url must point to a file")
+	}
+
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnCancel(ctx, conn)
+	// до открытия файла каждый шаг ограничен таймаутом, чтение — только
+	// контекстом: почта может забирать файл медленно
+	conn.SetDeadline(time.Now().Add(timeout))
+	body, size, err := openSFTP(conn, addr, config, p)
+	if err != nil {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	body.stop = stop
+	return &Result{Body: body, Size: size, Filename: baseName(p), URL: u}, nil
+}
+
+func sshConfig(l *Login) (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if len(l.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(l.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("sftp private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if l.Password != "" {
+		auth = append(auth, ssh.Password(l.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp needs a password or a private key")
+	}
+
+	var want ssh.PublicKey
+	if l.HostKey != "" {
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(l.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("sftp host key: %w", err)
+		}
+		want = k
+	}
+	return &ssh.ClientConfig{
+		User: l.User,
+		Auth: auth,
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+			if want == nil {
+				return fmt.Errorf("%w, server key: %s", ErrHostKeyUnknown, line)
+			}
+			if !bytes.Equal(key.Marshal(), want.Marshal()) {
+				return fmt.Errorf("sftp: host key mismatch, server key: %s", line)
+			}
+			return nil
+		},
+		HostKeyAlgorithms: hostKeyAlgorithms(want),
+	}, nil
+}
+
+// hostKeyAlgorithms просит у сервера ключ того же типа, что сохранён:
+// у сервера их обычно несколько.
+func hostKeyAlgorithms(k ssh.PublicKey) []string {
+	if k == nil {
+		return nil
+	}
+	if k.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{k.Type()}
+}
+
+// Пакеты SFTP версии 3 (draft-ietf-secsh-filexfer-02), нужные для
+// чтения одного файла.
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpFstat   = 8
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpAttrs   = 105
+
+	sftpOK  = 0
+	sftpEOF = 1
+
+	sftpReadFlag     = 1
+	sftpAttrSizeFlag = 1
+
+	sftpChunk = 32 << 10
+	// больше чанка с заголовками сервер прислать не должен
+	sftpMaxPacket = 256 << 10
+)
+
+func openSFTP(conn net.Conn, addr string, config *ssh.ClientConfig, p string) (*sftpBody, int64, error) {
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		return nil, 0, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	b := &sftpBody{client: client}
+	size, err := b.open(p)
+	if err != nil {
+		client.Close()
+		return nil, 0, err
+	}
+	return b, size, nil
+}
+
+// sftpBody читает файл запросами READ по очереди.
+type sftpBody struct {
+	client  *ssh.Client
+	session *ssh.Session
+	w       io.Writer
+	r       io.Reader
+	id      uint32
+	handle  string
+	offset  uint64
+	stop    func() bool
+	eof     bool
+}
+
+func (b *sftpBody) open(p string) (int64, error) {
+	session, err := b.client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	b.session = session
+	if b.w, err = session.StdinPipe(); err != nil {
+		return 0, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	b.r = stdout
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return 0, err
+	}
+
+	// INIT без id, ответ VERSION тоже
+	if err := b.write(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return 0, err
+	}
+	typ, _, err := b.read()
+	if err != nil {
+		return 0, err
+	}
+	if typ != sftpVersion {
+		return 0, fmt.Errorf("sftp: unexpected packet %d", typ)
+	}
+
+	msg := appendString(nil, p)
+	msg = binary.BigEndian.AppendUint32(msg, sftpReadFlag)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	resp, err := b.call(sftpOpen, sftpHandle, msg)
+	if err != nil {
+		return 0, err
+	}
+	handle, _, ok := readString(resp)
+	if !ok {
+		return 0, errors.New("sftp: bad HANDLE packet")
+	}
+	b.handle = handle
+
+	resp, err = b.call(sftpFstat, sftpAttrs, appendString(nil, b.handle))
+	if err != nil || len(resp) < 4 {
+		// без размера файл всё равно можно прочитать
+		return -1, nil
+	}
+	if binary.BigEndian.Uint32(resp)&sftpAttrSizeFlag == 0 || len(resp) < 12 {
+		return -1, nil
+	}
+	return int64(binary.BigEndian.Uint64(resp[4:])), nil
+}
+
+func (b *sftpBody) Read(p []byte) (int, error) {
+	if b.eof {
+		return 0, io.EOF
+	}
+	n := min(len(p), sftpChunk)
+	msg := appendString(nil, b.handle)
+	msg = binary.BigEndian.AppendUint64(msg, b.offset)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(n))
+	resp, err := b.call(sftpRead, sftpData, msg)
+	var serr *StatusError
+	if errors.As(err, &serr) && serr.Code == sftpEOF {
+		b.eof = true
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	data, _, ok := readString(resp)
+	if !ok || len(data) > n {
+		return 0, errors.New("sftp: bad DATA packet")
+	}
+	b.offset += uint64(len(data))
+	return copy(p, data), nil
+}
+
+func (b *sftpBody) Close() error {
+	if b.stop != nil {
+		b.stop()
+	}
+	var err error
+	if b.handle != "" {
+		_, err = b.call(sftpClose, sftpStatus, appendString(nil, b.handle))
+	}
+	b.session.Close()
+	b.client.Close()
+	return err
+}
+
+// call отправляет запрос со следующим id и ждёт ответ типа want; ответ
+// STATUS с ошибкой становится StatusError.
+func (b *sftpBody) call(typ, want byte, payload []byte) ([]byte, error) {
+	b.id++
+	if err := b.write(typ, append(binary.BigEndian.AppendUint32(nil, b.id), payload...)); err != nil {
+		return nil, err
+	}
+	rtyp, resp, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 4 || binary.BigEndian.Uint32(resp) != b.id {
+		return nil, errors.New("sftp: unexpected response id")
+	}
+	resp = resp[4:]
+	if rtyp == sftpStatus {
+		if len(resp) < 4 {
+			return nil, errors.New("sftp: bad STATUS packet")
+		}
+		code := binary.BigEndian.Uint32(resp)
+		msg, _, _ := readString(resp[4:])
+		if code == sftpOK && want == sftpStatus {
+			return nil, nil
+		}
+		if code == sftpOK {
+			return nil, fmt.Errorf("sftp: unexpected status ok for packet %d", typ)
+		}
+		return nil, &StatusError{Code: int(code), Msg: msg}
+	}
+	if rtyp != want {
+		return nil, fmt.Errorf("sftp: unexpected packet %d", rtyp)
+	}
+	return resp, nil
+}
+
+func (b *sftpBody) write(typ byte, payload []byte) error {
+	pkt := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	pkt = append(pkt, typ)
+	_, err := b.w.Write(append(pkt, payload...))
+	return err
+}
+
+func (b *sftpBody) read() (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(b.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(b.r, pkt); err != nil {
+		return 0, nil, err
+	}
+	return pkt[0], pkt[1:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return "", nil, false
+	}
+	return string(b[4 : 4+n]), b[4+n:], true
+}
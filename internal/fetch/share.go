@@ -0,0 +1,315 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// ErrLoginRequired — файл по ссылке на облачный диск доступен только
+// после входа.
+var ErrLoginRequired = errors.New("share link requires login")
+
+// Share скачивает по http и https, превращая публичные ссылки Google
+// Drive, Dropbox, OneDrive и Яндекс Диска в ссылки на сам файл: иначе
+// скачалась бы страница диска. Остальные ссылки скачиваются как есть.
+type Share struct {
+	HTTP *HTTP
+}
+
+// shareProvider — облачный диск: match узнаёт его ссылки, fetch
+// скачивает по ним файл.
+type shareProvider struct {
+	name  string
+	match func(u *url.URL) bool
+	fetch func(ctx context.Context, h *HTTP, u *url.URL) (*Result, error)
+}
+
+var shareProviders = []shareProvider{
+	{"Google Drive", isGoogleDrive, fetchGoogleDrive},
+	{"Dropbox", isDropbox, fetchDropbox},
+	{"OneDrive", isOneDrive, fetchOneDrive},
+	{"Yandex Disk", isYandexDisk, fetchYandexDisk},
+}
+
+func (s *Share) Fetch(ctx context.Context, u *url.URL) (*Result, error) {
+	for _, p := range shareProviders {
+		if p.match(u) {
+			return p.get(ctx, s.HTTP, u)
+		}
+	}
+	return s.HTTP.Fetch(ctx, u)
+}
+
+// get скачивает файл и отличает его от страницы входа или другой
+// страницы диска, которую тот отдаёт вместо файла.
+func (p shareProvider) get(ctx context.Context, h *HTTP, u *url.URL) (*Result, error) {
+	res, err := p.fetch(ctx, h, u)
+	var serr *StatusError
+	if errors.As(err, &serr) && (serr.Code == http.StatusUnauthorized || serr.Code == http.StatusForbidden) {
+		return nil, fmt.Errorf("%w: %s", ErrLoginRequired, p.name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.name, err)
+	}
+	if loginPage(res.URL) {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrLoginRequired, p.name)
+	}
+	if isPage(res) {
+		// папка, удалённый файл или превышенная квота
+		res.Body.Close()
+		return nil, fmt.Errorf("%s returned a web page instead of the file", p.name)
+	}
+	return res, nil
+}
+
+// isPage — ответ похож на веб-страницу, а не на скачиваемый файл.
+func isPage(res *Result) bool {
+	mt, _, _ := mime.ParseMediaType(res.ContentType)
+	return (mt == "text/html" || mt == "application/xhtml+xml") && !res.attachment
+}
+
+// loginPage — редирект привёл на страницу входа.
+func loginPage(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "accounts.google.com", host == "login.live.com", host == "login.microsoftonline.com":
+		return true
+	case strings.HasPrefix(host, "passport.yandex."):
+		return true
+	case hostIs(u, "dropbox.com") && strings.HasPrefix(u.Path, "/login"):
+		return true
+	}
+	return false
+}
+
+// hostIs — хост u — domain или его поддомен.
+func hostIs(u *url.URL, domain string) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// --- Google Drive ---
+
+func isGoogleDrive(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == "drive.google.com" || host == "docs.google.com"
+}
+
+// googleExports — в каком формате выгружаются документы Google.
+var googleExports = map[string]string{
+	"document":     "pdf",
+	"spreadsheets": "xlsx",
+	"presentation": "pdf",
+}
+
+func fetchGoogleDrive(ctx context.Context, h *HTTP, u *url.URL) (*Result, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	// docs.google.com/document/d/<id>/edit — документ выгружается файлом
+	if len(parts) >= 3 && parts[1] == "d" && googleExports[parts[0]] != "" {
+		export := &url.URL{Scheme: "https", Host: "docs.google.com", Path: "/" + parts[0] + "/d/" + parts[2] + "/export",
+			RawQuery: "format=" + googleExports[parts[0]]}
+		return h.Fetch(ctx, export)
+	}
+
+	id := u.Query().Get("id")
+	switch {
+	case len(parts) >= 3 && parts[0] == "file" && parts[1] == "d":
+		id = parts[2]
+	case len(parts) >= 1 && parts[0] == "drive" && strings.Contains(u.Path, "/folders/"):
+		return nil, errors.New("folder links are not supported")
+	}
+	if id == "" {
+		return h.Fetch(ctx, u)
+	}
+
+	q := url.Values{"id": {id}, "export": {"download"}}
+	if key := u.Query().Get("resourcekey"); key != "" {
+		q.Set("resourcekey", key)
+	}
+	res, err := h.Fetch(ctx, &url.URL{Scheme: "https", Host: "drive.usercontent.google.com", Path: "/download", RawQuery: q.Encode()})
+	if err != nil || !isPage(res) {
+		return res, err
+	}
+
+	// большие файлы Google не проверяет на вирусы и просит подтвердить
+	// скачивание формой на странице
+	page, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	next := driveConfirmURL(page, res.URL)
+	if next == nil {
+		res.Body = io.NopCloser(bytes.NewReader(page))
+		return res, nil
+	}
+	return h.Fetch(ctx, next)
+}
+
+// driveConfirmURL находит на странице предупреждения Google Drive ссылку
+// на файл: форму download-form или, на старых страницах, ссылку с
+// параметром confirm.
+func driveConfirmURL(page []byte, base *url.URL) *url.URL {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil
+	}
+	var form, link *url.URL
+	var visit func(n *html.Node, inForm bool)
+	visit = func(n *html.Node, inForm bool) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "form":
+				if attr(n, "id") == "download-form" {
+					if a, err := base.Parse(attr(n, "action")); err == nil {
+						form, inForm = a, true
+						form.RawQuery = ""
+					}
+				}
+			case "input":
+				if inForm && form != nil && attr(n, "name") != "" {
+					q := form.Query()
+					q.Set(attr(n, "name"), attr(n, "value"))
+					form.RawQuery = q.Encode()
+				}
+			case "a":
+				if href := attr(n, "href"); link == nil && strings.Contains(href, "confirm=") {
+					link, _ = base.Parse(href)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			visit(c, inForm)
+		}
+	}
+	visit(doc, false)
+	if form != nil {
+		return form
+	}
+	return link
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// --- Dropbox ---
+
+func isDropbox(u *url.URL) bool {
+	if !hostIs(u, "dropbox.com") {
+		return false
+	}
+	for _, prefix := range []string{"/s/", "/sh/", "/scl/"} {
+		if strings.HasPrefix(u.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDropbox: dl=1 вместо dl=0 отдаёт файл, а папку — архивом.
+func fetchDropbox(ctx context.Context, h *HTTP, u *url.URL) (*Result, error) {
+	dl := *u
+	q := dl.Query()
+	q.Set("dl", "1")
+	dl.RawQuery = q.Encode()
+	return h.Fetch(ctx, &dl)
+}
+
+// --- OneDrive ---
+
+func isOneDrive(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == "1drv.ms" || host == "onedrive.live.com" || hostIs(u, "sharepoint.com") && strings.Contains(u.Path, "/:")
+}
+
+// fetchOneDrive скачивает личные ссылки через API shares, которому
+// ссылка передаётся в base64url с префиксом u!, а ссылки SharePoint — с
+// параметром download=1.
+func fetchOneDrive(ctx context.Context, h *HTTP, u *url.URL) (*Result, error) {
+	if hostIs(u, "sharepoint.com") {
+		dl := *u
+		q := dl.Query()
+		q.Set("download", "1")
+		dl.RawQuery = q.Encode()
+		return h.Fetch(ctx, &dl)
+	}
+	token := "u!" + base64.RawURLEncoding.EncodeToString([]byte(u.String()))
+	return h.Fetch(ctx, &url.URL{Scheme: "https", Host: "api.onedrive.com", Path: "/v1.0/shares/" + token + "/root/content"})
+}
+
+// --- Яндекс Диск ---
+
+func isYandexDisk(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if host != "yadi.sk" && !strings.HasPrefix(host, "disk.yandex.") {
+		return false
+	}
+	return strings.HasPrefix(u.Path, "/d/") || strings.HasPrefix(u.Path, "/i/")
+}
+
+// fetchYandexDisk спрашивает адрес файла у API публичных ресурсов.
+// Ссылка на файл внутри публичной папки — /d/<ключ>/<путь>.
+func fetchYandexDisk(ctx context.Context, h *HTTP, u *url.URL) (*Result, error) {
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, errors.New("bad public link")
+	}
+	q := url.Values{"public_key": {u.Scheme + "://" + u.Host + "/" + parts[0] + "/" + parts[1]}}
+	if len(parts) == 3 && parts[2] != "" {
+		q.Set("path", "/"+parts[2])
+	}
+	api := "https://cloud-api.yandex.net/v1/disk/public/resources/download?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var link struct {
+		Href string `json:"href"`
+		// ответ с ошибкой
+		Error       string `json:"error"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&link); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("public resources api: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := link.Description
+		if msg == "" {
+			msg = link.Error
+		}
+		if msg == "" {
+			msg = http.StatusText(resp.StatusCode)
+		}
+		return nil, &StatusError{Code: resp.StatusCode, Msg: msg}
+	}
+	href, err := url.Parse(link.Href)
+	if err != nil || href.Scheme != "https" {
+		return nil, fmt.Errorf("public resources api returned bad href %q", link.Href)
+	}
+	return h.Fetch(ctx, href)
+}
@@ -0,0 +1,213 @@
+package fetch
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// cloudTransport отправляет запросы к любым хостам на тестовый сервер,
+// сохраняя Host: по нему сервер изображает нужный диск.
+type cloudTransport struct{ addr string }
+
+func (t cloudTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	out := r.Clone(r.Context())
+	out.Host = r.URL.Host
+	out.URL.Scheme, out.URL.Host = "http", t.addr
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if err == nil {
+		resp.Request = r
+	}
+	return resp, err
+}
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func attachment(w http.ResponseWriter, name, body string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	io.WriteString(w, body)
+}
+
+func page(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
+}
+
+func cloud(t *testing.T) *Share {
+	t.Helper()
+	onedriveToken := "u!" + base64.RawURLEncoding.EncodeToString([]byte("https://1drv.ms/b/s!AkPublic"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.Host + r.URL.Path {
+		case "drive.usercontent.google.com/download":
+			switch q.Get("id") + ":" + q.Get("confirm") {
+			case "1SmallFileId:":
+				attachment(w, "notes.txt", "small file")
+			case "1BigFileId:":
+				page(w, fixture(t, "gdrive_warning.html"))
+			case "1BigFileId:t":
+				if q.Get("uuid") == "" {
+					http.Error(w, "uuid is missing", http.StatusBadRequest)
+					return
+				}
+				attachment(w, "ubuntu.iso", "big file")
+			case "1OldFileId:":
+				page(w, fixture(t, "gdrive_warning_legacy.html"))
+			case "1BusyFileId:":
+				page(w, fixture(t, "gdrive_quota.html"))
+			case "1PrivateFileId:":
+				http.Redirect(w, r, "https://accounts.google.com/ServiceLogin?continue=https://drive.usercontent.google.com/download", http.StatusFound)
+			default:
+				http.NotFound(w, r)
+			}
+		case "drive.usercontent.google.com/uc":
+			if q.Get("confirm") == "Xk3q" && q.Get("id") == "1OldFileId" {
+				attachment(w, "backup.zip", "old file")
+				return
+			}
+			http.NotFound(w, r)
+		case "accounts.google.com/ServiceLogin":
+			page(w, []byte("<html><title>Sign in</title></html>"))
+		case "docs.google.com/document/d/1DocId/export":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", `attachment; filename="Plan.pdf"`)
+			io.WriteString(w, "format="+q.Get("format"))
+
+		case "www.dropbox.com/s/abc123/report.pdf":
+			if q.Get("dl") != "1" {
+				page(w, []byte("<html><title>Dropbox - report.pdf</title></html>"))
+				return
+			}
+			attachment(w, "report.pdf", "dropbox file")
+		case "www.dropbox.com/scl/fi/private/secret.txt":
+			http.Redirect(w, r, "https://www.dropbox.com/login?cont=/scl/fi/private/secret.txt", http.StatusFound)
+		case "www.dropbox.com/login":
+			page(w, []byte("<html><title>Dropbox - Sign in</title></html>"))
+		case "www.dropbox.com/s/gone/old.pdf":
+			page(w, []byte("<html><title>Dropbox - Error</title></html>"))
+
+		case "api.onedrive.com/v1.0/shares/" + onedriveToken + "/root/content":
+			http.Redirect(w, r, "https://public.bn.files.1drv.com/y4m/slides.pdf", http.StatusFound)
+		case "public.bn.files.1drv.com/y4m/slides.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			io.WriteString(w, "onedrive file")
+		case "contoso.sharepoint.com/:b:/g/personal/EaXyz":
+			if q.Get("download") != "1" {
+				page(w, []byte("<html><title>SharePoint</title></html>"))
+				return
+			}
+			attachment(w, "budget.pdf", "sharepoint file")
+
+		case "cloud-api.yandex.net/v1/disk/public/resources/download":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			switch q.Get("public_key") + q.Get("path") {
+			case "https://yadi.sk/d/Qw3rTy", "https://disk.yandex.ru/d/F0lder/docs/report.pdf":
+				w.Write(fixture(t, "yandex_download.json"))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write(fixture(t, "yandex_not_found.json"))
+			}
+		case "downloader.disk.yandex.ru/disk/0d2d5b4c/report.pdf":
+			attachment(w, q.Get("filename"), "yandex file")
+
+		case "example.com/drive/file/d/1SmallFileId":
+			attachment(w, "plain.bin", "plain site")
+		default:
+			if r.Host == "api.onedrive.com" {
+				// ссылка не анонимная
+				http.Error(w, `{"error":{"code":"unauthenticated"}}`, http.StatusUnauthorized)
+				return
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &Share{HTTP: &HTTP{Client: &http.Client{Transport: cloudTransport{srv.Listener.Addr().String()}}}}
+}
+
+func TestShareLinks(t *testing.T) {
+	s := cloud(t)
+	for _, tc := range []struct {
+		url, name, body string
+	}{
+		{"https://drive.google.com/file/d/1SmallFileId/view?usp=sharing", "notes.txt", "small file"},
+		{"https://drive.google.com/open?id=1SmallFileId", "notes.txt", "small file"},
+		{"https://drive.google.com/uc?id=1BigFileId&export=download", "ubuntu.iso", "big file"},
+		{"https://docs.google.com/uc?id=1OldFileId", "backup.zip", "old file"},
+		{"https://docs.google.com/document/d/1DocId/edit?usp=sharing", "Plan.pdf", "format=pdf"},
+		{"https://www.dropbox.com/s/abc123/report.pdf?dl=0", "report.pdf", "dropbox file"},
+		{"https://1drv.ms/b/s!AkPublic", "slides.pdf", "onedrive file"},
+		{"https://contoso.sharepoint.com/:b:/g/personal/EaXyz?e=4f2", "budget.pdf", "sharepoint file"},
+		{"https://yadi.sk/d/Qw3rTy", "report.pdf", "yandex file"},
+		{"https://disk.yandex.ru/d/F0lder/docs/report.pdf", "report.pdf", "yandex file"},
+		// не облачный диск, хотя путь похож
+		{"https://example.com/drive/file/d/1SmallFileId", "plain.bin", "plain site"},
+	} {
+		res, err := s.Fetch(context.Background(), mustParse(t, tc.url))
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+			continue
+		}
+		if got := readAll(t, res); got != tc.body || res.Filename != tc.name {
+			t.Errorf("%s: name %q, body %q; want %q, %q", tc.url, res.Filename, got, tc.name, tc.body)
+		}
+	}
+}
+
+func TestShareLinkErrors(t *testing.T) {
+	s := cloud(t)
+	for _, tc := range []struct {
+		url  string
+		want error
+		text string
+	}{
+		{"https://drive.google.com/file/d/1PrivateFileId/view", ErrLoginRequired, "Google Drive"},
+		{"https://www.dropbox.com/scl/fi/private/secret.txt?rlkey=x&dl=0", ErrLoginRequired, "Dropbox"},
+		{"https://1drv.ms/b/s!AkPrivate", ErrLoginRequired, "OneDrive"},
+		{"https://drive.google.com/file/d/1BusyFileId/view", nil, "Google Drive returned a web page"},
+		{"https://www.dropbox.com/s/gone/old.pdf?dl=0", nil, "Dropbox returned a web page"},
+		{"https://drive.google.com/drive/folders/1FolderId", nil, "folder links are not supported"},
+		{"https://yadi.sk/d/Missing", nil, "Resource not found"},
+	} {
+		_, err := s.Fetch(context.Background(), mustParse(t, tc.url))
+		if err == nil {
+			t.Errorf("%s: no error", tc.url)
+			continue
+		}
+		if tc.want != nil && !errors.Is(err, tc.want) || !strings.Contains(err.Error(), tc.text) {
+			t.Errorf("%s: err = %v, want %v with %q", tc.url, err, tc.want, tc.text)
+		}
+	}
+
+	// 404 диска остаётся ошибкой статуса, как у обычной ссылки
+	var serr *StatusError
+	if _, err := s.Fetch(context.Background(), mustParse(t, "https://yadi.sk/d/Missing")); !errors.As(err, &serr) || serr.Code != 404 {
+		t.Errorf("err = %v, want status 404", err)
+	}
+}
+
+func TestDriveConfirmURL(t *testing.T) {
+	base, _ := url.Parse("https://drive.usercontent.google.com/download?id=1BigFileId&export=download")
+	u := driveConfirmURL(fixture(t, "gdrive_warning.html"), base)
+	if u == nil || u.Host != "drive.usercontent.google.com" || u.Query().Get("confirm") != "t" || u.Query().Get("id") != "1BigFileId" {
+		t.Fatalf("confirm url = %v", u)
+	}
+	if u := driveConfirmURL(fixture(t, "gdrive_quota.html"), base); u != nil {
+		t.Fatalf("quota page gave confirm url %v", u)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package health
+
+import (
+	"errors"
+	"runtime"
+)
+
+func freeBytes(dir string) (uint64, error) {
+	return 0, errors.New("free space check is not supported on " + runtime.GOOS)
+}
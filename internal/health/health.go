@@ -0,0 +1,178 @@
+// Package health реализует эндпоинты liveness и readiness, общие для
+// бота и http-service.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// таймаут одной проверки по умолчанию
+const defaultTimeout = 3 * time.Second
+
+// CheckFunc возвращает nil, если зависимость в порядке.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name    string
+	timeout time.Duration
+	fn      CheckFunc
+}
+
+// Checker — набор проверок готовности.
+type Checker struct {
+	mu     sync.RWMutex
+	checks []check
+}
+
+// Add регистрирует проверку; timeout 0 означает таймаут по умолчанию.
+func (c *Checker) Add(name string, timeout time.Duration, fn CheckFunc) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	c.mu.Lock()
+	c.checks = append(c.checks, check{name: name, timeout: timeout, fn: fn})
+	c.mu.Unlock()
+}
+
+// Result — итог одной проверки в ответе /readyz.
+type Result struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Report — тело ответа /readyz.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Run выполняет все проверки параллельно.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.RUnlock()
+
+	rep := Report{Status: "ok", Checks: make(map[string]Result, len(checks))}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, ch := range checks {
+		wg.Add(1)
+		go func(ch check) {
+			defer wg.Done()
+
+			cctx, cancel := context.WithTimeout(ctx, ch.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runCheck(cctx, ch.fn)
+			res := Result{Status: "ok", DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				res.Status = "fail"
+				res.Error = err.Error()
+			}
+
+			mu.Lock()
+			rep.Checks[ch.name] = res
+			if err != nil {
+				rep.Status = "fail"
+			}
+			mu.Unlock()
+		}(ch)
+	}
+	wg.Wait()
+	return rep
+}
+
+// runCheck не даёт зависшей проверке держать ответ дольше таймаута.
+func runCheck(ctx context.Context, fn CheckFunc) (err error) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- fn(ctx)
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReadyHandler отвечает 200, если все проверки прошли, иначе 503.
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := c.Run(r.Context())
+		status := http.StatusOK
+		if rep.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, rep)
+	})
+}
+
+// LiveHandler отвечает 200, пока процесс способен обслуживать HTTP.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// DB проверяет соединение с базой.
+func DB(db *sql.DB) CheckFunc {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// DiskFree проверяет, что в каталоге dir свободно не меньше minBytes.
+func DiskFree(dir string, minBytes uint64) CheckFunc {
+	return func(ctx context.Context) error {
+		free, err := freeBytes(dir)
+		if err != nil {
+			return err
+		}
+		if free < minBytes {
+			return fmt.Errorf("%s: %d MiB free, need %d MiB", dir, free>>20, minBytes>>20)
+		}
+		return nil
+	}
+}
+
+// HTTP проверяет, что url отвечает 2xx.
+func HTTP(client *http.Client, url string) CheckFunc {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s: status %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,175 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, h http.Handler, path string) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("Cache-Control = %q", cc)
+	}
+	var rep Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body, err)
+	}
+	return rec.Code, rep
+}
+
+func ok(context.Context) error { return nil }
+
+func TestLiveHandler(t *testing.T) {
+	code, rep := serve(t, LiveHandler(), "/healthz")
+	if code != http.StatusOK || rep.Status != "ok" {
+		t.Fatalf("/healthz = %d %+v", code, rep)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	// зависшая проверка, которая не смотрит на ctx
+	hang := make(chan struct{})
+	defer close(hang)
+
+	for _, tc := range []struct {
+		name   string
+		checks map[string]CheckFunc
+		code   int
+		fail   map[string]string // имя проверки → фрагмент ошибки
+	}{
+		{"no checks", nil, http.StatusOK, nil},
+		{"all ok", map[string]CheckFunc{"db": ok, "disk": ok}, http.StatusOK, nil},
+		{
+			"failing dependency",
+			map[string]CheckFunc{
+				"db":   ok,
+				"smtp": func(context.Context) error { return errors.New("connection refused") },
+			},
+			http.StatusServiceUnavailable,
+			map[string]string{"smtp": "connection refused"},
+		},
+		{
+			"timeout",
+			map[string]CheckFunc{
+				"db":   ok,
+				"slow": func(context.Context) error { <-hang; return nil },
+			},
+			http.StatusServiceUnavailable,
+			map[string]string{"slow": "deadline exceeded"},
+		},
+		{
+			"panic",
+			map[string]CheckFunc{"bad": func(context.Context) error { panic("boom") }},
+			http.StatusServiceUnavailable,
+			map[string]string{"bad": "panic: boom"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Checker
+			for name, fn := range tc.checks {
+				c.Add(name, 50*time.Millisecond, fn)
+			}
+			start := time.Now()
+			code, rep := serve(t, c.ReadyHandler(), "/readyz")
+			// проверки идут параллельно и не держат ответ дольше таймаута
+			if took := time.Since(start); took > time.Second {
+				t.Fatalf("/readyz took %s", took)
+			}
+			if code != tc.code {
+				t.Fatalf("status = %d, want %d", code, tc.code)
+			}
+			wantStatus := "ok"
+			if tc.code != http.StatusOK {
+				wantStatus = "fail"
+			}
+			if rep.Status != wantStatus {
+				t.Fatalf("report status = %q, want %q", rep.Status, wantStatus)
+			}
+			if len(rep.Checks) != len(tc.checks) {
+				t.Fatalf("checks = %+v", rep.Checks)
+			}
+			for name := range tc.checks {
+				res := rep.Checks[name]
+				want, failed := tc.fail[name]
+				switch {
+				case failed && (res.Status != "fail" || !strings.Contains(res.Error, want)):
+					t.Fatalf("%s = %+v, want error %q", name, res, want)
+				case !failed && (res.Status != "ok" || res.Error != ""):
+					t.Fatalf("%s = %+v, want ok", name, res)
+				}
+			}
+		})
+	}
+}
+
+func TestAddDefaultTimeout(t *testing.T) {
+	var c Checker
+	c.Add("db", 0, ok)
+	if c.checks[0].timeout != defaultTimeout {
+		t.Fatalf("timeout = %s", c.checks[0].timeout)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	var c Checker
+	c.Add("db", time.Hour, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	// клиент ушёл: проверки прерываются вместе с запросом
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rep := c.Run(ctx)
+	if rep.Status != "fail" || rep.Checks["db"].Error != context.Canceled.Error() {
+		t.Fatalf("report = %+v", rep)
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	if err := HTTP(srv.Client(), srv.URL+"/up")(ctx); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if err := HTTP(srv.Client(), srv.URL+"/down")(ctx); err == nil || !strings.Contains(err.Error(), "status 502") {
+		t.Fatalf("down: %v", err)
+	}
+
+	// упавшая зависимость через ReadyHandler даёт 503
+	var c Checker
+	c.Add("api", time.Second, HTTP(srv.Client(), srv.URL+"/down"))
+	if code, _ := serve(t, c.ReadyHandler(), "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz = %d", code)
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeBytes(dir); err != nil {
+		t.Skip(err)
+	}
+	ctx := context.Background()
+	if err := DiskFree(dir, 0)(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := DiskFree(dir, 1<<62)(ctx); err == nil {
+		t.Fatal("DiskFree passed with 4 EiB required")
+	}
+}
@@ -0,0 +1,95 @@
+// Package i18n — тексты бота и писем на нескольких языках. Каталоги
+// лежат в locales/<язык>.yaml и встроены в бинарники; ключ — строка
+// формата для fmt.Sprintf.
+package i18n
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default — язык, если у пользователя нет своего и язык Telegram не
+// поддерживается.
+const Default = "ru"
+
+//go:embed locales/*.yaml
+var localesFS embed.FS
+
+// catalogs[язык][ключ] = строка формата
+var catalogs = mustLoad()
+
+func mustLoad() map[string]map[string]string {
+	files, err := localesFS.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	out := make(map[string]map[string]string)
+	for _, f := range files {
+		data, err := localesFS.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var msgs map[string]string
+		if err := yaml.Unmarshal(data, &msgs); err != nil {
+			panic(fmt.Sprintf("i18n: %s: %v", f.Name(), err))
+		}
+		out[strings.TrimSuffix(f.Name(), ".yaml")] = msgs
+	}
+	if _, ok := out[Default]; !ok {
+		panic("i18n: no catalog for default language " + Default)
+	}
+	return out
+}
+
+// Supported — коды языков, для которых есть каталоги; Default первым.
+func Supported() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		if lang != Default {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	return append([]string{Default}, langs...)
+}
+
+func IsSupported(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// Match подбирает язык по коду IETF из Telegram (language_code):
+// "en-US" → "en". Неподдерживаемый или пустой код — Default.
+func Match(code string) string {
+	lang, _, _ := strings.Cut(strings.ToLower(code), "-")
+	if IsSupported(lang) {
+		return lang
+	}
+	return Default
+}
+
+// T возвращает текст по ключу на языке lang. Если перевода нет, берётся
+// Default, а если нет и его — сам ключ, чтобы пропуск был заметен.
+func T(lang, key string, args ...any) string {
+	msg, ok := catalogs[lang][key]
+	if !ok {
+		msg, ok = catalogs[Default][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Name — название языка на нём самом: «Русский», «English».
+func Name(lang string) string {
+	return T(lang, "language.name")
+}
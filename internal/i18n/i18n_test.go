@@ -0,0 +1,69 @@
+package i18n
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// все каталоги переведены полностью и с теми же аргументами формата
+func TestCatalogsMatchDefault(t *testing.T) {
+	verbs := regexp.MustCompile(`%(\[\d+\])?[-+# 0]*\d*[a-zA-Z%]`)
+	for lang, msgs := range catalogs {
+		for key, def := range catalogs[Default] {
+			msg, ok := msgs[key]
+			if !ok {
+				t.Errorf("%s: missing key %s", lang, key)
+				continue
+			}
+			want, got := verbs.FindAllString(def, -1), verbs.FindAllString(msg, -1)
+			sort.Strings(want)
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("%s: %s has verbs %v, want %v", lang, key, got, want)
+			}
+		}
+		for key := range msgs {
+			if _, ok := catalogs[Default][key]; !ok {
+				t.Errorf("%s: key %s is not in %s", lang, key, Default)
+			}
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := map[string]string{
+		"":      Default,
+		"en":    "en",
+		"en-US": "en",
+		"EN-gb": "en",
+		"ru":    "ru",
+		"de":    Default,
+	}
+	for code, want := range tests {
+		if got := Match(code); got != want {
+			t.Errorf("Match(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestT(t *testing.T) {
+	if got := T("en", "change.processed", 3, "approved"); got != "Request #3 is already processed (status=approved)." {
+		t.Errorf("en: %q", got)
+	}
+	// « #» в YAML без кавычек начинает комментарий
+	if got := T("ru", "change.rejected_admin", 3); got != "Заявка #3 отклонена." {
+		t.Errorf("ru: %q", got)
+	}
+	// нет языка — текст на Default
+	if got, want := T("xx", "bot.busy"), T(Default, "bot.busy"); got != want {
+		t.Errorf("unknown language: %q, want %q", got, want)
+	}
+	if got := T("en", "no.such.key"); got != "no.such.key" {
+		t.Errorf("missing key: %q", got)
+	}
+	if got := Supported(); got[0] != Default || len(got) < 2 {
+		t.Errorf("Supported() = %v", got)
+	}
+}
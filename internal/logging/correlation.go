@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// CorrelationHeader — заголовок, в котором бот передаёт http-service
+// идентификатор запроса.
+const CorrelationHeader = "X-Correlation-ID"
+
+type correlationKey struct{}
+
+// NewCorrelationID возвращает случайный идентификатор из 16 hex-символов.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithCorrelationID кладёт идентификатор в контекст.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID достаёт идентификатор из контекста.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// ValidCorrelationID проверяет идентификатор, пришедший снаружи: до 64
+// символов A-Z, a-z, 0-9, '-', '_' и '.'.
+func ValidCorrelationID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
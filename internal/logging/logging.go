@@ -0,0 +1,107 @@
+// Package logging настраивает структурированные JSON-логи (log/slog) с
+// выводом в stdout, в файл с ротацией или в оба места сразу.
+package logging
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"download_track/internal/config"
+)
+
+// куда писать лог
+const (
+	OutputStdout = "stdout"
+	OutputFile   = "file"
+	OutputBoth   = "both"
+)
+
+// Config — настройки вывода.
+type Config struct {
+	Output string
+	// путь к файлу для OutputFile и OutputBoth
+	File string
+	// ротация по размеру; 0 — выключена
+	MaxSize int64
+	// ротация по времени; 0 — выключена
+	RotateEvery time.Duration
+	// сколько старых файлов хранить; 0 — все
+	MaxBackups int
+}
+
+// FromConfig переводит секцию log общего конфига в Config; defaultFile
+// используется, если файл не задан.
+func FromConfig(c config.Log, defaultFile string) Config {
+	cfg := Config{
+		Output:      c.Output,
+		File:        c.File,
+		MaxSize:     c.MaxSizeMB << 20,
+		RotateEvery: c.RotateEvery,
+		MaxBackups:  c.MaxBackups,
+	}
+	if cfg.File == "" {
+		cfg.File = defaultFile
+	}
+	return cfg
+}
+
+// New создаёт JSON-логгер. Если файл открыть не удалось, лог пишется
+// только в stdout: сервис не должен падать из-за недоступного каталога.
+// Возвращённый io.Closer закрывает файл.
+func New(cfg Config) (*slog.Logger, io.Closer) {
+	var (
+		w      io.Writer = os.Stdout
+		closer io.Closer = nopCloser{}
+	)
+	if cfg.Output == OutputFile || cfg.Output == OutputBoth {
+		rw, err := OpenRotating(cfg.File, cfg.MaxSize, cfg.RotateEvery, cfg.MaxBackups)
+		if err != nil {
+			log.Printf("warning: cannot open log file %s, logging to stdout: %v", cfg.File, err)
+		} else {
+			closer = rw
+			w = rw
+			if cfg.Output == OutputBoth {
+				w = io.MultiWriter(os.Stdout, rw)
+			}
+		}
+	}
+
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{ReplaceAttr: replaceAttr})
+	return slog.New(contextHandler{h}), closer
+}
+
+// replaceAttr пишет длительности в секундах, а не в наносекундах.
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.Float64(a.Key, a.Value.Duration().Seconds())
+	}
+	return a
+}
+
+// contextHandler добавляет correlation_id из контекста в каждую запись.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := CorrelationID(ctx); id != "" {
+		r.AddAttrs(slog.String("correlation_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
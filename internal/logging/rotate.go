@@ -0,0 +1,156 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat — время ротации в имени копии.
+const backupTimeFormat = "20060102-150405.000"
+
+// RotatingWriter пишет в файл и переименовывает его в <file>.<время>,
+// когда файл превышает maxSize или прошло rotateEvery с его начала.
+type RotatingWriter struct {
+	path        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+	// часы; подменяются в тестах
+	now func() time.Time
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenRotating открывает файл на дозапись, создавая каталог при
+// необходимости.
+func OpenRotating(path string, maxSize int64, rotateEvery time.Duration, maxBackups int) (*RotatingWriter, error) {
+	return openRotating(path, maxSize, rotateEvery, maxBackups, time.Now)
+}
+
+func openRotating(path string, maxSize int64, rotateEvery time.Duration, maxBackups int, now func() time.Time) (*RotatingWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	w := &RotatingWriter{
+		path:        path,
+		maxSize:     maxSize,
+		rotateEvery: rotateEvery,
+		maxBackups:  maxBackups,
+		now:         now,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, st.Size()
+	// время жизни файла считается от его создания, а не от перезапуска.
+	// Время изменения — это последняя запись, поэтому начало файла берётся
+	// из имени последней копии: с той ротации он и пишется. Без копий
+	// возраст неизвестен, и файл ротируется при первой же записи.
+	w.openedAt = w.now()
+	if w.size > 0 {
+		w.openedAt = w.lastRotation()
+	}
+	return nil
+}
+
+// lastRotation — время последней ротации по именам копий; нулевое, если
+// копий нет.
+func (w *RotatingWriter) lastRotation() time.Time {
+	var last time.Time
+	matches, _ := filepath.Glob(w.path + ".*")
+	for _, m := range matches {
+		t, err := time.ParseInLocation(backupTimeFormat, m[len(w.path)+1:], time.Local)
+		if err == nil && t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && w.due(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			// ротация не удалась — продолжаем писать в старый файл
+			fmt.Fprintln(os.Stderr, "log rotate err:", err)
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) due(next int64) bool {
+	if w.maxSize > 0 && w.size+next > w.maxSize {
+		return true
+	}
+	return w.rotateEvery > 0 && w.now().Sub(w.openedAt) >= w.rotateEvery
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	backup := w.path + "." + w.now().Format(backupTimeFormat)
+	if err := os.Rename(w.path, backup); err != nil {
+		// файл закрыт, так что открываем его снова в любом случае
+		if oerr := w.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.prune()
+	return nil
+}
+
+// prune удаляет самые старые копии сверх maxBackups.
+func (w *RotatingWriter) prune() {
+	if w.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return
+	}
+	backups := matches
+	if len(backups) <= w.maxBackups {
+		return
+	}
+	// имена содержат время, поэтому сортировка по имени — по возрасту
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-w.maxBackups] {
+		os.Remove(old)
+	}
+}
+
+// Close закрывает файл.
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
@@ -0,0 +1,215 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock — часы, которые идут только по команде теста.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newClock() *fakeClock {
+	return &fakeClock{t: time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)}
+}
+
+func write(t *testing.T, w *RotatingWriter, s string) {
+	t.Helper()
+	if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+		t.Fatalf("Write(%q) = %d, %v", s, n, err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// backups — копии лога по возрастанию времени.
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func TestRotateBySize(t *testing.T) {
+	clock := newClock()
+	path := filepath.Join(t.TempDir(), "logs", "app.log")
+	w, err := openRotating(path, 10, 0, 0, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// первая запись идёт в пустой файл, даже если она больше лимита
+	write(t, w, "0123456789ab\n")
+	if b := backups(t, path); len(b) != 0 {
+		t.Fatalf("rotated an empty file: %v", b)
+	}
+	clock.advance(time.Second)
+	write(t, w, "one\n")
+	write(t, w, "two\n")
+
+	b := backups(t, path)
+	if len(b) != 1 || b[0] != path+".20260301-120001.000" {
+		t.Fatalf("backups = %v", b)
+	}
+	if got := readFile(t, b[0]); got != "0123456789ab\n" {
+		t.Fatalf("backup = %q", got)
+	}
+	// 8 байт укладываются в лимит, ротации нет
+	if got := readFile(t, path); got != "one\ntwo\n" {
+		t.Fatalf("current = %q", got)
+	}
+
+	clock.advance(time.Second)
+	write(t, w, "three\n")
+	if b := backups(t, path); len(b) != 2 {
+		t.Fatalf("backups = %v", b)
+	}
+	if got := readFile(t, path); got != "three\n" {
+		t.Fatalf("current = %q", got)
+	}
+}
+
+func TestRotateByTime(t *testing.T) {
+	clock := newClock()
+	path := filepath.Join(t.TempDir(), "app.log")
+	w, err := openRotating(path, 0, time.Hour, 0, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	write(t, w, "first\n")
+	clock.advance(59 * time.Minute)
+	write(t, w, "second\n")
+	if b := backups(t, path); len(b) != 0 {
+		t.Fatalf("rotated before rotate_every: %v", b)
+	}
+
+	clock.advance(time.Minute)
+	write(t, w, "third\n")
+	b := backups(t, path)
+	if len(b) != 1 || b[0] != path+".20260301-130000.000" {
+		t.Fatalf("backups = %v", b)
+	}
+	if got := readFile(t, b[0]); got != "first\nsecond\n" {
+		t.Fatalf("backup = %q", got)
+	}
+	if got := readFile(t, path); got != "third\n" {
+		t.Fatalf("current = %q", got)
+	}
+
+	// срок нового файла считается от ротации
+	clock.advance(30 * time.Minute)
+	write(t, w, "fourth\n")
+	if b := backups(t, path); len(b) != 1 {
+		t.Fatalf("backups = %v", b)
+	}
+}
+
+func TestRotateAgeSurvivesRestart(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// когда начат текущий файл: время последней копии; 0 — копий нет
+		started time.Duration
+		rotated bool
+	}{
+		// файл пишется с ротации два часа назад, последняя запись только
+		// что: по времени изменения срок ещё не вышел бы
+		{"period ended", 2 * time.Hour, true},
+		{"period running", 30 * time.Minute, false},
+		// возраст неизвестен
+		{"no backups", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newClock()
+			dir := t.TempDir()
+			path := filepath.Join(dir, "app.log")
+			if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			written := clock.now().Add(-time.Minute)
+			if err := os.Chtimes(path, written, written); err != nil {
+				t.Fatal(err)
+			}
+			var prev []string
+			if tc.started > 0 {
+				for _, ago := range []time.Duration{tc.started + 3*time.Hour, tc.started} {
+					name := path + "." + clock.now().Add(-ago).Format(backupTimeFormat)
+					if err := os.WriteFile(name, []byte("older\n"), 0644); err != nil {
+						t.Fatal(err)
+					}
+					prev = append(prev, name)
+				}
+			}
+
+			w, err := openRotating(path, 0, time.Hour, 0, clock.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			write(t, w, "new\n")
+			b := backups(t, path)
+			if !tc.rotated {
+				if len(b) != len(prev) || readFile(t, path) != "old\nnew\n" {
+					t.Fatalf("rotated too early: backups = %v", b)
+				}
+				// срок идёт от последней ротации, а не от перезапуска
+				clock.advance(30 * time.Minute)
+				write(t, w, "later\n")
+				b = backups(t, path)
+			}
+			if len(b) != len(prev)+1 {
+				t.Fatalf("backups = %v", b)
+			}
+			if got := readFile(t, b[len(b)-1]); !strings.HasPrefix(got, "old\n") {
+				t.Fatalf("last backup = %q", got)
+			}
+		})
+	}
+}
+
+func TestRotatePrune(t *testing.T) {
+	clock := newClock()
+	path := filepath.Join(t.TempDir(), "app.log")
+	w, err := openRotating(path, 4, 0, 2, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"aaa\n", "bbb\n", "ccc\n", "ddd\n", "eee\n"} {
+		clock.advance(time.Second)
+		write(t, w, line)
+	}
+	// четыре ротации, остаются две последние копии
+	b := backups(t, path)
+	if len(b) != 2 {
+		t.Fatalf("backups = %v", b)
+	}
+	if readFile(t, b[0]) != "ccc\n" || readFile(t, b[1]) != "ddd\n" {
+		t.Fatalf("kept %q and %q", readFile(t, b[0]), readFile(t, b[1]))
+	}
+	if got := readFile(t, path); got != "eee\n" {
+		t.Fatalf("current = %q", got)
+	}
+}
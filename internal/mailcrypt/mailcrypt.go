@@ -0,0 +1,286 @@
+// Package mailcrypt шифрует письма открытым ключом получателя: PGP/MIME
+// (RFC 3156) для ключей OpenPGP и S/MIME (RFC 8551) для сертификатов
+// X.509 с ключом RSA. Key реализует mailmsg.Encrypter.
+package mailcrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"download_track/internal/store"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/smallstep/pkcs7"
+)
+
+var (
+	ErrUnknownFormat = errors.New("not an OpenPGP public key or X.509 certificate")
+	ErrPrivateKey    = errors.New("this is a private key, send the public one")
+	ErrMultipleKeys  = errors.New("key ring has more than one key")
+	ErrCannotEncrypt = errors.New("key has no valid encryption key: it is expired, revoked or signing-only")
+	ErrNotRSA        = errors.New("only RSA certificates are supported")
+)
+
+func init() {
+	// по умолчанию pkcs7 шифрует DES-CBC
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// Key — открытый ключ получателя.
+type Key struct {
+	// store.KeyPGP или store.KeySMIME
+	Kind string
+	// ключ в двоичном виде: пакеты OpenPGP или сертификат DER
+	Data []byte
+	// отпечаток ключа OpenPGP или SHA-256 сертификата, hex
+	Fingerprint string
+	// владелец: user ID ключа или субъект сертификата
+	Owner string
+
+	entity *openpgp.Entity
+	cert   *x509.Certificate
+	// для тестов; nil — time.Now
+	now func() time.Time
+}
+
+// ParseKey разбирает ключ, присланный пользователем: ключ OpenPGP в
+// ASCII armor или двоичном виде либо сертификат в PEM или DER. Ключ должен
+// годиться для шифрования прямо сейчас.
+func ParseKey(data []byte) (*Key, error) {
+	// пробелы обрезаются только для проверки формата: в двоичном ключе
+	// это обычные байты
+	text := bytes.TrimSpace(data)
+	var (
+		k   *Key
+		err error
+	)
+	switch {
+	case bytes.HasPrefix(text, []byte("-----BEGIN PGP")):
+		k, err = parsePGP(openpgp.ReadArmoredKeyRing(bytes.NewReader(text)))
+	case bytes.HasPrefix(text, []byte("-----BEGIN")):
+		block, _ := pem.Decode(text)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, ErrUnknownFormat
+		}
+		k, err = parseCert(block.Bytes)
+	default:
+		// DER сертификата начинается с SEQUENCE, пакеты OpenPGP — с
+		// установленного старшего бита; пробуем оба
+		if k, err = parseCert(data); err != nil && !errors.Is(err, ErrNotRSA) {
+			k, err = parsePGP(openpgp.ReadKeyRing(bytes.NewReader(data)))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !k.CanEncrypt() {
+		return nil, ErrCannotEncrypt
+	}
+	return k, nil
+}
+
+// LoadKey восстанавливает ключ, сохранённый в store. Срок действия здесь
+// не проверяется: ключ мог истечь после загрузки, это выяснится в Encrypt.
+func LoadKey(kind string, data []byte) (*Key, error) {
+	switch kind {
+	case store.KeyPGP:
+		return parsePGP(openpgp.ReadKeyRing(bytes.NewReader(data)))
+	case store.KeySMIME:
+		return parseCert(data)
+	}
+	return nil, fmt.Errorf("unknown key kind %q", kind)
+}
+
+func parsePGP(el openpgp.EntityList, err error) (*Key, error) {
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, err)
+	}
+	if len(el) != 1 {
+		return nil, ErrMultipleKeys
+	}
+	e := el[0]
+	if e.PrivateKey != nil {
+		return nil, ErrPrivateKey
+	}
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	k := &Key{
+		Kind:        store.KeyPGP,
+		Data:        buf.Bytes(),
+		Fingerprint: strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint)),
+		entity:      e,
+	}
+	if id := e.PrimaryIdentity(); id != nil {
+		k.Owner = id.Name
+	}
+	return k, nil
+}
+
+func parseCert(der []byte) (*Key, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, err)
+	}
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, ErrNotRSA
+	}
+	sum := sha256.Sum256(cert.Raw)
+	k := &Key{
+		Kind:        store.KeySMIME,
+		Data:        cert.Raw,
+		Fingerprint: strings.ToUpper(hex.EncodeToString(sum[:])),
+		Owner:       cert.Subject.CommonName,
+		cert:        cert,
+	}
+	if len(cert.EmailAddresses) > 0 {
+		k.Owner = strings.TrimSpace(k.Owner + " <" + cert.EmailAddresses[0] + ">")
+	}
+	return k, nil
+}
+
+func (k *Key) time() time.Time {
+	if k.now != nil {
+		return k.now()
+	}
+	return time.Now()
+}
+
+// CanEncrypt — ключ сейчас годится для шифрования: не истёк и не отозван.
+func (k *Key) CanEncrypt() bool {
+	now := k.time()
+	if k.entity != nil {
+		_, ok := k.entity.EncryptionKey(now)
+		return ok
+	}
+	if now.Before(k.cert.NotBefore) || now.After(k.cert.NotAfter) {
+		return false
+	}
+	// сертификат только для подписи не годится
+	return k.cert.KeyUsage == 0 || k.cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0
+}
+
+// Encrypt шифрует MIME-часть entity для владельца ключа.
+func (k *Key) Encrypt(w io.Writer, entity io.Reader) error {
+	if !k.CanEncrypt() {
+		return ErrCannotEncrypt
+	}
+	if k.entity != nil {
+		return k.encryptPGP(w, entity)
+	}
+	return k.encryptSMIME(w, entity)
+}
+
+// encryptPGP пишет multipart/encrypted по RFC 3156: служебную часть с
+// версией и зашифрованную часть в ASCII armor.
+func (k *Key) encryptPGP(w io.Writer, entity io.Reader) error {
+	bw := bufio.NewWriter(w)
+	mw := multipart.NewWriter(bw)
+	fmt.Fprintf(bw, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": mw.Boundary(),
+	}))
+	bw.WriteString("This is an OpenPGP/MIME encrypted message (RFC 3156).\r\n")
+
+	control, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/pgp-encrypted"}})
+	if err != nil {
+		return err
+	}
+	io.WriteString(control, "Version: 1\r\n")
+
+	data, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		return err
+	}
+	aw, err := armor.Encode(&crlfWriter{w: data}, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	pw, err := openpgp.Encrypt(aw, []*openpgp.Entity{k.entity}, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(pw, entity); err != nil {
+		return err
+	}
+	if err := pw.Close(); err != nil {
+		return err
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	io.WriteString(data, "\r\n")
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encryptSMIME пишет application/pkcs7-mime. pkcs7 шифрует только
+// целиком в памяти, поэтому письмо читается полностью.
+func (k *Key) encryptSMIME(w io.Writer, entity io.Reader) error {
+	content, err := io.ReadAll(entity)
+	if err != nil {
+		return err
+	}
+	der, err := pkcs7.Encrypt(content, []*x509.Certificate{k.cert})
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n")
+	bw.WriteString("Content-Transfer-Encoding: base64\r\n")
+	bw.WriteString("Content-Disposition: attachment; filename=smime.p7m\r\n\r\n")
+	enc := base64.StdEncoding.EncodeToString(der)
+	for len(enc) > 76 {
+		bw.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	bw.WriteString(enc + "\r\n")
+	return bw.Flush()
+}
+
+// crlfWriter заменяет переводы строк LF, которые пишет armor, на CRLF.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (cw *crlfWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m, err := cw.w.Write(p)
+			return n + m, err
+		}
+		if _, err := cw.w.Write(p[:i]); err != nil {
+			return n, err
+		}
+		if _, err := io.WriteString(cw.w, "\r\n"); err != nil {
+			return n, err
+		}
+		n += i + 1
+		p = p[i+1:]
+	}
+	return n, nil
+}
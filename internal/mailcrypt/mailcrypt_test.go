@@ -0,0 +1,296 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"download_track/internal/mailmsg"
+	"download_track/internal/store"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/smallstep/pkcs7"
+)
+
+func pgpEntity(t *testing.T) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity("Alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func armoredPublic(t *testing.T, entities ...*openpgp.Entity) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entities {
+		if err := e.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func certificate(t *testing.T, pub, priv any, notAfter time.Time) []byte {
+	t.Helper()
+	// случайный серийный номер: подпись RSA детерминирована, а тестам
+	// бывают нужны разные байты сертификата
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       notAfter,
+		KeyUsage:       x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// encryptedMessage шифрует письмо ключом k и возвращает его разобранным.
+func encryptedMessage(t *testing.T, k *Key) *mail.Message {
+	t.Helper()
+	m := &mailmsg.Message{
+		From:      mail.Address{Address: "bot@example.com"},
+		To:        []string{"alice@example.com"},
+		Subject:   "Файл",
+		Text:      "secret text",
+		HTML:      "<p>secret html</p>",
+		Encrypter: k,
+		TempDir:   t.TempDir(),
+	}
+	defer m.Close()
+	var buf bytes.Buffer
+	if err := m.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("plaintext leaked:\n%s", buf.String())
+	}
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// checkInner проверяет, что расшифрована исходная часть письма.
+func checkInner(t *testing.T, plain []byte) {
+	t.Helper()
+	inner, err := mail.ReadMessage(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, _, _ := mime.ParseMediaType(inner.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" || !bytes.Contains(plain, []byte("secret text")) {
+		t.Fatalf("unexpected decrypted part:\n%s", plain)
+	}
+}
+
+func TestPGP(t *testing.T) {
+	e := pgpEntity(t)
+	k, err := ParseKey(armoredPublic(t, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Kind != store.KeyPGP || k.Owner != "Alice <alice@example.com>" || len(k.Fingerprint) != 40 {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	// двоичный вид из store читается обратно
+	if k, err = LoadKey(k.Kind, k.Data); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := encryptedMessage(t, k)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("Content-Type = %q", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	control, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(control); strings.TrimSpace(string(b)) != "Version: 1" {
+		t.Fatalf("control part = %q", b)
+	}
+	data, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := armor.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{e}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInner(t, plain)
+}
+
+func TestSMIME(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := certificate(t, &priv.PublicKey, priv, time.Now().Add(time.Hour))
+	k, err := ParseKey(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Kind != store.KeySMIME || k.Owner != "Alice <alice@example.com>" || !bytes.Equal(k.Data, der) {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	if k, err = LoadKey(k.Kind, k.Data); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := encryptedMessage(t, k)
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "application/pkcs7-mime; smime-type=enveloped-data") {
+		t.Fatalf("Content-Type = %q", msg.Header.Get("Content-Type"))
+	}
+	raw, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	plain, err := p7.Decrypt(cert, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInner(t, plain)
+}
+
+func TestSMIMEWhitespaceDER(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DER начинается с SEQUENCE (0x30), а вот последний байт подписи
+	// бывает любым; ищем сертификат, который кончается «пробелом»
+	var der []byte
+	for i := 0; ; i++ {
+		if i == 2000 {
+			t.Fatal("no certificate ending with a whitespace byte")
+		}
+		der = certificate(t, &priv.PublicKey, priv, time.Now().Add(time.Hour))
+		if c := der[len(der)-1]; bytes.IndexByte([]byte(" \t\n\v\f\r"), c) >= 0 {
+			break
+		}
+	}
+	if len(bytes.TrimSpace(der)) == len(der) {
+		t.Fatal("TrimSpace keeps the certificate intact")
+	}
+
+	k, err := ParseKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Kind != store.KeySMIME || !bytes.Equal(k.Data, der) {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	msg := encryptedMessage(t, k)
+	raw, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := p7.Decrypt(k.cert, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInner(t, plain)
+}
+
+func TestParseKeyErrors(t *testing.T) {
+	e := pgpEntity(t)
+	var private bytes.Buffer
+	w, _ := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+	if err := e.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	for name, tc := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"garbage":     {[]byte("hello"), ErrUnknownFormat},
+		"private pgp": {private.Bytes(), ErrPrivateKey},
+		"two keys":    {armoredPublic(t, e, pgpEntity(t)), ErrMultipleKeys},
+		"ed25519":     {certificate(t, edPub, edPriv, time.Now().Add(time.Hour)), ErrNotRSA},
+		"expired":     {certificate(t, &rsaKey.PublicKey, rsaKey, time.Now().Add(-time.Minute)), ErrCannotEncrypt},
+		"pem key":     {pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}), ErrUnknownFormat},
+	} {
+		if _, err := ParseKey(tc.data); !errors.Is(err, tc.err) {
+			t.Errorf("%s: err = %v, want %v", name, err, tc.err)
+		}
+	}
+}
+
+func TestEncryptExpired(t *testing.T) {
+	k, err := ParseKey(armoredPublic(t, pgpEntity(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ключ NewEntity действует бессрочно, а сертификат — нет
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	c, err := LoadKey(store.KeySMIME, certificate(t, &priv.PublicKey, priv, time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := c.Encrypt(io.Discard, strings.NewReader("x")); !errors.Is(err, ErrCannotEncrypt) {
+		t.Fatalf("expired certificate: err = %v", err)
+	}
+	if err := k.Encrypt(io.Discard, strings.NewReader("Content-Type: text/plain\r\n\r\nx")); err != nil {
+		t.Fatal(err)
+	}
+}
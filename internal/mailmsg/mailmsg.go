@@ -0,0 +1,290 @@
+// Package mailmsg собирает письмо в формате MIME: текст, необязательная
+// HTML-версия и вложения. Вложения читаются с диска во время записи, а
+// не держатся в памяти целиком. Письмо можно зашифровать для получателя
+// через Encrypter.
+package mailmsg
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Attachment — файл, прикладываемый к письму.
+type Attachment struct {
+	// имя вложения в письме
+	Name string
+	// файл на диске
+	Path string
+}
+
+// Message — письмо. Если HTML пустой, тело — только текст; иначе
+// multipart/alternative с обеими версиями.
+type Message struct {
+	From        mail.Address
+	To          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+	// пустые — текущее время и случайный идентификатор
+	Date      time.Time
+	MessageID string
+	// nil — письмо не шифруется
+	Encrypter Encrypter
+	// каталог для зашифрованного тела; пустой — os.TempDir()
+	TempDir string
+
+	// дерево частей; строится при первом Encode вместе со случайными
+	// границами
+	root *part
+	// зашифрованное тело; шифрование случайно, поэтому делается один
+	// раз, а повторные Encode читают файл
+	encrypted *os.File
+}
+
+// Encrypter шифрует письмо. Encrypt читает исходную MIME-часть целиком —
+// поля Content-*, пустую строку и тело — и пишет в w зашифрованную часть
+// в том же виде.
+type Encrypter interface {
+	Encrypt(w io.Writer, entity io.Reader) error
+}
+
+// part — MIME-часть: заголовки и функция, которая пишет содержимое.
+type part struct {
+	header textproto.MIMEHeader
+	body   func(w io.Writer) error
+}
+
+// порядок полей в заголовке верхней части
+var partHeaderOrder = []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"}
+
+// Encode пишет письмо целиком: заголовки и тело с переводами строк CRLF.
+// Первый вызов фиксирует дату, Message-ID и границы частей, так что
+// повторный Encode того же письма даёт те же байты: письмо можно сначала
+// подписать, а потом отправить. Зашифрованное письмо после отправки
+// нужно закрыть через Close.
+func (m *Message) Encode(w io.Writer) error {
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+	if m.MessageID == "" {
+		m.MessageID = newMessageID(m.From.Address)
+	}
+	if m.root == nil {
+		m.root = m.build()
+	}
+	if m.Encrypter != nil && m.encrypted == nil {
+		if err := m.encrypt(); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From: %s\r\n", m.From.String())
+	fmt.Fprintf(bw, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(bw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(bw, "Date: %s\r\n", m.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(bw, "Message-ID: %s\r\n", m.MessageID)
+	bw.WriteString("MIME-Version: 1.0\r\n")
+
+	if m.encrypted != nil {
+		if _, err := m.encrypted.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(bw, m.encrypted); err != nil {
+			return err
+		}
+	} else if err := m.root.write(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encrypt шифрует верхнюю часть письма во временный файл.
+func (m *Message) encrypt() error {
+	f, err := os.CreateTemp(m.TempDir, "mail-*.enc")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		err := m.root.write(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	err = m.Encrypter.Encrypt(f, pr)
+	// Encrypt мог не дочитать часть; пишущая горутина не должна зависнуть
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	m.encrypted = f
+	return nil
+}
+
+// Close освобождает временный файл зашифрованного письма.
+func (m *Message) Close() error {
+	if m.encrypted == nil {
+		return nil
+	}
+	err := m.encrypted.Close()
+	m.encrypted = nil
+	return err
+}
+
+// write пишет часть целиком: поля Content-*, пустую строку и тело.
+func (p *part) write(w io.Writer) error {
+	for _, k := range partHeaderOrder {
+		if v := p.header.Get(k); v != "" {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := io.WriteString(w, "\r\n"); err != nil {
+		return err
+	}
+	return p.body(w)
+}
+
+// build собирает дерево частей: тело и вложения.
+func (m *Message) build() *part {
+	root := m.content()
+	if len(m.Attachments) > 0 {
+		parts := []part{root}
+		for _, a := range m.Attachments {
+			parts = append(parts, attachmentPart(a))
+		}
+		root = multipartPart("mixed", parts...)
+	}
+	return &root
+}
+
+// content — текст или текст вместе с HTML.
+func (m *Message) content() part {
+	text := textPart("text/plain", m.Text)
+	if m.HTML == "" {
+		return text
+	}
+	return multipartPart("alternative", text, textPart("text/html", m.HTML))
+}
+
+func textPart(contentType, s string) part {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return part{header: h, body: func(w io.Writer) error {
+		qw := quotedprintable.NewWriter(w)
+		if _, err := io.WriteString(qw, s); err != nil {
+			return err
+		}
+		return qw.Close()
+	}}
+}
+
+func multipartPart(subtype string, parts ...part) part {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary}))
+	return part{header: h, body: func(w io.Writer) error {
+		mw := multipart.NewWriter(w)
+		if err := mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+		for _, p := range parts {
+			pw, err := mw.CreatePart(p.header)
+			if err != nil {
+				return err
+			}
+			if err := p.body(pw); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	}}
+}
+
+func attachmentPart(a Attachment) part {
+	contentType := mime.TypeByExtension(filepath.Ext(a.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	// FormatMediaType кодирует не-ASCII имя по RFC 2231
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	return part{header: h, body: func(w io.Writer) error {
+		f, err := os.Open(a.Path)
+		if err != nil {
+			return fmt.Errorf("attach %s: %w", a.Name, err)
+		}
+		defer f.Close()
+
+		enc := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: w})
+		if _, err := io.Copy(enc, f); err != nil {
+			return fmt.Errorf("attach %s: %w", a.Name, err)
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "\r\n")
+		return err
+	}}
+}
+
+// lineWriter разбивает base64 на строки по 76 символов (RFC 2045).
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if lw.col == 76 {
+			if _, err := io.WriteString(lw.w, "\r\n"); err != nil {
+				return n, err
+			}
+			lw.col = 0
+		}
+		chunk := min(len(p), 76-lw.col)
+		if _, err := lw.w.Write(p[:chunk]); err != nil {
+			return n, err
+		}
+		lw.col += chunk
+		n += chunk
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// newMessageID — случайный Message-ID в домене отправителя.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndexByte(from, '@'); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
@@ -0,0 +1,265 @@
+package mailmsg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readPart возвращает декодированное содержимое части.
+func readPart(t *testing.T, p *multipart.Part) string {
+	t.Helper()
+	// multipart.Reader сам снимает quoted-printable
+	data, err := io.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestEncodeTextOnly(t *testing.T) {
+	m := &Message{
+		From:    mail.Address{Name: "filemailer", Address: "bot@example.com"},
+		To:      []string{"user@example.com"},
+		Subject: "[files] Файл report.pdf",
+		Text:    "Строка с длинным текстом, которую quoted-printable перенесёт: " + strings.Repeat("x", 100) + "\n",
+	}
+	var buf bytes.Buffer
+	if err := m.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != m.Subject {
+		t.Fatalf("subject = %q, %v", subject, err)
+	}
+	if got := msg.Header.Get("Message-ID"); !strings.HasSuffix(got, "@example.com>") {
+		t.Fatalf("message-id = %q", got)
+	}
+	if ct := msg.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Fatalf("content-type = %q", ct)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.ReplaceAll(m.Text, "\n", "\r\n"); string(body) != want {
+		t.Fatalf("body = %q, want %q", body, want)
+	}
+}
+
+func TestEncodeAlternativeWithAttachment(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Message{
+		From:        mail.Address{Address: "bot@example.com"},
+		To:          []string{"user@example.com"},
+		Subject:     "file",
+		Text:        "plain",
+		HTML:        "<p>html</p>",
+		Attachments: []Attachment{{Name: "отчёт.txt", Path: path}},
+	}
+	var buf bytes.Buffer
+	if err := m.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("line longer than 998 bytes: %d", len(line))
+		}
+	}
+
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content-type = %q, %v", mediaType, err)
+	}
+	mixed := multipart.NewReader(msg.Body, params["boundary"])
+
+	alt, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(alt.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("first part = %q", mediaType)
+	}
+	altReader := multipart.NewReader(alt, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", "plain"},
+		{"text/html; charset=utf-8", "<p>html</p>"},
+	} {
+		p, err := altReader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := p.Header.Get("Content-Type"); ct != want.contentType {
+			t.Fatalf("content-type = %q, want %q", ct, want.contentType)
+		}
+		if got := readPart(t, p); got != want.body {
+			t.Fatalf("body = %q, want %q", got, want.body)
+		}
+	}
+
+	att, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if att.FileName() != "отчёт.txt" {
+		t.Fatalf("filename = %q", att.FileName())
+	}
+	raw, err := io.ReadAll(att)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(base64Reader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatal("attachment content differs")
+	}
+	if _, err := mixed.NextPart(); err != io.EOF {
+		t.Fatalf("extra part: %v", err)
+	}
+}
+
+func TestEncodeRepeatable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{
+		From:        mail.Address{Address: "bot@example.com"},
+		To:          []string{"user@example.com"},
+		Text:        "plain",
+		HTML:        "<p>html</p>",
+		Attachments: []Attachment{{Name: "a.bin", Path: path}},
+	}
+	var first, second bytes.Buffer
+	if err := m.Encode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Encode(&second); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Fatal("second Encode differs from the first")
+	}
+}
+
+func TestEncodeMissingAttachment(t *testing.T) {
+	m := &Message{
+		From:        mail.Address{Address: "bot@example.com"},
+		To:          []string{"user@example.com"},
+		Attachments: []Attachment{{Name: "a", Path: filepath.Join(t.TempDir(), "missing")}},
+	}
+	if err := m.Encode(io.Discard); err == nil {
+		t.Fatal("want error for missing attachment")
+	}
+}
+
+// nonceEncrypter «шифрует» часть, приписывая к ней счётчик вызовов:
+// повторный Encode не должен шифровать заново.
+type nonceEncrypter struct{ calls int }
+
+func (e *nonceEncrypter) Encrypt(w io.Writer, entity io.Reader) error {
+	e.calls++
+	data, err := io.ReadAll(entity)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Type: application/x-test; n=%d\r\n\r\n%s", e.calls, base64.StdEncoding.EncodeToString(data))
+	return err
+}
+
+func TestEncodeEncrypted(t *testing.T) {
+	enc := &nonceEncrypter{}
+	m := &Message{
+		From:      mail.Address{Address: "bot@example.com"},
+		To:        []string{"user@example.com"},
+		Subject:   "s",
+		Text:      "secret",
+		HTML:      "<p>secret</p>",
+		Encrypter: enc,
+		TempDir:   t.TempDir(),
+	}
+	defer m.Close()
+
+	var first, second bytes.Buffer
+	if err := m.Encode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Encode(&second); err != nil {
+		t.Fatal(err)
+	}
+	if enc.calls != 1 || first.String() != second.String() {
+		t.Fatalf("encrypted %d times, encodings equal: %v", enc.calls, first.String() == second.String())
+	}
+
+	msg, err := mail.ReadMessage(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := msg.Header.Get("Content-Type"); ct != "application/x-test; n=1" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if msg.Header.Get("Subject") != "s" || strings.Contains(first.String(), "secret") {
+		t.Fatalf("unexpected message:\n%s", first.String())
+	}
+
+	// зашифрована исходная верхняя часть целиком, вместе с её заголовками
+	data, err := io.ReadAll(base64Reader(mustReadAll(t, msg.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, _, _ := mime.ParseMediaType(inner.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("inner Content-Type = %q", inner.Header.Get("Content-Type"))
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(m.TempDir); len(entries) != 0 {
+		t.Fatalf("temp files left: %v", entries)
+	}
+}
+
+func mustReadAll(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// base64Reader декодирует base64 с переводами строк.
+func base64Reader(raw []byte) io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw))
+}
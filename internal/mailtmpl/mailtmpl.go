@@ -0,0 +1,234 @@
+// Package mailtmpl — шаблоны писем с файлом: тема, текст и HTML-версия
+// на каждом языке из i18n. Шаблоны по умолчанию встроены в бинарник,
+// оператор может переопределить любой из них файлом в своём каталоге.
+//
+// Файлы ищутся по порядку:
+//
+//	<dir>/<язык>/<имя>
+//	<dir>/<имя>
+//	встроенный templates/<язык>/<имя>
+//	встроенный templates/<i18n.Default>/<имя>
+//
+// где имя — subject.txt, body.txt или body.html. Тема и текст — шаблоны
+// text/template, HTML — html/template. Пустой body.html отключает
+// HTML-версию письма.
+package mailtmpl
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"download_track/internal/i18n"
+)
+
+//go:embed templates
+var defaultFS embed.FS
+
+// MaxPrefixLen — максимальная длина префикса темы в символах.
+const MaxPrefixLen = 32
+
+var ErrPrefixInvalid = fmt.Errorf("subject prefix must be a single line of at most %d characters", MaxPrefixLen)
+
+// Data — переменные, доступные в шаблонах.
+type Data struct {
+	JobID    int64
+	URL      string
+	FileName string
+	// размер в байтах; {{size .Size}} — в читаемом виде
+	Size int64
+	// SHA-256 файла в hex
+	Checksum string
+	// email аккаунта и адрес, на который уходит письмо
+	User      string
+	Recipient string
+	// время отправки
+	Time time.Time
+}
+
+// Message — готовые тема и тело письма. HTML пустой, если HTML-версия
+// отключена.
+type Message struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Set — загруженные шаблоны всех языков. Set не меняется после Load,
+// перезагрузка создаёт новый.
+type Set struct {
+	langs map[string]*templates
+}
+
+type templates struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	// nil — HTML-версия отключена
+	html *htmltemplate.Template
+}
+
+var funcs = map[string]any{
+	"size": HumanSize,
+}
+
+// Load загружает шаблоны по умолчанию и переопределения из dir (пустой —
+// без переопределений). Каждый шаблон пробно исполняется, чтобы опечатка
+// в имени переменной обнаружилась при загрузке, а не при отправке.
+func Load(dir string) (*Set, error) {
+	s := &Set{langs: make(map[string]*templates)}
+	for _, lang := range i18n.Supported() {
+		t, err := loadLang(dir, lang)
+		if err != nil {
+			return nil, err
+		}
+		s.langs[lang] = t
+	}
+	return s, nil
+}
+
+func loadLang(dir, lang string) (*templates, error) {
+	var t templates
+
+	src, name, err := readTemplate(dir, lang, "subject.txt")
+	if err != nil {
+		return nil, err
+	}
+	if t.subject, err = texttemplate.New(name).Funcs(funcs).Parse(src); err != nil {
+		return nil, err
+	}
+
+	if src, name, err = readTemplate(dir, lang, "body.txt"); err != nil {
+		return nil, err
+	}
+	if t.text, err = texttemplate.New(name).Funcs(funcs).Parse(src); err != nil {
+		return nil, err
+	}
+
+	if src, name, err = readTemplate(dir, lang, "body.html"); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(src) != "" {
+		if t.html, err = htmltemplate.New(name).Funcs(funcs).Parse(src); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := t.render(sampleData()); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// readTemplate возвращает текст шаблона и его источник для сообщений об
+// ошибках.
+func readTemplate(dir, lang, name string) (src, source string, err error) {
+	if dir != "" {
+		for _, p := range []string{filepath.Join(dir, lang, name), filepath.Join(dir, name)} {
+			data, err := os.ReadFile(p)
+			if err == nil {
+				return string(data), p, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", "", err
+			}
+		}
+	}
+	for _, l := range []string{lang, i18n.Default} {
+		p := path.Join("templates", l, name)
+		if data, err := defaultFS.ReadFile(p); err == nil {
+			return string(data), "default " + path.Join(l, name), nil
+		}
+	}
+	return "", "", fmt.Errorf("no template %s for %s", name, lang)
+}
+
+// Render заполняет шаблоны языка lang; неподдерживаемый язык — i18n.Default.
+func (s *Set) Render(lang string, d Data) (*Message, error) {
+	t, ok := s.langs[lang]
+	if !ok {
+		t = s.langs[i18n.Default]
+	}
+	return t.render(d)
+}
+
+func (t *templates) render(d Data) (*Message, error) {
+	var m Message
+	var buf bytes.Buffer
+
+	if err := t.subject.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+	// тема — одна строка, переводы строк из шаблона схлопываются
+	m.Subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := t.text.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+	m.Text = buf.String()
+
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, d); err != nil {
+			return nil, err
+		}
+		m.HTML = buf.String()
+	}
+	return &m, nil
+}
+
+func sampleData() Data {
+	return Data{
+		JobID:     1,
+		URL:       "https://example.com/file.pdf",
+		FileName:  "file.pdf",
+		Size:      1 << 20,
+		Checksum:  strings.Repeat("0", 64),
+		User:      "user@example.com",
+		Recipient: "user@example.com",
+		Time:      time.Unix(0, 0).UTC(),
+	}
+}
+
+// HumanSize — размер в двоичных единицах: 512 B, 1.5 MiB.
+func HumanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// CleanPrefix проверяет префикс темы, заданный пользователем. Пустой
+// префикс допустим и означает «без префикса».
+func CleanPrefix(prefix string) (string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if utf8.RuneCountInString(prefix) > MaxPrefixLen || strings.ContainsFunc(prefix, unicode.IsControl) {
+		return "", ErrPrefixInvalid
+	}
+	return prefix, nil
+}
+
+// Subject добавляет к теме префикс пользователя.
+func Subject(prefix, subject string) string {
+	if prefix == "" {
+		return subject
+	}
+	return prefix + " " + subject
+}
@@ -0,0 +1,156 @@
+package mailtmpl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testData() Data {
+	return Data{
+		JobID:    42,
+		URL:      "https://example.com/a.pdf?x=1&y=2",
+		FileName: "<a>.pdf",
+		Size:     3 << 20,
+		Checksum: "abc123",
+		User:     "user@example.com",
+		Time:     time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	s, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ lang, subject, text string }{
+		{"ru", "Файл <a>.pdf от 2024-05-01 12:30", "Размер:  3.0 MiB"},
+		{"en", "File <a>.pdf, 2024-05-01 12:30", "Size:    3.0 MiB"},
+		// неизвестный язык — язык по умолчанию
+		{"de", "Файл <a>.pdf от 2024-05-01 12:30", "SHA-256: abc123"},
+	} {
+		m, err := s.Render(tc.lang, testData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Subject != tc.subject {
+			t.Errorf("%s: subject = %q, want %q", tc.lang, m.Subject, tc.subject)
+		}
+		if !strings.Contains(m.Text, tc.text) || !strings.Contains(m.Text, "#42") {
+			t.Errorf("%s: text = %q, want %q", tc.lang, m.Text, tc.text)
+		}
+		// в HTML значения экранируются
+		if !strings.Contains(m.HTML, "&lt;a&gt;.pdf") || strings.Contains(m.HTML, "<a>.pdf") {
+			t.Errorf("%s: html is not escaped: %q", tc.lang, m.HTML)
+		}
+		if !strings.Contains(m.HTML, "x=1&amp;y=2") {
+			t.Errorf("%s: html url = %q", tc.lang, m.HTML)
+		}
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	dir := t.TempDir()
+	// общий шаблон темы и отдельный — для английского
+	writeFile(t, filepath.Join(dir, "subject.txt"), "{{.FileName}}\n")
+	writeFile(t, filepath.Join(dir, "en", "subject.txt"), "en: {{.FileName}} ({{size .Size}})")
+	writeFile(t, filepath.Join(dir, "ru", "body.html"), "  \n")
+
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ru, err := s.Render("ru", testData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ru.Subject != "<a>.pdf" {
+		t.Errorf("ru subject = %q", ru.Subject)
+	}
+	if ru.HTML != "" {
+		t.Errorf("empty body.html should disable html, got %q", ru.HTML)
+	}
+	if !strings.Contains(ru.Text, "Задание: #42") {
+		t.Errorf("ru text should stay default, got %q", ru.Text)
+	}
+
+	en, err := s.Render("en", testData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if en.Subject != "en: <a>.pdf (3.0 MiB)" {
+		t.Errorf("en subject = %q", en.Subject)
+	}
+	if en.HTML == "" {
+		t.Error("en html should stay default")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"syntax":        {"body.txt": "{{.URL"},
+		"unknown field": {"en/body.html": "{{.Filename}}"},
+		"unknown func":  {"subject.txt": "{{upper .FileName}}"},
+	} {
+		dir := t.TempDir()
+		for path, content := range files {
+			writeFile(t, filepath.Join(dir, path), content)
+		}
+		if _, err := Load(dir); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KiB",
+		1536:          "1.5 KiB",
+		500 << 20:     "500.0 MiB",
+		5 << 30:       "5.0 GiB",
+		(1 << 40) + 1: "1.0 TiB",
+	} {
+		if got := HumanSize(n); got != want {
+			t.Errorf("HumanSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"  [files] ", "[files]", true},
+		{"", "", true},
+		{strings.Repeat("ж", MaxPrefixLen), strings.Repeat("ж", MaxPrefixLen), true},
+		{strings.Repeat("ж", MaxPrefixLen+1), "", false},
+		{"[a]\r\nBcc: x@example.com", "", false},
+	} {
+		got, err := CleanPrefix(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("CleanPrefix(%q) = %q, %v", tc.in, got, err)
+		}
+	}
+	if got := Subject("[files]", "File"); got != "[files] File" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := Subject("", "File"); got != "File" {
+		t.Errorf("Subject without prefix = %q", got)
+	}
+}
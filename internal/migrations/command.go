@@ -0,0 +1,87 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Usage — справка по подкоманде migrate.
+const Usage = `migrate up           apply all pending migrations
+migrate down [n]     revert the last n migrations (default 1)
+migrate status       list migrations and when they were applied`
+
+// RunCommand выполняет подкоманду migrate с аргументами args.
+func RunCommand(ctx context.Context, db *sql.DB, args []string, out io.Writer) error {
+	m, err := New(db)
+	if err != nil {
+		return err
+	}
+	m.Logf = func(format string, a ...any) { fmt.Fprintf(out, format+"\n", a...) }
+
+	if len(args) == 0 {
+		return errors.New("usage:\n" + Usage)
+	}
+	switch args[0] {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d migration(s) applied\n", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		n, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d migration(s) reverted\n", n)
+	case "status":
+		st, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range st {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q\nusage:\n%s", args[0], Usage)
+	}
+	return nil
+}
+
+// OnStartup применяет миграции при старте сервиса, если apply=true,
+// иначе только проверяет, что схема актуальна.
+func OnStartup(ctx context.Context, db *sql.DB, apply bool, logf func(format string, args ...any)) error {
+	m, err := New(db)
+	if err != nil {
+		return err
+	}
+	m.Logf = logf
+	if apply {
+		_, err := m.Up(ctx)
+		return err
+	}
+	n, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logf("warning: %d pending migration(s), run `migrate up` or set DB_MIGRATE=true", n)
+	}
+	return nil
+}
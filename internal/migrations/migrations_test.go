@@ -0,0 +1,230 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+func TestAll(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(files, "sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// каждая версия — ровно пара файлов up и down
+	if len(entries) != 2*len(all) {
+		t.Fatalf("%d files for %d migrations", len(entries), len(all))
+	}
+	for i, m := range all {
+		// версии идут подряд с 1: пропуск или дубль — ошибка нумерации
+		if m.Version != i+1 {
+			t.Fatalf("migration #%d has version %d", i, m.Version)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Fatalf("migration %d_%s has an empty up or down", m.Version, m.Name)
+		}
+		for _, dir := range []string{"up", "down"} {
+			name := fmt.Sprintf("sql/%04d_%s.%s.sql", m.Version, m.Name, dir)
+			if _, err := fs.Stat(files, name); err != nil {
+				t.Fatalf("migration %d: %v", m.Version, err)
+			}
+		}
+	}
+}
+
+func TestRunCommandUsage(t *testing.T) {
+	// до базы эти ошибки не доходят
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "usage:"},
+		{[]string{"sideways"}, `unknown migrate command "sideways"`},
+		{[]string{"down", "0"}, `invalid number of steps "0"`},
+		{[]string{"down", "x"}, `invalid number of steps "x"`},
+	} {
+		err := RunCommand(context.Background(), nil, tc.args, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("RunCommand(%q) = %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
+
+// testDB открывает TEST_DB_DSN в отдельной схеме, чтобы откат миграций
+// не задел таблицы, с которыми работают тесты store/postgres.
+func testDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("migrations_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func pending(t *testing.T, m *Migrator) int {
+	t.Helper()
+	n, err := m.Pending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var ok bool
+	if err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, name).Scan(&ok); err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestUpDownUp(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := len(m.migrations)
+
+	// Status на пустой базе не создаёт schema_migrations
+	if n := pending(t, m); n != total {
+		t.Fatalf("pending on empty db = %d, want %d", n, total)
+	}
+	if tableExists(t, db, "schema_migrations") {
+		t.Fatal("Status created schema_migrations")
+	}
+
+	if n, err := m.Up(ctx); err != nil || n != total {
+		t.Fatalf("Up = %d, %v; want %d", n, err, total)
+	}
+	if n, err := m.Up(ctx); err != nil || n != 0 {
+		t.Fatalf("second Up = %d, %v", n, err)
+	}
+	st, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range st {
+		if s.AppliedAt == nil {
+			t.Fatalf("migration %d_%s not applied", s.Version, s.Name)
+		}
+	}
+
+	// откат последней и повторное применение
+	if n, err := m.Down(ctx, 1); err != nil || n != 1 {
+		t.Fatalf("Down(1) = %d, %v", n, err)
+	}
+	if n := pending(t, m); n != 1 {
+		t.Fatalf("pending after Down(1) = %d", n)
+	}
+	if n, err := m.Up(ctx); err != nil || n != 1 {
+		t.Fatalf("Up after Down(1) = %d, %v", n, err)
+	}
+
+	// down-файлы убирают всё, что создали up-файлы
+	if n, err := m.Down(ctx, total+5); err != nil || n != total {
+		t.Fatalf("Down(all) = %d, %v; want %d", n, err, total)
+	}
+	for _, table := range []string{"users", "jobs", "addresses", "credentials"} {
+		if tableExists(t, db, table) {
+			t.Fatalf("table %s left after Down", table)
+		}
+	}
+	if n := pending(t, m); n != total {
+		t.Fatalf("pending after Down(all) = %d", n)
+	}
+	if n, err := m.Up(ctx); err != nil || n != total {
+		t.Fatalf("Up after Down(all) = %d, %v", n, err)
+	}
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// другой процесс держит блокировку, например параллельно стартующий бот
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := m.Up(waitCtx); err == nil {
+		t.Fatal("Up did not wait for the advisory lock")
+	}
+	if n := pending(t, m); n != len(m.migrations) {
+		t.Fatalf("migrations applied without the lock: %d pending", n)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Up(ctx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Up finished while the lock is held: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Up did not continue after the lock was released")
+	}
+	if n := pending(t, m); n != 0 {
+		t.Fatalf("%d pending after Up", n)
+	}
+}
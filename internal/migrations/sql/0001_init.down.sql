@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS email_change_requests;
+DROP TABLE IF EXISTS telegram_users;
+DROP TABLE IF EXISTS users;
@@ -1,3 +1,5 @@
+-- IF NOT EXISTS: базы, созданные до появления миграций из migrations.sql,
+-- принимают эту миграцию без ошибок.
 CREATE TABLE IF NOT EXISTS users (
     id         SERIAL PRIMARY KEY,
     email      TEXT UNIQUE NOT NULL,
@@ -0,0 +1,18 @@
+-- задания на скачивание и отправку (REST API и /send)
+CREATE TABLE IF NOT EXISTS jobs (
+    id           BIGSERIAL PRIMARY KEY,
+    user_id      INTEGER      NOT NULL REFERENCES users(id),
+    file_url     TEXT         NOT NULL,
+    recipient    TEXT         NOT NULL,
+    filename     TEXT         NOT NULL DEFAULT '',
+    subject      TEXT         NOT NULL DEFAULT '',
+    status       TEXT         NOT NULL DEFAULT 'queued', -- queued | downloading | sending | sent | failed | canceled
+    error        TEXT         NOT NULL DEFAULT '',
+    size_bytes   BIGINT       NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    started_at   TIMESTAMPTZ,
+    finished_at  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS jobs_user_id_idx ON jobs (user_id, id DESC);
+CREATE INDEX IF NOT EXISTS jobs_queued_idx ON jobs (id) WHERE status = 'queued';
@@ -0,0 +1,8 @@
+-- одноразовые коды для привязки Telegram к существующему аккаунту (/link <код>)
+CREATE TABLE IF NOT EXISTS telegram_link_codes (
+    code        TEXT PRIMARY KEY,
+    user_id     INTEGER      NOT NULL REFERENCES users(id),
+    expires_at  TIMESTAMPTZ  NOT NULL,
+    used_at     TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
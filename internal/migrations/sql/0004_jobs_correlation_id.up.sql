@@ -0,0 +1,2 @@
+-- идентификатор запроса, связывающий задание с логами бота
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS correlation_id TEXT NOT NULL DEFAULT '';
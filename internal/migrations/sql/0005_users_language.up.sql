@@ -0,0 +1,2 @@
+-- язык бота и писем; пустой — язык Telegram или язык по умолчанию
+ALTER TABLE users ADD COLUMN IF NOT EXISTS language TEXT NOT NULL DEFAULT '';
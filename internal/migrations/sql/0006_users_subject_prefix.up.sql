@@ -0,0 +1,2 @@
+-- префикс темы писем, по которому пользователь фильтрует почту
+ALTER TABLE users ADD COLUMN IF NOT EXISTS subject_prefix TEXT NOT NULL DEFAULT '';
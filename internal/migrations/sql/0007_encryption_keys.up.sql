@@ -0,0 +1,10 @@
+-- открытые ключи для шифрования писем: PGP или сертификат S/MIME
+CREATE TABLE IF NOT EXISTS encryption_keys (
+    user_id     INTEGER      PRIMARY KEY REFERENCES users(id),
+    kind        TEXT         NOT NULL, -- pgp | smime
+    data        BYTEA        NOT NULL,
+    fingerprint TEXT         NOT NULL,
+    -- не отправлять письма без шифрования
+    required    BOOLEAN      NOT NULL DEFAULT false,
+    updated_at  TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
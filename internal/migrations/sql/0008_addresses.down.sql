@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS default_address;
+DROP TABLE IF EXISTS addresses;
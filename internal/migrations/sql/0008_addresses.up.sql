@@ -0,0 +1,17 @@
+-- дополнительные адреса пользователя с метками: /send kindle <ссылка>
+CREATE TABLE IF NOT EXISTS addresses (
+    id               SERIAL       PRIMARY KEY,
+    user_id          INTEGER      NOT NULL REFERENCES users(id),
+    label            TEXT         NOT NULL,
+    email            TEXT         NOT NULL,
+    -- код из письма с подтверждением; NULL после подтверждения
+    verify_code      TEXT,
+    code_expires_at  TIMESTAMPTZ,
+    verify_attempts  INTEGER      NOT NULL DEFAULT 0,
+    verified_at      TIMESTAMPTZ,
+    created_at       TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    UNIQUE (user_id, label)
+);
+
+-- метка адреса по умолчанию; пустая — основной email
+ALTER TABLE users ADD COLUMN IF NOT EXISTS default_address TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS profile;
+ALTER TABLE addresses DROP COLUMN IF EXISTS profile;
@@ -0,0 +1,5 @@
+-- профиль доставки: kindle проверяет формат файла и ставит тему
+-- по правилам Send to Kindle
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS profile TEXT NOT NULL DEFAULT '';
+-- профиль запоминается в задании: адрес могут изменить, пока оно в очереди
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS profile TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- как сохранять HTML-страницу: пустой — со всеми ресурсами одним файлом,
+-- readable — только текст статьи, raw — как отдал сервер
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS page_mode TEXT NOT NULL DEFAULT '';
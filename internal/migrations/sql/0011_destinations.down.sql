@@ -0,0 +1,3 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS delivered_to;
+ALTER TABLE jobs DROP COLUMN IF EXISTS destination;
+DROP TABLE IF EXISTS destinations;
@@ -0,0 +1,20 @@
+-- куда доставлять файлы вместо почты: s3 | webdav | local
+CREATE TABLE IF NOT EXISTS destinations (
+    user_id     INTEGER      PRIMARY KEY REFERENCES users(id),
+    kind        TEXT         NOT NULL,
+    -- адрес S3 API или каталога WebDAV
+    endpoint    TEXT         NOT NULL DEFAULT '',
+    bucket      TEXT         NOT NULL DEFAULT '',
+    region      TEXT         NOT NULL DEFAULT '',
+    -- префикс ключа в S3 или подкаталог
+    path        TEXT         NOT NULL DEFAULT '',
+    -- ключ доступа S3 или пользователь WebDAV и секрет к нему
+    username    TEXT         NOT NULL DEFAULT '',
+    secret      TEXT         NOT NULL DEFAULT '',
+    updated_at  TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+
+-- вид места доставки на момент создания задания; пустой — письмо
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS destination TEXT NOT NULL DEFAULT '';
+-- где оказался файл: mailto:, URL объекта или путь
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS delivered_to TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+-- учётные данные для скачивания по ftp:// и sftp://
+CREATE TABLE IF NOT EXISTS credentials (
+    user_id      INTEGER      NOT NULL REFERENCES users(id),
+    -- ftp | sftp
+    scheme       TEXT         NOT NULL,
+    -- имя хоста в нижнем регистре, без порта
+    host         TEXT         NOT NULL,
+    username     TEXT         NOT NULL,
+    password     TEXT         NOT NULL DEFAULT '',
+    -- закрытый ключ SSH в PEM
+    private_key  TEXT         NOT NULL DEFAULT '',
+    -- ключ сервера SSH в формате authorized_keys
+    host_key     TEXT         NOT NULL DEFAULT '',
+    updated_at   TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, scheme, host)
+);
@@ -0,0 +1,6 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS auth;
+DELETE FROM credentials WHERE scheme IN ('http', 'https');
+ALTER TABLE credentials
+    DROP COLUMN IF EXISTS user_agent,
+    DROP COLUMN IF EXISTS cookies,
+    DROP COLUMN IF EXISTS headers;
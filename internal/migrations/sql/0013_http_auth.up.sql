@@ -0,0 +1,13 @@
+-- учётные данные для скачивания по http:// и https://; password,
+-- private_key, headers, cookies и jobs.auth шифруются ключом
+-- db.secrets_key; записанное до появления ключа не читается, пока
+-- его не зашифрует SealSecrets при старте сервиса с ключом
+ALTER TABLE credentials
+    -- заголовки и cookie: зашифрованный JSON-объект имя → значение
+    ADD COLUMN IF NOT EXISTS headers     TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS cookies     TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS user_agent  TEXT NOT NULL DEFAULT '';
+
+-- учётные данные одного задания: зашифрованный JSON, стирается по
+-- завершении задания
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS auth TEXT NOT NULL DEFAULT '';
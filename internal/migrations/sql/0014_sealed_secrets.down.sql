@@ -0,0 +1,2 @@
+ALTER TABLE destinations DROP COLUMN IF EXISTS sealed;
+ALTER TABLE credentials DROP COLUMN IF EXISTS sealed;
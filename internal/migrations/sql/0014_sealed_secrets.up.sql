@@ -0,0 +1,5 @@
+-- строка зашифрована целиком: по префиксу v1: этого не понять, пароль
+-- открытым текстом тоже может с него начинаться. Строки до этой
+-- миграции проверяет SealSecrets.
+ALTER TABLE credentials ADD COLUMN IF NOT EXISTS sealed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE destinations ADD COLUMN IF NOT EXISTS sealed BOOLEAN NOT NULL DEFAULT FALSE;
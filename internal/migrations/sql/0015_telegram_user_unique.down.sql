@@ -0,0 +1 @@
+DROP INDEX IF EXISTS telegram_users_user_id_key;
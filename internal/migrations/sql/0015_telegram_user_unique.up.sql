@@ -0,0 +1,8 @@
+-- у аккаунта не больше одной привязки Telegram: две одновременные
+-- привязки разными кодами проходили проверку в LinkTelegram обе.
+-- Лишние привязки, если они уже есть, убираются, остаётся первая.
+DELETE FROM telegram_users t
+USING telegram_users first
+WHERE t.user_id = first.user_id AND t.id > first.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS telegram_users_user_id_key ON telegram_users (user_id);
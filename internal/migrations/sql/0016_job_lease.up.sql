@@ -0,0 +1,5 @@
+-- до какого времени задание из очереди числится за воркером. Воркер
+-- продлевает срок, пока выполняет задание; задание с истёкшим сроком
+-- осталось от упавшего экземпляра, и ClaimJob забирает его снова.
+-- NULL — задание выполняется не из очереди, а в запросе /send.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ;
@@ -0,0 +1,88 @@
+// Package secret шифрует учётные данные пользователей перед записью в
+// БД: AES-256-GCM с ключом из настроек (SECRETS_KEY).
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize — длина ключа в байтах.
+const KeySize = 32
+
+// prefix отличает зашифрованное значение от записанного до шифрования.
+const prefix = "v1:"
+
+// Box шифрует и расшифровывает значения одним ключом.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// ParseKey разбирает ключ в base64, например из openssl rand -base64 32.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("key must be base64")
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal шифрует plain. context — где хранится значение, например
+// "credentials.password:42": значение, переставленное в другую строку
+// или колонку, не расшифруется. Пустое значение остаётся пустым.
+func (b *Box) Seal(plain, context string) string {
+	if plain == "" {
+		return ""
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := b.aead.Seal(nonce, nonce, []byte(plain), []byte(context))
+	return prefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// Open расшифровывает значение Seal с тем же context. Значение без
+// префикса не зашифровано и не читается.
+func (b *Box) Open(sealed, context string) (string, error) {
+	data, ok := strings.CutPrefix(sealed, prefix)
+	if !ok {
+		return "", errors.New("secret: value is not encrypted")
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", errors.New("secret: malformed value")
+	}
+	n := b.aead.NonceSize()
+	plain, err := b.aead.Open(nil, raw[:n], raw[n:], []byte(context))
+	if err != nil {
+		return "", errors.New("secret: cannot decrypt value, wrong key?")
+	}
+	return string(plain), nil
+}
+
+// IsSealed сообщает, зашифровано ли значение.
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
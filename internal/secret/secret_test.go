@@ -0,0 +1,62 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testBox(t *testing.T, fill byte) *Box {
+	t.Helper()
+	b, err := NewBox(bytes.Repeat([]byte{fill}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSealOpen(t *testing.T) {
+	b := testBox(t, 1)
+	sealed := b.Seal("Bearer token", "jobs.auth:7")
+	if !IsSealed(sealed) || strings.Contains(sealed, "token") {
+		t.Fatalf("sealed = %q", sealed)
+	}
+	if again := b.Seal("Bearer token", "jobs.auth:7"); again == sealed {
+		t.Fatal("same nonce used twice")
+	}
+	got, err := b.Open(sealed, "jobs.auth:7")
+	if err != nil || got != "Bearer token" {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+
+	if _, err := b.Open(sealed, "jobs.auth:8"); err == nil {
+		t.Error("value opened in another context")
+	}
+	if _, err := testBox(t, 2).Open(sealed, "jobs.auth:7"); err == nil {
+		t.Error("value opened with another key")
+	}
+	if _, err := b.Open("v1:!!!", "jobs.auth:7"); err == nil {
+		t.Error("malformed value opened")
+	}
+
+	if b.Seal("", "x") != "" {
+		t.Error("empty value sealed")
+	}
+	// открытый текст за зашифрованное не выдаётся
+	if got, err := b.Open("plain password", "x"); err == nil {
+		t.Errorf("Open(plain) = %q", got)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, KeySize))
+	if k, err := ParseKey(" " + key + "\n"); err != nil || len(k) != KeySize {
+		t.Fatalf("ParseKey = %v, %v", k, err)
+	}
+	for _, bad := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKey(bad); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", bad)
+		}
+	}
+}
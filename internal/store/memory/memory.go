@@ -0,0 +1,810 @@
+// Package memory — реализация store.Store в памяти процесса для тестов.
+// Ведёт себя так же, как postgres: это проверяют тесты storetest.
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"download_track/internal/store"
+)
+
+type linkCode struct {
+	userID    int
+	expiresAt time.Time
+	used      bool
+}
+
+// address — адрес вместе с полями подтверждения, которых нет в
+// store.Address.
+type address struct {
+	store.Address
+	code      string
+	expiresAt time.Time
+	attempts  int
+}
+
+type Store struct {
+	mu sync.Mutex
+
+	users      map[int]*store.User
+	addresses  map[int64]*address
+	identities map[int64]*store.TelegramIdentity
+	linkCodes  map[string]*linkCode
+	changes    map[int64]*store.EmailChange
+	keys       map[int]*store.EncryptionKey
+	dests      map[int]*store.Destination
+	creds      map[credKey]*store.Credential
+	jobs       map[int64]*store.Job
+	// срок, до которого задание из очереди числится за воркером
+	leases map[int64]time.Time
+
+	lastUserID    int
+	lastAddressID int64
+	lastChangeID  int64
+	lastJobID     int64
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New() *Store {
+	return &Store{
+		users:      make(map[int]*store.User),
+		addresses:  make(map[int64]*address),
+		identities: make(map[int64]*store.TelegramIdentity),
+		linkCodes:  make(map[string]*linkCode),
+		changes:    make(map[int64]*store.EmailChange),
+		keys:       make(map[int]*store.EncryptionKey),
+		dests:      make(map[int]*store.Destination),
+		creds:      make(map[credKey]*store.Credential),
+		jobs:       make(map[int64]*store.Job),
+		leases:     make(map[int64]time.Time),
+	}
+}
+
+// --- пользователи ---
+
+// user возвращает копию пользователя с username из привязки Telegram.
+func (s *Store) user(id int) *store.User {
+	u, ok := s.users[id]
+	if !ok {
+		return nil
+	}
+	cp := *u
+	if ti := s.identityByUser(id); ti != nil {
+		cp.TelegramID, cp.TelegramUsername = ti.TelegramID, ti.Username
+	}
+	return &cp
+}
+
+func (s *Store) identityByUser(userID int) *store.TelegramIdentity {
+	for _, ti := range s.identities {
+		if ti.UserID == userID {
+			return ti
+		}
+	}
+	return nil
+}
+
+func (s *Store) emailTaken(email string, exceptID int) bool {
+	for _, u := range s.users {
+		if u.Email == email && u.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) insertUser(email, apiKey string) (*store.User, error) {
+	if s.emailTaken(email, 0) {
+		return nil, store.ErrEmailTaken
+	}
+	s.lastUserID++
+	u := &store.User{ID: s.lastUserID, Email: email, APIKey: apiKey, CreatedAt: time.Now()}
+	s.users[u.ID] = u
+	return s.user(u.ID), nil
+}
+
+func (s *Store) CreateUser(ctx context.Context, email, apiKey string) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertUser(email, apiKey)
+}
+
+func (s *Store) UserByID(ctx context.Context, id int) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.user(id); u != nil {
+		return u, nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (s *Store) UserByAPIKey(ctx context.Context, apiKey string) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.APIKey == apiKey {
+			return s.user(u.ID), nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (s *Store) UserByEmail(ctx context.Context, email string) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return s.user(u.ID), nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (s *Store) SetLanguage(ctx context.Context, userID int, lang string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	u.Language = lang
+	return nil
+}
+
+func (s *Store) SetSubjectPrefix(ctx context.Context, userID int, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	u.SubjectPrefix = prefix
+	return nil
+}
+
+// --- адреса ---
+
+func (s *Store) addressByLabel(userID int, label string) *address {
+	for _, a := range s.addresses {
+		if a.UserID == userID && a.Label == label {
+			return a
+		}
+	}
+	return nil
+}
+
+func copyAddress(a *address) *store.Address {
+	cp := a.Address
+	return &cp
+}
+
+func (s *Store) CreateAddress(ctx context.Context, userID int, label, email, code string, expiresAt time.Time) (*store.Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return nil, store.ErrNotFound
+	}
+	a := s.addressByLabel(userID, label)
+	if a != nil && a.VerifiedAt != nil {
+		return nil, store.ErrLabelTaken
+	}
+	if a == nil {
+		s.lastAddressID++
+		a = &address{Address: store.Address{ID: s.lastAddressID, UserID: userID, Label: label}}
+		s.addresses[a.ID] = a
+	}
+	a.Email, a.CreatedAt = email, time.Now()
+	a.code, a.expiresAt, a.attempts = code, expiresAt, 0
+	return copyAddress(a), nil
+}
+
+func (s *Store) Addresses(ctx context.Context, userID int) ([]*store.Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*store.Address
+	for _, a := range s.addresses {
+		if a.UserID == userID {
+			out = append(out, copyAddress(a))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Label < out[j].Label })
+	return out, nil
+}
+
+func (s *Store) Address(ctx context.Context, userID int, label string) (*store.Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.addressByLabel(userID, label)
+	if a == nil {
+		return nil, store.ErrNotFound
+	}
+	return copyAddress(a), nil
+}
+
+func (s *Store) VerifyAddress(ctx context.Context, userID int, label, code string) (*store.Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.addressByLabel(userID, label)
+	if a == nil {
+		return nil, store.ErrNotFound
+	}
+	if a.VerifiedAt != nil {
+		return copyAddress(a), nil
+	}
+	if a.attempts >= store.MaxVerifyAttempts || time.Now().After(a.expiresAt) || code != a.code {
+		a.attempts++
+		return nil, store.ErrCodeInvalid
+	}
+	now := time.Now()
+	a.VerifiedAt, a.code = &now, ""
+	return copyAddress(a), nil
+}
+
+func (s *Store) SetDefaultAddress(ctx context.Context, userID int, label string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	if label != "" {
+		a := s.addressByLabel(userID, label)
+		if a == nil {
+			return store.ErrNotFound
+		}
+		if a.VerifiedAt == nil {
+			return store.ErrNotVerified
+		}
+	}
+	u.DefaultAddress = label
+	return nil
+}
+
+func (s *Store) SetAddressProfile(ctx context.Context, userID int, label, profile string) (*store.Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.addressByLabel(userID, label)
+	if a == nil {
+		return nil, store.ErrNotFound
+	}
+	a.Profile = profile
+	return copyAddress(a), nil
+}
+
+func (s *Store) DeleteAddress(ctx context.Context, userID int, label string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.addressByLabel(userID, label)
+	if a == nil {
+		return store.ErrNotFound
+	}
+	delete(s.addresses, a.ID)
+	if u := s.users[userID]; u.DefaultAddress == label {
+		u.DefaultAddress = ""
+	}
+	return nil
+}
+
+// --- привязки Telegram ---
+
+func (s *Store) IdentityByTelegramID(ctx context.Context, telegramID int64) (*store.TelegramIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ti, ok := s.identities[telegramID]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	cp := *ti
+	return &cp, nil
+}
+
+func (s *Store) addIdentity(telegramID int64, username string, userID int) {
+	s.identities[telegramID] = &store.TelegramIdentity{
+		TelegramID: telegramID,
+		Username:   username,
+		UserID:     userID,
+		CreatedAt:  time.Now(),
+	}
+}
+
+func (s *Store) RegisterTelegram(ctx context.Context, telegramID int64, username, email, apiKey string) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.identities[telegramID]; ok {
+		return nil, store.ErrTelegramLinked
+	}
+	u, err := s.insertUser(email, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	s.addIdentity(telegramID, username, u.ID)
+	return s.user(u.ID), nil
+}
+
+func (s *Store) CreateLinkCode(ctx context.Context, userID int, code string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.identityByUser(userID) != nil {
+		return store.ErrAccountLinked
+	}
+	s.linkCodes[strings.ToUpper(code)] = &linkCode{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *Store) LinkTelegram(ctx context.Context, telegramID int64, username, code string) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lc, ok := s.linkCodes[strings.ToUpper(code)]
+	if !ok || lc.used || !lc.expiresAt.After(time.Now()) {
+		return nil, store.ErrLinkCodeInvalid
+	}
+	if _, ok := s.identities[telegramID]; ok {
+		return nil, store.ErrTelegramLinked
+	}
+	if s.identityByUser(lc.userID) != nil {
+		return nil, store.ErrAccountLinked
+	}
+	s.addIdentity(telegramID, username, lc.userID)
+	lc.used = true
+	return s.user(lc.userID), nil
+}
+
+func (s *Store) UnlinkTelegram(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ti := s.identityByUser(userID)
+	if ti == nil {
+		return store.ErrNotFound
+	}
+	delete(s.identities, ti.TelegramID)
+	return nil
+}
+
+// --- заявки на смену email ---
+
+func (s *Store) CreateEmailChange(ctx context.Context, userID int, telegramID int64, oldEmail, newEmail string) (*store.EmailChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastChangeID++
+	ec := &store.EmailChange{
+		ID:         s.lastChangeID,
+		UserID:     userID,
+		TelegramID: telegramID,
+		OldEmail:   oldEmail,
+		NewEmail:   newEmail,
+		Status:     store.ChangePending,
+		CreatedAt:  time.Now(),
+	}
+	s.changes[ec.ID] = ec
+	cp := *ec
+	return &cp, nil
+}
+
+func (s *Store) PendingEmailChanges(ctx context.Context) ([]*store.EmailChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*store.EmailChange
+	for _, ec := range s.changes {
+		if ec.Status == store.ChangePending {
+			cp := *ec
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.After(out[j].CreatedAt)
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out, nil
+}
+
+func (s *Store) ApproveEmailChange(ctx context.Context, id int64) (*store.EmailChange, error) {
+	return s.processEmailChange(id, store.ChangeApproved)
+}
+
+func (s *Store) RejectEmailChange(ctx context.Context, id int64) (*store.EmailChange, error) {
+	return s.processEmailChange(id, store.ChangeRejected)
+}
+
+func (s *Store) processEmailChange(id int64, status string) (*store.EmailChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ec, ok := s.changes[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	if ec.Status != store.ChangePending {
+		cp := *ec
+		return &cp, store.ErrNotPending
+	}
+	if status == store.ChangeApproved {
+		if s.emailTaken(ec.NewEmail, ec.UserID) {
+			return nil, store.ErrEmailTaken
+		}
+		if u, ok := s.users[ec.UserID]; ok {
+			u.Email = ec.NewEmail
+		}
+	}
+	now := time.Now()
+	ec.Status = status
+	ec.ProcessedAt = &now
+	cp := *ec
+	return &cp, nil
+}
+
+// --- ключи шифрования ---
+
+func copyKey(k *store.EncryptionKey) *store.EncryptionKey {
+	cp := *k
+	cp.Data = append([]byte(nil), k.Data...)
+	return &cp
+}
+
+func (s *Store) SetEncryptionKey(ctx context.Context, k store.EncryptionKey) (*store.EncryptionKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[k.UserID]; !ok {
+		return nil, store.ErrNotFound
+	}
+	if old, ok := s.keys[k.UserID]; ok {
+		k.Required = old.Required
+	}
+	k.UpdatedAt = time.Now()
+	s.keys[k.UserID] = copyKey(&k)
+	return copyKey(&k), nil
+}
+
+func (s *Store) EncryptionKey(ctx context.Context, userID int) (*store.EncryptionKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[userID]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return copyKey(k), nil
+}
+
+func (s *Store) SetEncryptionRequired(ctx context.Context, userID int, required bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[userID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	k.Required = required
+	k.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *Store) DeleteEncryptionKey(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[userID]; !ok {
+		return store.ErrNotFound
+	}
+	delete(s.keys, userID)
+	return nil
+}
+
+// --- места доставки ---
+
+func (s *Store) SetDestination(ctx context.Context, d store.Destination) (*store.Destination, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[d.UserID]; !ok {
+		return nil, store.ErrNotFound
+	}
+	d.UpdatedAt = time.Now()
+	cp := d
+	s.dests[d.UserID] = &cp
+	return &d, nil
+}
+
+func (s *Store) Destination(ctx context.Context, userID int) (*store.Destination, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.dests[userID]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	cp := *d
+	return &cp, nil
+}
+
+func (s *Store) DeleteDestination(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dests[userID]; !ok {
+		return store.ErrNotFound
+	}
+	delete(s.dests, userID)
+	return nil
+}
+
+// --- учётные данные ---
+
+type credKey struct {
+	userID       int
+	scheme, host string
+}
+
+func (s *Store) SetCredential(ctx context.Context, c store.Credential) (*store.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[c.UserID]; !ok {
+		return nil, store.ErrNotFound
+	}
+	c.UpdatedAt = time.Now()
+	cp := c
+	s.creds[credKey{c.UserID, c.Scheme, c.Host}] = &cp
+	return &c, nil
+}
+
+func (s *Store) Credential(ctx context.Context, userID int, scheme, host string) (*store.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.creds[credKey{userID, scheme, host}]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	cp := *c
+	return &cp, nil
+}
+
+func (s *Store) Credentials(ctx context.Context, userID int) ([]*store.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*store.Credential
+	for k, c := range s.creds {
+		if k.userID == userID {
+			cp := *c
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Scheme != out[j].Scheme {
+			return out[i].Scheme < out[j].Scheme
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out, nil
+}
+
+func (s *Store) DeleteCredential(ctx context.Context, userID int, scheme, host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := credKey{userID, scheme, host}
+	if _, ok := s.creds[k]; !ok {
+		return store.ErrNotFound
+	}
+	delete(s.creds, k)
+	return nil
+}
+
+// --- задания ---
+
+// copyJob копирует задание без Auth: как и в postgres, учётные данные
+// отдают только CreateJob и ClaimJob.
+func copyJob(j *store.Job) *store.Job {
+	cp := *j
+	cp.Auth = nil
+	return &cp
+}
+
+// finishJob завершает задание и стирает его учётные данные.
+func finishJob(j *store.Job, now time.Time) {
+	j.FinishedAt = &now
+	j.Auth = nil
+}
+
+func isActive(status string) bool {
+	return status == store.StatusQueued || status == store.StatusDownloading || status == store.StatusSending
+}
+
+func (s *Store) CreateJob(ctx context.Context, nj store.NewJob) (*store.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.lastJobID++
+	j := &store.Job{
+		ID:            s.lastJobID,
+		UserID:        nj.UserID,
+		CorrelationID: nj.CorrelationID,
+		URL:           nj.URL,
+		Recipient:     nj.Recipient,
+		Filename:      nj.Filename,
+		Subject:       nj.Subject,
+		Profile:       nj.Profile,
+		PageMode:      nj.PageMode,
+		Destination:   nj.Destination,
+		Status:        nj.Status,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		Auth:          nj.Auth,
+	}
+	if nj.Status != store.StatusQueued {
+		j.StartedAt = &now
+	}
+	s.jobs[j.ID] = j
+	cp := copyJob(j)
+	cp.Auth = j.Auth
+	return cp, nil
+}
+
+func (s *Store) Job(ctx context.Context, userID int, id int64) (*store.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.UserID != userID {
+		return nil, store.ErrNotFound
+	}
+	return copyJob(j), nil
+}
+
+func (s *Store) ListJobs(ctx context.Context, f store.JobFilter) ([]*store.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []*store.Job{}
+	for _, j := range s.jobs {
+		if j.UserID != f.UserID ||
+			(f.Status != "" && j.Status != f.Status) ||
+			(f.BeforeID > 0 && j.ID >= f.BeforeID) {
+			continue
+		}
+		jobs = append(jobs, copyJob(j))
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID > jobs[b].ID })
+	if f.Limit > 0 && len(jobs) > f.Limit {
+		jobs = jobs[:f.Limit]
+	}
+	return jobs, nil
+}
+
+func (s *Store) CancelJob(ctx context.Context, userID int, id int64) (*store.Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.UserID != userID {
+		return nil, false, store.ErrNotFound
+	}
+	if !isActive(j.Status) {
+		return copyJob(j), false, nil
+	}
+	now := time.Now()
+	j.Status = store.StatusCanceled
+	j.UpdatedAt = now
+	finishJob(j, now)
+	return copyJob(j), true, nil
+}
+
+func (s *Store) SetJobStatus(ctx context.Context, id int64, status, errText string, size int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.Status == store.StatusCanceled {
+		return false, nil
+	}
+	now := time.Now()
+	j.Status, j.Error, j.Size, j.UpdatedAt = status, errText, size, now
+	if status == store.StatusSent || status == store.StatusFailed {
+		finishJob(j, now)
+	}
+	return true, nil
+}
+
+func (s *Store) SetJobDeliveredTo(ctx context.Context, id int64, location string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		j.DeliveredTo, j.UpdatedAt = location, time.Now()
+	}
+	return nil
+}
+
+func (s *Store) RequeueJob(ctx context.Context, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || (j.Status != store.StatusDownloading && j.Status != store.StatusSending) {
+		return false, nil
+	}
+	j.Status, j.Error, j.Size, j.StartedAt, j.UpdatedAt = store.StatusQueued, "", 0, nil, time.Now()
+	delete(s.leases, id)
+	return true, nil
+}
+
+// claimable — задание в очереди или брошенное упавшим воркером.
+func (s *Store) claimable(j *store.Job, now time.Time) bool {
+	if j.Status == store.StatusQueued {
+		return true
+	}
+	until, ok := s.leases[j.ID]
+	return ok && (j.Status == store.StatusDownloading || j.Status == store.StatusSending) && until.Before(now)
+}
+
+func (s *Store) ClaimJob(ctx context.Context, lease time.Duration) (*store.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var oldest *store.Job
+	for _, j := range s.jobs {
+		if s.claimable(j, now) && (oldest == nil || j.ID < oldest.ID) {
+			oldest = j
+		}
+	}
+	if oldest == nil {
+		return nil, store.ErrNotFound
+	}
+	oldest.Status, oldest.Error, oldest.Size = store.StatusDownloading, "", 0
+	oldest.StartedAt, oldest.UpdatedAt = &now, now
+	s.leases[oldest.ID] = now.Add(lease)
+	cp := copyJob(oldest)
+	cp.Auth = oldest.Auth
+	return cp, nil
+}
+
+func (s *Store) RenewJobLease(ctx context.Context, id int64, lease time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if _, leased := s.leases[id]; !ok || !leased || (j.Status != store.StatusDownloading && j.Status != store.StatusSending) {
+		return false, nil
+	}
+	s.leases[id] = time.Now().Add(lease)
+	return true, nil
+}
+
+func (s *Store) CountActiveJobs(ctx context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[string]int{store.StatusQueued: 0, store.StatusDownloading: 0, store.StatusSending: 0}
+	for _, j := range s.jobs {
+		if isActive(j.Status) {
+			counts[j.Status]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *Store) ReportDelivery(ctx context.Context, userID int, id int64, location, errText string) (*store.Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.UserID != userID {
+		return nil, false, store.ErrNotFound
+	}
+	if j.Destination != store.DestTelegram || j.Status != store.StatusSending || j.DeliveredTo != "" {
+		return copyJob(j), false, nil
+	}
+	now := time.Now()
+	j.Status = store.StatusSent
+	if location == "" {
+		j.Status = store.StatusFailed
+	}
+	j.DeliveredTo, j.Error, j.UpdatedAt = location, errText, now
+	finishJob(j, now)
+	return copyJob(j), true, nil
+}
+
+func (s *Store) FailUnreportedJobs(ctx context.Context, before time.Time, errText string) ([]*store.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var failed []*store.Job
+	now := time.Now()
+	for _, j := range s.jobs {
+		if j.Destination != store.DestTelegram || j.Status != store.StatusSending ||
+			j.DeliveredTo != "" || !j.UpdatedAt.Before(before) {
+			continue
+		}
+		j.Status, j.Error, j.UpdatedAt = store.StatusFailed, errText, now
+		finishJob(j, now)
+		failed = append(failed, copyJob(j))
+	}
+	return failed, nil
+}
@@ -0,0 +1,13 @@
+package memory_test
+
+import (
+	"testing"
+
+	"download_track/internal/store"
+	"download_track/internal/store/memory"
+	"download_track/internal/store/storetest"
+)
+
+func TestContract(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store { return memory.New() })
+}
@@ -0,0 +1,1150 @@
+// Package postgres — реализация store.Store поверх PostgreSQL.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"download_track/internal/secret"
+	"download_track/internal/store"
+
+	"github.com/lib/pq"
+)
+
+type Store struct {
+	db *sql.DB
+	// шифр учётных данных; nil — сохранять секреты нельзя
+	secrets *secret.Box
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New(db *sql.DB, secrets *secret.Box) *Store {
+	return &Store{db: db, secrets: secrets}
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// violatedConstraint — имя ограничения из ошибки PostgreSQL.
+func violatedConstraint(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Constraint
+	}
+	return ""
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return store.ErrNotFound
+	}
+	return err
+}
+
+// seal шифрует секрет перед записью. where — таблица, колонка и строка:
+// зашифрованное значение не расшифруется в другом месте.
+func (s *Store) seal(value, where string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if s.secrets == nil {
+		return "", store.ErrNoSecretKey
+	}
+	return s.secrets.Seal(value, where), nil
+}
+
+// errNotSealed — секрет записан открытым текстом до появления ключа и
+// ещё не зашифрован SealSecrets.
+var errNotSealed = errors.New("postgres: secret is stored unencrypted, start with db.secrets_key to encrypt it")
+
+// open расшифровывает секрет. Открытый текст не читается: его шифрует
+// SealSecrets при старте сервиса с ключом.
+func (s *Store) open(value, where string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if s.secrets == nil {
+		return "", store.ErrNoSecretKey
+	}
+	if !secret.IsSealed(value) {
+		return "", errNotSealed
+	}
+	return s.secrets.Open(value, where)
+}
+
+// sealJSON шифрует v в JSON; пустое значение остаётся пустой строкой.
+func (s *Store) sealJSON(v any, empty bool, where string) (string, error) {
+	if empty {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return s.seal(string(data), where)
+}
+
+func (s *Store) openJSON(value, where string, v any) error {
+	plain, err := s.open(value, where)
+	if err != nil || plain == "" {
+		return err
+	}
+	return json.Unmarshal([]byte(plain), v)
+}
+
+// SealSecrets шифрует секреты, записанные открытым текстом до появления
+// db.secrets_key: пароли, ключи, заголовки и cookie учётных данных и
+// секреты мест доставки. Проверяются только строки без отметки sealed:
+// значение, которое не расшифровывается текущим ключом, считается
+// открытым текстом, даже если начинается с v1:. Возвращает число
+// зашифрованных значений. Вызывается при старте; одновременный вызов из
+// другого сервиса ждёт блокировки строк и пропускает отмеченное.
+func (s *Store) SealSecrets(ctx context.Context) (int, error) {
+	if s.secrets == nil {
+		return 0, store.ErrNoSecretKey
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	sealed := 0
+	sealRow := func(values []*string, where func(i int) string) {
+		for i, v := range values {
+			if *v == "" {
+				continue
+			}
+			if _, err := s.secrets.Open(*v, where(i)); err == nil {
+				continue
+			}
+			*v = s.secrets.Seal(*v, where(i))
+			sealed++
+		}
+	}
+
+	type credential struct {
+		userID                                 int
+		scheme, host                           string
+		password, privateKey, headers, cookies string
+	}
+	var creds []credential
+	rows, err := tx.QueryContext(ctx,
+		`SELECT user_id, scheme, host, password, private_key, headers, cookies FROM credentials
+         WHERE NOT sealed FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var c credential
+		if err := rows.Scan(&c.userID, &c.scheme, &c.host, &c.password, &c.privateKey, &c.headers, &c.cookies); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		creds = append(creds, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	columns := []string{"password", "private_key", "headers", "cookies"}
+	for _, c := range creds {
+		sealRow([]*string{&c.password, &c.privateKey, &c.headers, &c.cookies}, func(i int) string {
+			return credentialWhere(columns[i], c.userID, c.scheme, c.host)
+		})
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE credentials SET password = $4, private_key = $5, headers = $6, cookies = $7, sealed = TRUE
+             WHERE user_id = $1 AND scheme = $2 AND host = $3`,
+			c.userID, c.scheme, c.host, c.password, c.privateKey, c.headers, c.cookies); err != nil {
+			return 0, err
+		}
+	}
+
+	type destination struct {
+		userID int
+		secret string
+	}
+	var dests []destination
+	rows, err = tx.QueryContext(ctx, `SELECT user_id, secret FROM destinations WHERE NOT sealed FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var d destination
+		if err := rows.Scan(&d.userID, &d.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		dests = append(dests, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, d := range dests {
+		sealRow([]*string{&d.secret}, func(int) string { return destinationWhere(d.userID) })
+		if _, err := tx.ExecContext(ctx, `UPDATE destinations SET secret = $2, sealed = TRUE WHERE user_id = $1`, d.userID, d.secret); err != nil {
+			return 0, err
+		}
+	}
+	return sealed, tx.Commit()
+}
+
+// --- пользователи ---
+
+const userSelect = `SELECT u.id, u.email, u.api_key, u.language, u.subject_prefix, u.default_address, u.created_at,
+                t.telegram_id, t.username
+         FROM users u
+         LEFT JOIN telegram_users t ON t.user_id = u.id`
+
+func scanUser(row interface{ Scan(...any) error }) (*store.User, error) {
+	var (
+		u          store.User
+		telegramID sql.NullInt64
+		username   sql.NullString
+	)
+	if err := row.Scan(&u.ID, &u.Email, &u.APIKey, &u.Language, &u.SubjectPrefix, &u.DefaultAddress, &u.CreatedAt,
+		&telegramID, &username); err != nil {
+		return nil, notFound(err)
+	}
+	u.TelegramID, u.TelegramUsername = telegramID.Int64, username.String
+	return &u, nil
+}
+
+func (s *Store) CreateUser(ctx context.Context, email, apiKey string) (*store.User, error) {
+	u := store.User{Email: email, APIKey: apiKey}
+	err := s.db.QueryRowContext(ctx,
+		"INSERT INTO users (email, api_key) VALUES ($1,$2) RETURNING id, created_at",
+		email, apiKey,
+	).Scan(&u.ID, &u.CreatedAt)
+	if isUniqueViolation(err) {
+		return nil, store.ErrEmailTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *Store) UserByID(ctx context.Context, id int) (*store.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, userSelect+` WHERE u.id = $1 LIMIT 1`, id))
+}
+
+func (s *Store) UserByAPIKey(ctx context.Context, apiKey string) (*store.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, userSelect+` WHERE u.api_key = $1 LIMIT 1`, apiKey))
+}
+
+func (s *Store) UserByEmail(ctx context.Context, email string) (*store.User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, userSelect+` WHERE u.email = $1 LIMIT 1`, email))
+}
+
+func (s *Store) SetLanguage(ctx context.Context, userID int, lang string) error {
+	return s.updateUser(ctx, "UPDATE users SET language = $2 WHERE id = $1", userID, lang)
+}
+
+func (s *Store) SetSubjectPrefix(ctx context.Context, userID int, prefix string) error {
+	return s.updateUser(ctx, "UPDATE users SET subject_prefix = $2 WHERE id = $1", userID, prefix)
+}
+
+// updateUser выполняет UPDATE одного пользователя; ErrNotFound, если его нет.
+func (s *Store) updateUser(ctx context.Context, query string, userID int, value any) error {
+	res, err := s.db.ExecContext(ctx, query, userID, value)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// --- адреса ---
+
+const addressColumns = `id, user_id, label, email, profile, verified_at, created_at`
+
+func scanAddress(row interface{ Scan(...any) error }) (*store.Address, error) {
+	var (
+		a          store.Address
+		verifiedAt sql.NullTime
+	)
+	if err := row.Scan(&a.ID, &a.UserID, &a.Label, &a.Email, &a.Profile, &verifiedAt, &a.CreatedAt); err != nil {
+		return nil, notFound(err)
+	}
+	if verifiedAt.Valid {
+		a.VerifiedAt = &verifiedAt.Time
+	}
+	return &a, nil
+}
+
+func (s *Store) CreateAddress(ctx context.Context, userID int, label, email, code string, expiresAt time.Time) (*store.Address, error) {
+	// подтверждённый адрес WHERE не даёт заменить, и строка не возвращается
+	a, err := scanAddress(s.db.QueryRowContext(ctx,
+		`INSERT INTO addresses (user_id, label, email, verify_code, code_expires_at)
+         VALUES ($1, $2, $3, $4, $5)
+         ON CONFLICT (user_id, label) DO UPDATE
+         SET email = EXCLUDED.email, verify_code = EXCLUDED.verify_code,
+             code_expires_at = EXCLUDED.code_expires_at, verify_attempts = 0, created_at = now()
+         WHERE addresses.verified_at IS NULL
+         RETURNING `+addressColumns,
+		userID, label, email, code, expiresAt,
+	))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, store.ErrLabelTaken
+	}
+	if isForeignKeyViolation(err) {
+		return nil, store.ErrNotFound
+	}
+	return a, err
+}
+
+func (s *Store) Addresses(ctx context.Context, userID int) ([]*store.Address, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+addressColumns+` FROM addresses WHERE user_id = $1 ORDER BY label`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*store.Address
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) Address(ctx context.Context, userID int, label string) (*store.Address, error) {
+	return scanAddress(s.db.QueryRowContext(ctx,
+		`SELECT `+addressColumns+` FROM addresses WHERE user_id = $1 AND label = $2`, userID, label))
+}
+
+func (s *Store) VerifyAddress(ctx context.Context, userID int, label, code string) (*store.Address, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		id        int64
+		want      sql.NullString
+		expiresAt sql.NullTime
+		attempts  int
+		verified  bool
+	)
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, verify_code, code_expires_at, verify_attempts, verified_at IS NOT NULL
+         FROM addresses WHERE user_id = $1 AND label = $2 FOR UPDATE`,
+		userID, label,
+	).Scan(&id, &want, &expiresAt, &attempts, &verified)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	if !verified {
+		if attempts >= store.MaxVerifyAttempts || !expiresAt.Valid || time.Now().After(expiresAt.Time) || code != want.String {
+			// неверная попытка сохраняется, поэтому транзакция фиксируется
+			if _, err := tx.ExecContext(ctx, `UPDATE addresses SET verify_attempts = verify_attempts + 1 WHERE id = $1`, id); err != nil {
+				return nil, err
+			}
+			if err := tx.Commit(); err != nil {
+				return nil, err
+			}
+			return nil, store.ErrCodeInvalid
+		}
+		_, err = tx.ExecContext(ctx,
+			`UPDATE addresses SET verified_at = now(), verify_code = NULL, code_expires_at = NULL WHERE id = $1`, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a, err := scanAddress(tx.QueryRowContext(ctx, `SELECT `+addressColumns+` FROM addresses WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return a, tx.Commit()
+}
+
+func (s *Store) SetDefaultAddress(ctx context.Context, userID int, label string) error {
+	if label != "" {
+		a, err := s.Address(ctx, userID, label)
+		if err != nil {
+			return err
+		}
+		if a.VerifiedAt == nil {
+			return store.ErrNotVerified
+		}
+	}
+	return s.updateUser(ctx, "UPDATE users SET default_address = $2 WHERE id = $1", userID, label)
+}
+
+func (s *Store) SetAddressProfile(ctx context.Context, userID int, label, profile string) (*store.Address, error) {
+	return scanAddress(s.db.QueryRowContext(ctx,
+		`UPDATE addresses SET profile = $3 WHERE user_id = $1 AND label = $2 RETURNING `+addressColumns,
+		userID, label, profile))
+}
+
+func (s *Store) DeleteAddress(ctx context.Context, userID int, label string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM addresses WHERE user_id = $1 AND label = $2", userID, label)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE users SET default_address = '' WHERE id = $1 AND default_address = $2", userID, label)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// --- привязки Telegram ---
+
+func (s *Store) IdentityByTelegramID(ctx context.Context, telegramID int64) (*store.TelegramIdentity, error) {
+	var (
+		ti       store.TelegramIdentity
+		username sql.NullString
+	)
+	err := s.db.QueryRowContext(ctx,
+		"SELECT telegram_id, username, user_id, created_at FROM telegram_users WHERE telegram_id=$1",
+		telegramID,
+	).Scan(&ti.TelegramID, &username, &ti.UserID, &ti.CreatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	ti.Username = username.String
+	return &ti, nil
+}
+
+func (s *Store) RegisterTelegram(ctx context.Context, telegramID int64, username, email, apiKey string) (*store.User, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM telegram_users WHERE telegram_id=$1)", telegramID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, store.ErrTelegramLinked
+	}
+
+	u := store.User{Email: email, APIKey: apiKey, TelegramUsername: username, TelegramID: telegramID}
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO users (email, api_key) VALUES ($1,$2) RETURNING id, created_at",
+		email, apiKey,
+	).Scan(&u.ID, &u.CreatedAt)
+	if isUniqueViolation(err) {
+		return nil, store.ErrEmailTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO telegram_users (telegram_id, username, user_id) VALUES ($1,$2,$3)",
+		telegramID, username, u.ID,
+	)
+	if isUniqueViolation(err) {
+		return nil, store.ErrTelegramLinked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, tx.Commit()
+}
+
+func (s *Store) CreateLinkCode(ctx context.Context, userID int, code string, expiresAt time.Time) error {
+	var linked bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM telegram_users WHERE user_id=$1)", userID,
+	).Scan(&linked)
+	if err != nil {
+		return err
+	}
+	if linked {
+		return store.ErrAccountLinked
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO telegram_link_codes (code, user_id, expires_at) VALUES ($1,$2,$3)",
+		strings.ToUpper(code), userID, expiresAt,
+	)
+	return err
+}
+
+func (s *Store) LinkTelegram(ctx context.Context, telegramID int64, username, code string) (*store.User, error) {
+	code = strings.ToUpper(code)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx,
+		`SELECT user_id
+         FROM telegram_link_codes
+         WHERE code = $1 AND used_at IS NULL AND expires_at > now()
+         FOR UPDATE`,
+		code,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, store.ErrLinkCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var telegramLinked, accountLinked bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM telegram_users WHERE telegram_id=$1),
+                EXISTS(SELECT 1 FROM telegram_users WHERE user_id=$2)`,
+		telegramID, userID,
+	).Scan(&telegramLinked, &accountLinked)
+	if err != nil {
+		return nil, err
+	}
+	if telegramLinked {
+		return nil, store.ErrTelegramLinked
+	}
+	if accountLinked {
+		return nil, store.ErrAccountLinked
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO telegram_users (telegram_id, username, user_id) VALUES ($1,$2,$3)",
+		telegramID, username, userID,
+	)
+	// проверку выше одновременно прошла другая привязка
+	if isUniqueViolation(err) {
+		if violatedConstraint(err) == "telegram_users_user_id_key" {
+			return nil, store.ErrAccountLinked
+		}
+		return nil, store.ErrTelegramLinked
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE telegram_link_codes SET used_at = now() WHERE code = $1", code)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := scanUser(tx.QueryRowContext(ctx, userSelect+` WHERE u.id = $1 LIMIT 1`, userID))
+	if err != nil {
+		return nil, err
+	}
+	return u, tx.Commit()
+}
+
+func (s *Store) UnlinkTelegram(ctx context.Context, userID int) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM telegram_users WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// --- заявки на смену email ---
+
+const emailChangeColumns = `id, user_id, telegram_id, old_email, new_email, status, created_at, processed_at`
+
+func scanEmailChange(row interface{ Scan(...any) error }) (*store.EmailChange, error) {
+	var (
+		ec          store.EmailChange
+		processedAt sql.NullTime
+	)
+	err := row.Scan(&ec.ID, &ec.UserID, &ec.TelegramID, &ec.OldEmail, &ec.NewEmail, &ec.Status, &ec.CreatedAt, &processedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if processedAt.Valid {
+		ec.ProcessedAt = &processedAt.Time
+	}
+	return &ec, nil
+}
+
+func (s *Store) CreateEmailChange(ctx context.Context, userID int, telegramID int64, oldEmail, newEmail string) (*store.EmailChange, error) {
+	return scanEmailChange(s.db.QueryRowContext(ctx,
+		`INSERT INTO email_change_requests (user_id, telegram_id, old_email, new_email, status)
+         VALUES ($1, $2, $3, $4, 'pending')
+         RETURNING `+emailChangeColumns,
+		userID, telegramID, oldEmail, newEmail,
+	))
+}
+
+func (s *Store) PendingEmailChanges(ctx context.Context) ([]*store.EmailChange, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+emailChangeColumns+`
+         FROM email_change_requests
+         WHERE status = 'pending'
+         ORDER BY created_at DESC, id DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*store.EmailChange
+	for rows.Next() {
+		ec, err := scanEmailChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ec)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) ApproveEmailChange(ctx context.Context, id int64) (*store.EmailChange, error) {
+	return s.processEmailChange(ctx, id, store.ChangeApproved)
+}
+
+func (s *Store) RejectEmailChange(ctx context.Context, id int64) (*store.EmailChange, error) {
+	return s.processEmailChange(ctx, id, store.ChangeRejected)
+}
+
+// processEmailChange закрывает заявку; при подтверждении в той же
+// транзакции меняет email пользователя.
+func (s *Store) processEmailChange(ctx context.Context, id int64, status string) (*store.EmailChange, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ec, err := scanEmailChange(tx.QueryRowContext(ctx,
+		`SELECT `+emailChangeColumns+` FROM email_change_requests WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	if ec.Status != store.ChangePending {
+		return ec, store.ErrNotPending
+	}
+
+	if status == store.ChangeApproved {
+		_, err = tx.ExecContext(ctx, `UPDATE users SET email = $1 WHERE id = $2`, ec.NewEmail, ec.UserID)
+		if isUniqueViolation(err) {
+			return nil, store.ErrEmailTaken
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ec, err = scanEmailChange(tx.QueryRowContext(ctx,
+		`UPDATE email_change_requests
+         SET status = $2, processed_at = now()
+         WHERE id = $1
+         RETURNING `+emailChangeColumns,
+		id, status,
+	))
+	if err != nil {
+		return nil, err
+	}
+	return ec, tx.Commit()
+}
+
+// --- ключи шифрования ---
+
+const encryptionKeyColumns = `user_id, kind, data, fingerprint, required, updated_at`
+
+func scanEncryptionKey(row interface{ Scan(...any) error }) (*store.EncryptionKey, error) {
+	var k store.EncryptionKey
+	if err := row.Scan(&k.UserID, &k.Kind, &k.Data, &k.Fingerprint, &k.Required, &k.UpdatedAt); err != nil {
+		return nil, notFound(err)
+	}
+	return &k, nil
+}
+
+func (s *Store) SetEncryptionKey(ctx context.Context, k store.EncryptionKey) (*store.EncryptionKey, error) {
+	key, err := scanEncryptionKey(s.db.QueryRowContext(ctx,
+		`INSERT INTO encryption_keys (user_id, kind, data, fingerprint, required)
+         VALUES ($1, $2, $3, $4, $5)
+         ON CONFLICT (user_id) DO UPDATE
+         SET kind = EXCLUDED.kind, data = EXCLUDED.data, fingerprint = EXCLUDED.fingerprint, updated_at = now()
+         RETURNING `+encryptionKeyColumns,
+		k.UserID, k.Kind, k.Data, k.Fingerprint, k.Required,
+	))
+	if isForeignKeyViolation(err) {
+		return nil, store.ErrNotFound
+	}
+	return key, err
+}
+
+func (s *Store) EncryptionKey(ctx context.Context, userID int) (*store.EncryptionKey, error) {
+	return scanEncryptionKey(s.db.QueryRowContext(ctx,
+		`SELECT `+encryptionKeyColumns+` FROM encryption_keys WHERE user_id = $1`, userID))
+}
+
+func (s *Store) SetEncryptionRequired(ctx context.Context, userID int, required bool) error {
+	return s.updateUser(ctx, "UPDATE encryption_keys SET required = $2, updated_at = now() WHERE user_id = $1", userID, required)
+}
+
+func (s *Store) DeleteEncryptionKey(ctx context.Context, userID int) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM encryption_keys WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// --- места доставки ---
+
+const destinationColumns = `user_id, kind, endpoint, bucket, region, path, username, secret, updated_at`
+
+func destinationWhere(userID int) string {
+	return fmt.Sprintf("destinations.secret:%d", userID)
+}
+
+func (s *Store) scanDestination(row interface{ Scan(...any) error }) (*store.Destination, error) {
+	var d store.Destination
+	err := row.Scan(&d.UserID, &d.Kind, &d.Endpoint, &d.Bucket, &d.Region, &d.Path, &d.Username, &d.Secret, &d.UpdatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if d.Secret, err = s.open(d.Secret, destinationWhere(d.UserID)); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *Store) SetDestination(ctx context.Context, d store.Destination) (*store.Destination, error) {
+	sealed, err := s.seal(d.Secret, destinationWhere(d.UserID))
+	if err != nil {
+		return nil, err
+	}
+	dest, err := s.scanDestination(s.db.QueryRowContext(ctx,
+		`INSERT INTO destinations (user_id, kind, endpoint, bucket, region, path, username, secret, sealed)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, TRUE)
+         ON CONFLICT (user_id) DO UPDATE
+         SET kind = EXCLUDED.kind, endpoint = EXCLUDED.endpoint, bucket = EXCLUDED.bucket, region = EXCLUDED.region,
+             path = EXCLUDED.path, username = EXCLUDED.username, secret = EXCLUDED.secret, sealed = TRUE, updated_at = now()
+         RETURNING `+destinationColumns,
+		d.UserID, d.Kind, d.Endpoint, d.Bucket, d.Region, d.Path, d.Username, sealed,
+	))
+	if isForeignKeyViolation(err) {
+		return nil, store.ErrNotFound
+	}
+	return dest, err
+}
+
+func (s *Store) Destination(ctx context.Context, userID int) (*store.Destination, error) {
+	return s.scanDestination(s.db.QueryRowContext(ctx,
+		`SELECT `+destinationColumns+` FROM destinations WHERE user_id = $1`, userID))
+}
+
+func (s *Store) DeleteDestination(ctx context.Context, userID int) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM destinations WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// --- учётные данные ---
+
+const credentialColumns = `user_id, scheme, host, username, password, private_key, host_key, headers, cookies, user_agent, updated_at`
+
+func credentialWhere(column string, userID int, scheme, host string) string {
+	return fmt.Sprintf("credentials.%s:%d:%s:%s", column, userID, scheme, host)
+}
+
+func (s *Store) scanCredential(row interface{ Scan(...any) error }) (*store.Credential, error) {
+	var (
+		c                store.Credential
+		headers, cookies string
+	)
+	err := row.Scan(&c.UserID, &c.Scheme, &c.Host, &c.Username, &c.Password, &c.PrivateKey, &c.HostKey, &headers, &cookies, &c.UserAgent, &c.UpdatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	where := func(column string) string { return credentialWhere(column, c.UserID, c.Scheme, c.Host) }
+	if c.Password, err = s.open(c.Password, where("password")); err != nil {
+		return nil, err
+	}
+	if c.PrivateKey, err = s.open(c.PrivateKey, where("private_key")); err != nil {
+		return nil, err
+	}
+	if err := s.openJSON(headers, where("headers"), &c.Headers); err != nil {
+		return nil, err
+	}
+	if err := s.openJSON(cookies, where("cookies"), &c.Cookies); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Store) SetCredential(ctx context.Context, c store.Credential) (*store.Credential, error) {
+	where := func(column string) string { return credentialWhere(column, c.UserID, c.Scheme, c.Host) }
+	password, err := s.seal(c.Password, where("password"))
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := s.seal(c.PrivateKey, where("private_key"))
+	if err != nil {
+		return nil, err
+	}
+	headers, err := s.sealJSON(c.Headers, len(c.Headers) == 0, where("headers"))
+	if err != nil {
+		return nil, err
+	}
+	cookies, err := s.sealJSON(c.Cookies, len(c.Cookies) == 0, where("cookies"))
+	if err != nil {
+		return nil, err
+	}
+	cred, err := s.scanCredential(s.db.QueryRowContext(ctx,
+		`INSERT INTO credentials (user_id, scheme, host, username, password, private_key, host_key, headers, cookies, user_agent, sealed)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, TRUE)
+         ON CONFLICT (user_id, scheme, host) DO UPDATE
+         SET username = EXCLUDED.username, password = EXCLUDED.password, private_key = EXCLUDED.private_key,
+             host_key = EXCLUDED.host_key, headers = EXCLUDED.headers, cookies = EXCLUDED.cookies,
+             user_agent = EXCLUDED.user_agent, sealed = TRUE, updated_at = now()
+         RETURNING `+credentialColumns,
+		c.UserID, c.Scheme, c.Host, c.Username, password, privateKey, c.HostKey, headers, cookies, c.UserAgent,
+	))
+	if isForeignKeyViolation(err) {
+		return nil, store.ErrNotFound
+	}
+	return cred, err
+}
+
+func (s *Store) Credential(ctx context.Context, userID int, scheme, host string) (*store.Credential, error) {
+	return s.scanCredential(s.db.QueryRowContext(ctx,
+		`SELECT `+credentialColumns+` FROM credentials WHERE user_id = $1 AND scheme = $2 AND host = $3`,
+		userID, scheme, host))
+}
+
+func (s *Store) Credentials(ctx context.Context, userID int) ([]*store.Credential, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+credentialColumns+` FROM credentials WHERE user_id = $1 ORDER BY scheme, host`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*store.Credential
+	for rows.Next() {
+		c, err := s.scanCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) DeleteCredential(ctx context.Context, userID int, scheme, host string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM credentials WHERE user_id = $1 AND scheme = $2 AND host = $3",
+		userID, scheme, host)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// --- задания ---
+
+const jobColumns = `id, user_id, correlation_id, file_url, recipient, filename, subject, profile, page_mode, destination, delivered_to, status, error,
+	size_bytes, created_at, updated_at, started_at, finished_at`
+
+// scanJob читает jobColumns; extra — колонки, выбранные после них.
+func scanJob(row interface{ Scan(...any) error }, extra ...any) (*store.Job, error) {
+	var (
+		j          store.Job
+		startedAt  sql.NullTime
+		finishedAt sql.NullTime
+	)
+	err := row.Scan(append([]any{&j.ID, &j.UserID, &j.CorrelationID, &j.URL, &j.Recipient, &j.Filename, &j.Subject, &j.Profile, &j.PageMode, &j.Destination, &j.DeliveredTo, &j.Status, &j.Error,
+		&j.Size, &j.CreatedAt, &j.UpdatedAt, &startedAt, &finishedAt}, extra...)...)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if startedAt.Valid {
+		j.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		j.FinishedAt = &finishedAt.Time
+	}
+	return &j, nil
+}
+
+func (s *Store) CreateJob(ctx context.Context, nj store.NewJob) (*store.Job, error) {
+	var startedAt *time.Time
+	if nj.Status != store.StatusQueued {
+		now := time.Now()
+		startedAt = &now
+	}
+	auth, err := s.sealJSON(nj.Auth, nj.Auth == nil, jobAuthWhere(nj.UserID))
+	if err != nil {
+		return nil, err
+	}
+	j, err := scanJob(s.db.QueryRowContext(ctx,
+		`INSERT INTO jobs (user_id, correlation_id, file_url, recipient, filename, subject, profile, page_mode, destination, status, started_at, auth)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+         RETURNING `+jobColumns,
+		nj.UserID, nj.CorrelationID, nj.URL, nj.Recipient, nj.Filename, nj.Subject, nj.Profile, nj.PageMode, nj.Destination, nj.Status, startedAt, auth,
+	))
+	if err != nil {
+		return nil, err
+	}
+	j.Auth = nj.Auth
+	return j, nil
+}
+
+// jobAuthWhere: id задания при шифровании ещё неизвестен, поэтому
+// учётные данные привязаны к пользователю.
+func jobAuthWhere(userID int) string {
+	return fmt.Sprintf("jobs.auth:%d", userID)
+}
+
+func (s *Store) Job(ctx context.Context, userID int, id int64) (*store.Job, error) {
+	return scanJob(s.db.QueryRowContext(ctx,
+		`SELECT `+jobColumns+` FROM jobs WHERE id = $1 AND user_id = $2`,
+		id, userID,
+	))
+}
+
+func (s *Store) ListJobs(ctx context.Context, f store.JobFilter) ([]*store.Job, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+jobColumns+`
+         FROM jobs
+         WHERE user_id = $1
+           AND ($2 = '' OR status = $2)
+           AND ($3 = 0 OR id < $3)
+         ORDER BY id DESC
+         LIMIT NULLIF($4, 0)`,
+		f.UserID, f.Status, f.BeforeID, f.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*store.Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *Store) CancelJob(ctx context.Context, userID int, id int64) (*store.Job, bool, error) {
+	j, err := scanJob(s.db.QueryRowContext(ctx,
+		`UPDATE jobs
+         SET status = 'canceled', auth = '', updated_at = now(), finished_at = now()
+         WHERE id = $1 AND user_id = $2
+           AND status IN ('queued', 'downloading', 'sending')
+         RETURNING `+jobColumns,
+		id, userID,
+	))
+	if errors.Is(err, store.ErrNotFound) {
+		// либо задания нет, либо оно уже завершено
+		j, err = s.Job(ctx, userID, id)
+		return j, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return j, true, nil
+}
+
+func (s *Store) SetJobStatus(ctx context.Context, id int64, status, errText string, size int64) (bool, error) {
+	final := status == store.StatusSent || status == store.StatusFailed
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE jobs
+         SET status = $2, error = $3, size_bytes = $4, updated_at = now(),
+             finished_at = CASE WHEN $5 THEN now() ELSE finished_at END,
+             auth = CASE WHEN $5 THEN '' ELSE auth END
+         WHERE id = $1 AND status <> 'canceled'`,
+		id, status, errText, size, final,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Store) SetJobDeliveredTo(ctx context.Context, id int64, location string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE jobs SET delivered_to = $2, updated_at = now() WHERE id = $1", id, location)
+	return err
+}
+
+func (s *Store) RequeueJob(ctx context.Context, id int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE jobs
+         SET status = 'queued', error = '', size_bytes = 0, started_at = NULL, lease_until = NULL, updated_at = now()
+         WHERE id = $1 AND status IN ('downloading', 'sending')`,
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimJob использует SKIP LOCKED, так что несколько экземпляров сервиса
+// могут разбирать одну очередь.
+func (s *Store) ClaimJob(ctx context.Context, lease time.Duration) (*store.Job, error) {
+	var auth string
+	j, err := scanJob(s.db.QueryRowContext(ctx,
+		`UPDATE jobs
+         SET status = 'downloading', error = '', size_bytes = 0, started_at = now(), updated_at = now(),
+             lease_until = now() + make_interval(secs => $1)
+         WHERE id = (
+             SELECT id FROM jobs
+             WHERE status = 'queued'
+                OR (status IN ('downloading', 'sending') AND lease_until < now())
+             ORDER BY id
+             FOR UPDATE SKIP LOCKED
+             LIMIT 1
+         )
+         RETURNING `+jobColumns+`, auth`,
+		lease.Seconds(),
+	), &auth)
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		j.Auth = &store.JobAuth{}
+		if err := s.openJSON(auth, jobAuthWhere(j.UserID), j.Auth); err != nil {
+			// задание уже забрано; без учётных данных его не выполнить,
+			// и оно не должно зависнуть в downloading
+			s.SetJobStatus(ctx, j.ID, store.StatusFailed, "cannot read job credentials", 0)
+			return nil, fmt.Errorf("job %d auth: %w", j.ID, err)
+		}
+	}
+	return j, nil
+}
+
+func (s *Store) RenewJobLease(ctx context.Context, id int64, lease time.Duration) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE jobs SET lease_until = now() + make_interval(secs => $2)
+         WHERE id = $1 AND status IN ('downloading', 'sending') AND lease_until IS NOT NULL`,
+		id, lease.Seconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Store) ReportDelivery(ctx context.Context, userID int, id int64, location, errText string) (*store.Job, bool, error) {
+	// проверка и переход в одном UPDATE: два отчёта или отчёт вместе с
+	// FailUnreportedJobs не завершат задание дважды
+	j, err := scanJob(s.db.QueryRowContext(ctx,
+		`UPDATE jobs
+         SET status = CASE WHEN $3 = '' THEN 'failed' ELSE 'sent' END,
+             delivered_to = $3, error = $4, auth = '', updated_at = now(), finished_at = now()
+         WHERE id = $1 AND user_id = $2
+           AND destination = 'telegram' AND status = 'sending' AND delivered_to = ''
+         RETURNING `+jobColumns,
+		id, userID, location, errText,
+	))
+	if errors.Is(err, store.ErrNotFound) {
+		j, err = s.Job(ctx, userID, id)
+		return j, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return j, true, nil
+}
+
+func (s *Store) FailUnreportedJobs(ctx context.Context, before time.Time, errText string) ([]*store.Job, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`UPDATE jobs
+         SET status = 'failed', error = $2, auth = '', updated_at = now(), finished_at = now()
+         WHERE destination = 'telegram' AND status = 'sending' AND delivered_to = ''
+           AND updated_at < $1
+         RETURNING `+jobColumns,
+		before, errText,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*store.Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *Store) CountActiveJobs(ctx context.Context) (map[string]int, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT status, count(*)
+         FROM jobs
+         WHERE status IN ('queued', 'downloading', 'sending')
+         GROUP BY status`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{store.StatusQueued: 0, store.StatusDownloading: 0, store.StatusSending: 0}
+	for rows.Next() {
+		var (
+			status string
+			n      int
+		)
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
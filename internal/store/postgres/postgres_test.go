@@ -0,0 +1,207 @@
+package postgres_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"download_track/internal/migrations"
+	"download_track/internal/secret"
+	"download_track/internal/store"
+	"download_track/internal/store/postgres"
+	"download_track/internal/store/storetest"
+
+	_ "github.com/lib/pq"
+)
+
+// Тесты очищают таблицы, поэтому нужна отдельная база:
+// TEST_DB_DSN=postgres://... go test ./internal/store/postgres
+func TestContract(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal("migrate:", err)
+	}
+
+	secrets, err := secret.NewBox(bytes.Repeat([]byte{1}, secret.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newStore := func(t *testing.T) *postgres.Store {
+		_, err := db.Exec(`TRUNCATE users, telegram_users, telegram_link_codes, email_change_requests, encryption_keys, addresses, jobs
+			RESTART IDENTITY CASCADE`)
+		if err != nil {
+			t.Fatal("truncate:", err)
+		}
+		return postgres.New(db, secrets)
+	}
+	storetest.Run(t, func(t *testing.T) store.Store { return newStore(t) })
+
+	t.Run("SecretsAtRest", func(t *testing.T) {
+		testSecretsAtRest(t, db, newStore(t))
+	})
+	t.Run("SealSecrets", func(t *testing.T) {
+		testSealSecrets(t, db, newStore(t))
+	})
+}
+
+// testSecretsAtRest проверяет, что секреты не лежат в БД открытым текстом
+// и что учётные данные задания стираются по его завершении.
+func testSecretsAtRest(t *testing.T, db *sql.DB, s *postgres.Store) {
+	ctx := context.Background()
+	u, err := s.CreateUser(ctx, "a@example.com", "key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetCredential(ctx, store.Credential{UserID: u.ID, Scheme: "https", Host: "example.com",
+		Username: "alice", Password: "pa55word", Headers: map[string]string{"Authorization": "Bearer t0ken"},
+		Cookies: map[string]string{"sid": "c00kie"}}); err != nil {
+		t.Fatal(err)
+	}
+	var row string
+	if err := db.QueryRow(`SELECT password || headers || cookies FROM credentials`).Scan(&row); err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"pa55word", "t0ken", "c00kie"} {
+		if strings.Contains(row, plain) {
+			t.Errorf("credentials row contains %q", plain)
+		}
+	}
+
+	if _, err := s.SetDestination(ctx, store.Destination{UserID: u.ID, Kind: store.DestS3, Endpoint: "https://s3.example.com",
+		Bucket: "b", Username: "AKIA", Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT secret FROM destinations`).Scan(&row); err != nil {
+		t.Fatal(err)
+	}
+	if row == "" || strings.Contains(row, "s3cret") {
+		t.Errorf("destinations.secret = %q", row)
+	}
+	if d, err := s.Destination(ctx, u.ID); err != nil || d.Secret != "s3cret" {
+		t.Errorf("Destination = %+v, %v", d, err)
+	}
+
+	j, err := s.CreateJob(ctx, store.NewJob{UserID: u.ID, URL: "https://example.com/f", Recipient: "to@example.com",
+		Status: store.StatusDownloading, Auth: &store.JobAuth{Password: "pa55word"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auth string
+	db.QueryRow(`SELECT auth FROM jobs WHERE id = $1`, j.ID).Scan(&auth)
+	if auth == "" || strings.Contains(auth, "pa55word") {
+		t.Errorf("jobs.auth = %q", auth)
+	}
+	s.SetJobStatus(ctx, j.ID, store.StatusSent, "", 1)
+	db.QueryRow(`SELECT auth FROM jobs WHERE id = $1`, j.ID).Scan(&auth)
+	if auth != "" {
+		t.Errorf("jobs.auth after finish = %q", auth)
+	}
+
+	// без ключа секрет не сохранить и не прочитать
+	noKey := postgres.New(db, nil)
+	_, err = noKey.SetCredential(ctx, store.Credential{UserID: u.ID, Scheme: "ftp", Host: "example.com", Username: "bob", Password: "x"})
+	if !errors.Is(err, store.ErrNoSecretKey) {
+		t.Errorf("SetCredential without key: %v", err)
+	}
+	if _, err := noKey.Credential(ctx, u.ID, "https", "example.com"); !errors.Is(err, store.ErrNoSecretKey) {
+		t.Errorf("Credential without key: %v", err)
+	}
+	_, err = noKey.SetDestination(ctx, store.Destination{UserID: u.ID, Kind: store.DestWebDAV, Endpoint: "https://dav.example.com",
+		Username: "bob", Secret: "x"})
+	if !errors.Is(err, store.ErrNoSecretKey) {
+		t.Errorf("SetDestination without key: %v", err)
+	}
+	if _, err := noKey.SetDestination(ctx, store.Destination{UserID: u.ID, Kind: store.DestTelegram}); err != nil {
+		t.Errorf("SetDestination without secret: %v", err)
+	}
+}
+
+// testSealSecrets проверяет шифрование секретов, записанных открытым
+// текстом до появления ключа.
+func testSealSecrets(t *testing.T, db *sql.DB, s *postgres.Store) {
+	ctx := context.Background()
+	u, err := s.CreateUser(ctx, "a@example.com", "key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO credentials (user_id, scheme, host, username, password, private_key, headers)
+		VALUES ($1, 'sftp', 'files.example.com', 'alice', 'pa55word', 'PRIVATE KEY', ''),
+		       ($1, 'https', 'example.com', 'alice', '', '', '{"X-Token":"t0ken"}'),
+		       ($1, 'ftp', 'files.example.com', 'alice', 'v1:pa55word', '', '')`, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO destinations (user_id, kind, username, secret) VALUES ($1, 's3', 'AKIA', 's3cret')`, u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// открытый текст не выдаётся за зашифрованное
+	if _, err := s.Credential(ctx, u.ID, "sftp", "files.example.com"); err == nil {
+		t.Error("plaintext credential was read")
+	}
+
+	// зашифрованное ключом раньше, но без отметки sealed, не шифруется повторно
+	if _, err := s.SetCredential(ctx, store.Credential{UserID: u.ID, Scheme: "ftp", Host: "old.example.com", Username: "alice", Password: "0ld"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE credentials SET sealed = FALSE`); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.SealSecrets(ctx)
+	if err != nil || n != 5 {
+		t.Fatalf("SealSecrets = %d, %v; want 5", n, err)
+	}
+	if n, err := s.SealSecrets(ctx); err != nil || n != 0 {
+		t.Fatalf("second SealSecrets = %d, %v", n, err)
+	}
+	var row string
+	db.QueryRow(`SELECT string_agg(password || private_key || headers, '') FROM credentials`).Scan(&row)
+	for _, plain := range []string{"pa55word", "PRIVATE KEY", "t0ken"} {
+		if strings.Contains(row, plain) {
+			t.Errorf("credentials contain %q after SealSecrets", plain)
+		}
+	}
+
+	c, err := s.Credential(ctx, u.ID, "sftp", "files.example.com")
+	if err != nil || c.Password != "pa55word" || c.PrivateKey != "PRIVATE KEY" {
+		t.Errorf("sftp credential = %+v, %v", c, err)
+	}
+	// пароль с префиксом v1: — тоже открытый текст
+	c, err = s.Credential(ctx, u.ID, "ftp", "files.example.com")
+	if err != nil || c.Password != "v1:pa55word" {
+		t.Errorf("ftp credential = %+v, %v", c, err)
+	}
+	c, err = s.Credential(ctx, u.ID, "ftp", "old.example.com")
+	if err != nil || c.Password != "0ld" {
+		t.Errorf("old credential = %+v, %v", c, err)
+	}
+	c, err = s.Credential(ctx, u.ID, "https", "example.com")
+	if err != nil || c.Headers["X-Token"] != "t0ken" {
+		t.Errorf("https credential = %+v, %v", c, err)
+	}
+	if d, err := s.Destination(ctx, u.ID); err != nil || d.Secret != "s3cret" {
+		t.Errorf("destination = %+v, %v", d, err)
+	}
+
+	if _, err := postgres.New(db, nil).SealSecrets(ctx); !errors.Is(err, store.ErrNoSecretKey) {
+		t.Errorf("SealSecrets without key: %v", err)
+	}
+}
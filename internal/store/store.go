@@ -0,0 +1,415 @@
+// Package store описывает хранилище пользователей, их адресов, привязок
+// Telegram, заявок на смену email, ключей шифрования писем и заданий. Реализации:
+// postgres для сервисов и memory для тестов; обе проверяются одним
+// набором тестов storetest.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrEmailTaken      = errors.New("email already registered")
+	ErrTelegramLinked  = errors.New("telegram already linked")
+	ErrAccountLinked   = errors.New("account already has telegram")
+	ErrLinkCodeInvalid = errors.New("link code not found or expired")
+	ErrNotPending      = errors.New("email change already processed")
+	ErrLabelTaken      = errors.New("address label already in use")
+	ErrCodeInvalid     = errors.New("verification code is wrong or expired")
+	ErrNotVerified     = errors.New("address is not verified")
+	ErrLabelInvalid    = fmt.Errorf("label must be 1-%d latin letters, digits, _ or -, and not %q", MaxLabelLen, MainLabel)
+
+	// ErrNoSecretKey — секрет нельзя сохранить или прочитать: не задан
+	// ключ шифрования db.secrets_key.
+	ErrNoSecretKey = errors.New("secrets key is not configured")
+)
+
+const (
+	// MainLabel — метка основного email аккаунта; занять её адресом нельзя.
+	MainLabel   = "main"
+	MaxLabelLen = 32
+	// после стольких неверных кодов адрес можно только добавить заново
+	MaxVerifyAttempts = 5
+)
+
+// статусы задания
+const (
+	StatusQueued      = "queued"
+	StatusDownloading = "downloading"
+	StatusSending     = "sending"
+	StatusSent        = "sent"
+	StatusFailed      = "failed"
+	StatusCanceled    = "canceled"
+)
+
+// статусы заявки на смену email
+const (
+	ChangePending  = "pending"
+	ChangeApproved = "approved"
+	ChangeRejected = "rejected"
+)
+
+// виды ключей шифрования
+const (
+	KeyPGP   = "pgp"
+	KeySMIME = "smime"
+)
+
+// профили доставки; пустой — обычное письмо
+const (
+	ProfileKindle = "kindle"
+)
+
+// режимы сохранения HTML-страниц; пустой — страница со всеми ресурсами
+// одним файлом
+const (
+	// только текст статьи
+	PageReadable = "readable"
+	// как отдал сервер
+	PageRaw = "raw"
+)
+
+// места доставки файлов вместо почты
+const (
+	// S3-совместимое хранилище
+	DestS3 = "s3"
+	// каталог на WebDAV-сервере
+	DestWebDAV = "webdav"
+	// подкаталог локального каталога сервиса
+	DestLocal = "local"
+	// документ в чате с ботом; файл загружает бот
+	DestTelegram = "telegram"
+)
+
+// User — аккаунт. TelegramUsername пустой, если Telegram не привязан или
+// у пользователя нет username.
+type User struct {
+	ID               int
+	Email            string
+	APIKey           string
+	TelegramUsername string
+	// 0 — Telegram не привязан; у привязанного username может не быть
+	TelegramID int64
+	// код языка из i18n; пустой — не выбран
+	Language string
+	// добавляется в начало темы писем, чтобы их было удобно фильтровать
+	SubjectPrefix string
+	// метка адреса, на который уходят файлы; пустая — Email
+	DefaultAddress string
+	CreatedAt      time.Time
+}
+
+// Address — дополнительный адрес пользователя с меткой. Письма на него
+// уходят только после подтверждения кодом из письма.
+type Address struct {
+	ID     int64
+	UserID int
+	Label  string
+	Email  string
+	// профиль доставки, например ProfileKindle
+	Profile string
+	// nil — адрес ещё не подтверждён
+	VerifiedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// CleanLabel приводит метку адреса к нижнему регистру и проверяет её.
+func CleanLabel(label string) (string, error) {
+	label = strings.ToLower(strings.TrimSpace(label))
+	if label == "" || len(label) > MaxLabelLen || label == MainLabel {
+		return "", ErrLabelInvalid
+	}
+	for _, r := range label {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' {
+			return "", ErrLabelInvalid
+		}
+	}
+	return label, nil
+}
+
+// TelegramIdentity — привязка Telegram к аккаунту.
+type TelegramIdentity struct {
+	TelegramID int64
+	Username   string
+	UserID     int
+	CreatedAt  time.Time
+}
+
+// EmailChange — заявка на смену email, которую подтверждает админ.
+type EmailChange struct {
+	ID          int64
+	UserID      int
+	TelegramID  int64
+	OldEmail    string
+	NewEmail    string
+	Status      string
+	CreatedAt   time.Time
+	ProcessedAt *time.Time
+}
+
+// EncryptionKey — открытый ключ, которым шифруются письма пользователя:
+// PGP-ключ или сертификат S/MIME.
+type EncryptionKey struct {
+	UserID int
+	// KeyPGP или KeySMIME
+	Kind string
+	// ключ в двоичном виде: пакеты OpenPGP или сертификат DER
+	Data        []byte
+	Fingerprint string
+	// не отправлять письма, которые нельзя зашифровать
+	Required  bool
+	UpdatedAt time.Time
+}
+
+// Destination — куда доставляются файлы пользователя вместо почты.
+type Destination struct {
+	UserID int
+	// DestS3, DestWebDAV, DestLocal или DestTelegram
+	Kind string
+	// адрес S3 API или каталога WebDAV
+	Endpoint string
+	Bucket   string
+	Region   string
+	// префикс ключа в S3 или подкаталог
+	Path string
+	// ключ доступа S3 или пользователь WebDAV
+	Username string
+	// секретный ключ S3 или пароль WebDAV
+	Secret    string
+	UpdatedAt time.Time
+}
+
+// Credential — учётные данные пользователя для скачивания с сервера FTP,
+// SFTP или сайта. Пароль, ключ, заголовки и cookie хранятся зашифрованными.
+type Credential struct {
+	UserID int
+	// ftp, sftp, http или https
+	Scheme string
+	// имя хоста в нижнем регистре, без порта
+	Host     string
+	Username string
+	Password string
+	// закрытый ключ SSH в PEM; только для SFTP
+	PrivateKey string
+	// открытый ключ сервера SSH в формате authorized_keys
+	HostKey string
+	// заголовки запроса и cookie; только для HTTP(S)
+	Headers   map[string]string
+	Cookies   map[string]string
+	UserAgent string
+	UpdatedAt time.Time
+}
+
+// JobAuth — учётные данные для скачивания файла одного задания. Хранятся
+// зашифрованными и стираются, когда задание завершается.
+type JobAuth struct {
+	Username  string            `json:"username,omitempty"`
+	Password  string            `json:"password,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Cookies   map[string]string `json:"cookies,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+}
+
+type Job struct {
+	ID     int64
+	UserID int
+	// идентификатор запроса, по которому задание видно в логах бота
+	CorrelationID string
+	URL           string
+	Recipient     string
+	Filename      string
+	Subject       string
+	// профиль доставки получателя на момент создания
+	Profile string
+	// режим сохранения HTML-страницы, например PageReadable
+	PageMode string
+	// место доставки на момент создания, например DestS3; пустое — письмо
+	Destination string
+	// где оказался файл: mailto:, URL или путь; пустое — ещё не доставлен
+	DeliveredTo string
+	Status      string
+	Error       string
+	Size        int64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	StartedAt   *time.Time
+	FinishedAt  *time.Time
+
+	// учётные данные для скачивания; заполнены только в заданиях из
+	// CreateJob и ClaimJob
+	Auth *JobAuth
+}
+
+// NewJob — параметры нового задания. Status — queued для очереди или
+// downloading, если задание сразу выполняется вызывающим.
+type NewJob struct {
+	UserID        int
+	CorrelationID string
+	URL           string
+	Recipient     string
+	Filename      string
+	Subject       string
+	Profile       string
+	PageMode      string
+	Destination   string
+	Auth          *JobAuth
+	Status        string
+}
+
+// JobFilter — выборка заданий пользователя от новых к старым;
+// Limit 0 — без ограничения.
+type JobFilter struct {
+	UserID int
+	// пустой — любой статус
+	Status string
+	// > 0 — только задания с id меньше (курсор)
+	BeforeID int64
+	Limit    int
+}
+
+type UserStore interface {
+	// CreateUser создаёт аккаунт без Telegram; ErrEmailTaken, если email занят.
+	CreateUser(ctx context.Context, email, apiKey string) (*User, error)
+	UserByID(ctx context.Context, id int) (*User, error)
+	UserByAPIKey(ctx context.Context, apiKey string) (*User, error)
+	UserByEmail(ctx context.Context, email string) (*User, error)
+	// SetLanguage сохраняет язык пользователя; ErrNotFound, если его нет.
+	SetLanguage(ctx context.Context, userID int, lang string) error
+	// SetSubjectPrefix сохраняет префикс темы писем; пустой — без префикса.
+	SetSubjectPrefix(ctx context.Context, userID int, prefix string) error
+}
+
+type AddressStore interface {
+	// CreateAddress добавляет неподтверждённый адрес с кодом подтверждения.
+	// Неподтверждённый адрес с той же меткой заменяется, подтверждённый —
+	// ErrLabelTaken.
+	CreateAddress(ctx context.Context, userID int, label, email, code string, expiresAt time.Time) (*Address, error)
+	// Addresses — адреса пользователя по алфавиту меток.
+	Addresses(ctx context.Context, userID int) ([]*Address, error)
+	// Address возвращает адрес по метке; ErrNotFound, если его нет.
+	Address(ctx context.Context, userID int, label string) (*Address, error)
+	// VerifyAddress подтверждает адрес кодом. ErrCodeInvalid — код неверный,
+	// истёк или попытки кончились; уже подтверждённый адрес возвращается
+	// как есть.
+	VerifyAddress(ctx context.Context, userID int, label, code string) (*Address, error)
+	// SetDefaultAddress выбирает адрес по умолчанию; пустая метка —
+	// основной email. ErrNotFound или ErrNotVerified для такого адреса.
+	SetDefaultAddress(ctx context.Context, userID int, label string) error
+	// SetAddressProfile меняет профиль доставки адреса; ErrNotFound, если
+	// адреса нет.
+	SetAddressProfile(ctx context.Context, userID int, label, profile string) (*Address, error)
+	// DeleteAddress удаляет адрес; если он был адресом по умолчанию,
+	// письма снова уходят на основной email.
+	DeleteAddress(ctx context.Context, userID int, label string) error
+}
+
+type TelegramIdentityStore interface {
+	// IdentityByTelegramID возвращает ErrNotFound, если Telegram не привязан.
+	IdentityByTelegramID(ctx context.Context, telegramID int64) (*TelegramIdentity, error)
+	// RegisterTelegram создаёт аккаунт сразу с привязкой Telegram.
+	// ErrTelegramLinked — этот Telegram уже привязан, ErrEmailTaken — email занят.
+	RegisterTelegram(ctx context.Context, telegramID int64, username, email, apiKey string) (*User, error)
+	// CreateLinkCode сохраняет одноразовый код привязки; ErrAccountLinked,
+	// если у аккаунта уже есть Telegram.
+	CreateLinkCode(ctx context.Context, userID int, code string, expiresAt time.Time) error
+	// LinkTelegram привязывает Telegram к аккаунту по коду и гасит код.
+	LinkTelegram(ctx context.Context, telegramID int64, username, code string) (*User, error)
+	// UnlinkTelegram отвязывает Telegram; ErrNotFound, если привязки нет.
+	UnlinkTelegram(ctx context.Context, userID int) error
+}
+
+type EmailChangeStore interface {
+	CreateEmailChange(ctx context.Context, userID int, telegramID int64, oldEmail, newEmail string) (*EmailChange, error)
+	// PendingEmailChanges — необработанные заявки, новые первыми.
+	PendingEmailChanges(ctx context.Context) ([]*EmailChange, error)
+	// ApproveEmailChange меняет email пользователя и закрывает заявку.
+	// Для уже обработанной заявки возвращает её вместе с ErrNotPending.
+	ApproveEmailChange(ctx context.Context, id int64) (*EmailChange, error)
+	RejectEmailChange(ctx context.Context, id int64) (*EmailChange, error)
+}
+
+type EncryptionKeyStore interface {
+	// SetEncryptionKey сохраняет или заменяет ключ пользователя; флаг
+	// Required при замене сохраняется.
+	SetEncryptionKey(ctx context.Context, k EncryptionKey) (*EncryptionKey, error)
+	// EncryptionKey возвращает ErrNotFound, если ключа нет.
+	EncryptionKey(ctx context.Context, userID int) (*EncryptionKey, error)
+	// SetEncryptionRequired — ErrNotFound, если ключа нет.
+	SetEncryptionRequired(ctx context.Context, userID int, required bool) error
+	// DeleteEncryptionKey удаляет ключ; ErrNotFound, если ключа нет.
+	DeleteEncryptionKey(ctx context.Context, userID int) error
+}
+
+type DestinationStore interface {
+	// SetDestination сохраняет или заменяет место доставки пользователя;
+	// ErrNoSecretKey, если есть секрет, а ключа шифрования нет.
+	SetDestination(ctx context.Context, d Destination) (*Destination, error)
+	// Destination возвращает ErrNotFound, если файлы уходят письмом.
+	Destination(ctx context.Context, userID int) (*Destination, error)
+	// DeleteDestination возвращает доставку письмом; ErrNotFound, если
+	// места доставки не было.
+	DeleteDestination(ctx context.Context, userID int) error
+}
+
+type CredentialStore interface {
+	// SetCredential сохраняет или заменяет учётные данные для схемы и хоста.
+	SetCredential(ctx context.Context, c Credential) (*Credential, error)
+	// Credential возвращает ErrNotFound, если данных для хоста нет.
+	Credential(ctx context.Context, userID int, scheme, host string) (*Credential, error)
+	// Credentials — все учётные данные пользователя по схеме и хосту.
+	Credentials(ctx context.Context, userID int) ([]*Credential, error)
+	// DeleteCredential — ErrNotFound, если данных для хоста нет.
+	DeleteCredential(ctx context.Context, userID int, scheme, host string) error
+}
+
+type JobStore interface {
+	CreateJob(ctx context.Context, nj NewJob) (*Job, error)
+	// Job возвращает задание пользователя; ErrNotFound для чужих.
+	Job(ctx context.Context, userID int, id int64) (*Job, error)
+	ListJobs(ctx context.Context, f JobFilter) ([]*Job, error)
+	// CancelJob отменяет незавершённое задание. Для завершённого
+	// возвращает его как есть и false.
+	CancelJob(ctx context.Context, userID int, id int64) (*Job, bool, error)
+	// SetJobStatus меняет статус, не трогая отменённые задания; false —
+	// задание уже отменено. Завершённое задание теряет Auth.
+	SetJobStatus(ctx context.Context, id int64, status, errText string, size int64) (bool, error)
+	// SetJobDeliveredTo запоминает, куда доставлен файл задания.
+	SetJobDeliveredTo(ctx context.Context, id int64, location string) error
+	// ReportDelivery завершает задание, отданное боту для загрузки в
+	// Telegram: sent с местом location или failed с ошибкой errText.
+	// Задание, которое уже не ждёт отчёта, возвращается как есть с false.
+	ReportDelivery(ctx context.Context, userID int, id int64, location, errText string) (*Job, bool, error)
+	// RequeueJob возвращает выполняющееся задание в очередь.
+	RequeueJob(ctx context.Context, id int64) (bool, error)
+	// ClaimJob забирает самое старое задание из очереди и переводит его в
+	// downloading на срок lease; ErrNotFound, если очередь пуста. Задание,
+	// срок которого истёк без продления, забирается снова: его воркер
+	// упал вместе с экземпляром сервиса.
+	ClaimJob(ctx context.Context, lease time.Duration) (*Job, error)
+	// RenewJobLease продлевает срок выполняющегося задания на lease от
+	// текущего момента; false — задание уже не выполняется.
+	RenewJobLease(ctx context.Context, id int64, lease time.Duration) (bool, error)
+	// CountActiveJobs — число заданий в статусах queued, downloading и sending.
+	CountActiveJobs(ctx context.Context) (map[string]int, error)
+	// FailUnreportedJobs завершает ошибкой errText задания, отданные боту
+	// для загрузки в Telegram раньше before, о которых он не сообщил.
+	// Возвращает завершённые задания.
+	FailUnreportedJobs(ctx context.Context, before time.Time, errText string) ([]*Job, error)
+}
+
+// Store — всё хранилище целиком.
+type Store interface {
+	UserStore
+	AddressStore
+	TelegramIdentityStore
+	EmailChangeStore
+	EncryptionKeyStore
+	DestinationStore
+	CredentialStore
+	JobStore
+}
@@ -0,0 +1,1018 @@
+// Package storetest — общие контрактные тесты для реализаций store.Store.
+// Реализация подключает их из своего _test.go:
+//
+//	func TestContract(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Store { return memory.New() })
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"download_track/internal/store"
+)
+
+// Run прогоняет контрактные тесты. newStore должен возвращать пустое
+// хранилище для каждого теста.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store)
+	}{
+		{"CreateUser", testCreateUser},
+		{"UserLookups", testUserLookups},
+		{"SetLanguage", testSetLanguage},
+		{"SetSubjectPrefix", testSetSubjectPrefix},
+		{"EncryptionKey", testEncryptionKey},
+		{"Destination", testDestination},
+		{"Credentials", testCredentials},
+		{"Addresses", testAddresses},
+		{"VerifyAddress", testVerifyAddress},
+		{"RegisterTelegram", testRegisterTelegram},
+		{"LinkTelegram", testLinkTelegram},
+		{"UnlinkTelegram", testUnlinkTelegram},
+		{"EmailChanges", testEmailChanges},
+		{"JobLifecycle", testJobLifecycle},
+		{"ListJobs", testListJobs},
+		{"CancelJob", testCancelJob},
+		{"ClaimJob", testClaimJob},
+		{"JobLease", testJobLease},
+		{"JobAuth", testJobAuth},
+		{"FailUnreportedJobs", testFailUnreportedJobs},
+		{"ReportDelivery", testReportDelivery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func ctx() context.Context { return context.Background() }
+
+func mustUser(t *testing.T, s store.Store, email string) *store.User {
+	t.Helper()
+	key, err := store.NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.CreateUser(ctx(), email, key)
+	if err != nil {
+		t.Fatalf("CreateUser(%q): %v", email, err)
+	}
+	return u
+}
+
+func mustJob(t *testing.T, s store.Store, userID int, status string) *store.Job {
+	t.Helper()
+	j, err := s.CreateJob(ctx(), store.NewJob{
+		UserID:        userID,
+		CorrelationID: "corr-1",
+		URL:           "https://example.com/file.pdf",
+		Recipient:     "to@example.com",
+		Status:        status,
+	})
+	if err != nil {
+		t.Fatalf("CreateJob: %v", err)
+	}
+	return j
+}
+
+func wantErr(t *testing.T, what string, got, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Fatalf("%s: got error %v, want %v", what, got, want)
+	}
+}
+
+func testCreateUser(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	if u.ID == 0 || u.Email != "a@example.com" || u.APIKey == "" || u.CreatedAt.IsZero() {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	if u.TelegramUsername != "" {
+		t.Fatalf("new user has telegram username %q", u.TelegramUsername)
+	}
+
+	_, err := s.CreateUser(ctx(), "a@example.com", "other-key")
+	wantErr(t, "duplicate email", err, store.ErrEmailTaken)
+}
+
+func testUserLookups(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+
+	lookups := []struct {
+		name string
+		fn   func() (*store.User, error)
+	}{
+		{"UserByID", func() (*store.User, error) { return s.UserByID(ctx(), u.ID) }},
+		{"UserByAPIKey", func() (*store.User, error) { return s.UserByAPIKey(ctx(), u.APIKey) }},
+		{"UserByEmail", func() (*store.User, error) { return s.UserByEmail(ctx(), u.Email) }},
+	}
+	for _, l := range lookups {
+		got, err := l.fn()
+		if err != nil {
+			t.Fatalf("%s: %v", l.name, err)
+		}
+		if got.ID != u.ID || got.Email != u.Email || got.APIKey != u.APIKey {
+			t.Fatalf("%s: got %+v, want %+v", l.name, got, u)
+		}
+	}
+
+	missing := []struct {
+		name string
+		fn   func() (*store.User, error)
+	}{
+		{"UserByID", func() (*store.User, error) { return s.UserByID(ctx(), u.ID+1000) }},
+		{"UserByAPIKey", func() (*store.User, error) { return s.UserByAPIKey(ctx(), "nope") }},
+		{"UserByEmail", func() (*store.User, error) { return s.UserByEmail(ctx(), "nope@example.com") }},
+	}
+	for _, l := range missing {
+		_, err := l.fn()
+		wantErr(t, l.name+" missing", err, store.ErrNotFound)
+	}
+}
+
+func testSetLanguage(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	if u.Language != "" {
+		t.Fatalf("new user has language %q", u.Language)
+	}
+	if err := s.SetLanguage(ctx(), u.ID, "en"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.UserByAPIKey(ctx(), u.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Language != "en" {
+		t.Fatalf("language = %q, want en", got.Language)
+	}
+	err = s.SetLanguage(ctx(), u.ID+1000, "en")
+	wantErr(t, "missing user", err, store.ErrNotFound)
+}
+
+func testSetSubjectPrefix(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	for _, prefix := range []string{"[files]", ""} {
+		if err := s.SetSubjectPrefix(ctx(), u.ID, prefix); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.UserByID(ctx(), u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.SubjectPrefix != prefix {
+			t.Fatalf("subject prefix = %q, want %q", got.SubjectPrefix, prefix)
+		}
+	}
+	err := s.SetSubjectPrefix(ctx(), u.ID+1000, "[x]")
+	wantErr(t, "missing user", err, store.ErrNotFound)
+}
+
+func testAddresses(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	other := mustUser(t, s, "b@example.com")
+	expires := time.Now().Add(time.Hour)
+
+	work, err := s.CreateAddress(ctx(), u.ID, "work", "a@work.example", "111111", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.Label != "work" || work.Email != "a@work.example" || work.VerifiedAt != nil {
+		t.Fatalf("unexpected address %+v", work)
+	}
+	if _, err := s.CreateAddress(ctx(), u.ID, "kindle", "a@kindle.example", "222222", expires); err != nil {
+		t.Fatal(err)
+	}
+	// метки у каждого пользователя свои
+	if _, err := s.CreateAddress(ctx(), other.ID, "work", "b@work.example", "333333", expires); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateAddress(ctx(), u.ID+1000, "work", "x@example.com", "1", expires)
+	wantErr(t, "missing user", err, store.ErrNotFound)
+
+	list, err := s.Addresses(ctx(), u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Label != "kindle" || list[1].Label != "work" {
+		t.Fatalf("unexpected addresses %+v", list)
+	}
+
+	if a, err := s.SetAddressProfile(ctx(), u.ID, "kindle", store.ProfileKindle); err != nil || a.Profile != store.ProfileKindle {
+		t.Fatalf("SetAddressProfile = %+v, %v", a, err)
+	}
+	if a, _ := s.Address(ctx(), u.ID, "kindle"); a.Profile != store.ProfileKindle {
+		t.Fatalf("profile = %q", a.Profile)
+	}
+	_, err = s.SetAddressProfile(ctx(), u.ID, "home", store.ProfileKindle)
+	wantErr(t, "profile of missing address", err, store.ErrNotFound)
+
+	// неподтверждённый адрес заменяется, подтверждённый — нет
+	replaced, err := s.CreateAddress(ctx(), u.ID, "work", "a2@work.example", "444444", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ID != work.ID || replaced.Email != "a2@work.example" {
+		t.Fatalf("unexpected replaced address %+v", replaced)
+	}
+	wantErr(t, "default unverified", s.SetDefaultAddress(ctx(), u.ID, "work"), store.ErrNotVerified)
+	wantErr(t, "default missing", s.SetDefaultAddress(ctx(), u.ID, "home"), store.ErrNotFound)
+	if _, err := s.VerifyAddress(ctx(), u.ID, "work", "444444"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateAddress(ctx(), u.ID, "work", "evil@example.com", "555555", expires)
+	wantErr(t, "replace verified", err, store.ErrLabelTaken)
+
+	if err := s.SetDefaultAddress(ctx(), u.ID, "work"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := s.UserByID(ctx(), u.ID)
+	if got.DefaultAddress != "work" {
+		t.Fatalf("default address = %q", got.DefaultAddress)
+	}
+
+	// удаление адреса по умолчанию возвращает основной email
+	if err := s.DeleteAddress(ctx(), u.ID, "work"); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "delete again", s.DeleteAddress(ctx(), u.ID, "work"), store.ErrNotFound)
+	got, _ = s.UserByID(ctx(), u.ID)
+	if got.DefaultAddress != "" {
+		t.Fatalf("default address = %q after delete", got.DefaultAddress)
+	}
+	_, err = s.Address(ctx(), u.ID, "work")
+	wantErr(t, "deleted address", err, store.ErrNotFound)
+	if a, err := s.Address(ctx(), other.ID, "work"); err != nil || a.Email != "b@work.example" {
+		t.Fatalf("other user's address: %+v, %v", a, err)
+	}
+}
+
+func testVerifyAddress(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	if _, err := s.CreateAddress(ctx(), u.ID, "work", "a@work.example", "123456", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateAddress(ctx(), u.ID, "old", "a@old.example", "123456", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.VerifyAddress(ctx(), u.ID, "home", "123456")
+	wantErr(t, "missing label", err, store.ErrNotFound)
+	_, err = s.VerifyAddress(ctx(), u.ID, "old", "123456")
+	wantErr(t, "expired code", err, store.ErrCodeInvalid)
+	_, err = s.VerifyAddress(ctx(), u.ID, "work", "000000")
+	wantErr(t, "wrong code", err, store.ErrCodeInvalid)
+
+	a, err := s.VerifyAddress(ctx(), u.ID, "work", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.VerifiedAt == nil {
+		t.Fatal("address is not verified")
+	}
+	// повторное подтверждение ничего не меняет
+	if _, err := s.VerifyAddress(ctx(), u.ID, "work", "whatever"); err != nil {
+		t.Fatal(err)
+	}
+
+	// после MaxVerifyAttempts неверных кодов не подходит и верный
+	if _, err := s.CreateAddress(ctx(), u.ID, "home", "a@home.example", "654321", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for range store.MaxVerifyAttempts {
+		s.VerifyAddress(ctx(), u.ID, "home", "000000")
+	}
+	_, err = s.VerifyAddress(ctx(), u.ID, "home", "654321")
+	wantErr(t, "attempts exhausted", err, store.ErrCodeInvalid)
+}
+
+func testEncryptionKey(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	_, err := s.EncryptionKey(ctx(), u.ID)
+	wantErr(t, "no key", err, store.ErrNotFound)
+	wantErr(t, "require without key", s.SetEncryptionRequired(ctx(), u.ID, true), store.ErrNotFound)
+	wantErr(t, "delete without key", s.DeleteEncryptionKey(ctx(), u.ID), store.ErrNotFound)
+	_, err = s.SetEncryptionKey(ctx(), store.EncryptionKey{UserID: u.ID + 1000, Kind: store.KeyPGP, Data: []byte{1}, Fingerprint: "x"})
+	wantErr(t, "missing user", err, store.ErrNotFound)
+
+	k, err := s.SetEncryptionKey(ctx(), store.EncryptionKey{UserID: u.ID, Kind: store.KeyPGP, Data: []byte{1, 2, 3}, Fingerprint: "AAAA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Kind != store.KeyPGP || k.Fingerprint != "AAAA" || k.Required || k.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	if err := s.SetEncryptionRequired(ctx(), u.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// замена ключа не сбрасывает требование шифрования
+	if _, err := s.SetEncryptionKey(ctx(), store.EncryptionKey{UserID: u.ID, Kind: store.KeySMIME, Data: []byte{4, 5}, Fingerprint: "BBBB"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.EncryptionKey(ctx(), u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != store.KeySMIME || string(got.Data) != "\x04\x05" || got.Fingerprint != "BBBB" || !got.Required {
+		t.Fatalf("unexpected key after replace %+v", got)
+	}
+
+	if err := s.DeleteEncryptionKey(ctx(), u.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.EncryptionKey(ctx(), u.ID)
+	wantErr(t, "deleted key", err, store.ErrNotFound)
+}
+
+func testRegisterTelegram(t *testing.T, s store.Store) {
+	u, err := s.RegisterTelegram(ctx(), 100, "alice", "alice@example.com", "key-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.TelegramUsername != "alice" || u.TelegramID != 100 || u.Email != "alice@example.com" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	ti, err := s.IdentityByTelegramID(ctx(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.UserID != u.ID || ti.Username != "alice" {
+		t.Fatalf("unexpected identity %+v", ti)
+	}
+
+	got, err := s.UserByAPIKey(ctx(), "key-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TelegramUsername != "alice" || got.TelegramID != 100 {
+		t.Fatalf("lookup lost telegram identity: %+v", got)
+	}
+
+	_, err = s.RegisterTelegram(ctx(), 100, "alice", "other@example.com", "key-2")
+	wantErr(t, "same telegram", err, store.ErrTelegramLinked)
+
+	_, err = s.RegisterTelegram(ctx(), 200, "bob", "alice@example.com", "key-3")
+	wantErr(t, "same email", err, store.ErrEmailTaken)
+	// неудачная регистрация не оставляет привязки
+	_, err = s.IdentityByTelegramID(ctx(), 200)
+	wantErr(t, "identity after failed register", err, store.ErrNotFound)
+}
+
+func testLinkTelegram(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	future := time.Now().Add(time.Hour)
+
+	if err := s.CreateLinkCode(ctx(), u.ID, "EXPIRED1", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateLinkCode(ctx(), u.ID, "GOODCODE", future); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		tgID int64
+		code string
+		want error
+	}{
+		{"unknown code", 1, "NOPENOPE", store.ErrLinkCodeInvalid},
+		{"expired code", 1, "EXPIRED1", store.ErrLinkCodeInvalid},
+		// код сравнивается без учёта регистра
+		{"lower case", 1, "goodcode", nil},
+		{"reused code", 2, "GOODCODE", store.ErrLinkCodeInvalid},
+	}
+	for _, c := range cases {
+		linked, err := s.LinkTelegram(ctx(), c.tgID, "alice", c.code)
+		wantErr(t, c.name, err, c.want)
+		if c.want == nil && (linked.ID != u.ID || linked.TelegramUsername != "alice" || linked.TelegramID != c.tgID) {
+			t.Fatalf("%s: unexpected user %+v", c.name, linked)
+		}
+	}
+
+	err := s.CreateLinkCode(ctx(), u.ID, "SECOND01", future)
+	wantErr(t, "code for linked account", err, store.ErrAccountLinked)
+
+	// Telegram уже привязан к другому аккаунту
+	other := mustUser(t, s, "b@example.com")
+	if err := s.CreateLinkCode(ctx(), other.ID, "OTHER001", future); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.LinkTelegram(ctx(), 1, "alice", "OTHER001")
+	wantErr(t, "telegram linked elsewhere", err, store.ErrTelegramLinked)
+
+	// два кода одного аккаунта отправлены одновременно с разных Telegram:
+	// привязывается только один
+	third := mustUser(t, s, "c@example.com")
+	codes := []string{"RACE0001", "RACE0002"}
+	for _, code := range codes {
+		if err := s.CreateLinkCode(ctx(), third.ID, code, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs := make([]error, len(codes))
+	var wg sync.WaitGroup
+	for i, code := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = s.LinkTelegram(ctx(), int64(300+i), "carol", code)
+		}()
+	}
+	wg.Wait()
+	linked := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			linked++
+		case !errors.Is(err, store.ErrAccountLinked):
+			t.Fatalf("concurrent link: %v", err)
+		}
+	}
+	if linked != 1 {
+		t.Fatalf("concurrent links succeeded %d times, want 1", linked)
+	}
+}
+
+func testUnlinkTelegram(t *testing.T, s store.Store) {
+	u, err := s.RegisterTelegram(ctx(), 100, "alice", "alice@example.com", "key-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UnlinkTelegram(ctx(), u.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.IdentityByTelegramID(ctx(), 100)
+	wantErr(t, "identity after unlink", err, store.ErrNotFound)
+
+	got, err := s.UserByID(ctx(), u.ID)
+	if err != nil {
+		t.Fatal("account removed with unlink:", err)
+	}
+	if got.TelegramUsername != "" {
+		t.Fatalf("username kept after unlink: %+v", got)
+	}
+
+	err = s.UnlinkTelegram(ctx(), u.ID)
+	wantErr(t, "second unlink", err, store.ErrNotFound)
+}
+
+func testEmailChanges(t *testing.T, s store.Store) {
+	u, err := s.RegisterTelegram(ctx(), 100, "alice", "old@example.com", "key-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustUser(t, s, "taken@example.com")
+
+	approve, err := s.CreateEmailChange(ctx(), u.ID, 100, "old@example.com", "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reject, err := s.CreateEmailChange(ctx(), u.ID, 100, "old@example.com", "other@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflict, err := s.CreateEmailChange(ctx(), u.ID, 100, "old@example.com", "taken@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approve.Status != store.ChangePending || approve.ProcessedAt != nil {
+		t.Fatalf("unexpected new change %+v", approve)
+	}
+
+	pending, err := s.PendingEmailChanges(ctx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 || pending[0].ID != conflict.ID || pending[2].ID != approve.ID {
+		t.Fatalf("pending changes not newest first: %+v", pending)
+	}
+
+	got, err := s.ApproveEmailChange(ctx(), approve.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != store.ChangeApproved || got.ProcessedAt == nil || got.TelegramID != 100 {
+		t.Fatalf("unexpected approved change %+v", got)
+	}
+	if user, _ := s.UserByID(ctx(), u.ID); user.Email != "new@example.com" {
+		t.Fatalf("email not changed: %+v", user)
+	}
+
+	got, err = s.RejectEmailChange(ctx(), reject.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != store.ChangeRejected {
+		t.Fatalf("unexpected rejected change %+v", got)
+	}
+	if user, _ := s.UserByID(ctx(), u.ID); user.Email != "new@example.com" {
+		t.Fatalf("reject changed email: %+v", user)
+	}
+
+	got, err = s.ApproveEmailChange(ctx(), reject.ID)
+	wantErr(t, "approve processed", err, store.ErrNotPending)
+	if got == nil || got.Status != store.ChangeRejected {
+		t.Fatalf("processed change not returned: %+v", got)
+	}
+
+	_, err = s.ApproveEmailChange(ctx(), conflict.ID)
+	wantErr(t, "approve taken email", err, store.ErrEmailTaken)
+
+	_, err = s.RejectEmailChange(ctx(), conflict.ID+1000)
+	wantErr(t, "missing change", err, store.ErrNotFound)
+
+	pending, err = s.PendingEmailChanges(ctx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != conflict.ID {
+		t.Fatalf("unexpected pending changes %+v", pending)
+	}
+}
+
+func testDestination(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	_, err := s.Destination(ctx(), u.ID)
+	wantErr(t, "no destination", err, store.ErrNotFound)
+	wantErr(t, "delete without destination", s.DeleteDestination(ctx(), u.ID), store.ErrNotFound)
+	_, err = s.SetDestination(ctx(), store.Destination{UserID: u.ID + 1000, Kind: store.DestLocal})
+	wantErr(t, "missing user", err, store.ErrNotFound)
+
+	d, err := s.SetDestination(ctx(), store.Destination{UserID: u.ID, Kind: store.DestS3, Endpoint: "http://minio:9000",
+		Bucket: "files", Region: "eu", Path: "in/", Username: "key", Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Kind != store.DestS3 || d.Bucket != "files" || d.Secret != "secret" || d.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected destination %+v", d)
+	}
+
+	// замена переписывает все поля
+	if _, err := s.SetDestination(ctx(), store.Destination{UserID: u.ID, Kind: store.DestLocal, Path: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Destination(ctx(), u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != store.DestLocal || got.Path != "alice" || got.Endpoint != "" || got.Secret != "" {
+		t.Fatalf("unexpected destination after replace %+v", got)
+	}
+
+	if err := s.DeleteDestination(ctx(), u.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Destination(ctx(), u.ID)
+	wantErr(t, "deleted destination", err, store.ErrNotFound)
+}
+
+func testCredentials(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	other := mustUser(t, s, "b@example.com")
+	_, err := s.Credential(ctx(), u.ID, "sftp", "files.example.com")
+	wantErr(t, "no credential", err, store.ErrNotFound)
+	wantErr(t, "delete without credential", s.DeleteCredential(ctx(), u.ID, "sftp", "files.example.com"), store.ErrNotFound)
+	_, err = s.SetCredential(ctx(), store.Credential{UserID: u.ID + 1000, Scheme: "ftp", Host: "h", Username: "x"})
+	wantErr(t, "missing user", err, store.ErrNotFound)
+
+	c, err := s.SetCredential(ctx(), store.Credential{UserID: u.ID, Scheme: "sftp", Host: "files.example.com",
+		Username: "alice", Password: "pw", HostKey: "ssh-ed25519 AAAA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "alice" || c.Password != "pw" || c.UpdatedAt.IsZero() {
+		t.Fatalf("unexpected credential %+v", c)
+	}
+	// та же пара схема и хост заменяется, другая схема — отдельная запись
+	if _, err := s.SetCredential(ctx(), store.Credential{UserID: u.ID, Scheme: "sftp", Host: "files.example.com",
+		Username: "alice", PrivateKey: "-----BEGIN", HostKey: "ssh-ed25519 BBBB"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetCredential(ctx(), store.Credential{UserID: u.ID, Scheme: "ftp", Host: "files.example.com", Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetCredential(ctx(), store.Credential{UserID: other.ID, Scheme: "ftp", Host: "files.example.com", Username: "eve"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Credential(ctx(), u.ID, "sftp", "files.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Password != "" || got.PrivateKey != "-----BEGIN" || got.HostKey != "ssh-ed25519 BBBB" {
+		t.Fatalf("unexpected credential after replace %+v", got)
+	}
+	list, err := s.Credentials(ctx(), u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Scheme != "ftp" || list[0].Username != "bob" || list[1].Scheme != "sftp" {
+		t.Fatalf("unexpected credentials %+v", list)
+	}
+
+	if err := s.DeleteCredential(ctx(), u.ID, "ftp", "files.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.Credentials(ctx(), u.ID); len(list) != 1 {
+		t.Fatalf("%d credentials after delete, want 1", len(list))
+	}
+	if _, err := s.Credential(ctx(), other.ID, "ftp", "files.example.com"); err != nil {
+		t.Fatalf("other user's credential: %v", err)
+	}
+
+	// профиль сайта: заголовки и cookie
+	if _, err := s.SetCredential(ctx(), store.Credential{UserID: u.ID, Scheme: "https", Host: "intranet.example.com",
+		Headers: map[string]string{"Authorization": "Bearer t0ken"}, Cookies: map[string]string{"session": "abc"},
+		UserAgent: "Mozilla/5.0"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.Credential(ctx(), u.ID, "https", "intranet.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Headers["Authorization"] != "Bearer t0ken" || got.Cookies["session"] != "abc" || got.UserAgent != "Mozilla/5.0" || got.Username != "" {
+		t.Fatalf("unexpected http credential %+v", got)
+	}
+}
+
+func testJobLifecycle(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+
+	j := mustJob(t, s, u.ID, store.StatusDownloading)
+	if j.ID == 0 || j.CorrelationID != "corr-1" || j.StartedAt == nil || j.FinishedAt != nil {
+		t.Fatalf("unexpected new job %+v", j)
+	}
+	if q := mustJob(t, s, u.ID, store.StatusQueued); q.StartedAt != nil {
+		t.Fatalf("queued job has started_at: %+v", q)
+	}
+	k, err := s.CreateJob(ctx(), store.NewJob{UserID: u.ID, URL: "https://example.com/book.epub", Recipient: "a@kindle.example",
+		Profile: store.ProfileKindle, PageMode: store.PageReadable, Status: store.StatusQueued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Job(ctx(), u.ID, k.ID); got.Profile != store.ProfileKindle || got.PageMode != store.PageReadable {
+		t.Fatalf("job profile = %q, page mode = %q", got.Profile, got.PageMode)
+	}
+	d, err := s.CreateJob(ctx(), store.NewJob{UserID: u.ID, URL: "https://example.com/a.pdf", Destination: store.DestWebDAV, Status: store.StatusQueued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetJobDeliveredTo(ctx(), d.ID, "https://dav.example/a.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Job(ctx(), u.ID, d.ID); got.Destination != store.DestWebDAV || got.DeliveredTo != "https://dav.example/a.pdf" {
+		t.Fatalf("job destination = %q, delivered to %q", got.Destination, got.DeliveredTo)
+	}
+	// завершённые задания не попадают в счётчики ниже
+	for _, id := range []int64{k.ID, d.ID} {
+		if _, err := s.SetJobStatus(ctx(), id, store.StatusCanceled, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		status   string
+		size     int64
+		errText  string
+		finished bool
+	}{
+		{store.StatusSending, 42, "", false},
+		{store.StatusSent, 42, "", true},
+	}
+	for _, st := range steps {
+		ok, err := s.SetJobStatus(ctx(), j.ID, st.status, st.errText, st.size)
+		if err != nil || !ok {
+			t.Fatalf("SetJobStatus(%s) = %v, %v", st.status, ok, err)
+		}
+		got, err := s.Job(ctx(), u.ID, j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != st.status || got.Size != st.size || (got.FinishedAt != nil) != st.finished {
+			t.Fatalf("after %s: %+v", st.status, got)
+		}
+	}
+
+	other := mustUser(t, s, "b@example.com")
+	_, err = s.Job(ctx(), other.ID, j.ID)
+	wantErr(t, "foreign job", err, store.ErrNotFound)
+
+	counts, err := s.CountActiveJobs(ctx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{store.StatusQueued: 1, store.StatusDownloading: 0, store.StatusSending: 0}
+	for status, n := range want {
+		if counts[status] != n {
+			t.Fatalf("CountActiveJobs = %v, want %v", counts, want)
+		}
+	}
+}
+
+func testListJobs(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	other := mustUser(t, s, "b@example.com")
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, mustJob(t, s, u.ID, store.StatusQueued).ID)
+	}
+	mustJob(t, s, other.ID, store.StatusQueued)
+	if _, err := s.SetJobStatus(ctx(), ids[1], store.StatusFailed, "boom", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		filter store.JobFilter
+		want   []int64
+	}{
+		{"all", store.JobFilter{UserID: u.ID}, []int64{ids[4], ids[3], ids[2], ids[1], ids[0]}},
+		{"limit", store.JobFilter{UserID: u.ID, Limit: 2}, []int64{ids[4], ids[3]}},
+		{"cursor", store.JobFilter{UserID: u.ID, BeforeID: ids[3], Limit: 2}, []int64{ids[2], ids[1]}},
+		{"status", store.JobFilter{UserID: u.ID, Status: store.StatusFailed}, []int64{ids[1]}},
+		{"nothing", store.JobFilter{UserID: u.ID, Status: store.StatusSent}, []int64{}},
+	}
+	for _, c := range cases {
+		jobs, err := s.ListJobs(ctx(), c.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if jobs == nil {
+			t.Fatalf("%s: nil slice", c.name)
+		}
+		got := make([]int64, len(jobs))
+		for i, j := range jobs {
+			got[i] = j.ID
+		}
+		if len(got) != len(c.want) {
+			t.Fatalf("%s: got %v, want %v", c.name, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("%s: got %v, want %v", c.name, got, c.want)
+			}
+		}
+	}
+}
+
+func testCancelJob(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	j := mustJob(t, s, u.ID, store.StatusDownloading)
+
+	got, canceled, err := s.CancelJob(ctx(), u.ID, j.ID)
+	if err != nil || !canceled {
+		t.Fatalf("CancelJob = %v, %v", canceled, err)
+	}
+	if got.Status != store.StatusCanceled || got.FinishedAt == nil {
+		t.Fatalf("unexpected canceled job %+v", got)
+	}
+
+	// отменённое задание не перезаписывается и не возвращается в очередь
+	if ok, err := s.SetJobStatus(ctx(), j.ID, store.StatusSent, "", 1); err != nil || ok {
+		t.Fatalf("SetJobStatus on canceled = %v, %v", ok, err)
+	}
+	if ok, err := s.RequeueJob(ctx(), j.ID); err != nil || ok {
+		t.Fatalf("RequeueJob on canceled = %v, %v", ok, err)
+	}
+
+	got, canceled, err = s.CancelJob(ctx(), u.ID, j.ID)
+	if err != nil || canceled || got.Status != store.StatusCanceled {
+		t.Fatalf("second CancelJob = %+v, %v, %v", got, canceled, err)
+	}
+
+	_, _, err = s.CancelJob(ctx(), u.ID, j.ID+1000)
+	wantErr(t, "cancel missing", err, store.ErrNotFound)
+}
+
+func testClaimJob(t *testing.T, s store.Store) {
+	_, err := s.ClaimJob(ctx(), time.Hour)
+	wantErr(t, "empty queue", err, store.ErrNotFound)
+
+	u := mustUser(t, s, "a@example.com")
+	first := mustJob(t, s, u.ID, store.StatusQueued)
+	second := mustJob(t, s, u.ID, store.StatusQueued)
+
+	j, err := s.ClaimJob(ctx(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != first.ID || j.Status != store.StatusDownloading || j.StartedAt == nil {
+		t.Fatalf("claimed %+v, want oldest job %d", j, first.ID)
+	}
+
+	// прерванное задание возвращается в очередь и забирается снова
+	if ok, err := s.RequeueJob(ctx(), first.ID); err != nil || !ok {
+		t.Fatalf("RequeueJob = %v, %v", ok, err)
+	}
+	requeued, err := s.Job(ctx(), u.ID, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued.Status != store.StatusQueued || requeued.StartedAt != nil {
+		t.Fatalf("unexpected requeued job %+v", requeued)
+	}
+
+	for _, want := range []int64{first.ID, second.ID} {
+		j, err := s.ClaimJob(ctx(), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.ID != want {
+			t.Fatalf("claimed %d, want %d", j.ID, want)
+		}
+	}
+	_, err = s.ClaimJob(ctx(), time.Hour)
+	wantErr(t, "drained queue", err, store.ErrNotFound)
+}
+
+func testJobLease(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	first := mustJob(t, s, u.ID, store.StatusQueued)
+	second := mustJob(t, s, u.ID, store.StatusQueued)
+	// задание /send выполняется без срока и не забирается
+	mustJob(t, s, u.ID, store.StatusDownloading)
+
+	// срок первого уже истёк: воркер упал, не успев его продлить
+	if j, err := s.ClaimJob(ctx(), -time.Minute); err != nil || j.ID != first.ID {
+		t.Fatalf("ClaimJob = %+v, %v", j, err)
+	}
+	if _, err := s.SetJobStatus(ctx(), first.ID, store.StatusSending, "", 5); err != nil {
+		t.Fatal(err)
+	}
+	j, err := s.ClaimJob(ctx(), time.Hour)
+	if err != nil || j.ID != first.ID || j.Status != store.StatusDownloading || j.Size != 0 {
+		t.Fatalf("abandoned job not reclaimed: %+v, %v", j, err)
+	}
+
+	// продлённое задание другому воркеру не достаётся
+	if j, err := s.ClaimJob(ctx(), -time.Minute); err != nil || j.ID != second.ID {
+		t.Fatalf("ClaimJob = %+v, %v", j, err)
+	}
+	if ok, err := s.RenewJobLease(ctx(), second.ID, time.Hour); err != nil || !ok {
+		t.Fatalf("RenewJobLease = %v, %v", ok, err)
+	}
+	_, err = s.ClaimJob(ctx(), time.Hour)
+	wantErr(t, "leased jobs", err, store.ErrNotFound)
+
+	// завершённое задание не продлевается и не забирается снова
+	if _, err := s.SetJobStatus(ctx(), second.ID, store.StatusSent, "", 5); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.RenewJobLease(ctx(), second.ID, -time.Minute); err != nil || ok {
+		t.Fatalf("RenewJobLease of finished job = %v, %v", ok, err)
+	}
+	_, err = s.ClaimJob(ctx(), time.Hour)
+	wantErr(t, "finished job", err, store.ErrNotFound)
+
+	// возвращённое в очередь задание забирается как обычно
+	if ok, err := s.RequeueJob(ctx(), first.ID); err != nil || !ok {
+		t.Fatalf("RequeueJob = %v, %v", ok, err)
+	}
+	if j, err := s.ClaimJob(ctx(), time.Hour); err != nil || j.ID != first.ID {
+		t.Fatalf("ClaimJob after requeue = %+v, %v", j, err)
+	}
+}
+
+func testJobAuth(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	auth := &store.JobAuth{Username: "alice", Password: "pw", Headers: map[string]string{"X-Token": "t"}, Cookies: map[string]string{"sid": "1"}}
+	nj := store.NewJob{UserID: u.ID, CorrelationID: "corr-1", URL: "https://example.com/f", Recipient: "to@example.com",
+		Status: store.StatusQueued, Auth: auth}
+	queued, err := s.CreateJob(ctx(), nj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued.Auth == nil || queued.Auth.Password != "pw" {
+		t.Fatalf("CreateJob auth = %+v", queued.Auth)
+	}
+	// учётные данные не видны в списках и при чтении задания
+	if j, _ := s.Job(ctx(), u.ID, queued.ID); j.Auth != nil {
+		t.Fatalf("Job returned auth %+v", j.Auth)
+	}
+
+	j, err := s.ClaimJob(ctx(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != queued.ID || j.Auth == nil || j.Auth.Username != "alice" || j.Auth.Headers["X-Token"] != "t" || j.Auth.Cookies["sid"] != "1" {
+		t.Fatalf("ClaimJob auth = %+v", j.Auth)
+	}
+
+	nj.Auth = nil
+	plain, err := s.CreateJob(ctx(), nj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j, err := s.ClaimJob(ctx(), time.Hour); err != nil || j.ID != plain.ID || j.Auth != nil {
+		t.Fatalf("ClaimJob without auth = %+v, %v", j, err)
+	}
+}
+
+func testFailUnreportedJobs(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	newJob := func(dest, status string) *store.Job {
+		j, err := s.CreateJob(ctx(), store.NewJob{UserID: u.ID, URL: "https://example.com/f", Destination: dest, Status: status,
+			Auth: &store.JobAuth{Username: "alice", Password: "pw"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+	handed := newJob(store.DestTelegram, store.StatusSending)
+	reported := newJob(store.DestTelegram, store.StatusSending)
+	if err := s.SetJobDeliveredTo(ctx(), reported.ID, "tg://chat/1/2"); err != nil {
+		t.Fatal(err)
+	}
+	queued := newJob(store.DestTelegram, store.StatusQueued)
+	dav := newJob(store.DestWebDAV, store.StatusSending)
+
+	// ещё не истекли
+	failed, err := s.FailUnreportedJobs(ctx(), time.Now().Add(-time.Hour), "timeout")
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("FailUnreportedJobs before timeout = %v, %v", failed, err)
+	}
+
+	failed, err = s.FailUnreportedJobs(ctx(), time.Now().Add(time.Minute), "timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].ID != handed.ID || failed[0].Status != store.StatusFailed ||
+		failed[0].Error != "timeout" || failed[0].FinishedAt == nil {
+		t.Fatalf("FailUnreportedJobs = %+v", failed)
+	}
+	for _, j := range []*store.Job{reported, queued, dav} {
+		if got, _ := s.Job(ctx(), u.ID, j.ID); got.Status != j.Status {
+			t.Fatalf("job %d: status %s, want %s", j.ID, got.Status, j.Status)
+		}
+	}
+	// завершённое задание второй раз не трогается
+	if again, err := s.FailUnreportedJobs(ctx(), time.Now().Add(time.Minute), "timeout"); err != nil || len(again) != 0 {
+		t.Fatalf("second FailUnreportedJobs = %v, %v", again, err)
+	}
+}
+
+func testReportDelivery(t *testing.T, s store.Store) {
+	u := mustUser(t, s, "a@example.com")
+	other := mustUser(t, s, "b@example.com")
+	newJob := func(dest, status string) *store.Job {
+		j, err := s.CreateJob(ctx(), store.NewJob{UserID: u.ID, URL: "https://example.com/f", Destination: dest, Status: status,
+			Auth: &store.JobAuth{Username: "alice", Password: "pw"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	sent := newJob(store.DestTelegram, store.StatusSending)
+	j, ok, err := s.ReportDelivery(ctx(), u.ID, sent.ID, "telegram:1/2", "")
+	if err != nil || !ok {
+		t.Fatalf("ReportDelivery = %v, %v", ok, err)
+	}
+	if j.Status != store.StatusSent || j.DeliveredTo != "telegram:1/2" || j.FinishedAt == nil || j.Auth != nil {
+		t.Fatalf("delivered job %+v", j)
+	}
+	// повторный отчёт ничего не меняет
+	j, ok, err = s.ReportDelivery(ctx(), u.ID, sent.ID, "", "upload failed")
+	if err != nil || ok || j.Status != store.StatusSent || j.Error != "" {
+		t.Fatalf("second ReportDelivery = %+v, %v, %v", j, ok, err)
+	}
+
+	failed := newJob(store.DestTelegram, store.StatusSending)
+	j, ok, err = s.ReportDelivery(ctx(), u.ID, failed.ID, "", "telegram: too big")
+	if err != nil || !ok || j.Status != store.StatusFailed || j.Error != "telegram: too big" || j.DeliveredTo != "" {
+		t.Fatalf("failed report = %+v, %v, %v", j, ok, err)
+	}
+	// опоздавший отчёт не вернёт заданию статус sent
+	if again, err := s.FailUnreportedJobs(ctx(), time.Now().Add(time.Minute), "timeout"); err != nil || len(again) != 0 {
+		t.Fatalf("FailUnreportedJobs after report = %v, %v", again, err)
+	}
+
+	for name, j := range map[string]*store.Job{
+		"queued":   newJob(store.DestTelegram, store.StatusQueued),
+		"not tg":   newJob(store.DestWebDAV, store.StatusSending),
+		"canceled": newJob(store.DestTelegram, store.StatusSending),
+	} {
+		if name == "canceled" {
+			if _, _, err := s.CancelJob(ctx(), u.ID, j.ID); err != nil {
+				t.Fatal(err)
+			}
+			j, _ = s.Job(ctx(), u.ID, j.ID)
+		}
+		got, ok, err := s.ReportDelivery(ctx(), u.ID, j.ID, "telegram:1/2", "")
+		if err != nil || ok || got.Status != j.Status || got.DeliveredTo != "" {
+			t.Fatalf("%s: ReportDelivery = %+v, %v, %v", name, got, ok, err)
+		}
+	}
+
+	_, _, err = s.ReportDelivery(ctx(), other.ID, newJob(store.DestTelegram, store.StatusSending).ID, "telegram:1/2", "")
+	wantErr(t, "other user's job", err, store.ErrNotFound)
+}
@@ -0,0 +1,182 @@
+package webpage
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// readableCSS — стили упрощённой страницы вместо стилей сайта.
+const readableCSS = `body { margin: 0 auto; max-width: 42em; padding: 1em; font: 18px/1.6 Georgia, serif; color: #222; background: #fff; }
+h1, h2, h3 { line-height: 1.25; }
+img { max-width: 100%; height: auto; }
+pre { overflow-x: auto; }
+blockquote { margin-left: 0; padding-left: 1em; border-left: 3px solid #ccc; color: #555; }
+`
+
+// минимальная длина абзаца, который считается текстом статьи
+const minParagraph = 25
+
+// clutter — class или id элементов, которые не относятся к статье.
+var clutter = regexp.MustCompile(`(?i)comment|share|social|related|sidebar|promo|advert|banner|subscribe|newsletter|cookie|popup|breadcrumb`)
+
+// noise — элементы, которые выбрасываются из статьи целиком.
+var noise = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Link: true, atom.Meta: true, atom.Noscript: true,
+	atom.Nav: true, atom.Aside: true, atom.Footer: true, atom.Form: true,
+	atom.Button: true, atom.Input: true, atom.Select: true, atom.Textarea: true,
+	atom.Iframe: true, atom.Frame: true, atom.Object: true, atom.Embed: true, atom.Template: true,
+	atom.Dialog: true, atom.Svg: true, atom.Canvas: true,
+}
+
+// readableAttrs — атрибуты, которые остаются у элементов статьи.
+var readableAttrs = map[string]bool{
+	"href": true, "src": true, "data-src": true, "alt": true, "title": true,
+	"lang": true, "dir": true, "colspan": true, "rowspan": true, "start": true, "datetime": true,
+}
+
+// readable собирает новый документ из текста статьи: находит основной
+// блок страницы, выбрасывает из него меню, формы и врезки и оформляет
+// своими стилями.
+func readable(doc *html.Node, title string) *html.Node {
+	lang := ""
+	if root := find(doc, atom.Html); root != nil {
+		lang = attr(root, "lang")
+	}
+
+	content := mainContent(doc)
+	clearNoise(content)
+
+	article := element(atom.Article)
+	if title != "" {
+		// заголовок статьи обычно повторяет <title>
+		if h1 := find(content, atom.H1); h1 == nil {
+			h := element(atom.H1)
+			h.AppendChild(&html.Node{Type: html.TextNode, Data: title})
+			article.AppendChild(h)
+		}
+	}
+	for ch := content.FirstChild; ch != nil; ch = content.FirstChild {
+		content.RemoveChild(ch)
+		article.AppendChild(ch)
+	}
+
+	head := element(atom.Head)
+	if title != "" {
+		t := element(atom.Title)
+		t.AppendChild(&html.Node{Type: html.TextNode, Data: title})
+		head.AppendChild(t)
+	}
+	style := element(atom.Style)
+	style.AppendChild(&html.Node{Type: html.TextNode, Data: readableCSS})
+	head.AppendChild(style)
+
+	body := element(atom.Body)
+	body.AppendChild(article)
+	root := element(atom.Html)
+	if lang != "" {
+		root.Attr = []html.Attribute{{Key: "lang", Val: lang}}
+	}
+	root.AppendChild(head)
+	root.AppendChild(body)
+
+	out := &html.Node{Type: html.DocumentNode}
+	out.AppendChild(&html.Node{Type: html.DoctypeNode, Data: "html"})
+	out.AppendChild(root)
+	return out
+}
+
+// mainContent — блок с текстом статьи: самый длинный <article>, иначе
+// <main>, иначе элемент с наибольшим количеством текста в абзацах.
+func mainContent(doc *html.Node) *html.Node {
+	var best *html.Node
+	bestLen := 0
+	each(doc, func(n *html.Node) {
+		if n.DataAtom == atom.Article {
+			if l := len(textOf(n)); l > bestLen {
+				best, bestLen = n, l
+			}
+		}
+	})
+	if best != nil {
+		return best
+	}
+	each(doc, func(n *html.Node) {
+		if best == nil && (n.DataAtom == atom.Main || attr(n, "role") == "main") {
+			best = n
+		}
+	})
+	if best != nil {
+		return best
+	}
+
+	// каждый абзац отдаёт очки родителю и половину — деду
+	scores := make(map[*html.Node]int)
+	each(doc, func(n *html.Node) {
+		if n.DataAtom != atom.P || n.Parent == nil {
+			return
+		}
+		l := len(strings.TrimSpace(textOf(n)))
+		if l < minParagraph {
+			return
+		}
+		scores[n.Parent] += l
+		if gp := n.Parent.Parent; gp != nil && gp.Type == html.ElementNode {
+			scores[gp] += l / 2
+		}
+	})
+	bestScore := 0
+	each(doc, func(n *html.Node) {
+		if s := scores[n]; s > bestScore {
+			best, bestScore = n, s
+		}
+	})
+	if best != nil {
+		return best
+	}
+	if b := find(doc, atom.Body); b != nil {
+		return b
+	}
+	return doc
+}
+
+// clearNoise выбрасывает из поддерева всё, кроме текста, и лишние
+// атрибуты.
+func clearNoise(n *html.Node) {
+	for ch := n.FirstChild; ch != nil; {
+		next := ch.NextSibling
+		switch {
+		case ch.Type == html.CommentNode:
+			n.RemoveChild(ch)
+		case ch.Type != html.ElementNode:
+		case noise[ch.DataAtom], clutter.MatchString(attr(ch, "class")), clutter.MatchString(attr(ch, "id")):
+			n.RemoveChild(ch)
+		default:
+			attrs := ch.Attr[:0]
+			for _, a := range ch.Attr {
+				if a.Namespace == "" && readableAttrs[a.Key] {
+					attrs = append(attrs, a)
+				}
+			}
+			ch.Attr = attrs
+			clearNoise(ch)
+		}
+		ch = next
+	}
+}
+
+// each вызывает f для всех элементов поддерева.
+func each(n *html.Node, f func(*html.Node)) {
+	if n.Type == html.ElementNode {
+		f(n)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		each(c, f)
+	}
+}
+
+func element(a atom.Atom) *html.Node {
+	return &html.Node{Type: html.ElementNode, Data: a.String(), DataAtom: a}
+}
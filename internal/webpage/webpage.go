@@ -0,0 +1,446 @@
+// Package webpage сохраняет HTML-страницу одним файлом: стили, картинки
+// и шрифты скачиваются и встраиваются в data: URI, скрипты выбрасываются.
+// Такой файл открывается без сети, в том числе из вложения письма. По
+// желанию от страницы остаётся только текст статьи.
+package webpage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// DefaultMaxResources — сколько ресурсов скачивается по умолчанию.
+	DefaultMaxResources = 200
+	// ResourceTimeout — таймаут скачивания одного ресурса.
+	ResourceTimeout = 30 * time.Second
+	// глубина вложенных @import
+	maxImportDepth = 5
+)
+
+var errBudget = errors.New("resource limit reached")
+
+// Options — параметры сохранения.
+type Options struct {
+	// Readable оставляет только текст статьи: без меню, боковых колонок,
+	// комментариев и стилей сайта.
+	Readable bool
+	// MaxBytes — предел суммарного размера ресурсов; 0 — без предела.
+	MaxBytes int64
+	// MaxResources — предел числа ресурсов; 0 — DefaultMaxResources.
+	MaxResources int
+	// Client скачивает ресурсы; nil — http.DefaultClient.
+	Client *http.Client
+}
+
+// Result — что получилось при сохранении.
+type Result struct {
+	Title string
+	// встроено ресурсов
+	Resources int
+	// ресурсы, которые не скачались или не влезли в лимит: на них
+	// остаются абсолютные ссылки
+	Failed int
+	// скачано байт ресурсов
+	Bytes int64
+}
+
+// Capture читает страницу, загруженную с base, и пишет в w её
+// самодостаточную копию в UTF-8. contentType — заголовок ответа, по нему
+// и по <meta charset> определяется кодировка. Ошибки отдельных ресурсов
+// не прерывают сохранение, они считаются в Result.Failed.
+func Capture(ctx context.Context, w io.Writer, page io.Reader, contentType string, base *url.URL, opts Options) (*Result, error) {
+	r, err := charset.NewReader(page, contentType)
+	if err != nil {
+		return nil, err
+	}
+	// без скриптов содержимое <noscript> разбирается как разметка
+	doc, err := html.ParseWithOptions(r, html.ParseOptionEnableScripting(false))
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MaxResources == 0 {
+		opts.MaxResources = DefaultMaxResources
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	c := &capturer{ctx: ctx, opts: opts, base: base, cache: make(map[string]string), res: &Result{}}
+
+	if b := find(doc, atom.Base); b != nil {
+		if u, err := base.Parse(attr(b, "href")); err == nil {
+			c.base = u
+		}
+	}
+	c.res.Title = strings.Join(strings.Fields(textOf(find(doc, atom.Title))), " ")
+	if opts.Readable {
+		doc = readable(doc, c.res.Title)
+	}
+
+	c.walk(doc)
+	setCharset(doc)
+	return c.res, html.Render(w, doc)
+}
+
+type capturer struct {
+	ctx  context.Context
+	opts Options
+	base *url.URL
+	// data: URI по абсолютному адресу ресурса; пустая строка — не скачался
+	cache map[string]string
+	res   *Result
+	// лимиты исчерпаны, дальше ресурсы не скачиваются
+	exhausted bool
+}
+
+// walk встраивает ресурсы поддерева и убирает то, что без сети не
+// работает.
+func (c *capturer) walk(n *html.Node) {
+	for ch := n.FirstChild; ch != nil; {
+		next := ch.NextSibling
+		switch {
+		case ch.Type == html.ElementNode && c.drop(ch):
+			n.RemoveChild(ch)
+		case ch.Type == html.ElementNode && ch.DataAtom == atom.Noscript:
+			// скриптов нет — показываем запасное содержимое
+			c.walk(ch)
+			for gc := ch.FirstChild; gc != nil; gc = ch.FirstChild {
+				ch.RemoveChild(gc)
+				n.InsertBefore(gc, ch)
+			}
+			n.RemoveChild(ch)
+		case ch.Type == html.ElementNode:
+			c.element(ch)
+			c.walk(ch)
+		}
+		ch = next
+	}
+}
+
+// drop — элемент выбрасывается целиком.
+func (c *capturer) drop(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.Script, atom.Iframe, atom.Frame, atom.Object, atom.Embed, atom.Applet, atom.Base:
+		return true
+	case atom.Source:
+		// у <picture> есть запасной <img>
+		return n.Parent != nil && n.Parent.DataAtom == atom.Picture
+	case atom.Meta:
+		// CSP и refresh ломают сохранённую копию, кодировка выставляется заново
+		return attr(n, "charset") != "" || attr(n, "http-equiv") != ""
+	case atom.Link:
+		rel := strings.ToLower(attr(n, "rel"))
+		for _, r := range strings.Fields(rel) {
+			switch r {
+			case "preload", "prefetch", "modulepreload", "dns-prefetch", "preconnect", "manifest", "serviceworker":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *capturer) element(n *html.Node) {
+	// обработчики событий без скриптов бесполезны
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		if !strings.HasPrefix(strings.ToLower(a.Key), "on") {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+
+	if style := attr(n, "style"); style != "" {
+		setAttr(n, "style", c.css(style, c.base, 0))
+	}
+
+	switch n.DataAtom {
+	case atom.Link:
+		rel := " " + strings.ToLower(attr(n, "rel")) + " "
+		href := attr(n, "href")
+		switch {
+		case strings.Contains(rel, " stylesheet "):
+			c.inlineStylesheet(n, href)
+		case strings.Contains(rel, " icon "):
+			setAttr(n, "href", c.dataURI(href, c.base))
+		default:
+			setAttr(n, "href", c.absolute(href))
+		}
+	case atom.Style:
+		if t := n.FirstChild; t != nil && t.Type == html.TextNode {
+			t.Data = styleText(c.css(t.Data, c.base, 0))
+		}
+	case atom.Img:
+		src := attr(n, "src")
+		// ленивые картинки держат настоящий адрес в data-src
+		if lazy := attr(n, "data-src"); lazy != "" && (src == "" || strings.HasPrefix(src, "data:")) {
+			src = lazy
+		}
+		if src != "" {
+			setAttr(n, "src", c.dataURI(src, c.base))
+		}
+		removeAttr(n, "srcset", "sizes", "loading", "data-src", "data-srcset")
+	case atom.Input:
+		if strings.EqualFold(attr(n, "type"), "image") {
+			setAttr(n, "src", c.dataURI(attr(n, "src"), c.base))
+		}
+	case atom.Video, atom.Audio:
+		// видео и звук не встраиваются: ссылки остаются на оригинал
+		if src := attr(n, "src"); src != "" {
+			setAttr(n, "src", c.absolute(src))
+		}
+		if poster := attr(n, "poster"); poster != "" {
+			setAttr(n, "poster", c.dataURI(poster, c.base))
+		}
+	case atom.A, atom.Area:
+		if href := attr(n, "href"); href != "" && !strings.HasPrefix(href, "#") {
+			setAttr(n, "href", c.absolute(href))
+		}
+	}
+}
+
+// inlineStylesheet заменяет <link rel=stylesheet> на <style> с тем же
+// содержимым; если таблица не скачалась, остаётся абсолютная ссылка.
+func (c *capturer) inlineStylesheet(n *html.Node, href string) {
+	u, err := c.base.Parse(href)
+	if err != nil {
+		return
+	}
+	data, _, err := c.fetch(u)
+	if err != nil {
+		setAttr(n, "href", u.String())
+		return
+	}
+	n.Data, n.DataAtom = "style", atom.Style
+	var attrs []html.Attribute
+	if media := attr(n, "media"); media != "" {
+		attrs = append(attrs, html.Attribute{Key: "media", Val: media})
+	}
+	n.Attr = attrs
+	n.AppendChild(&html.Node{Type: html.TextNode, Data: styleText(c.css(string(data), u, 0))})
+}
+
+// styleText не даёт тексту таблицы закрыть <style>: html.Render пишет
+// его как есть.
+func styleText(css string) string {
+	return strings.ReplaceAll(css, "</", `<\/`)
+}
+
+var (
+	cssImport = regexp.MustCompile(`@import\s+(?:url\(\s*)?["']?([^"')\s;]+)["']?\s*\)?\s*([^;]*);`)
+	cssURL    = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+)
+
+// css встраивает в таблицу стилей @import и ресурсы из url().
+func (c *capturer) css(s string, base *url.URL, depth int) string {
+	s = cssImport.ReplaceAllStringFunc(s, func(m string) string {
+		sub := cssImport.FindStringSubmatch(m)
+		u, err := base.Parse(sub[1])
+		if err != nil || depth >= maxImportDepth {
+			return m
+		}
+		data, _, err := c.fetch(u)
+		if err != nil {
+			return "@import url(" + cssString(u.String()) + ") " + sub[2] + ";"
+		}
+		imported := c.css(string(data), u, depth+1)
+		if media := strings.TrimSpace(sub[2]); media != "" {
+			return "@media " + media + " {\n" + imported + "\n}"
+		}
+		return imported
+	})
+	return cssURL.ReplaceAllStringFunc(s, func(m string) string {
+		sub := cssURL.FindStringSubmatch(m)
+		ref := sub[1] + sub[2] + sub[3]
+		if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+			return m
+		}
+		return "url(" + cssString(c.dataURI(ref, base)) + ")"
+	})
+}
+
+// cssString — адрес в кавычках для url() в CSS.
+func cssString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", "", "\r", "").Replace(s) + `"`
+}
+
+// dataURI скачивает ресурс и возвращает его data: URI; если не вышло —
+// абсолютный адрес ресурса.
+func (c *capturer) dataURI(ref string, base *url.URL) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "data:") {
+		return ref
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	key := u.String()
+	if uri, ok := c.cache[key]; ok {
+		if uri == "" {
+			return key
+		}
+		return uri
+	}
+
+	data, contentType, err := c.fetch(u)
+	if err != nil {
+		c.cache[key] = ""
+		return key
+	}
+	uri := "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	c.cache[key] = uri
+	return uri
+}
+
+func (c *capturer) absolute(ref string) string {
+	u, err := c.base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
+
+// fetch скачивает ресурс с учётом лимитов и возвращает его тип.
+func (c *capturer) fetch(u *url.URL) ([]byte, string, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if c.exhausted || c.res.Resources+c.res.Failed >= c.opts.MaxResources {
+		c.exhausted = true
+		c.res.Failed++
+		return nil, "", errBudget
+	}
+
+	data, contentType, err := c.get(u)
+	if err != nil {
+		c.res.Failed++
+		return nil, "", err
+	}
+	c.res.Resources++
+	c.res.Bytes += int64(len(data))
+	return data, contentType, nil
+}
+
+func (c *capturer) get(u *url.URL) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, ResourceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: http status %d", u, resp.StatusCode)
+	}
+
+	body := io.Reader(resp.Body)
+	if c.opts.MaxBytes > 0 {
+		body = io.LimitReader(body, c.opts.MaxBytes-c.res.Bytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.opts.MaxBytes > 0 && c.res.Bytes+int64(len(data)) > c.opts.MaxBytes {
+		c.exhausted = true
+		return nil, "", errBudget
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	return data, contentType, nil
+}
+
+// setCharset объявляет кодировку UTF-8 первым элементом <head>: в ней
+// html.Render пишет документ.
+func setCharset(doc *html.Node) {
+	head := find(doc, atom.Head)
+	if head == nil {
+		return
+	}
+	meta := &html.Node{Type: html.ElementNode, Data: "meta", DataAtom: atom.Meta,
+		Attr: []html.Attribute{{Key: "charset", Val: "utf-8"}}}
+	head.InsertBefore(meta, head.FirstChild)
+}
+
+func find(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := find(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func textOf(n *html.Node) string {
+	if n == nil {
+		return ""
+	}
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textOf(c))
+	}
+	return sb.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+func removeAttr(n *html.Node, keys ...string) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		drop := false
+		for _, k := range keys {
+			if a.Namespace == "" && a.Key == k {
+				drop = true
+			}
+		}
+		if !drop {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+}
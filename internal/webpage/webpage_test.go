@@ -0,0 +1,231 @@
+package webpage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// pixel — PNG 1×1.
+var pixel, _ = base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII=")
+
+const page = `<!DOCTYPE html>
+<html lang="ru"><head>
+<meta charset="windows-1251">
+<meta http-equiv="Content-Security-Policy" content="default-src 'self'">
+<title> Статья </title>
+<link rel="stylesheet" href="/css/site.css" media="screen">
+<link rel="preload" href="/font.woff2">
+<link rel="icon" href="/favicon.png">
+<script src="/app.js"></script>
+</head>
+<body onload="init()">
+<nav><a href="/">Главная</a> <a href="/news">Новости</a></nav>
+<article>
+<h1>Заголовок статьи</h1>
+<p style="background: url('img/bg.png')">Первый абзац статьи, в котором достаточно текста.</p>
+<img src="img/photo.png" alt="фото" srcset="img/photo@2x.png 2x">
+<img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" data-src="img/lazy.png" alt="ленивая">
+<img src="img/missing.png" alt="нет">
+<noscript><img src="img/photo.png" alt="запасная"></noscript>
+<div class="share-buttons">Поделиться</div>
+<p>Второй абзац статьи со <a href="/other">ссылкой</a> на другую страницу.</p>
+</article>
+<aside>Реклама в колонке</aside>
+<iframe src="/ad"></iframe>
+<script>track()</script>
+</body></html>`
+
+func site(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+		w.Write(cp1251(page))
+	})
+	mux.HandleFunc("/css/site.css", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/css")
+		w.Write([]byte(`@import "print.css" print;
+body { background: url(../img/bg.png) }
+</style><script>x()</script>`))
+	})
+	mux.HandleFunc("/css/print.css", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(`h1 { color: black }`))
+	})
+	png := func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write(pixel)
+	}
+	mux.HandleFunc("/img/bg.png", png)
+	mux.HandleFunc("/img/photo.png", png)
+	mux.HandleFunc("/img/lazy.png", png)
+	mux.HandleFunc("/favicon.png", png)
+	mux.HandleFunc("/img/missing.png", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL)
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func capture(t *testing.T, srv *httptest.Server, opts Options) (string, *Result) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/article")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	base, _ := url.Parse(srv.URL + "/article")
+
+	var buf bytes.Buffer
+	res, err := Capture(context.Background(), &buf, resp.Body, resp.Header.Get("Content-Type"), base, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), res
+}
+
+func TestCapture(t *testing.T) {
+	srv, hits := site(t)
+	out, res := capture(t, srv, Options{})
+
+	dataPNG := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pixel)
+	for _, want := range []string{
+		`<meta charset="utf-8"/>`,
+		"<title> Статья </title>",
+		`<style media="screen">@media print {`,
+		"h1 { color: black }",
+		`body { background: url("` + dataPNG + `") }`,
+		`<p style="background: url(&#34;` + dataPNG + `&#34;)">`,
+		`<img src="` + dataPNG + `" alt="фото"/>`,
+		`<img src="` + dataPNG + `" alt="ленивая"/>`,
+		`<img src="` + srv.URL + `/img/missing.png" alt="нет"/>`,
+		`<img src="` + dataPNG + `" alt="запасная"/>`,
+		`<link rel="icon" href="` + dataPNG + `"/>`,
+		`<a href="` + srv.URL + `/other">`,
+		"<body>",
+		"Реклама в колонке",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output has no %q:\n%s", want, out)
+		}
+	}
+	for _, bad := range []string{"<script src", "track()", "windows-1251", "Content-Security-Policy", "preload", "srcset", "<iframe", "onload", "<noscript", "</style><script>"} {
+		if strings.Contains(out, bad) {
+			t.Errorf("output still has %q:\n%s", bad, out)
+		}
+	}
+
+	if res.Title != "Статья" {
+		t.Errorf("Title = %q", res.Title)
+	}
+	// bg.png и photo.png скачиваются по одному разу
+	if res.Resources != 6 || res.Failed != 1 || hits.Load() != 7 {
+		t.Errorf("Resources = %d, Failed = %d, hits = %d", res.Resources, res.Failed, hits.Load())
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	srv, hits := site(t)
+	out, res := capture(t, srv, Options{MaxResources: 2})
+	if res.Resources != 2 || hits.Load() != 2 {
+		t.Errorf("Resources = %d, hits = %d", res.Resources, hits.Load())
+	}
+	if res.Failed == 0 {
+		t.Error("Failed = 0")
+	}
+	// ресурсы сверх лимита остаются ссылками
+	if !strings.Contains(out, srv.URL+"/img/photo.png") {
+		t.Errorf("output has no link to photo.png:\n%s", out)
+	}
+
+	srv, _ = site(t)
+	_, res = capture(t, srv, Options{MaxBytes: int64(len(pixel))})
+	if res.Bytes > int64(len(pixel)) {
+		t.Errorf("Bytes = %d, limit %d", res.Bytes, len(pixel))
+	}
+}
+
+func TestCaptureReadable(t *testing.T) {
+	srv, _ := site(t)
+	out, res := capture(t, srv, Options{Readable: true})
+
+	dataPNG := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pixel)
+	for _, want := range []string{
+		`<html lang="ru">`,
+		`<meta charset="utf-8"/>`,
+		"<title>Статья</title>",
+		"max-width: 42em",
+		"<h1>Заголовок статьи</h1>",
+		"<p>Первый абзац статьи",
+		`<img src="` + dataPNG + `" alt="фото"/>`,
+		`<img src="` + dataPNG + `" alt="ленивая"/>`,
+		`<a href="` + srv.URL + `/other">ссылкой</a>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output has no %q:\n%s", want, out)
+		}
+	}
+	for _, bad := range []string{"Главная", "Реклама", "Поделиться", "<script", "site.css", "color: black", "style=\""} {
+		if strings.Contains(out, bad) {
+			t.Errorf("output still has %q:\n%s", bad, out)
+		}
+	}
+	// стили сайта не скачиваются
+	if res.Resources != 2 {
+		t.Errorf("Resources = %d", res.Resources)
+	}
+}
+
+func TestReadableScoring(t *testing.T) {
+	doc := `<html><body>
+<div id="menu"><p>Коротко</p></div>
+<div id="content"><div class="text">
+<p>Это длинный абзац основного текста страницы.</p>
+<p>И ещё один длинный абзац основного текста.</p>
+</div><div class="comments"><p>Комментарий читателя, тоже довольно длинный.</p></div></div>
+</body></html>`
+	var buf bytes.Buffer
+	_, err := Capture(context.Background(), &buf, strings.NewReader(doc), "text/html", &url.URL{Scheme: "http", Host: "example.com"}, Options{Readable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "основного текста страницы") || strings.Contains(out, "Коротко") || strings.Contains(out, "Комментарий") {
+		t.Errorf("unexpected article:\n%s", out)
+	}
+}
+
+// cp1251 кодирует кириллицу страницы в windows-1251.
+func cp1251(s string) []byte {
+	var b []byte
+	for _, r := range s {
+		switch {
+		case r < 0x80:
+			b = append(b, byte(r))
+		case r >= 'А' && r <= 'я':
+			b = append(b, byte(r-'А'+0xC0))
+		case r == 'ё':
+			b = append(b, 0xB8)
+		case r == 'Ё':
+			b = append(b, 0xA8)
+		default:
+			b = append(b, '?')
+		}
+	}
+	return b
+}